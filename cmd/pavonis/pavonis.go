@@ -9,6 +9,7 @@ import (
 	"github.com/Fallen-Breath/pavonis/internal/diagnostics"
 	"github.com/Fallen-Breath/pavonis/internal/server"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -58,11 +59,11 @@ func runPavonis(cfg *config.Config) {
 	httpServers := httpServerHolder{}
 
 	mainHttpServer := pavonisServer.CreateHttpServer()
-	httpServers.Add(mainHttpServer)
+	httpServers.AddWithListener(mainHttpServer, pavonisServer.Listen)
 	log.Infof("Starting Pavonis v%s on %s", constants.Version, mainHttpServer.Addr)
 
 	if cfg.Diagnostics.Enabled {
-		diagnosticsHttpServer := diagnostics.NewServer(cfg.Diagnostics).CreateHttpServer()
+		diagnosticsHttpServer := diagnostics.NewServer(cfg.Diagnostics, pavonisServer.GetBanList()).CreateHttpServer()
 		httpServers.Add(diagnosticsHttpServer)
 		log.Debugf("Starting diagnostics http server on %s", diagnosticsHttpServer.Addr)
 	}
@@ -74,17 +75,36 @@ func runPavonis(cfg *config.Config) {
 }
 
 type httpServerHolder struct {
-	servers []*http.Server
+	servers   []*http.Server
+	listeners map[*http.Server]func() (net.Listener, error)
 }
 
 func (h *httpServerHolder) Add(server *http.Server) {
 	h.servers = append(h.servers, server)
 }
 
+// AddWithListener adds the server that serves on the listener from the given function, instead of server.Addr
+func (h *httpServerHolder) AddWithListener(server *http.Server, listen func() (net.Listener, error)) {
+	if h.listeners == nil {
+		h.listeners = make(map[*http.Server]func() (net.Listener, error))
+	}
+	h.servers = append(h.servers, server)
+	h.listeners[server] = listen
+}
+
 func (h *httpServerHolder) Run(stopCh chan os.Signal) {
 	for _, httpServer := range h.servers {
 		go func() {
-			if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			var err error
+			if listen, ok := h.listeners[httpServer]; ok {
+				var listener net.Listener
+				if listener, err = listen(); err == nil {
+					err = httpServer.Serve(listener)
+				}
+			} else {
+				err = httpServer.ListenAndServe()
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
 				log.Fatalf("httpServer ListenAndServe failed: %v", err)
 			}
 		}()
@@ -10,6 +10,9 @@ import (
 
 func (cfg *Config) finalizeValues() error {
 	siteSettingMapping := make(map[SiteMode]func() any)
+	siteSettingMapping[SiteModeCondaProxy] = func() any {
+		return &CondaProxySettings{}
+	}
 	siteSettingMapping[SiteModeContainerRegistryProxy] = func() any {
 		return &ContainerRegistrySettings{}
 	}
@@ -22,6 +25,9 @@ func (cfg *Config) finalizeValues() error {
 	siteSettingMapping[SiteModeHttpGeneralProxy] = func() any {
 		return &HttpGeneralProxySettings{}
 	}
+	siteSettingMapping[SiteModeOllamaProxy] = func() any {
+		return &OllamaProxySettings{}
+	}
 	siteSettingMapping[SiteModePypiProxy] = func() any {
 		return &PypiRegistrySettings{}
 	}
@@ -85,7 +91,25 @@ func (cfg *Config) Dump() {
 		if siteCfg.PathPrefix != "" {
 			siteInfo = append(siteInfo, "path_prefix="+siteCfg.PathPrefix)
 		}
+		if siteCfg.ResourceLimit.PoolTrafficAvgMibps != nil {
+			siteInfo = append(siteInfo, "traffic_pool="+formatTrafficPool(siteCfg.ResourceLimit))
+		}
+		if siteCfg.ResourceLimit.PoolMaxConcurrentRequests != nil {
+			siteInfo = append(siteInfo, fmt.Sprintf("concurrency_pool=%d", *siteCfg.ResourceLimit.PoolMaxConcurrentRequests))
+		}
+		if *siteCfg.ApiKeyRequired != cfg.ApiKey.Required {
+			siteInfo = append(siteInfo, fmt.Sprintf("api_key_required=%v", *siteCfg.ApiKeyRequired))
+		}
+		if len(siteCfg.AccessControl.Rules) > 0 || *siteCfg.AccessControl.DefaultAction != AccessActionAllow {
+			siteInfo = append(siteInfo, fmt.Sprintf("access_rules=%d access_default=%s", len(siteCfg.AccessControl.Rules), *siteCfg.AccessControl.DefaultAction))
+		}
+		if *siteCfg.ResourceLimit.RequestTimeout != *cfg.ResourceLimit.RequestTimeout {
+			siteInfo = append(siteInfo, "request_timeout="+siteCfg.ResourceLimit.RequestTimeout.String())
+		}
 		log.Infof("site%d (id=%s): %s", siteIdx, siteCfg.Id, strings.Join(siteInfo, " "))
+		if siteCfg.ResourceLimit.ClientLimitKey() != cfg.ResourceLimit.ClientLimitKey() {
+			log.Infof("  Request Limit: %s; Traffic Limit: %s", formatRequestLimit(siteCfg.ResourceLimit), formatTrafficLimit(siteCfg.ResourceLimit))
+		}
 
 		switch *siteCfg.Mode {
 		case SiteModeContainerRegistryProxy:
@@ -105,39 +129,96 @@ func (cfg *Config) Dump() {
 			for _, mapping := range settings.Mappings {
 				log.Infof("  %+q -> %+q", mapping.Path, mapping.Destination)
 			}
+		case SiteModeOllamaProxy:
+			settings := siteCfg.Settings.(*OllamaProxySettings)
+			log.Infof("  %+v", settings)
 		case SiteModePypiProxy:
 			settings := siteCfg.Settings.(*PypiRegistrySettings)
 			log.Infof("  %+v", settings)
+		case SiteModeCondaProxy:
+			settings := siteCfg.Settings.(*CondaProxySettings)
+			log.Infof("  %+v", settings)
 		case SiteModeSpeedTest:
 			settings := siteCfg.Settings.(*SpeedTestSettings)
-			log.Infof("  MaxUpload=%s, MaxDownload=%s", utils.PrettyByteSize(*settings.MaxUploadBytes), utils.PrettyByteSize(*settings.MaxUploadBytes))
+			log.Infof("  MaxUpload=%s, MaxDownload=%s, WebUi=%v", utils.PrettyByteSize(*settings.MaxUploadBytes), utils.PrettyByteSize(*settings.MaxDownloadBytes), *settings.WebUi)
+			if settings.Upstream != nil {
+				interval := "on demand"
+				if settings.Upstream.Interval != nil {
+					interval = settings.Upstream.Interval.String()
+				}
+				log.Infof("  Upstream=%+q, SampleSize=%d, Timeout=%v, Interval=%s", settings.Upstream.Url, *settings.Upstream.SampleSize, *settings.Upstream.Timeout, interval)
+			}
 		}
 	}
 
-	if cfg.ResourceLimit.RequestPerSecond != nil || cfg.ResourceLimit.RequestPerMinute != nil || cfg.ResourceLimit.RequestPerHour != nil {
-		var parts []string
-		if cfg.ResourceLimit.RequestPerSecond != nil {
-			parts = append(parts, fmt.Sprintf("qps=%v", *cfg.ResourceLimit.RequestPerSecond))
-		}
-		if cfg.ResourceLimit.RequestPerMinute != nil {
-			parts = append(parts, fmt.Sprintf("qpm=%v", *cfg.ResourceLimit.RequestPerMinute))
-		}
-		if cfg.ResourceLimit.RequestPerHour != nil {
-			parts = append(parts, fmt.Sprintf("qph=%v", *cfg.ResourceLimit.RequestPerHour))
-		}
-		log.Infof("Request Limit: %s", strings.Join(parts, ", "))
+	if requestLimit := formatRequestLimit(cfg.ResourceLimit); requestLimit != "" {
+		log.Infof("Request Limit: %s", requestLimit)
 	}
-	if cfg.ResourceLimit.TrafficAvgMibps != nil || cfg.ResourceLimit.TrafficBurstMib != nil || cfg.ResourceLimit.TrafficMaxMibps != nil {
-		var parts []string
-		if cfg.ResourceLimit.TrafficAvgMibps != nil {
-			parts = append(parts, fmt.Sprintf("avg=%vMiB/s", *cfg.ResourceLimit.TrafficAvgMibps))
-		}
-		if cfg.ResourceLimit.TrafficBurstMib != nil {
-			parts = append(parts, fmt.Sprintf("burst=%vMiB", *cfg.ResourceLimit.TrafficBurstMib))
-		}
-		if cfg.ResourceLimit.TrafficMaxMibps != nil {
-			parts = append(parts, fmt.Sprintf("max=%vMiB/s", *cfg.ResourceLimit.TrafficMaxMibps))
-		}
-		log.Infof("Traffic Limit: %s", strings.Join(parts, ", "))
+	if trafficLimit := formatTrafficLimit(cfg.ResourceLimit); trafficLimit != "" {
+		log.Infof("Traffic Limit: %s", trafficLimit)
+	}
+	if cfg.ResourceLimit.PoolTrafficAvgMibps != nil {
+		log.Infof("Global Traffic Pool: %s", formatTrafficPool(cfg.ResourceLimit))
+	}
+	if cfg.ResourceLimit.PoolMaxConcurrentRequests != nil {
+		log.Infof("Global Concurrency Pool: %d", *cfg.ResourceLimit.PoolMaxConcurrentRequests)
+	}
+	if *cfg.RateLimitStore.Type != RateLimitStoreTypeLocal {
+		log.Infof("Rate Limit Store: %s %s", *cfg.RateLimitStore.Type, cfg.RateLimitStore.Address)
+	}
+	if cfg.GeoIp.Database != "" {
+		log.Infof("GeoIP Database: %s", cfg.GeoIp.Database)
+	}
+	if cfg.Ban.Enabled {
+		log.Infof("Ban: %d rejections %v within %s, for %s", *cfg.Ban.Threshold, *cfg.Ban.StatusCodes, *cfg.Ban.Window, *cfg.Ban.Duration)
+	}
+	if healthCfg := cfg.Request.IpPool.Health; cfg.Request.IpPool.Enabled && healthCfg.Enabled {
+		log.Infof("IP Pool Health: quarantine for %s if failure rate > %v or 429 rate > %v, within %s and at least %d requests",
+			*healthCfg.QuarantineDuration, *healthCfg.MaxFailureRate, *healthCfg.MaxRateLimitedRate, *healthCfg.Window, *healthCfg.MinRequests)
+	}
+	if cfg.Server.ProxyProtocol {
+		log.Infof("PROXY protocol: enabled for %v", *cfg.Server.TrustedProxyIps)
+	}
+	if cfg.ApiKey.Enabled {
+		log.Infof("Api Key: %d keys, required=%v, quota_file=%+q", len(cfg.ApiKey.Keys), cfg.ApiKey.Required, cfg.ApiKey.QuotaFile)
+	}
+}
+
+func formatRequestLimit(rlc *ResourceLimitConfig) string {
+	var parts []string
+	if rlc.RequestPerSecond != nil {
+		parts = append(parts, fmt.Sprintf("qps=%v", *rlc.RequestPerSecond))
+	}
+	if rlc.RequestPerMinute != nil {
+		parts = append(parts, fmt.Sprintf("qpm=%v", *rlc.RequestPerMinute))
+	}
+	if rlc.RequestPerHour != nil {
+		parts = append(parts, fmt.Sprintf("qph=%v", *rlc.RequestPerHour))
+	}
+	if rlc.MaxConcurrentRequests != nil {
+		parts = append(parts, fmt.Sprintf("concurrency=%v", *rlc.MaxConcurrentRequests))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatTrafficLimit(rlc *ResourceLimitConfig) string {
+	var parts []string
+	if rlc.TrafficAvgMibps != nil {
+		parts = append(parts, fmt.Sprintf("avg=%vMiB/s", *rlc.TrafficAvgMibps))
+	}
+	if rlc.TrafficBurstMib != nil {
+		parts = append(parts, fmt.Sprintf("burst=%vMiB", *rlc.TrafficBurstMib))
+	}
+	if rlc.TrafficMaxMibps != nil {
+		parts = append(parts, fmt.Sprintf("max=%vMiB/s", *rlc.TrafficMaxMibps))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatTrafficPool(rlc *ResourceLimitConfig) string {
+	text := fmt.Sprintf("avg=%vMiB/s", *rlc.PoolTrafficAvgMibps)
+	if rlc.PoolTrafficBurstMib != nil {
+		text += fmt.Sprintf(",burst=%vMiB", *rlc.PoolTrafficBurstMib)
 	}
+	return text
 }
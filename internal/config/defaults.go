@@ -3,7 +3,10 @@ package config
 import (
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"net/http"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,11 +23,9 @@ func (cfg *Config) setDefaultValues() error {
 		cfg.Server.TrustedProxyIps = utils.ToPtr([]string{"127.0.0.1/24"})
 	}
 	if cfg.Server.TrustedProxyHeaders == nil {
-		cfg.Server.TrustedProxyHeaders = utils.ToPtr([]string{
-			"CF-Connecting-IP", // Cloudflare
-			"X-Forwarded-For",  // Standard proxy header
-			"X-Real-IP",        // Common alternative
-		})
+		// the default was [CF-Connecting-IP, X-Forwarded-For, X-Real-IP], which let the clients behind other proxies spoof their ip
+		log.Warnf("TrustedProxyHeaders is unset, using the default [X-Forwarded-For]. The default was [CF-Connecting-IP, X-Forwarded-For, X-Real-IP] before, set it to [CF-Connecting-IP] explicitly if Pavonis is behind Cloudflare")
+		cfg.Server.TrustedProxyHeaders = utils.ToPtr([]string{"X-Forwarded-For"})
 	}
 
 	// Request
@@ -37,6 +38,25 @@ func (cfg *Config) setDefaultValues() error {
 	if cfg.Request.IpPool.DefaultStrategy == nil {
 		cfg.Request.IpPool.DefaultStrategy = utils.ToPtr(IpPoolStrategyNone)
 	}
+	if cfg.Request.IpPool.Health == nil {
+		cfg.Request.IpPool.Health = &IpPoolHealthConfig{}
+	}
+	healthCfg := cfg.Request.IpPool.Health
+	if healthCfg.Window == nil {
+		healthCfg.Window = utils.ToPtr(1 * time.Minute)
+	}
+	if healthCfg.MinRequests == nil {
+		healthCfg.MinRequests = utils.ToPtr(20)
+	}
+	if healthCfg.MaxFailureRate == nil {
+		healthCfg.MaxFailureRate = utils.ToPtr(0.5)
+	}
+	if healthCfg.MaxRateLimitedRate == nil {
+		healthCfg.MaxRateLimitedRate = utils.ToPtr(0.5)
+	}
+	if healthCfg.QuarantineDuration == nil {
+		healthCfg.QuarantineDuration = utils.ToPtr(5 * time.Minute)
+	}
 	if cfg.Request.Header == nil {
 		cfg.Request.Header = &HeaderModificationConfig{}
 	}
@@ -89,6 +109,63 @@ func (cfg *Config) setDefaultValues() error {
 	if cfg.ResourceLimit.RequestTimeout == nil {
 		cfg.ResourceLimit.RequestTimeout = utils.ToPtr(1 * time.Hour)
 	}
+	if cfg.ResourceLimit.ConcurrencyQueueTimeout == nil {
+		cfg.ResourceLimit.ConcurrencyQueueTimeout = utils.ToPtr(10 * time.Second)
+	}
+
+	// RateLimitStore
+	if cfg.RateLimitStore == nil {
+		cfg.RateLimitStore = &RateLimitStoreConfig{}
+	}
+	if cfg.RateLimitStore.Type == nil {
+		cfg.RateLimitStore.Type = utils.ToPtr(RateLimitStoreTypeLocal)
+	}
+	if cfg.RateLimitStore.KeyPrefix == nil {
+		cfg.RateLimitStore.KeyPrefix = utils.ToPtr("pavonis:ratelimit:")
+	}
+	if cfg.RateLimitStore.Timeout == nil {
+		cfg.RateLimitStore.Timeout = utils.ToPtr(100 * time.Millisecond)
+	}
+
+	// GeoIp
+	if cfg.GeoIp == nil {
+		cfg.GeoIp = &GeoIpConfig{}
+	}
+
+	// Ban
+	if cfg.Ban == nil {
+		cfg.Ban = &BanConfig{}
+	}
+	if cfg.Ban.StatusCodes == nil {
+		cfg.Ban.StatusCodes = utils.ToPtr([]int{http.StatusForbidden, http.StatusTooManyRequests})
+	}
+	if cfg.Ban.Threshold == nil {
+		cfg.Ban.Threshold = utils.ToPtr(60)
+	}
+	if cfg.Ban.Window == nil {
+		cfg.Ban.Window = utils.ToPtr(1 * time.Minute)
+	}
+	if cfg.Ban.Duration == nil {
+		cfg.Ban.Duration = utils.ToPtr(10 * time.Minute)
+	}
+
+	// ApiKey
+	if cfg.ApiKey == nil {
+		cfg.ApiKey = &ApiKeyConfig{}
+	}
+	if cfg.ApiKey.Header == nil {
+		cfg.ApiKey.Header = utils.ToPtr("X-Api-Key")
+	}
+	if cfg.ApiKey.QueryParam == nil {
+		cfg.ApiKey.QueryParam = utils.ToPtr("api_key")
+	}
+	cfg.ApiKey.Keys = cleanNil(cfg.ApiKey.Keys)
+	for _, keyCfg := range cfg.ApiKey.Keys {
+		if keyCfg.ResourceLimit == nil {
+			keyCfg.ResourceLimit = &ResourceLimitConfig{}
+		}
+		inheritResourceLimit(keyCfg.ResourceLimit, cfg.ResourceLimit)
+	}
 
 	// Diagnostics
 	if cfg.Diagnostics == nil {
@@ -110,6 +187,30 @@ func (cfg *Config) setDefaultValues() error {
 			return fmt.Errorf("[site%d] site mode is not provided", siteIdx)
 		}
 
+		// the traffic pool is not inherited, since the site pool is a separate pool inside the global pool
+		if siteCfg.ResourceLimit == nil {
+			siteCfg.ResourceLimit = &ResourceLimitConfig{}
+		}
+		inheritResourceLimit(siteCfg.ResourceLimit, cfg.ResourceLimit)
+		if siteCfg.ApiKeyRequired == nil {
+			siteCfg.ApiKeyRequired = utils.ToPtr(cfg.ApiKey.Required)
+		}
+		if siteCfg.AccessControl == nil {
+			siteCfg.AccessControl = &AccessControlConfig{}
+		}
+		siteCfg.AccessControl.Rules = cleanNil(siteCfg.AccessControl.Rules)
+		if siteCfg.AccessControl.DefaultAction == nil {
+			siteCfg.AccessControl.DefaultAction = utils.ToPtr(AccessActionAllow)
+		}
+		for _, ruleCfg := range siteCfg.AccessControl.Rules {
+			for i, country := range ruleCfg.Countries {
+				ruleCfg.Countries[i] = strings.ToUpper(country)
+			}
+			for i, method := range ruleCfg.Methods {
+				ruleCfg.Methods[i] = strings.ToUpper(method)
+			}
+		}
+
 		if siteCfg.Id == "" {
 			newIdBase := fmt.Sprintf("site%d", siteIdx)
 			attempt := 1
@@ -167,6 +268,47 @@ func (cfg *Config) setDefaultValues() error {
 			if settings.AllowList == nil {
 				settings.AllowList = utils.ToPtr(false)
 			}
+		case SiteModeGithubDownloadProxy:
+			settings := siteCfg.Settings.(*GithubDownloadProxySettings)
+			if settings.Cache == nil {
+				settings.Cache = &DiskCacheConfig{}
+			}
+			if settings.CacheRevalidateInterval == nil {
+				settings.CacheRevalidateInterval = utils.ToPtr(24 * time.Hour)
+			}
+			if settings.Api == nil {
+				settings.Api = &GithubApiConfig{}
+			}
+			if len(settings.RawTextUrlRewriteContentTypes) == 0 {
+				settings.RawTextUrlRewriteContentTypes = []string{"text/plain", "text/x-shellscript", "application/x-sh", "application/json", "text/html"}
+			}
+			settings.Hosts = cleanNil(settings.Hosts)
+			if len(settings.Hosts) == 0 {
+				settings.Hosts = []*GithubProxyHostConfig{{Preset: utils.ToPtr(GithubProxyHostPresetGithub)}}
+			}
+		case SiteModeHuggingFaceProxy:
+			settings := siteCfg.Settings.(*HuggingFaceProxySettings)
+			if settings.AllowUpload == nil {
+				settings.AllowUpload = utils.ToPtr(false)
+			}
+			settings.ExtraPaths = cleanNil(settings.ExtraPaths)
+			if settings.Gated == nil {
+				settings.Gated = &HuggingFaceGatedConfig{}
+			}
+			if settings.Gated.Policy == nil {
+				settings.Gated.Policy = utils.ToPtr(HuggingFaceGatedPolicyAllow)
+			}
+			if settings.Cache == nil {
+				settings.Cache = &DiskCacheConfig{}
+			}
+			for _, pathCfg := range settings.ExtraPaths {
+				if len(pathCfg.Methods) == 0 {
+					pathCfg.Methods = []string{http.MethodGet, http.MethodHead}
+				}
+				for i, method := range pathCfg.Methods {
+					pathCfg.Methods[i] = strings.ToUpper(method)
+				}
+			}
 		case SiteModeHttpGeneralProxy:
 			settings := siteCfg.Settings.(*HttpGeneralProxySettings)
 			if settings.RedirectAction == nil {
@@ -177,13 +319,35 @@ func (cfg *Config) setDefaultValues() error {
 			if (settings.UpstreamSimpleUrl == nil) != (settings.UpstreamFilesUrl == nil) {
 				return fmt.Errorf("[site%d] UpstreamSimpleUrl and UpstreamFilesUrl not all-set or all-unset", siteIdx)
 			}
+			settings.Upstreams = cleanNil(settings.Upstreams)
 			// default to PyPI
 			if settings.UpstreamSimpleUrl == nil {
 				settings.UpstreamSimpleUrl = utils.ToPtr("https://pypi.org/simple")
+				// with multiple upstreams, the JSON API of each upstream is configured separately
+				if settings.UpstreamJsonApiUrl == nil && len(settings.Upstreams) == 0 {
+					settings.UpstreamJsonApiUrl = utils.ToPtr("https://pypi.org/pypi")
+				}
 			}
 			if settings.UpstreamFilesUrl == nil {
 				settings.UpstreamFilesUrl = utils.ToPtr("https://files.pythonhosted.org")
 			}
+			if settings.IndexStrategy == nil {
+				settings.IndexStrategy = utils.ToPtr(PypiIndexStrategyFirstMatch)
+			}
+		case SiteModeCondaProxy:
+			settings := siteCfg.Settings.(*CondaProxySettings)
+			if settings.UpstreamUrl == nil {
+				settings.UpstreamUrl = utils.ToPtr("https://conda.anaconda.org")
+			}
+			settings.Channels = cleanNil(settings.Channels)
+		case SiteModeOllamaProxy:
+			settings := siteCfg.Settings.(*OllamaProxySettings)
+			if settings.UpstreamUrl == nil {
+				settings.UpstreamUrl = utils.ToPtr("https://registry.ollama.ai")
+			}
+			if settings.Cache == nil {
+				settings.Cache = &DiskCacheConfig{}
+			}
 		case SiteModeSpeedTest:
 			settings := siteCfg.Settings.(*SpeedTestSettings)
 			_1GiB := int64(1) * 1024 * 1024 * 1024
@@ -193,8 +357,42 @@ func (cfg *Config) setDefaultValues() error {
 			if settings.MaxUploadBytes == nil {
 				settings.MaxUploadBytes = utils.ToPtr(_1GiB)
 			}
+			if settings.WebUi == nil {
+				settings.WebUi = utils.ToPtr(true)
+			}
+			if settings.Upstream != nil {
+				if settings.Upstream.SampleSize == nil {
+					settings.Upstream.SampleSize = utils.ToPtr(16)
+				}
+				if settings.Upstream.Timeout == nil {
+					settings.Upstream.Timeout = utils.ToPtr(10 * time.Second)
+				}
+			}
 		}
 	}
 
 	return nil
 }
+
+func inheritResourceLimit(rlc *ResourceLimitConfig, parent *ResourceLimitConfig) {
+	inherit := func(value **float64, parentValue *float64) {
+		if *value == nil {
+			*value = parentValue
+		}
+	}
+	inherit(&rlc.TrafficAvgMibps, parent.TrafficAvgMibps)
+	inherit(&rlc.TrafficBurstMib, parent.TrafficBurstMib)
+	inherit(&rlc.TrafficMaxMibps, parent.TrafficMaxMibps)
+	inherit(&rlc.RequestPerSecond, parent.RequestPerSecond)
+	inherit(&rlc.RequestPerMinute, parent.RequestPerMinute)
+	inherit(&rlc.RequestPerHour, parent.RequestPerHour)
+	if rlc.MaxConcurrentRequests == nil {
+		rlc.MaxConcurrentRequests = parent.MaxConcurrentRequests
+	}
+	if rlc.RequestTimeout == nil {
+		rlc.RequestTimeout = parent.RequestTimeout
+	}
+	if rlc.ConcurrencyQueueTimeout == nil {
+		rlc.ConcurrencyQueueTimeout = parent.ConcurrencyQueueTimeout
+	}
+}
@@ -13,14 +13,60 @@ type HttpGeneralProxySettings struct {
 	RedirectAction *RedirectAction            `yaml:"redirect_action"`
 }
 
+type DiskCacheConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	Directory    string `yaml:"directory"`
+	MaxTotalSize int64  `yaml:"max_total_size"` // <= 0 means unlimited
+}
+
+type GithubApiConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Token   string `yaml:"token"` // optional, used for requests without the Authorization header. Do not use a token with private repository access
+}
+
+// GithubProxyHostConfig defines the proxyable host(s) of a code-hosting platform
+// Use a preset for the well-known platforms, or leave Preset empty for a custom host
+type GithubProxyHostConfig struct {
+	Preset            *GithubProxyHostPreset `yaml:"preset"`
+	Host              string                 `yaml:"host"`                 // required for custom hosts and the gitea preset, optional for the gitlab, codeberg and bitbucket presets
+	PathPatterns      []string               `yaml:"path_patterns"`        // custom only. Regexes matching allowed paths, group 1 is the owner, the optional group 2 is the repos
+	RawTextUrlRewrite bool                   `yaml:"raw_text_url_rewrite"` // custom only. If the text contents from the host can be rewritten
+}
+
 type GithubDownloadProxySettings struct {
-	SizeLimit         int64    `yaml:"size_limit"`
-	RawTextUrlRewrite bool     `yaml:"raw_text_url_rewrite"`
-	ReposWhitelist    []string `yaml:"repos_whitelist"`
-	ReposBlacklist    []string `yaml:"repos_blacklist"`
+	SizeLimit                     int64                    `yaml:"size_limit"` // also the upper bound of cacheable objects
+	RawTextUrlRewrite             bool                     `yaml:"raw_text_url_rewrite"`
+	RawTextUrlRewriteContentTypes []string                 `yaml:"raw_text_url_rewrite_content_types"` // media types, e.g. "text/plain"
+	RawTextUrlRewriteHosts        []string                 `yaml:"raw_text_url_rewrite_hosts"`         // hosts whose responses are rewritten, overriding the defaults of Hosts. Empty means using the defaults
+	ReposWhitelist                []string                 `yaml:"repos_whitelist"`
+	ReposBlacklist                []string                 `yaml:"repos_blacklist"`
+	Cache                         *DiskCacheConfig         `yaml:"cache"`                     // release asset cache
+	CacheRevalidateInterval       *time.Duration           `yaml:"cache_revalidate_interval"` // how long the final redirected url of an asset, which is the cache key, is reused before resolving it again
+	GitClonePerMinute             *float64                 `yaml:"git_clone_per_minute"`      // per client, nil means unlimited
+	GitClonePerHour               *float64                 `yaml:"git_clone_per_hour"`        // per client, nil means unlimited
+	Api                           *GithubApiConfig         `yaml:"api"`                       // read-only api.github.com proxying
+	Hosts                         []*GithubProxyHostConfig `yaml:"hosts"`                     // default: the github preset only
+}
+
+type HuggingFacePathConfig struct {
+	Pattern string   `yaml:"pattern"` // regex of the huggingface.co request path, e.g. "^/api/models/(?P<repo>[^/]+/[^/]+)/discussions$". The optional "repo" group is used for the repo checks
+	Methods []string `yaml:"methods"` // default: GET, HEAD
+}
+
+type HuggingFaceGatedConfig struct {
+	Policy *HuggingFaceGatedPolicy `yaml:"policy"`
+	Token  string                  `yaml:"token"` // the server-side token, for the token policy
+	Repos  []string                `yaml:"repos"` // repos to use the server-side token for, e.g. "meta-llama/*"
 }
 
 type HuggingFaceProxySettings struct {
+	AllowUpload    *bool                    `yaml:"allow_upload"`    // allow the preupload / commit endpoints and the LFS / Xet uploads
+	ExtraPaths     []*HuggingFacePathConfig `yaml:"extra_paths"`     // additional allowed paths, besides the builtin download paths
+	ReposWhitelist []string                 `yaml:"repos_whitelist"` // "namespace/repo" of models, datasets and spaces, e.g. "HuggingFaceH4/*"
+	ReposBlacklist []string                 `yaml:"repos_blacklist"` // "namespace/repo" of models, datasets and spaces, e.g. "HuggingFaceH4/*"
+	Gated          *HuggingFaceGatedConfig  `yaml:"gated"`
+	SizeLimit      int64                    `yaml:"size_limit"` // max total file size per request, 0 means unlimited
+	Cache          *DiskCacheConfig         `yaml:"cache"`      // cache of the "resolve/<commit-sha>/..." files
 }
 
 type User struct {
@@ -52,36 +98,104 @@ type ContainerRegistrySettings struct {
 	ReposBlacklist       []string      `yaml:"repos_blacklist"`
 }
 
+type PypiUpstreamConfig struct {
+	Name       string   `yaml:"name"`         // used in the proxied file urls, i.e. "/files/<name>/..."
+	SimpleUrl  string   `yaml:"simple_url"`   // no trailing '/'
+	FilesUrl   string   `yaml:"files_url"`    // no trailing '/'
+	JsonApiUrl string   `yaml:"json_api_url"` // no trailing '/', e.g. "https://pypi.org/pypi". Empty means the upstream has no JSON API
+	Projects   []string `yaml:"projects"`     // project name patterns that can only be served by this upstream, e.g. "acme-*"
+}
+
 type PypiRegistrySettings struct {
-	UpstreamSimpleUrl *string `yaml:"upstream_simple_url"` // no trailing '/'
-	UpstreamFilesUrl  *string `yaml:"upstream_files_url"`  // no trailing '/'
+	UpstreamSimpleUrl  *string `yaml:"upstream_simple_url"`   // no trailing '/'
+	UpstreamFilesUrl   *string `yaml:"upstream_files_url"`    // no trailing '/'
+	UpstreamJsonApiUrl *string `yaml:"upstream_json_api_url"` // no trailing '/', e.g. "https://pypi.org/pypi". nil means the JSON API is disabled. Use Upstreams[].JsonApiUrl with Upstreams
+	UploadUrl          *string `yaml:"upload_url"`            // e.g. "https://pypi.example.com/legacy/". nil means uploading is disabled
+
+	// Multiple indexes, in priority order. If set, UpstreamSimpleUrl and UpstreamFilesUrl are not used
+	Upstreams     []*PypiUpstreamConfig `yaml:"upstreams"`
+	IndexStrategy *PypiIndexStrategy    `yaml:"index_strategy"`
+
+	ProjectsWhitelist []string `yaml:"projects_whitelist"` // project name patterns, e.g. "acme-*"
+	ProjectsBlacklist []string `yaml:"projects_blacklist"` // project name patterns, e.g. "acme-*"
+
+	// Version filtering of the project detail pages
+	HideYanked                        bool           `yaml:"hide_yanked"`
+	Quarantine                        *time.Duration `yaml:"quarantine"`                           // hide releases uploaded within the duration. Only works for upstreams with PEP 700 upload-time
+	VulnerabilitiesFile               string         `yaml:"vulnerabilities_file"`                 // versions to hide, one "<project>==<version>" per line
+	VulnerabilitiesFileReloadInterval *time.Duration `yaml:"vulnerabilities_file_reload_interval"` // nil means no reload
+}
+
+type CondaChannelConfig struct {
+	Name        string `yaml:"name"`         // e.g. "conda-forge"
+	UpstreamUrl string `yaml:"upstream_url"` // the channel url, no trailing '/'. Empty means "<upstream_url>/<name>"
+}
+
+type CondaProxySettings struct {
+	UpstreamUrl *string               `yaml:"upstream_url"` // no trailing '/', e.g. "https://conda.anaconda.org"
+	Channels    []*CondaChannelConfig `yaml:"channels"`     // allowed channels. Empty means all channels under UpstreamUrl are allowed
+
+	// Package filtering of the repodata files and package downloads
+	PackagesWhitelist []string `yaml:"packages_whitelist"` // package name patterns, e.g. "py*"
+	PackagesBlacklist []string `yaml:"packages_blacklist"` // package name patterns, e.g. "py*"
+}
+
+type OllamaProxySettings struct {
+	UpstreamUrl     *string          `yaml:"upstream_url"`     // no trailing '/', e.g. "https://registry.ollama.ai"
+	ModelsWhitelist []string         `yaml:"models_whitelist"` // "namespace/model", e.g. "library/*" or "qwen3". The "library/" namespace can be omitted
+	ModelsBlacklist []string         `yaml:"models_blacklist"` // "namespace/model", e.g. "library/*" or "qwen3". The "library/" namespace can be omitted
+	Cache           *DiskCacheConfig `yaml:"cache"`            // blob cache
+}
+
+type SpeedTestUpstreamConfig struct {
+	Url        string         `yaml:"url"`         // the file to download through the ip pool addresses, e.g. "https://speed.cloudflare.com/__down?bytes=100000000"
+	SampleSize *int           `yaml:"sample_size"` // max number of the ip pool addresses to measure. Addresses are sampled randomly if the pool is larger
+	Timeout    *time.Duration `yaml:"timeout"`     // the download duration of each address. The measurement is truncated at the timeout
+	Interval   *time.Duration `yaml:"interval"`    // nil means the measurement only runs on demand
 }
 
 type SpeedTestSettings struct {
-	MaxUploadBytes   *int64 `yaml:"max_upload_bytes"`
-	MaxDownloadBytes *int64 `yaml:"max_download_bytes"`
+	MaxUploadBytes   *int64                   `yaml:"max_upload_bytes"`
+	MaxDownloadBytes *int64                   `yaml:"max_download_bytes"`
+	WebUi            *bool                    `yaml:"web_ui"`   // serve the speed test page at the site root
+	Upstream         *SpeedTestUpstreamConfig `yaml:"upstream"` // upstream measurement through the ip pool addresses. nil means disabled
 }
 
 type SiteConfig struct {
-	Id             string          `json:"id"`
-	Mode           *SiteMode       `yaml:"mode"`
-	Host           SiteHosts       `yaml:"host"`
-	SelfUrl        string          `yaml:"self_url"` // only scheme + host, not path (excluding path_prefix), not trailing '/'
-	PathPrefix     string          `yaml:"path_prefix"`
-	IpPoolStrategy *IpPoolStrategy `yaml:"ip_pool_strategy"`
-	Settings       interface{}     `yaml:"settings"`
+	Id             string               `json:"id"`
+	Mode           *SiteMode            `yaml:"mode"`
+	Host           SiteHosts            `yaml:"host"`
+	SelfUrl        string               `yaml:"self_url"` // only scheme + host, not path (excluding path_prefix), not trailing '/'
+	PathPrefix     string               `yaml:"path_prefix"`
+	IpPoolStrategy *IpPoolStrategy      `yaml:"ip_pool_strategy"`
+	ResourceLimit  *ResourceLimitConfig `yaml:"resource_limit"`   // unset fields are inherited from Config.ResourceLimit, except the traffic pool
+	ApiKeyRequired *bool                `yaml:"api_key_required"` // reject the requests without a valid api key. Only works if ApiKey is enabled
+	AccessControl  *AccessControlConfig `yaml:"access_control"`
+	Settings       interface{}          `yaml:"settings"`
 }
 
 type ServerConfig struct {
 	Listen              *string   `yaml:"listen"`
 	TrustedProxyIps     *[]string `yaml:"trusted_proxy_ips"`
-	TrustedProxyHeaders *[]string `yaml:"trusted_proxy_headers"`
+	TrustedProxyHeaders *[]string `yaml:"trusted_proxy_headers"` // the header set by the trusted proxies. X-Forwarded-For like lists, or the RFC 7239 "Forwarded" header. Multiple headers are deprecated, the first one present is used
+	ProxyProtocol       bool      `yaml:"proxy_protocol"`        // accept the optional PROXY protocol v1/v2 header from the TrustedProxyIps
+}
+
+// IpPoolHealthConfig quarantines the addresses that keep failing, e.g. blocked or rate limited by the upstream
+type IpPoolHealthConfig struct {
+	Enabled            bool           `yaml:"enabled"`
+	Window             *time.Duration `yaml:"window"`                // the upstream outcomes of an address are counted in a fixed window
+	MinRequests        *int           `yaml:"min_requests"`          // the min requests in the window before the rates are checked
+	MaxFailureRate     *float64       `yaml:"max_failure_rate"`      // rate of the connection errors and 403 responses
+	MaxRateLimitedRate *float64       `yaml:"max_rate_limited_rate"` // rate of the 429 responses
+	QuarantineDuration *time.Duration `yaml:"quarantine_duration"`
 }
 
 type IpPoolConfig struct {
-	Enabled         bool            `yaml:"enabled"`
-	DefaultStrategy *IpPoolStrategy `yaml:"default_strategy"`
-	Subnets         []string        `yaml:"subnets"`
+	Enabled         bool                `yaml:"enabled"`
+	DefaultStrategy *IpPoolStrategy     `yaml:"default_strategy"`
+	Subnets         []string            `yaml:"subnets"`
+	Health          *IpPoolHealthConfig `yaml:"health"`
 }
 
 type HeaderModificationConfig struct {
@@ -108,9 +222,76 @@ type ResourceLimitConfig struct {
 	RequestPerSecond *float64 `yaml:"request_per_second"`
 	RequestPerMinute *float64 `yaml:"request_per_minute"`
 	RequestPerHour   *float64 `yaml:"request_per_hour"`
+
+	// The traffic pool shared by all clients, where the bandwidth is fairly shared among the clients.
+	// Global pool in Config.ResourceLimit, per-site pool in SiteConfig.ResourceLimit
+	PoolTrafficAvgMibps *float64 `yaml:"pool_traffic_avg_mibps"`
+	PoolTrafficBurstMib *float64 `yaml:"pool_traffic_burst_mib"`
+
+	// In-flight downstream requests per client, and of all clients (global pool / per-site pool, same as the traffic pool)
+	MaxConcurrentRequests     *int `yaml:"max_concurrent_requests"`
+	PoolMaxConcurrentRequests *int `yaml:"pool_max_concurrent_requests"`
 	// nil-able fields end
 
-	RequestTimeout *time.Duration `yaml:"request_timeout"`
+	RequestTimeout          *time.Duration `yaml:"request_timeout"`
+	ConcurrencyQueueTimeout *time.Duration `yaml:"concurrency_queue_timeout"` // max wait for a concurrent request slot, before 429
+}
+
+// RateLimitStoreConfig is where the request rate counters are stored. The traffic limits are always local
+type RateLimitStoreConfig struct {
+	Type      *RateLimitStoreType `yaml:"type"`
+	Address   string              `yaml:"address"` // "host:port" of the redis server
+	Password  string              `yaml:"password"`
+	Db        int                 `yaml:"db"`
+	KeyPrefix *string             `yaml:"key_prefix"`
+	Timeout   *time.Duration      `yaml:"timeout"` // timeout of a store operation, after which the local limiter is used
+}
+
+// AccessRuleConfig matches a request if all the given conditions match. Unset conditions match everything
+type AccessRuleConfig struct {
+	Action      *AccessAction `yaml:"action"`
+	Cidrs       []string      `yaml:"cidrs"`        // the client address is in any of the CIDRs. A plain IP is the same as a /32 or /128
+	Countries   []string      `yaml:"countries"`    // ISO 3166-1 alpha-2 codes from the GeoIP database, e.g. "US". "-" matches the unknown countries
+	PathPattern string        `yaml:"path_pattern"` // regex of the request path, e.g. "^/v2/.+/blobs/uploads/"
+	Methods     []string      `yaml:"methods"`
+}
+
+// AccessControlConfig decides whether a client can access the site by the client address, i.e. RequestContext.ClientAddr
+type AccessControlConfig struct {
+	Rules         []*AccessRuleConfig `yaml:"rules"`          // the first matched rule decides
+	DefaultAction *AccessAction       `yaml:"default_action"` // used if no rule matches
+}
+
+// BanConfig bans the clients that keep being rejected, e.g. by the rate limits or the access rules.
+// The rejections of the requests with api keys are not counted
+type BanConfig struct {
+	Enabled     bool           `yaml:"enabled"`
+	StatusCodes *[]int         `yaml:"status_codes"` // the status codes of the rejections made by pavonis to count. Upstream responses are not counted
+	Threshold   *int           `yaml:"threshold"`    // the rejections within the window to ban the client
+	Window      *time.Duration `yaml:"window"`
+	Duration    *time.Duration `yaml:"duration"` // the cooling period of a ban
+}
+
+type GeoIpConfig struct {
+	Database string `yaml:"database"` // path to the MaxMind DB file with the countries, e.g. GeoLite2-Country.mmdb. Empty means disabled
+}
+
+type ApiKeyEntryConfig struct {
+	Name            string               `yaml:"name"` // shown in the logs, and used as the key of the quota usage
+	Key             string               `yaml:"key"`
+	ResourceLimit   *ResourceLimitConfig `yaml:"resource_limit"`    // per-key limits. Unset fields are inherited from Config.ResourceLimit, except the traffic pool
+	DailyQuotaMib   *float64             `yaml:"daily_quota_mib"`   // bytes sent to the client per UTC day, nil means unlimited
+	MonthlyQuotaMib *float64             `yaml:"monthly_quota_mib"` // bytes sent to the client per UTC month, nil means unlimited
+}
+
+type ApiKeyConfig struct {
+	Enabled    bool                 `yaml:"enabled"`
+	Required   bool                 `yaml:"required"`    // default value of SiteConfig.ApiKeyRequired
+	Header     *string              `yaml:"header"`      // header that carries the key
+	QueryParam *string              `yaml:"query_param"` // query parameter that carries the key
+	BasicAuth  bool                 `yaml:"basic_auth"`  // accept the key as the basic auth password. Unknown passwords are left for the upstream
+	Keys       []*ApiKeyEntryConfig `yaml:"keys"`
+	QuotaFile  string               `yaml:"quota_file"` // where the quota usage is persisted. Empty means not persisted
 }
 
 type DiagnosticsConfig struct {
@@ -119,11 +300,15 @@ type DiagnosticsConfig struct {
 }
 
 type Config struct {
-	Debug         bool                 `yaml:"debug"`
-	Server        *ServerConfig        `yaml:"server"`
-	Request       *RequestConfig       `yaml:"request"`
-	Response      *ResponseConfig      `yaml:"response"`
-	ResourceLimit *ResourceLimitConfig `yaml:"resource_limit"`
-	Diagnostics   *DiagnosticsConfig   `yaml:"diagnostics"`
-	Sites         []*SiteConfig        `yaml:"sites"`
+	Debug          bool                  `yaml:"debug"`
+	Server         *ServerConfig         `yaml:"server"`
+	Request        *RequestConfig        `yaml:"request"`
+	Response       *ResponseConfig       `yaml:"response"`
+	ResourceLimit  *ResourceLimitConfig  `yaml:"resource_limit"`
+	RateLimitStore *RateLimitStoreConfig `yaml:"rate_limit_store"`
+	GeoIp          *GeoIpConfig          `yaml:"geoip"`
+	Ban            *BanConfig            `yaml:"ban"`
+	ApiKey         *ApiKeyConfig         `yaml:"api_key"`
+	Diagnostics    *DiagnosticsConfig    `yaml:"diagnostics"`
+	Sites          []*SiteConfig         `yaml:"sites"`
 }
@@ -3,8 +3,11 @@ package config
 import (
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/utils"
+	log "github.com/sirupsen/logrus"
 	"golang.org/x/exp/slices"
+	"net"
 	"net/url"
+	"regexp"
 	"strings"
 	"time"
 )
@@ -16,32 +19,70 @@ func (cfg *Config) validateValues() error {
 			return fmt.Errorf("bad TrustedProxyIps value %+q: %v", *cfg.Server.TrustedProxyIps, err)
 		}
 	}
-
-	// ResourceLimit
-	checkGreaterThanZero := func(value *float64, what string) error {
-		if value != nil && *value <= 0 {
-			return fmt.Errorf("%s cannot <= 0, value: %v", what, *value)
-		}
-		return nil
+	if len(*cfg.Server.TrustedProxyHeaders) > 1 {
+		// the client can send the headers that the proxy does not set, so only the header set by the proxy can be trusted
+		log.Warnf("TrustedProxyHeaders %+q has more than 1 header, which is deprecated. Only the first one present in the request is used, and the client might send the headers that the trusted proxies do not set. Keep only the one set by the trusted proxies, e.g. [X-Forwarded-For]", *cfg.Server.TrustedProxyHeaders)
 	}
 
-	if err := checkGreaterThanZero(cfg.ResourceLimit.TrafficAvgMibps, "RateLimit.TrafficAvgMibps"); err != nil {
-		return err
-	}
-	if err := checkGreaterThanZero(cfg.ResourceLimit.TrafficBurstMib, "RateLimit.TrafficBurstMib"); err != nil {
-		return err
-	}
-	if err := checkGreaterThanZero(cfg.ResourceLimit.TrafficMaxMibps, "RateLimit.TrafficMaxMibps"); err != nil {
+	// ResourceLimit
+	if err := validateResourceLimit(cfg.ResourceLimit, "RateLimit"); err != nil {
 		return err
 	}
-	if err := checkGreaterThanZero(cfg.ResourceLimit.RequestPerSecond, "RateLimit.RequestPerSecond"); err != nil {
-		return err
+
+	// RateLimitStore
+	if *cfg.RateLimitStore.Type == RateLimitStoreTypeRedis {
+		if _, _, err := net.SplitHostPort(cfg.RateLimitStore.Address); err != nil {
+			return fmt.Errorf("bad RateLimitStore.Address %+q: %v", cfg.RateLimitStore.Address, err)
+		}
+		if *cfg.RateLimitStore.Timeout <= 0 {
+			return fmt.Errorf("RateLimitStore.Timeout %q should be positive", cfg.RateLimitStore.Timeout.String())
+		}
 	}
-	if err := checkGreaterThanZero(cfg.ResourceLimit.RequestPerMinute, "RateLimit.RequestPerMinute"); err != nil {
-		return err
+
+	// Ban
+	if cfg.Ban.Enabled {
+		if *cfg.Ban.Threshold <= 0 {
+			return fmt.Errorf("Ban.Threshold %d should be positive", *cfg.Ban.Threshold)
+		}
+		if *cfg.Ban.Window <= 0 || *cfg.Ban.Duration <= 0 {
+			return fmt.Errorf("Ban.Window %q and Ban.Duration %q should be positive", cfg.Ban.Window.String(), cfg.Ban.Duration.String())
+		}
+		for _, code := range *cfg.Ban.StatusCodes {
+			if code < 100 || code > 599 {
+				return fmt.Errorf("bad Ban.StatusCodes value %d", code)
+			}
+		}
 	}
-	if err := checkGreaterThanZero(cfg.ResourceLimit.RequestPerHour, "RateLimit.RequestPerHour"); err != nil {
-		return err
+
+	// ApiKey
+	if cfg.ApiKey.Enabled {
+		if *cfg.ApiKey.Header == "" && *cfg.ApiKey.QueryParam == "" && !cfg.ApiKey.BasicAuth {
+			return fmt.Errorf("ApiKey enabled but no key source is available")
+		}
+		names := make(map[string]bool)
+		keys := make(map[string]bool)
+		for i, keyCfg := range cfg.ApiKey.Keys {
+			if keyCfg.Name == "" || keyCfg.Key == "" {
+				return fmt.Errorf("ApiKey.Keys[%d] has empty name or key", i)
+			}
+			if names[keyCfg.Name] {
+				return fmt.Errorf("ApiKey.Keys[%d] has duplicated name %+q", i, keyCfg.Name)
+			}
+			if keys[keyCfg.Key] {
+				return fmt.Errorf("ApiKey.Keys[%d] %+q has duplicated key", i, keyCfg.Name)
+			}
+			names[keyCfg.Name] = true
+			keys[keyCfg.Key] = true
+			if err := validateResourceLimit(keyCfg.ResourceLimit, fmt.Sprintf("ApiKey.Keys[%d].ResourceLimit", i)); err != nil {
+				return err
+			}
+			if err := checkGreaterThanZero(keyCfg.DailyQuotaMib, fmt.Sprintf("ApiKey.Keys[%d].DailyQuotaMib", i)); err != nil {
+				return err
+			}
+			if err := checkGreaterThanZero(keyCfg.MonthlyQuotaMib, fmt.Sprintf("ApiKey.Keys[%d].MonthlyQuotaMib", i)); err != nil {
+				return err
+			}
+		}
 	}
 
 	// Request
@@ -53,6 +94,19 @@ func (cfg *Config) validateValues() error {
 	if cfg.Request.IpPool.Enabled && len(cfg.Request.IpPool.Subnets) == 0 {
 		return fmt.Errorf("IpPool enabled but no subnets specified")
 	}
+	if healthCfg := cfg.Request.IpPool.Health; healthCfg.Enabled {
+		if *healthCfg.Window <= 0 || *healthCfg.QuarantineDuration <= 0 {
+			return fmt.Errorf("IpPool.Health.Window %q and IpPool.Health.QuarantineDuration %q should be positive", healthCfg.Window.String(), healthCfg.QuarantineDuration.String())
+		}
+		if *healthCfg.MinRequests <= 0 {
+			return fmt.Errorf("IpPool.Health.MinRequests %d should be positive", *healthCfg.MinRequests)
+		}
+		for _, rate := range []*float64{healthCfg.MaxFailureRate, healthCfg.MaxRateLimitedRate} {
+			if *rate <= 0 || *rate > 1 {
+				return fmt.Errorf("IpPool.Health rate %v should be in (0, 1]", *rate)
+			}
+		}
+	}
 
 	// Site
 	for siteIdx, siteCfg := range cfg.Sites {
@@ -62,6 +116,31 @@ func (cfg *Config) validateValues() error {
 		if siteCfg.PathPrefix != "" && !strings.HasPrefix(siteCfg.PathPrefix, "/") {
 			return fmt.Errorf("[site%d] pathPrefix %+q does not start with /", siteIdx, siteCfg.PathPrefix)
 		}
+		if err := validateResourceLimit(siteCfg.ResourceLimit, fmt.Sprintf("[site%d] RateLimit", siteIdx)); err != nil {
+			return err
+		}
+		if *siteCfg.ApiKeyRequired && !cfg.ApiKey.Enabled {
+			return fmt.Errorf("[site%d] ApiKey is not enabled, but ApiKeyRequired is true", siteIdx)
+		}
+		for i, ruleCfg := range siteCfg.AccessControl.Rules {
+			if ruleCfg.Action == nil {
+				return fmt.Errorf("[site%d] AccessControl.Rules[%d] has no action", siteIdx, i)
+			}
+			if _, err := utils.NewIpPool(ruleCfg.Cidrs); err != nil {
+				return fmt.Errorf("[site%d] bad AccessControl.Rules[%d] cidrs %+q: %v", siteIdx, i, ruleCfg.Cidrs, err)
+			}
+			if len(ruleCfg.Countries) > 0 && cfg.GeoIp.Database == "" {
+				return fmt.Errorf("[site%d] AccessControl.Rules[%d] has countries, but GeoIp.Database is not set", siteIdx, i)
+			}
+			for _, country := range ruleCfg.Countries {
+				if !accessCountryPattern.MatchString(country) {
+					return fmt.Errorf("[site%d] bad AccessControl.Rules[%d] country %+q", siteIdx, i, country)
+				}
+			}
+			if _, err := regexp.Compile(ruleCfg.PathPattern); err != nil {
+				return fmt.Errorf("[site%d] invalid AccessControl.Rules[%d] path pattern %+q: %v", siteIdx, i, ruleCfg.PathPattern, err)
+			}
+		}
 
 		checkUrl := func(urlStr, what string, allowPath, allowTrailingSlash bool) error {
 			urlObj, err := url.Parse(urlStr)
@@ -112,10 +191,48 @@ func (cfg *Config) validateValues() error {
 			if settings.RawTextUrlRewrite {
 				checkSelfUrlReason = utils.ToPtr(fmt.Sprintf("RawTextUrlRewrite is %v", settings.RawTextUrlRewrite))
 			}
+			if settings.Api.Enabled {
+				checkSelfUrlReason = utils.ToPtr(fmt.Sprintf("Api.Enabled is %v", settings.Api.Enabled))
+			}
+			if err := validateDiskCacheConfig(settings.Cache); err != nil {
+				return fmt.Errorf("[site%d] bad Cache: %v", siteIdx, err)
+			}
+			if *settings.CacheRevalidateInterval <= 0 {
+				return fmt.Errorf("[site%d] CacheRevalidateInterval %q should be positive", siteIdx, settings.CacheRevalidateInterval.String())
+			}
+			if err := checkGreaterThanZero(settings.GitClonePerMinute, fmt.Sprintf("[site%d] GitClonePerMinute", siteIdx)); err != nil {
+				return err
+			}
+			if err := checkGreaterThanZero(settings.GitClonePerHour, fmt.Sprintf("[site%d] GitClonePerHour", siteIdx)); err != nil {
+				return err
+			}
+			for i, hostCfg := range settings.Hosts {
+				if err := validateGithubProxyHostConfig(hostCfg); err != nil {
+					return fmt.Errorf("[site%d] bad Hosts[%d]: %v", siteIdx, i, err)
+				}
+			}
 		case SiteModeHuggingFaceProxy:
 			settings := siteCfg.Settings.(*HuggingFaceProxySettings)
 			checkSelfUrlReason = utils.ToPtr(fmt.Sprintf("site mode is %s", *siteCfg.Mode))
-			_ = settings
+			for i, pathCfg := range settings.ExtraPaths {
+				if _, err := regexp.Compile(pathCfg.Pattern); err != nil {
+					return fmt.Errorf("[site%d] invalid ExtraPaths[%d] pattern %+q: %v", siteIdx, i, pathCfg.Pattern, err)
+				}
+			}
+			if *settings.Gated.Policy == HuggingFaceGatedPolicyToken {
+				if settings.Gated.Token == "" {
+					return fmt.Errorf("[site%d] Gated.Token is required for gated policy %s", siteIdx, *settings.Gated.Policy)
+				}
+				if len(settings.Gated.Repos) == 0 {
+					return fmt.Errorf("[site%d] Gated.Repos is required for gated policy %s", siteIdx, *settings.Gated.Policy)
+				}
+			}
+			if settings.SizeLimit < 0 {
+				return fmt.Errorf("[site%d] SizeLimit %d should not be negative", siteIdx, settings.SizeLimit)
+			}
+			if err := validateDiskCacheConfig(settings.Cache); err != nil {
+				return fmt.Errorf("[site%d] bad Cache: %v", siteIdx, err)
+			}
 		case SiteModeHttpGeneralProxy:
 			settings := siteCfg.Settings.(*HttpGeneralProxySettings)
 			for i, mapping := range settings.Mappings {
@@ -131,9 +248,109 @@ func (cfg *Config) validateValues() error {
 			if err := checkUrl(*settings.UpstreamFilesUrl, "UpstreamFilesUrl", true, false); err != nil {
 				return err
 			}
+			if settings.UpstreamJsonApiUrl != nil {
+				if len(settings.Upstreams) > 0 {
+					// otherwise the pinned projects might be resolved from this url, see Upstreams[].Projects
+					return fmt.Errorf("[site%d] UpstreamJsonApiUrl is not used with Upstreams, set Upstreams[].JsonApiUrl instead", siteIdx)
+				}
+				if err := checkUrl(*settings.UpstreamJsonApiUrl, "UpstreamJsonApiUrl", true, false); err != nil {
+					return err
+				}
+			}
+			if settings.UploadUrl != nil {
+				if err := checkUrl(*settings.UploadUrl, "UploadUrl", true, true); err != nil {
+					return err
+				}
+			}
+			upstreamNames := make(map[string]bool)
+			for i, upstream := range settings.Upstreams {
+				if !pypiUpstreamNamePattern.MatchString(upstream.Name) {
+					return fmt.Errorf("[site%d] bad Upstreams[%d] name %+q", siteIdx, i, upstream.Name)
+				}
+				if upstreamNames[upstream.Name] {
+					return fmt.Errorf("[site%d] duplicated Upstreams[%d] name %+q", siteIdx, i, upstream.Name)
+				}
+				upstreamNames[upstream.Name] = true
+				if err := checkUrl(upstream.SimpleUrl, fmt.Sprintf("Upstreams[%d].SimpleUrl", i), true, false); err != nil {
+					return err
+				}
+				if err := checkUrl(upstream.FilesUrl, fmt.Sprintf("Upstreams[%d].FilesUrl", i), true, false); err != nil {
+					return err
+				}
+				if upstream.JsonApiUrl != "" {
+					if err := checkUrl(upstream.JsonApiUrl, fmt.Sprintf("Upstreams[%d].JsonApiUrl", i), true, false); err != nil {
+						return err
+					}
+				}
+				for _, pattern := range upstream.Projects {
+					if pattern == "" {
+						return fmt.Errorf("[site%d] Upstreams[%d] has an empty project pattern", siteIdx, i)
+					}
+				}
+			}
+			if settings.Quarantine != nil && *settings.Quarantine <= 0 {
+				return fmt.Errorf("[site%d] Quarantine %q should be positive", siteIdx, settings.Quarantine.String())
+			}
+			if settings.VulnerabilitiesFile != "" && !utils.IsFile(settings.VulnerabilitiesFile) {
+				return fmt.Errorf("[site%d] VulnerabilitiesFile %+q is not a valid file", siteIdx, settings.VulnerabilitiesFile)
+			}
+			if settings.VulnerabilitiesFileReloadInterval != nil && *settings.VulnerabilitiesFileReloadInterval <= 1*time.Second {
+				return fmt.Errorf("[site%d] VulnerabilitiesFileReloadInterval %q is too small", siteIdx, settings.VulnerabilitiesFileReloadInterval.String())
+			}
+		case SiteModeCondaProxy:
+			settings := siteCfg.Settings.(*CondaProxySettings)
+			if err := checkUrl(*settings.UpstreamUrl, "UpstreamUrl", true, false); err != nil {
+				return err
+			}
+			channelNames := make(map[string]bool)
+			for i, channel := range settings.Channels {
+				if !condaChannelNamePattern.MatchString(channel.Name) {
+					return fmt.Errorf("[site%d] bad Channels[%d] name %+q", siteIdx, i, channel.Name)
+				}
+				if channelNames[channel.Name] {
+					return fmt.Errorf("[site%d] duplicated Channels[%d] name %+q", siteIdx, i, channel.Name)
+				}
+				channelNames[channel.Name] = true
+				if channel.UpstreamUrl != "" {
+					if err := checkUrl(channel.UpstreamUrl, fmt.Sprintf("Channels[%d].UpstreamUrl", i), true, false); err != nil {
+						return err
+					}
+				}
+			}
+		case SiteModeOllamaProxy:
+			settings := siteCfg.Settings.(*OllamaProxySettings)
+			if err := checkUrl(*settings.UpstreamUrl, "UpstreamUrl", true, false); err != nil {
+				return err
+			}
+			for i, entry := range settings.ModelsWhitelist {
+				if !ollamaModelPatternPattern.MatchString(entry) {
+					return fmt.Errorf("[site%d] invalid ModelsWhitelist[%d] %+q", siteIdx, i, entry)
+				}
+			}
+			for i, entry := range settings.ModelsBlacklist {
+				if !ollamaModelPatternPattern.MatchString(entry) {
+					return fmt.Errorf("[site%d] invalid ModelsBlacklist[%d] %+q", siteIdx, i, entry)
+				}
+			}
+			if err := validateDiskCacheConfig(settings.Cache); err != nil {
+				return fmt.Errorf("[site%d] bad Cache: %v", siteIdx, err)
+			}
 		case SiteModeSpeedTest:
 			settings := siteCfg.Settings.(*SpeedTestSettings)
-			_ = settings
+			if settings.Upstream != nil {
+				if err := checkUrl(settings.Upstream.Url, "Upstream.Url", true, true); err != nil {
+					return err
+				}
+				if *settings.Upstream.SampleSize <= 0 {
+					return fmt.Errorf("[site%d] Upstream.SampleSize %d should be positive", siteIdx, *settings.Upstream.SampleSize)
+				}
+				if *settings.Upstream.Timeout <= 0 {
+					return fmt.Errorf("[site%d] Upstream.Timeout %q should be positive", siteIdx, settings.Upstream.Timeout.String())
+				}
+				if settings.Upstream.Interval != nil && *settings.Upstream.Interval < 1*time.Minute {
+					return fmt.Errorf("[site%d] Upstream.Interval %q is too small", siteIdx, settings.Upstream.Interval.String())
+				}
+			}
 		}
 
 		if checkSelfUrlReason == nil && siteCfg.SelfUrl != "" {
@@ -150,6 +367,62 @@ func (cfg *Config) validateValues() error {
 	return nil
 }
 
+func validateDiskCacheConfig(cacheCfg *DiskCacheConfig) error {
+	if !cacheCfg.Enabled {
+		return nil
+	}
+	if cacheCfg.Directory == "" {
+		return fmt.Errorf("directory is empty")
+	}
+	if utils.IsFile(cacheCfg.Directory) {
+		return fmt.Errorf("directory %+q is a file", cacheCfg.Directory)
+	}
+	return nil
+}
+
+var accessCountryPattern = regexp.MustCompile(`^([A-Z]{2}|-)$`)
+var pypiUpstreamNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+var condaChannelNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+
+// "model", "namespace/model", with "*" as the wildcard segment
+var ollamaModelPatternPattern = regexp.MustCompile(`^([a-zA-Z0-9_.-]+|\*)(/([a-zA-Z0-9_.-]+|\*))?$`)
+
+func validateGithubProxyHostConfig(hostCfg *GithubProxyHostConfig) error {
+	if hostCfg.Preset != nil {
+		if len(hostCfg.PathPatterns) > 0 {
+			return fmt.Errorf("path_patterns is not supported for preset %s", *hostCfg.Preset)
+		}
+		switch *hostCfg.Preset {
+		case GithubProxyHostPresetGithub:
+			if hostCfg.Host != "" {
+				return fmt.Errorf("host is not supported for preset %s", *hostCfg.Preset)
+			}
+		case GithubProxyHostPresetGitea:
+			if hostCfg.Host == "" {
+				return fmt.Errorf("host is required for preset %s", *hostCfg.Preset)
+			}
+		}
+		return nil
+	}
+
+	if hostCfg.Host == "" {
+		return fmt.Errorf("host is required for custom hosts")
+	}
+	if len(hostCfg.PathPatterns) == 0 {
+		return fmt.Errorf("path_patterns is required for custom hosts")
+	}
+	for _, pattern := range hostCfg.PathPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid path pattern %+q: %v", pattern, err)
+		}
+		if re.NumSubexp() < 1 {
+			return fmt.Errorf("path pattern %+q has no capturing group for the owner", pattern)
+		}
+	}
+	return nil
+}
+
 func ValidateUser(userCfg *User) error {
 	if userCfg == nil {
 		return fmt.Errorf("userCfg is nil")
@@ -172,3 +445,48 @@ func ValidateUser(userCfg *User) error {
 
 	return nil
 }
+
+func checkGreaterThanZero(value *float64, what string) error {
+	if value != nil && *value <= 0 {
+		return fmt.Errorf("%s cannot <= 0, value: %v", what, *value)
+	}
+	return nil
+}
+
+func validateResourceLimit(rlc *ResourceLimitConfig, what string) error {
+	for _, field := range []struct {
+		name  string
+		value *float64
+	}{
+		{"TrafficAvgMibps", rlc.TrafficAvgMibps},
+		{"TrafficBurstMib", rlc.TrafficBurstMib},
+		{"TrafficMaxMibps", rlc.TrafficMaxMibps},
+		{"RequestPerSecond", rlc.RequestPerSecond},
+		{"RequestPerMinute", rlc.RequestPerMinute},
+		{"RequestPerHour", rlc.RequestPerHour},
+		{"PoolTrafficAvgMibps", rlc.PoolTrafficAvgMibps},
+		{"PoolTrafficBurstMib", rlc.PoolTrafficBurstMib},
+	} {
+		if err := checkGreaterThanZero(field.value, what+"."+field.name); err != nil {
+			return err
+		}
+	}
+	for _, field := range []struct {
+		name  string
+		value *int
+	}{
+		{"MaxConcurrentRequests", rlc.MaxConcurrentRequests},
+		{"PoolMaxConcurrentRequests", rlc.PoolMaxConcurrentRequests},
+	} {
+		if field.value != nil && *field.value <= 0 {
+			return fmt.Errorf("%s.%s cannot <= 0, value: %v", what, field.name, *field.value)
+		}
+	}
+	if *rlc.ConcurrencyQueueTimeout < 0 {
+		return fmt.Errorf("%s.ConcurrencyQueueTimeout %q cannot be negative", what, rlc.ConcurrencyQueueTimeout.String())
+	}
+	if *rlc.RequestTimeout <= 0 {
+		return fmt.Errorf("%s.RequestTimeout %q should be positive", what, rlc.RequestTimeout.String())
+	}
+	return nil
+}
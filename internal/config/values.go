@@ -5,12 +5,19 @@ import "fmt"
 type SiteMode string
 type IpPoolStrategy string
 type RedirectAction string
+type GithubProxyHostPreset string
+type PypiIndexStrategy string
+type HuggingFaceGatedPolicy string
+type RateLimitStoreType string
+type AccessAction string
 
 const (
+	SiteModeCondaProxy             SiteMode = "conda"
 	SiteModeContainerRegistryProxy SiteMode = "container_registry"
 	SiteModeGithubDownloadProxy    SiteMode = "gh_proxy"
 	SiteModeHttpGeneralProxy       SiteMode = "http"
 	SiteModeHuggingFaceProxy       SiteMode = "hugging_face"
+	SiteModeOllamaProxy            SiteMode = "ollama"
 	SiteModePypiProxy              SiteMode = "pypi"
 	SiteModeSpeedTest              SiteMode = "speed_test"
 
@@ -22,6 +29,25 @@ const (
 	RedirectActionRewriteOrFollow RedirectAction = "rewrite_or_follow" // rewrite relative, follow external,
 	RedirectActionRewriteOnly     RedirectAction = "rewrite_only"      // rewrite relative only
 	RedirectActionNone            RedirectAction = "none"              // do nothing
+
+	GithubProxyHostPresetGithub    GithubProxyHostPreset = "github"    // all github hosts
+	GithubProxyHostPresetGitlab    GithubProxyHostPreset = "gitlab"    // gitlab.com, or a self-hosted GitLab
+	GithubProxyHostPresetGitea     GithubProxyHostPreset = "gitea"     // a self-hosted Gitea / Forgejo, host required
+	GithubProxyHostPresetCodeberg  GithubProxyHostPreset = "codeberg"  // codeberg.org
+	GithubProxyHostPresetBitbucket GithubProxyHostPreset = "bitbucket" // bitbucket.org
+
+	PypiIndexStrategyFirstMatch PypiIndexStrategy = "first_match" // use the first upstream that has the project
+	PypiIndexStrategyMerge      PypiIndexStrategy = "merge"       // merge files from all upstreams, higher priority upstreams win on conflicts
+
+	HuggingFaceGatedPolicyAllow HuggingFaceGatedPolicy = "allow" // gated repos are accessed with the token of the user
+	HuggingFaceGatedPolicyBlock HuggingFaceGatedPolicy = "block" // gated repos are not allowed
+	HuggingFaceGatedPolicyToken HuggingFaceGatedPolicy = "token" // use the server-side token for the configured repos
+
+	RateLimitStoreTypeLocal RateLimitStoreType = "local" // the counters are in the memory of this instance
+	RateLimitStoreTypeRedis RateLimitStoreType = "redis" // the counters are shared by the instances, in a Redis-protocol compatible server
+
+	AccessActionAllow AccessAction = "allow"
+	AccessActionDeny  AccessAction = "deny"
 )
 
 func unmarshalStringEnum[T ~string](obj *T, unmarshal func(interface{}) error, what string, values []T) error {
@@ -43,10 +69,12 @@ func unmarshalStringEnum[T ~string](obj *T, unmarshal func(interface{}) error, w
 
 func (s *SiteMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return unmarshalStringEnum(s, unmarshal, "site mode", []SiteMode{
+		SiteModeCondaProxy,
 		SiteModeContainerRegistryProxy,
 		SiteModeGithubDownloadProxy,
 		SiteModeHttpGeneralProxy,
 		SiteModeHuggingFaceProxy,
+		SiteModeOllamaProxy,
 		SiteModePypiProxy,
 		SiteModeSpeedTest,
 	})
@@ -69,6 +97,23 @@ func (s *RedirectAction) UnmarshalYAML(unmarshal func(interface{}) error) error
 	})
 }
 
+func (s *GithubProxyHostPreset) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalStringEnum(s, unmarshal, "host preset", []GithubProxyHostPreset{
+		GithubProxyHostPresetGithub,
+		GithubProxyHostPresetGitlab,
+		GithubProxyHostPresetGitea,
+		GithubProxyHostPresetCodeberg,
+		GithubProxyHostPresetBitbucket,
+	})
+}
+
+func (s *PypiIndexStrategy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalStringEnum(s, unmarshal, "index strategy", []PypiIndexStrategy{
+		PypiIndexStrategyFirstMatch,
+		PypiIndexStrategyMerge,
+	})
+}
+
 type SiteHosts []string
 
 func unmarshalStringOrStringList[T ~[]string](obj *T, unmarshal func(interface{}) error, what string) error {
@@ -94,3 +139,30 @@ func (s *SiteHosts) UnmarshalYAML(unmarshal func(interface{}) error) error {
 func (s *SiteHosts) IsWildcard() bool {
 	return len(*s) == 1 && (*s)[0] == "*"
 }
+
+// ClientLimitKey returns the key of the per-client limits. Sites with the same key share the same client limiters
+func (rlc *ResourceLimitConfig) ClientLimitKey() string {
+	return formatRequestLimit(rlc) + "|" + formatTrafficLimit(rlc)
+}
+
+func (s *HuggingFaceGatedPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalStringEnum(s, unmarshal, "gated policy", []HuggingFaceGatedPolicy{
+		HuggingFaceGatedPolicyAllow,
+		HuggingFaceGatedPolicyBlock,
+		HuggingFaceGatedPolicyToken,
+	})
+}
+
+func (s *RateLimitStoreType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalStringEnum(s, unmarshal, "rate limit store type", []RateLimitStoreType{
+		RateLimitStoreTypeLocal,
+		RateLimitStoreTypeRedis,
+	})
+}
+
+func (s *AccessAction) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshalStringEnum(s, unmarshal, "access action", []AccessAction{
+		AccessActionAllow,
+		AccessActionDeny,
+	})
+}
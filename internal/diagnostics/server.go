@@ -1,9 +1,11 @@
 package diagnostics
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/config"
 	"github.com/Fallen-Breath/pavonis/internal/constants"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"net/http"
 	"net/http/pprof"
@@ -11,12 +13,14 @@ import (
 )
 
 type Server struct {
-	cfg *config.DiagnosticsConfig
+	cfg     *config.DiagnosticsConfig
+	banList *common.BanList // nil if ban is disabled
 }
 
-func NewServer(cfg *config.DiagnosticsConfig) *Server {
+func NewServer(cfg *config.DiagnosticsConfig, banList *common.BanList) *Server {
 	return &Server{
-		cfg: cfg,
+		cfg:     cfg,
+		banList: banList,
 	}
 }
 
@@ -25,6 +29,8 @@ func (s *Server) CreateHttpServer() *http.Server {
 	mux.HandleFunc("/{$}", s.createRootHandler())
 	mux.HandleFunc("/metrics", s.createMetricsHandler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("GET /bans", s.createBanListHandler())
+	mux.HandleFunc("DELETE /bans/{client}", s.createUnbanHandler())
 
 	return &http.Server{
 		Addr:    *s.cfg.Listen,
@@ -47,6 +53,33 @@ func (s *Server) createMetricsHandler() func(http.ResponseWriter, *http.Request)
 	return promHandler.ServeHTTP
 }
 
+func (s *Server) createBanListHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.banList == nil {
+			http.Error(w, "Ban is disabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(s.banList.List())
+	}
+}
+
+// createUnbanHandler unbans the client, which is the client key or an address of the client
+func (s *Server) createUnbanHandler() func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.banList == nil {
+			http.Error(w, "Ban is disabled", http.StatusNotFound)
+			return
+		}
+		client := r.PathValue("client")
+		if !s.banList.Unban(client) {
+			http.Error(w, fmt.Sprintf("Client %s is not banned", client), http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(fmt.Sprintf("Client %s is unbanned", client)))
+	}
+}
+
 func (s *Server) createDebugPprofHandler() func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if pprofName, found := strings.CutPrefix(r.URL.Path, "/debug/pprof/"); found {
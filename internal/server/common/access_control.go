@@ -0,0 +1,114 @@
+package common
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+const unknownCountry = "-"
+
+type accessRule struct {
+	action      config.AccessAction
+	cidrs       *utils.IpPool // nil if unset
+	countries   []string
+	pathPattern *regexp.Regexp // nil if unset
+	methods     []string
+}
+
+// AccessController decides whether a client can access a site, with the access rules of the site
+type AccessController struct {
+	siteId        string
+	rules         []*accessRule
+	defaultAction config.AccessAction
+	geoIp         *utils.MaxMindDb // nil if GeoIP is disabled
+}
+
+func newAccessController(siteCfg *config.SiteConfig, geoIp *utils.MaxMindDb) (*AccessController, error) {
+	controller := &AccessController{
+		siteId:        siteCfg.Id,
+		defaultAction: *siteCfg.AccessControl.DefaultAction,
+		geoIp:         geoIp,
+	}
+	for i, ruleCfg := range siteCfg.AccessControl.Rules {
+		rule := &accessRule{
+			action:    *ruleCfg.Action,
+			countries: ruleCfg.Countries,
+			methods:   ruleCfg.Methods,
+		}
+		if len(ruleCfg.Cidrs) > 0 {
+			var err error
+			if rule.cidrs, err = utils.NewIpPool(ruleCfg.Cidrs); err != nil {
+				return nil, fmt.Errorf("[site %s] bad cidrs of access rule %d: %v", siteCfg.Id, i, err)
+			}
+		}
+		if ruleCfg.PathPattern != "" {
+			var err error
+			if rule.pathPattern, err = regexp.Compile(ruleCfg.PathPattern); err != nil {
+				return nil, fmt.Errorf("[site %s] bad path pattern of access rule %d: %v", siteCfg.Id, i, err)
+			}
+		}
+		controller.rules = append(controller.rules, rule)
+	}
+	return controller, nil
+}
+
+// Check returns a HttpError if the request should be rejected
+func (c *AccessController) Check(ctx *context.RequestContext, r *http.Request) error {
+	if len(c.rules) == 0 && c.defaultAction == config.AccessActionAllow {
+		return nil
+	}
+
+	ip := net.ParseIP(ctx.ClientAddr)
+	country := ""
+	getCountry := func() string {
+		if country == "" {
+			country = unknownCountry
+			if ip != nil && c.geoIp != nil {
+				if code, err := c.geoIp.LookupCountry(ip); err != nil {
+					log.Warnf("%sGeoIP lookup for %s failed: %v", ctx.LogPrefix, ctx.ClientAddr, err)
+				} else if code != "" {
+					country = code
+				}
+			}
+		}
+		return country
+	}
+
+	action, ruleName := c.defaultAction, "default"
+	for i, rule := range c.rules {
+		if rule.cidrs != nil && (ip == nil || !rule.cidrs.Contains(ip)) {
+			continue
+		}
+		if rule.pathPattern != nil && !rule.pathPattern.MatchString(r.URL.Path) {
+			continue
+		}
+		if len(rule.methods) > 0 && !slices.Contains(rule.methods, r.Method) {
+			continue
+		}
+		if len(rule.countries) > 0 && !slices.Contains(rule.countries, getCountry()) {
+			continue
+		}
+		action, ruleName = rule.action, strconv.Itoa(i)
+		break
+	}
+
+	metricAccessDecision.WithLabelValues(c.siteId, string(action), ruleName).Inc()
+	desc := fmt.Sprintf("client %s %s %s by access rule %s", ctx.ClientAddr, r.Method, r.URL.Path, ruleName)
+	if country != "" {
+		desc += fmt.Sprintf(" (country %s)", country)
+	}
+	if action == config.AccessActionDeny {
+		log.Infof("%sAccess denied: %s", ctx.LogPrefix, desc)
+		return NewRejectionError(http.StatusForbidden, "Access denied")
+	}
+	log.Debugf("%sAccess allowed: %s", ctx.LogPrefix, desc)
+	return nil
+}
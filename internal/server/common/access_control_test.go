@@ -0,0 +1,68 @@
+package common
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccessController(t *testing.T) {
+	cfg := &config.Config{
+		Sites: []*config.SiteConfig{{
+			Mode: utils.ToPtr(config.SiteModeSpeedTest),
+			AccessControl: &config.AccessControlConfig{
+				Rules: []*config.AccessRuleConfig{
+					{Action: utils.ToPtr(config.AccessActionDeny), Cidrs: []string{"10.0.0.66"}},
+					{Action: utils.ToPtr(config.AccessActionAllow), Cidrs: []string{"10.0.0.0/8", "2001:db8::/32"}},
+					{Action: utils.ToPtr(config.AccessActionDeny), PathPattern: "^/v2/.+/blobs/uploads/", Methods: []string{"post", "put"}},
+				},
+			},
+		}},
+	}
+	require.NoError(t, cfg.Init())
+	assert.Equal(t, []string{"POST", "PUT"}, cfg.Sites[0].AccessControl.Rules[2].Methods)
+
+	controller, err := newAccessController(cfg.Sites[0], nil)
+	require.NoError(t, err)
+	check := func(clientAddr string, method string, path string) int {
+		err := controller.Check(context.NewRequestContext("localhost", clientAddr), httptest.NewRequest(method, path, nil))
+		if err == nil {
+			return http.StatusOK
+		}
+		return err.(*HttpError).Status
+	}
+
+	// the first matched rule decides
+	assert.Equal(t, http.StatusForbidden, check("10.0.0.66", http.MethodGet, "/"))
+	assert.Equal(t, http.StatusOK, check("10.1.2.3", http.MethodPost, "/v2/foo/blobs/uploads/"))
+	assert.Equal(t, http.StatusOK, check("2001:db8::1", http.MethodPut, "/v2/foo/blobs/uploads/"))
+
+	// only the office networks can push
+	assert.Equal(t, http.StatusForbidden, check("192.0.2.1", http.MethodPost, "/v2/foo/blobs/uploads/"))
+	assert.Equal(t, http.StatusOK, check("192.0.2.1", http.MethodGet, "/v2/foo/blobs/sha256:abc"))
+	assert.Equal(t, http.StatusOK, check("not-an-ip", http.MethodGet, "/"))
+}
+
+func TestAccessControllerDefaultDeny(t *testing.T) {
+	siteCfg := &config.SiteConfig{
+		Id: "site0",
+		AccessControl: &config.AccessControlConfig{
+			Rules: []*config.AccessRuleConfig{
+				// without a GeoIP database, all clients are in the unknown country
+				{Action: utils.ToPtr(config.AccessActionAllow), Countries: []string{"-"}, Methods: []string{http.MethodGet}},
+			},
+			DefaultAction: utils.ToPtr(config.AccessActionDeny),
+		},
+	}
+	controller, err := newAccessController(siteCfg, nil)
+	require.NoError(t, err)
+
+	ctx := context.NewRequestContext("localhost", "192.0.2.1")
+	assert.NoError(t, controller.Check(ctx, httptest.NewRequest(http.MethodGet, "/", nil)))
+	assert.Error(t, controller.Check(ctx, httptest.NewRequest(http.MethodPost, "/", nil)))
+}
@@ -0,0 +1,284 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/felixge/httpsnoop"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const apiKeyQuotaSaveInterval = 1 * time.Minute
+
+type apiKeyUsage struct {
+	Day        string `json:"day"` // UTC date, e.g. "2006-01-02"
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"` // UTC month, e.g. "2006-01"
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// rollover resets the counters of the passed periods
+func (u *apiKeyUsage) rollover(now time.Time) {
+	now = now.UTC()
+	if day := now.Format("2006-01-02"); u.Day != day {
+		u.Day, u.DayBytes = day, 0
+	}
+	if month := now.Format("2006-01"); u.Month != month {
+		u.Month, u.MonthBytes = month, 0
+	}
+}
+
+// ApiKey is a client identity, which has its own limits and quotas instead of the per-ip ones
+type ApiKey struct {
+	Name       string
+	ClientData *ClientData
+	cfg        *config.ApiKeyEntryConfig
+
+	mu    sync.Mutex
+	usage apiKeyUsage
+}
+
+// CheckQuota returns a 429 HttpError if any quota of the key is used up
+func (k *ApiKey) CheckQuota() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.usage.rollover(time.Now())
+	if k.cfg.DailyQuotaMib != nil && float64(k.usage.DayBytes) >= *k.cfg.DailyQuotaMib*1024*1024 {
+		return NewRejectionError(http.StatusTooManyRequests, "Daily quota exceeded")
+	}
+	if k.cfg.MonthlyQuotaMib != nil && float64(k.usage.MonthBytes) >= *k.cfg.MonthlyQuotaMib*1024*1024 {
+		return NewRejectionError(http.StatusTooManyRequests, "Monthly quota exceeded")
+	}
+	return nil
+}
+
+// AddUsage adds the bytes sent to the client to the quota usage
+func (k *ApiKey) AddUsage(bytes int64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.usage.rollover(time.Now())
+	k.usage.DayBytes += bytes
+	k.usage.MonthBytes += bytes
+}
+
+func (k *ApiKey) getUsage() apiKeyUsage {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.usage
+}
+
+// apiKeyClientKey returns the client key of the api key, which is used instead of the ClientKey of the client ip
+func apiKeyClientKey(name string) string {
+	return "apikey$" + name
+}
+
+type ApiKeyStore struct {
+	cfg        *config.ApiKeyConfig
+	keys       map[[32]byte]*ApiKey // sha256 of the key -> key
+	keysByName map[string]*ApiKey
+
+	dirty    atomic.Bool
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func NewApiKeyStore(cfg *config.ApiKeyConfig, rateLimitStore *RequestRateLimitStore) (*ApiKeyStore, error) {
+	s := &ApiKeyStore{
+		cfg:        cfg,
+		keys:       make(map[[32]byte]*ApiKey),
+		keysByName: make(map[string]*ApiKey),
+		stopCh:     make(chan struct{}),
+	}
+	for _, keyCfg := range cfg.Keys {
+		apiKey := &ApiKey{
+			Name:       keyCfg.Name,
+			ClientData: newClientData(keyCfg.ResourceLimit, rateLimitStore, apiKeyClientKey(keyCfg.Name)),
+			cfg:        keyCfg,
+		}
+		s.keys[sha256.Sum256([]byte(keyCfg.Key))] = apiKey
+		s.keysByName[keyCfg.Name] = apiKey
+	}
+
+	if cfg.QuotaFile != "" {
+		if err := s.load(); err != nil {
+			return nil, fmt.Errorf("failed to load the api key quota file %+q: %v", cfg.QuotaFile, err)
+		}
+		s.wg.Add(1)
+		go s.saveRoutine()
+	}
+	return s, nil
+}
+
+// Authenticate extracts the api key from the request, and removes it from the request, so it won't be sent to the upstream.
+// provided is true if a key is found in the header or the query string, even if it's invalid.
+// The basic auth password is only used if it matches a key, since it might be the credential for the upstream
+func (s *ApiKeyStore) Authenticate(r *http.Request) (apiKey *ApiKey, provided bool) {
+	var key string
+	if header := *s.cfg.Header; header != "" && r.Header.Get(header) != "" {
+		key = r.Header.Get(header)
+		r.Header.Del(header)
+	}
+	if param := *s.cfg.QueryParam; param != "" {
+		if query := r.URL.Query(); query.Has(param) {
+			if key == "" {
+				key = query.Get(param)
+			}
+			query.Del(param)
+			r.URL.RawQuery = query.Encode()
+		}
+	}
+	if key != "" {
+		return s.keys[sha256.Sum256([]byte(key))], true
+	}
+
+	if s.cfg.BasicAuth {
+		if _, password, ok := r.BasicAuth(); ok {
+			if apiKey = s.keys[sha256.Sum256([]byte(password))]; apiKey != nil {
+				r.Header.Del("Authorization")
+				return apiKey, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Get returns the key with the given name, or nil if not found
+func (s *ApiKeyStore) Get(name string) *ApiKey {
+	return s.keysByName[name]
+}
+
+// AddUsage adds the usage to the key, and marks the quota file to be saved
+func (s *ApiKeyStore) AddUsage(apiKey *ApiKey, bytes int64) {
+	apiKey.AddUsage(bytes)
+	s.dirty.Store(true)
+}
+
+// WrapResponseWriter returns the writer that charges the bytes sent to the client to the quota of the key as they are written.
+// Once the quota is used up, the following writes fail, so the transfer is stopped
+func (s *ApiKeyStore) WrapResponseWriter(apiKey *ApiKey, w http.ResponseWriter) http.ResponseWriter {
+	return httpsnoop.Wrap(w, httpsnoop.Hooks{
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				if err := apiKey.CheckQuota(); err != nil {
+					return 0, err
+				}
+				n, err := next(b)
+				s.AddUsage(apiKey, int64(n))
+				return n, err
+			}
+		},
+		ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+			return func(src io.Reader) (int64, error) {
+				return next(&quotaChargingReader{store: s, apiKey: apiKey, reader: src})
+			}
+		},
+	})
+}
+
+// quotaChargingReader charges the bytes read to the quota, for the io.ReaderFrom of the ResponseWriter
+type quotaChargingReader struct {
+	store  *ApiKeyStore
+	apiKey *ApiKey
+	reader io.Reader
+}
+
+func (r *quotaChargingReader) Read(p []byte) (int, error) {
+	if err := r.apiKey.CheckQuota(); err != nil {
+		return 0, err
+	}
+	n, err := r.reader.Read(p)
+	r.store.AddUsage(r.apiKey, int64(n))
+	return n, err
+}
+
+func (s *ApiKeyStore) load() error {
+	data, err := os.ReadFile(s.cfg.QuotaFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var usages map[string]apiKeyUsage
+	if err := json.Unmarshal(data, &usages); err != nil {
+		return err
+	}
+	for name, usage := range usages {
+		// usages of the removed keys are dropped
+		if apiKey := s.keysByName[name]; apiKey != nil {
+			apiKey.usage = usage
+		}
+	}
+	return nil
+}
+
+// save writes the usages to a temp file, then renames it to the quota file, so the quota file is never half-written
+func (s *ApiKeyStore) save() error {
+	usages := make(map[string]apiKeyUsage)
+	for name, apiKey := range s.keysByName {
+		usages[name] = apiKey.getUsage()
+	}
+	data, err := json.MarshalIndent(usages, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmpFile, err := os.CreateTemp(filepath.Dir(s.cfg.QuotaFile), filepath.Base(s.cfg.QuotaFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmpFile.Name())
+	}()
+	if _, err := tmpFile.Write(data); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), s.cfg.QuotaFile)
+}
+
+func (s *ApiKeyStore) saveIfDirty() {
+	if s.dirty.Swap(false) {
+		if err := s.save(); err != nil {
+			s.dirty.Store(true)
+			log.Errorf("Failed to save the api key quota file %+q: %v", s.cfg.QuotaFile, err)
+		}
+	}
+}
+
+func (s *ApiKeyStore) saveRoutine() {
+	defer s.wg.Done()
+	ticker := time.NewTicker(apiKeyQuotaSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.saveIfDirty()
+		case <-s.stopCh:
+			s.saveIfDirty()
+			return
+		}
+	}
+}
+
+// Shutdown stops the background saving, and saves the quota usages
+func (s *ApiKeyStore) Shutdown() {
+	s.stopOnce.Do(func() {
+		close(s.stopCh)
+	})
+	s.wg.Wait()
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestApiKeyConfig(t *testing.T, apiKeyCfg *config.ApiKeyConfig) *config.ApiKeyConfig {
+	apiKeyCfg.Enabled = true
+	cfg := &config.Config{ApiKey: apiKeyCfg}
+	require.NoError(t, cfg.Init())
+	return cfg.ApiKey
+}
+
+func TestApiKeyAuthenticate(t *testing.T) {
+	store, err := NewApiKeyStore(newTestApiKeyConfig(t, &config.ApiKeyConfig{
+		BasicAuth: true,
+		Keys: []*config.ApiKeyEntryConfig{
+			{Name: "alice", Key: "key-alice"},
+			{Name: "bob", Key: "key-bob"},
+		},
+	}), nil)
+	require.NoError(t, err)
+	defer store.Shutdown()
+
+	r := httptest.NewRequest(http.MethodGet, "/foo?a=1&api_key=key-alice", nil)
+	apiKey, provided := store.Authenticate(r)
+	require.NotNil(t, apiKey)
+	assert.True(t, provided)
+	assert.Equal(t, "alice", apiKey.Name)
+	assert.Equal(t, "a=1", r.URL.RawQuery)
+
+	r = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.Header.Set("X-Api-Key", "key-bob")
+	apiKey, _ = store.Authenticate(r)
+	require.NotNil(t, apiKey)
+	assert.Equal(t, "bob", apiKey.Name)
+	assert.Equal(t, "", r.Header.Get("X-Api-Key"))
+
+	r = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.Header.Set("X-Api-Key", "wrong")
+	apiKey, provided = store.Authenticate(r)
+	assert.Nil(t, apiKey)
+	assert.True(t, provided)
+
+	// unknown basic auth passwords are for the upstream
+	r = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.SetBasicAuth("user", "upstream-password")
+	apiKey, provided = store.Authenticate(r)
+	assert.Nil(t, apiKey)
+	assert.False(t, provided)
+	assert.NotEqual(t, "", r.Header.Get("Authorization"))
+
+	r = httptest.NewRequest(http.MethodGet, "/foo", nil)
+	r.SetBasicAuth("whatever", "key-alice")
+	apiKey, _ = store.Authenticate(r)
+	require.NotNil(t, apiKey)
+	assert.Equal(t, "alice", apiKey.Name)
+	assert.Equal(t, "", r.Header.Get("Authorization"))
+}
+
+func TestApiKeyQuotaPersistence(t *testing.T) {
+	apiKeyCfg := newTestApiKeyConfig(t, &config.ApiKeyConfig{
+		QuotaFile: filepath.Join(t.TempDir(), "quota.json"),
+		Keys: []*config.ApiKeyEntryConfig{
+			{Name: "alice", Key: "key-alice", DailyQuotaMib: utils.ToPtr(1.0)},
+		},
+	})
+
+	store, err := NewApiKeyStore(apiKeyCfg, nil)
+	require.NoError(t, err)
+	apiKey := store.Get("alice")
+	assert.NoError(t, apiKey.CheckQuota())
+	store.AddUsage(apiKey, 512*1024)
+	assert.NoError(t, apiKey.CheckQuota())
+	store.Shutdown()
+
+	// the usage survives the restart
+	store, err = NewApiKeyStore(apiKeyCfg, nil)
+	require.NoError(t, err)
+	defer store.Shutdown()
+	apiKey = store.Get("alice")
+	assert.NoError(t, apiKey.CheckQuota())
+	store.AddUsage(apiKey, 512*1024)
+	var httpErr *HttpError
+	require.ErrorAs(t, apiKey.CheckQuota(), &httpErr)
+	assert.Equal(t, http.StatusTooManyRequests, httpErr.Status)
+
+	// a new day resets the daily usage
+	apiKey.usage.Day = time.Now().UTC().Add(-24 * time.Hour).Format("2006-01-02")
+	assert.NoError(t, apiKey.CheckQuota())
+}
+
+func TestApiKeyWrapResponseWriter(t *testing.T) {
+	store, err := NewApiKeyStore(newTestApiKeyConfig(t, &config.ApiKeyConfig{
+		Keys: []*config.ApiKeyEntryConfig{
+			{Name: "alice", Key: "key-alice", DailyQuotaMib: utils.ToPtr(1.0)},
+		},
+	}), nil)
+	require.NoError(t, err)
+	defer store.Shutdown()
+	apiKey := store.Get("alice")
+
+	recorder := httptest.NewRecorder()
+	w := store.WrapResponseWriter(apiKey, recorder)
+	chunk := make([]byte, 512*1024)
+
+	// the usage is charged as the response is written
+	n, err := w.Write(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, len(chunk), n)
+	assert.Equal(t, int64(len(chunk)), apiKey.getUsage().DayBytes)
+	n, err = w.Write(chunk)
+	assert.NoError(t, err)
+	assert.Equal(t, len(chunk), n)
+
+	// the transfer is stopped once the quota is used up
+	n, err = w.Write(chunk)
+	var httpErr *HttpError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusTooManyRequests, httpErr.Status)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 2*len(chunk), recorder.Body.Len())
+	assert.Equal(t, int64(2*len(chunk)), apiKey.getUsage().DayBytes)
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+type Ban struct {
+	ClientKey  string    `json:"client_key"`
+	ClientAddr string    `json:"client_addr"` // the address of the rejected request that triggered the ban
+	Rejections int       `json:"rejections"`
+	Since      time.Time `json:"since"`
+	Until      time.Time `json:"until"`
+}
+
+const banSweepInterval = 1 * time.Minute
+
+// BanList bans the clients that keep being rejected. The rejections are counted in the ClientData of the clients
+type BanList struct {
+	cfg             *config.BanConfig
+	clientDataCache *ClientDataCache
+
+	mu   sync.RWMutex
+	bans map[string]*Ban // ClientKey -> ban
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newBanList(cfg *config.BanConfig, clientDataCache *ClientDataCache) *BanList {
+	l := &BanList{
+		cfg:             cfg,
+		clientDataCache: clientDataCache,
+		bans:            make(map[string]*Ban),
+		stopCh:          make(chan struct{}),
+	}
+	l.wg.Add(1)
+	go l.sweepRoutine()
+	return l
+}
+
+// GetBan returns the ban of the client with the given ClientKey, or nil if the client is not banned
+func (l *BanList) GetBan(clientKey string) *Ban {
+	l.mu.RLock()
+	ban, ok := l.bans[clientKey]
+	l.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	if time.Now().After(ban.Until) {
+		l.mu.Lock()
+		l.removeExpired(ban)
+		l.mu.Unlock()
+		return nil
+	}
+	return ban
+}
+
+// removeExpired removes the expired ban, if it's still in the list. The lock must be held
+func (l *BanList) removeExpired(ban *Ban) {
+	if l.bans[ban.ClientKey] == ban {
+		delete(l.bans, ban.ClientKey)
+		metricBanActive.Dec()
+		log.Infof("Client %s (%s) is unbanned, ban expired", ban.ClientAddr, ban.ClientKey)
+	}
+}
+
+// sweepExpired removes all expired bans, so the bans of the clients that never come back do not stay in the list
+func (l *BanList) sweepExpired() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ban := range l.bans {
+		if now.After(ban.Until) {
+			l.removeExpired(ban)
+		}
+	}
+}
+
+func (l *BanList) sweepRoutine() {
+	defer l.wg.Done()
+	ticker := time.NewTicker(banSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.sweepExpired()
+		case <-l.stopCh:
+			return
+		}
+	}
+}
+
+// Shutdown stops the background sweeping
+func (l *BanList) Shutdown() {
+	l.stopOnce.Do(func() {
+		close(l.stopCh)
+	})
+	l.wg.Wait()
+}
+
+// OnResponse counts the rejection if the request is rejected by pavonis itself with one of the configured status codes,
+// and bans the client if it exceeds the threshold. Rejections from the upstreams are not counted
+func (l *BanList) OnResponse(ctx *context.RequestContext, statusCode int) {
+	if ctx.ApiKeyName != "" || !ctx.Rejected || !slices.Contains(*l.cfg.StatusCodes, statusCode) {
+		return
+	}
+
+	clientKey := ClientKey(ctx.ClientAddr)
+	clientData := l.clientDataCache.GetData(clientKey)
+	now := time.Now()
+	rejections := clientData.rejections.add(now, *l.cfg.Window)
+	if rejections < *l.cfg.Threshold {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if ban, ok := l.bans[clientKey]; ok && now.Before(ban.Until) {
+		return
+	} else if !ok {
+		metricBanActive.Inc()
+	}
+	l.bans[clientKey] = &Ban{
+		ClientKey:  clientKey,
+		ClientAddr: ctx.ClientAddr,
+		Rejections: rejections,
+		Since:      now,
+		Until:      now.Add(*l.cfg.Duration),
+	}
+	clientData.rejections.reset()
+	metricBanTotal.Inc()
+	log.Warnf("%sClient %s (%s) is banned for %s, %d rejections within %s", ctx.LogPrefix, ctx.ClientAddr, clientKey, *l.cfg.Duration, rejections, *l.cfg.Window)
+}
+
+// List returns the active bans, sorted by the ban time
+func (l *BanList) List() []*Ban {
+	now := time.Now()
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	bans := make([]*Ban, 0, len(l.bans))
+	for _, ban := range l.bans {
+		if now.Before(ban.Until) {
+			bans = append(bans, ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Since.Before(bans[j].Since)
+	})
+	return bans
+}
+
+// Unban removes the ban of the client. The client can be the ClientKey, or an address of the client.
+// Returns false if the client is not banned
+func (l *BanList) Unban(client string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, clientKey := range []string{client, ClientKey(client)} {
+		if ban, ok := l.bans[clientKey]; ok {
+			delete(l.bans, clientKey)
+			metricBanActive.Dec()
+			l.clientDataCache.GetData(clientKey).rejections.reset()
+			log.Infof("Client %s (%s) is unbanned manually", ban.ClientAddr, clientKey)
+			return true
+		}
+	}
+	return false
+}
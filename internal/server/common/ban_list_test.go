@@ -0,0 +1,86 @@
+package common
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBanList(t *testing.T) {
+	cfg := &config.Config{
+		Ban: &config.BanConfig{
+			Enabled:   true,
+			Threshold: utils.ToPtr(3),
+			Duration:  utils.ToPtr(100 * time.Millisecond),
+		},
+	}
+	require.NoError(t, cfg.Init())
+	factory, err := NewRequestHelperFactory(cfg)
+	require.NoError(t, err)
+	defer factory.Shutdown()
+	banList := factory.GetBanList()
+	require.NotNil(t, banList)
+
+	newRejectedCtx := func(clientAddr string) *context.RequestContext {
+		ctx := context.NewRequestContext("localhost", clientAddr)
+		ctx.Rejected = true
+		return ctx
+	}
+	ctx := newRejectedCtx("2001:db8::1")
+	clientKey := ClientKey(ctx.ClientAddr)
+
+	// the rejections of the upstream are not counted
+	upstreamCtx := context.NewRequestContext("localhost", ctx.ClientAddr)
+	for i := 0; i < 5; i++ {
+		banList.OnResponse(upstreamCtx, http.StatusForbidden)
+	}
+	assert.Nil(t, banList.GetBan(clientKey))
+
+	banList.OnResponse(ctx, http.StatusTooManyRequests)
+	banList.OnResponse(ctx, http.StatusOK)
+	banList.OnResponse(ctx, http.StatusForbidden)
+	assert.Nil(t, banList.GetBan(clientKey))
+
+	// the requests with api keys are not counted
+	apiKeyCtx := newRejectedCtx(ctx.ClientAddr)
+	apiKeyCtx.ApiKeyName = "alice"
+	banList.OnResponse(apiKeyCtx, http.StatusTooManyRequests)
+	assert.Nil(t, banList.GetBan(clientKey))
+
+	// other addresses in the same /64 are the same client
+	banList.OnResponse(newRejectedCtx("2001:db8::2"), http.StatusTooManyRequests)
+	ban := banList.GetBan(clientKey)
+	require.NotNil(t, ban)
+	assert.Equal(t, 3, ban.Rejections)
+	assert.Len(t, banList.List(), 1)
+
+	// unban by an address of the client
+	assert.True(t, banList.Unban("2001:db8::3"))
+	assert.False(t, banList.Unban("2001:db8::3"))
+	assert.Nil(t, banList.GetBan(clientKey))
+	assert.Empty(t, banList.List())
+
+	// the ban expires after the cooling period
+	for i := 0; i < 3; i++ {
+		banList.OnResponse(ctx, http.StatusForbidden)
+	}
+	require.NotNil(t, banList.GetBan(clientKey))
+	time.Sleep(150 * time.Millisecond)
+	assert.Nil(t, banList.GetBan(clientKey))
+
+	// the expired bans are swept, even if the clients never come back
+	for i := 0; i < 3; i++ {
+		banList.OnResponse(ctx, http.StatusForbidden)
+	}
+	require.Len(t, banList.List(), 1)
+	time.Sleep(150 * time.Millisecond)
+	banList.sweepExpired()
+	banList.mu.RLock()
+	assert.Empty(t, banList.bans)
+	banList.mu.RUnlock()
+}
@@ -7,23 +7,55 @@ import (
 	expirelru "github.com/hashicorp/golang-lru/v2/expirable"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
 type ClientData struct {
 	TrafficRateLimiter utils.RateLimiter
 	RequestRateLimiter utils.RateLimiter
+	ConcurrencyLimiter *utils.ConcurrencyLimiter // nil if unlimited
+	rejections         rejectionCounter
 }
 
+// rejectionCounter counts the rejected requests of a client in a fixed time window
+type rejectionCounter struct {
+	mu          sync.Mutex
+	windowStart time.Time
+	count       int
+}
+
+// add adds a rejection, and returns the rejections in the current window
+func (c *rejectionCounter) add(now time.Time, window time.Duration) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if now.Sub(c.windowStart) >= window {
+		c.windowStart = now
+		c.count = 0
+	}
+	c.count++
+	return c.count
+}
+
+func (c *rejectionCounter) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count = 0
+}
+
+// ClientDataCache stores the per-client limiters of a group of sites with the same per-client limits
 type ClientDataCache struct {
-	cfg   *config.Config
-	cache *expirelru.LRU[string, *ClientData]
+	rlc            *config.ResourceLimitConfig
+	rateLimitStore *RequestRateLimitStore // nil if the request counters are local
+	cache          *expirelru.LRU[string, *ClientData]
 }
 
-func NewClientDataCache(cfg *config.Config) *ClientDataCache {
+// NewClientDataCache creates the cache for the given limits. The ttl should be longer than the request timeout of the sites
+func NewClientDataCache(rlc *config.ResourceLimitConfig, ttl time.Duration, rateLimitStore *RequestRateLimitStore) *ClientDataCache {
 	return &ClientDataCache{
-		cfg:   cfg,
-		cache: expirelru.NewLRU[string, *ClientData](10240, nil, *cfg.ResourceLimit.RequestTimeout+1*time.Minute),
+		rlc:            rlc,
+		rateLimitStore: rateLimitStore,
+		cache:          expirelru.NewLRU[string, *ClientData](10240, nil, ttl),
 	}
 }
 
@@ -41,32 +73,34 @@ func ipToKey(ip net.IP) string {
 	return "ipv6$" + strings.Join(hexParts, ":")
 }
 
-func (c *ClientDataCache) GetData(clientIp string) *ClientData {
-	var key string
+// ClientKey returns the key of the client ip, where the IPv6 addresses in the same /64 subnet share the same key
+func ClientKey(clientIp string) string {
 	if ip := net.ParseIP(clientIp); ip != nil {
-		key = ipToKey(ip)
-	} else {
-		key = "raw$" + clientIp
+		return ipToKey(ip)
 	}
+	return "raw$" + clientIp
+}
+
+// GetData returns the data of the client with the given ClientKey
+func (c *ClientDataCache) GetData(key string) *ClientData {
 	value, ok := c.cache.Get(key)
 	if ok {
 		return value
 	}
 
-	limiter := c.newClientData()
+	limiter := newClientData(c.rlc, c.rateLimitStore, key)
 	c.cache.Add(key, limiter)
 	return limiter
 }
 
-func (c *ClientDataCache) newClientData() *ClientData {
-	rlc := c.cfg.ResourceLimit
-
+func newClientData(rlc *config.ResourceLimitConfig, rateLimitStore *RequestRateLimitStore, clientKey string) *ClientData {
 	trafficRateLimiter := utils.CreateTrafficRateLimiter(rlc.TrafficAvgMibps, rlc.TrafficBurstMib, rlc.TrafficMaxMibps)
-	requestRateLimiter := utils.CreateRequestRateLimiter(rlc.RequestPerSecond, rlc.RequestPerMinute, rlc.RequestPerHour)
+	requestRateLimiter := rateLimitStore.createRequestRateLimiter(rlc, clientKey)
 
 	return &ClientData{
 		TrafficRateLimiter: trafficRateLimiter,
 		RequestRateLimiter: requestRateLimiter,
+		ConcurrencyLimiter: utils.CreateConcurrencyLimiter(rlc.MaxConcurrentRequests),
 	}
 }
 
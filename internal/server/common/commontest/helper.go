@@ -0,0 +1,24 @@
+// Package commontest provides the utilities for testing the handlers built on the common package
+package commontest
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// NewRequestHelper creates a RequestHelper of the first site in cfg, or of the global limits if there's no site,
+// which sends all downstream requests via the given transport. The given cfg should have been initialized
+func NewRequestHelper(t *testing.T, cfg *config.Config, transport http.RoundTripper) *common.RequestHelper {
+	factory, err := common.NewRequestHelperFactory(cfg, common.WithTransport(transport))
+	require.NoError(t, err)
+	t.Cleanup(factory.Shutdown)
+
+	siteCfg := &config.SiteConfig{Id: "test", ResourceLimit: cfg.ResourceLimit}
+	if len(cfg.Sites) > 0 {
+		siteCfg = cfg.Sites[0]
+	}
+	return factory.NewRequestHelper(siteCfg)
+}
@@ -0,0 +1,92 @@
+package commontest
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+type upstreamTransport struct {
+	upstreamUrl *url.URL
+}
+
+// NewUpstreamTransport creates a transport that sends all requests to the given upstream test server, as if it's every host.
+// The original host is kept in the Host header, and in the X-Original-Host header
+func NewUpstreamTransport(upstreamUrl string) http.RoundTripper {
+	return &upstreamTransport{upstreamUrl: utils.MustParseUrl(upstreamUrl)}
+}
+
+func (t *upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	upstreamReq := req.Clone(req.Context())
+	upstreamReq.Header.Set("X-Original-Host", req.URL.Host)
+	upstreamReq.URL.Scheme = t.upstreamUrl.Scheme
+	upstreamReq.URL.Host = t.upstreamUrl.Host
+	if upstreamReq.Host == "" {
+		upstreamReq.Host = req.URL.Host
+	}
+	resp, err := http.DefaultTransport.RoundTrip(upstreamReq)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// HandlerFactory creates the handler of a site with the given settings, e.g. the NewProxyHandler of the handler packages
+type HandlerFactory[S any] func(info *handler.Info, helper *common.RequestHelper, settings S) (handler.HttpHandler, error)
+
+// NewProxy starts a server of a site with the given mode and settings, whose downstream requests are sent via the given transport.
+// The site is added to the given uninitialized cfg, which can be nil. Returns the url of the server
+func NewProxy[S any](t *testing.T, cfg *config.Config, mode config.SiteMode, settings S, newHandler HandlerFactory[S], transport http.RoundTripper) string {
+	proxy := httptest.NewUnstartedServer(nil)
+	selfUrl := "http://" + proxy.Listener.Addr().String()
+
+	if cfg == nil {
+		cfg = &config.Config{}
+	}
+	cfg.Sites = []*config.SiteConfig{{
+		Mode:     utils.ToPtr(mode),
+		SelfUrl:  selfUrl,
+		Settings: settings,
+	}}
+	require.NoError(t, cfg.Init())
+
+	helper := NewRequestHelper(t, cfg, transport)
+	hdl, err := newHandler(handler.NewSiteInfo("test", cfg.Sites[0]), helper, cfg.Sites[0].Settings.(S))
+	require.NoError(t, err)
+	t.Cleanup(hdl.Shutdown)
+
+	proxy.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hdl.ServeHttp(context.NewRequestContext(r.Host, "127.0.0.1"), w, r)
+	})
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+	return selfUrl
+}
+
+// HttpGet sends a GET request with the given extra headers, and reads the whole response. Redirects are not followed
+func HttpGet(t *testing.T, urlStr string, header http.Header) (*http.Response, string) {
+	req, err := http.NewRequest(http.MethodGet, urlStr, nil)
+	require.NoError(t, err)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
@@ -0,0 +1,90 @@
+package common
+
+import (
+	"errors"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils/diskcache"
+	"io"
+	"net/http"
+	"time"
+)
+
+// PassthroughResponseError carries a downstream response that should not be cached, which is sent to the client as-is
+type PassthroughResponseError struct {
+	Response *http.Response
+}
+
+func (e *PassthroughResponseError) Error() string {
+	return "uncacheable downstream response: " + e.Response.Status
+}
+
+// ServeFromDiskCache serves the content of the key from the disk cache, with Range requests supported
+//
+// If the key is not cached, fetch is called to start a background fill, which the client reads along with.
+// Ranges that are not filled yet are sent once the fill reaches them, e.g. for clients downloading in parallel ranges.
+// fetch might return a PassthroughResponseError for the responses that should not be cached.
+// The fill should not be charged to the client that starts it, e.g. use NewBackgroundClient, since every reader is charged here
+func (h *RequestHelper) ServeFromDiskCache(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, cache *diskcache.Cache, key string, headerKeys []string, fetch diskcache.FetchFunc) {
+	w, releaser, err := h.limitCachedResponse(ctx, w, r)
+	if err != nil {
+		h.WriteError(ctx, w, err)
+		return
+	}
+	defer releaser()
+
+	reader, meta, err := cache.Open(r.Context(), key, fetch)
+	if err != nil {
+		var pe *PassthroughResponseError
+		if errors.As(err, &pe) {
+			WriteResponse(w, pe.Response)
+		} else {
+			h.WriteError(ctx, w, err)
+		}
+		return
+	}
+	serveCachedContent(w, r, reader, meta.Header, headerKeys)
+}
+
+// ServeCachedContent sends the content with the given keys of the header, and closes the content
+// The client is limited in the same way as the proxied requests
+func (h *RequestHelper) ServeCachedContent(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, content io.ReadSeekCloser, header http.Header, headerKeys []string) {
+	w, releaser, err := h.limitCachedResponse(ctx, w, r)
+	if err != nil {
+		_ = content.Close()
+		h.WriteError(ctx, w, err)
+		return
+	}
+	defer releaser()
+
+	serveCachedContent(w, r, content, header, headerKeys)
+}
+
+// limitCachedResponse charges the request rate, takes the concurrent request slots,
+// and wraps the writer with the traffic limiters of the client, since the cached responses do not go through a transport
+func (h *RequestHelper) limitCachedResponse(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func(), error) {
+	trafficLimiter, releaser, err := h.acquireClientLimits(ctx, r.Context(), true)
+	if err != nil {
+		return w, nil, err
+	}
+	return NewTrafficRateLimitedResponseWriter(r.Context(), w, trafficLimiter), releaser, nil
+}
+
+func serveCachedContent(w http.ResponseWriter, r *http.Request, content io.ReadSeekCloser, header http.Header, headerKeys []string) {
+	defer func() { _ = content.Close() }()
+	for _, key := range headerKeys {
+		if values := header.Values(key); len(values) > 0 {
+			w.Header()[key] = values
+		}
+	}
+	http.ServeContent(w, r, "", time.Time{}, content)
+}
+
+// WriteResponse sends the downstream response to the client as-is, and closes the response body
+func WriteResponse(w http.ResponseWriter, resp *http.Response) {
+	defer func() { _ = resp.Body.Close() }()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
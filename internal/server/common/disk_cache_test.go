@@ -0,0 +1,51 @@
+package common
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeCachedContentLimits(t *testing.T) {
+	cfg := &config.Config{
+		ResourceLimit: &config.ResourceLimitConfig{
+			TrafficAvgMibps:  utils.ToPtr(0.1),
+			TrafficBurstMib:  utils.ToPtr(0.04),
+			RequestPerMinute: utils.ToPtr(1.0),
+		},
+	}
+	require.NoError(t, cfg.Init())
+	helper := newTestRequestHelper(t, cfg, http.DefaultTransport)
+
+	data := strings.Repeat("0123456789", 10*1024)
+	path := filepath.Join(t.TempDir(), "content")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0644))
+	serve := func() (*httptest.ResponseRecorder, time.Duration) {
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		start := time.Now()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		helper.ServeCachedContent(context.NewRequestContext("localhost", "192.0.2.1"), w, r, file, http.Header{}, nil)
+		return w, time.Since(start)
+	}
+
+	// the traffic limit of the client applies to the cached content
+	w, cost := serve()
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, data, w.Body.String())
+	assert.GreaterOrEqual(t, cost, 300*time.Millisecond)
+
+	// so does the request rate limit
+	w, _ = serve()
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	gocontext "context"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+)
+
+// DownstreamClient sends downstream requests on behalf of a single client request,
+// for handlers that need to issue multiple downstream requests, e.g. merging responses from several upstreams
+//
+// The request rate limit of the client is only checked once on creation. Remember to call Close after use
+type DownstreamClient struct {
+	ctx               *context.RequestContext
+	helper            *RequestHelper
+	transport         http.RoundTripper // follows all redirects
+	rawTransport      http.RoundTripper
+	transportReleaser utils.TransportReleaser
+}
+
+// NewDownstreamClient creates the client for the client request. The wait for the concurrent request slots ends when reqCtx is done,
+// which is usually the context of the client request
+func (h *RequestHelper) NewDownstreamClient(ctx *context.RequestContext, reqCtx gocontext.Context) (*DownstreamClient, error) {
+	return h.newDownstreamClient(ctx, reqCtx, true)
+}
+
+// NewSubrequestClient is the same as NewDownstreamClient, but the request rate limit of the client is not checked.
+// It's for the auxiliary requests of a client request that is checked elsewhere, e.g. in the following RunReverseProxy
+func (h *RequestHelper) NewSubrequestClient(ctx *context.RequestContext, reqCtx gocontext.Context) (*DownstreamClient, error) {
+	return h.newDownstreamClient(ctx, reqCtx, false)
+}
+
+// NewBackgroundClient creates the client for the downstream requests shared by several client requests, e.g. the disk cache fills.
+// It's not bound to any client, so the client limits are not applied. Charge the clients that read the response instead,
+// e.g. with ServeFromDiskCache
+func (h *RequestHelper) NewBackgroundClient(ctx *context.RequestContext) *DownstreamClient {
+	transport, transportReleaser := h.getTransportForClient(ctx)
+	return h.newDownstreamClientWithTransport(ctx, transport, transportReleaser)
+}
+
+func (h *RequestHelper) newDownstreamClient(ctx *context.RequestContext, reqCtx gocontext.Context, chargeRequestRate bool) (*DownstreamClient, error) {
+	transport, transportReleaser, err := h.getTransport(ctx, reqCtx, chargeRequestRate)
+	if err != nil {
+		return nil, err
+	}
+	return h.newDownstreamClientWithTransport(ctx, transport, transportReleaser), nil
+}
+
+func (h *RequestHelper) newDownstreamClientWithTransport(ctx *context.RequestContext, transport http.RoundTripper, transportReleaser utils.TransportReleaser) *DownstreamClient {
+	return &DownstreamClient{
+		ctx:               ctx,
+		helper:            h,
+		transport:         NewRedirectFollowingTransport(ctx, transport, *h.cfg.Response.MaxRedirect, followAllRedirectHandler, nil),
+		rawTransport:      transport,
+		transportReleaser: transportReleaser,
+	}
+}
+
+func followAllRedirectHandler(_ *http.Response) *RedirectResult {
+	return &RedirectResult{Decision: RedirectDecisionFollow}
+}
+
+// Do sends the request, with redirects followed, and the configured header modifications applied
+func (c *DownstreamClient) Do(req *http.Request) (*http.Response, error) {
+	return c.do(c.transport, req)
+}
+
+// DoNoRedirect is the same as Do, but redirect responses are returned as-is
+func (c *DownstreamClient) DoNoRedirect(req *http.Request) (*http.Response, error) {
+	return c.do(c.rawTransport, req)
+}
+
+func (c *DownstreamClient) do(transport http.RoundTripper, req *http.Request) (*http.Response, error) {
+	adjustHeader(req.Header, c.helper.cfg.Request.Header)
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf("%sDownstream request: %+v", c.ctx.LogPrefix, utils.MaskRequestForLogging(req))
+	}
+
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf("%sDownstream raw response: %+v", c.ctx.LogPrefix, utils.MaskResponseForLogging(resp))
+	}
+	adjustHeader(resp.Header, c.helper.cfg.Response.Header)
+	return resp, nil
+}
+
+func (c *DownstreamClient) Close() {
+	c.transportReleaser()
+}
+
+// CloseWithBody returns a wrapped body, which closes the client along with the body
+// Useful when the body outlives the function that creates the client
+func (c *DownstreamClient) CloseWithBody(body io.ReadCloser) io.ReadCloser {
+	return &clientClosingBody{ReadCloser: body, client: c}
+}
+
+type clientClosingBody struct {
+	io.ReadCloser
+	client *DownstreamClient
+}
+
+func (b *clientClosingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.client.Close()
+	return err
+}
@@ -12,41 +12,111 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"time"
 )
 
 type RequestHelper struct {
 	requestHelperCommon
-	ipPoolStrategy config.IpPoolStrategy
+	ipPoolStrategy     config.IpPoolStrategy
+	siteTrafficLimiter *utils.FairSharedRateLimiter // nil if no site traffic pool
+
+	siteId                  string
+	siteConcurrencyLimiter  *utils.ConcurrencyLimiter // nil if no site concurrency pool
+	concurrencyQueueTimeout time.Duration
 }
 
-func (h *RequestHelper) getTransportForClientIp(ctx *context.RequestContext) (http.RoundTripper, utils.TransportReleaser, error) {
-	clientIp := ctx.ClientAddr
+func (h *RequestHelper) getTransportForClientIp(ctx *context.RequestContext, reqCtx gocontext.Context) (http.RoundTripper, utils.TransportReleaser, error) {
+	return h.getTransport(ctx, reqCtx, true)
+}
+
+// getTransport returns the transport for the client. The request rate of the client is only charged if chargeRequestRate is true
+// The wait for the concurrent request slots ends when reqCtx is done
+func (h *RequestHelper) getTransport(ctx *context.RequestContext, reqCtx gocontext.Context, chargeRequestRate bool) (http.RoundTripper, utils.TransportReleaser, error) {
+	trafficLimiter, limitsReleaser, err := h.acquireClientLimits(ctx, reqCtx, chargeRequestRate)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	transport, transportReleaser := h.getTransportForClient(ctx)
+	return NewTrafficRateLimitedTransport(transport, trafficLimiter), func() {
+		transportReleaser()
+		limitsReleaser()
+	}, nil
+}
 
+// acquireClientLimits charges the request rate of the client if chargeRequestRate is true, and takes the concurrent request slots.
+// The returned limiter is the traffic limiter of the client, along with the site and global pools
+func (h *RequestHelper) acquireClientLimits(ctx *context.RequestContext, reqCtx gocontext.Context, chargeRequestRate bool) (utils.RateLimiter, func(), error) {
 	// concurrency control
-	clientData := h.clientDataCache.GetData(clientIp)
-	if !clientData.RequestRateLimiter.Allow() {
-		return nil, nil, NewHttpError(http.StatusTooManyRequests, "Too many requests")
+	// clients with api keys use the limits of the key, instead of the limits of the ip
+	var clientKey string
+	var clientData *ClientData
+	if apiKey := h.getApiKey(ctx); apiKey != nil {
+		clientKey = apiKeyClientKey(apiKey.Name)
+		clientData = apiKey.ClientData
+	} else {
+		clientKey = ClientKey(ctx.ClientAddr)
+		clientData = h.clientDataCache.GetData(clientKey)
+	}
+	if chargeRequestRate && !clientData.RequestRateLimiter.Allow() {
+		return nil, nil, NewRejectionError(http.StatusTooManyRequests, "Too many requests")
+	}
+	inFlightReleaser, err := h.acquireInFlightSlots(ctx, reqCtx, clientData)
+	if err != nil {
+		return nil, nil, err
 	}
 
+	trafficLimiter := utils.NewMultiRateLimiter(clientData.TrafficRateLimiter)
+	if h.siteTrafficLimiter != nil {
+		trafficLimiter.AddLimiter(h.siteTrafficLimiter.Limiter(clientKey))
+	}
+	if h.globalTrafficLimiter != nil {
+		trafficLimiter.AddLimiter(h.globalTrafficLimiter.Limiter(clientKey))
+	}
+	return trafficLimiter, inFlightReleaser, nil
+}
+
+// getTransportForClient returns the transport with the local address picked for the client, without any client limits
+func (h *RequestHelper) getTransportForClient(ctx *context.RequestContext) (http.RoundTripper, utils.TransportReleaser) {
+	clientIp := ctx.ClientAddr
+
 	var localAddr net.IP
 	switch h.ipPoolStrategy {
 	case config.IpPoolStrategyNone:
 		localAddr = nil
 	case config.IpPoolStrategyRandom:
-		localAddr = h.ipPool.GetRandomly()
+		localAddr = h.ipPoolHealth.pickRandomly(h.ipPool)
 	case config.IpPoolStrategyIpHash:
-		localAddr = h.ipPool.GetByKey(utils.GetBucketForIpString(clientIp))
+		localAddr = h.ipPoolHealth.pickByKey(h.ipPool, utils.GetBucketForIpString(clientIp))
 	default:
 		panic(fmt.Sprintf("Unknown IP strategy: %s", h.ipPoolStrategy))
 	}
 	log.Debugf("%sTransport IP for client %s is %s", ctx.LogPrefix, clientIp, localAddr)
 
-	transport, transportReleaser := h.transportCache.GetTransport(localAddr)
-	trafficLimiter := utils.NewMultiRateLimiter(clientData.TrafficRateLimiter)
-	if h.globalTrafficLimiter != nil {
-		trafficLimiter.AddLimiter(h.globalTrafficLimiter)
+	transport, transportReleaser := h.transports.GetTransport(localAddr)
+	return h.ipPoolHealth.wrapTransport(transport, localAddr), transportReleaser
+}
+
+func (h *RequestHelper) getApiKey(ctx *context.RequestContext) *ApiKey {
+	if h.apiKeys == nil || ctx.ApiKeyName == "" {
+		return nil
 	}
-	return NewTrafficRateLimitedTransport(transport, trafficLimiter), transportReleaser, nil
+	return h.apiKeys.Get(ctx.ApiKeyName)
+}
+
+// GetIpPool returns the ip pool, or nil if the ip pool is disabled
+func (h *RequestHelper) GetIpPool() *utils.IpPool {
+	return h.ipPool
+}
+
+// GetTransportForLocalAddr returns the transport that sends requests from the given local address,
+// without the client rate limits and the traffic limits. A nil localAddr means the default address
+func (h *RequestHelper) GetTransportForLocalAddr(localAddr net.IP) (http.RoundTripper, utils.TransportReleaser, error) {
+	transport, transportReleaser := h.transports.GetTransport(localAddr)
+	if transport == nil {
+		return nil, nil, errors.New("transport cache has been shutdown")
+	}
+	return transport, transportReleaser, nil
 }
 
 func adjustHeader(header http.Header, cfg *config.HeaderModificationConfig) {
@@ -102,7 +172,7 @@ func (h *RequestHelper) createErrorHandler(ctx *context.RequestContext) func(htt
 
 		var httpErr *HttpError
 		if errors.As(err, &httpErr) {
-			http.Error(w, httpErr.Message, httpErr.Status)
+			WriteHttpError(ctx, w, httpErr)
 			return
 		}
 		log.Errorf("%sproxy error: %v", ctx.LogPrefix, err)
@@ -110,6 +180,11 @@ func (h *RequestHelper) createErrorHandler(ctx *context.RequestContext) func(htt
 	}
 }
 
+// WriteError writes the error to the client, in the same way as the errors in RunReverseProxy
+func (h *RequestHelper) WriteError(ctx *context.RequestContext, w http.ResponseWriter, err error) {
+	h.createErrorHandler(ctx)(w, nil, err)
+}
+
 // Response processing order:
 // 1. Prepare request
 //   a) responseModifier()
@@ -135,7 +210,7 @@ func (h *RequestHelper) RunReverseProxy(ctx *context.RequestContext, w http.Resp
 
 	errorHandler := h.createErrorHandler(ctx)
 
-	transport, transportReleaser, err := h.getTransportForClientIp(ctx)
+	transport, transportReleaser, err := h.getTransportForClientIp(ctx, r.Context())
 	if err != nil {
 		errorHandler(w, r, err)
 		return
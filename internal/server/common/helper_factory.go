@@ -5,24 +5,86 @@ import (
 	"github.com/Fallen-Breath/pavonis/internal/config"
 	"github.com/Fallen-Breath/pavonis/internal/utils"
 	log "github.com/sirupsen/logrus"
-	"golang.org/x/time/rate"
+	"net"
+	"net/http"
 	"net/url"
 	"time"
 )
 
 type requestHelperCommon struct {
-	cfg                  *config.Config
-	ipPool               *utils.IpPool
-	transportCache       *utils.HttpTransportCache
-	clientDataCache      *ClientDataCache
-	globalTrafficLimiter *rate.Limiter
+	cfg                      *config.Config
+	ipPool                   *utils.IpPool
+	ipPoolHealth             *IpPoolHealth // nil if the ip pool or the health tracking is disabled
+	transports               transportProvider
+	clientDataCache          *ClientDataCache
+	globalTrafficLimiter     *utils.FairSharedRateLimiter // nil if no global traffic pool
+	apiKeys                  *ApiKeyStore                 // nil if api key is disabled
+	inFlight                 *inFlightTracker
+	globalConcurrencyLimiter *utils.ConcurrencyLimiter // nil if no global concurrency pool
+}
+
+// transportProvider provides the transports that send the downstream requests from the given local addresses
+type transportProvider interface {
+	// GetTransport returns a nil transport if the provider has been shutdown
+	GetTransport(localAddr net.IP) (http.RoundTripper, utils.TransportReleaser)
+	Shutdown()
+}
+
+type transportCacheProvider struct {
+	cache *utils.HttpTransportCache
+}
+
+func (p *transportCacheProvider) GetTransport(localAddr net.IP) (http.RoundTripper, utils.TransportReleaser) {
+	transport, releaser := p.cache.GetTransport(localAddr)
+	if transport == nil {
+		return nil, nil
+	}
+	return transport, releaser
+}
+
+func (p *transportCacheProvider) Shutdown() {
+	p.cache.Shutdown()
+}
+
+// fixedTransportProvider sends all requests via the same transport, regardless of the local address
+type fixedTransportProvider struct {
+	transport http.RoundTripper
+}
+
+func (p *fixedTransportProvider) GetTransport(net.IP) (http.RoundTripper, utils.TransportReleaser) {
+	return p.transport, func() {}
+}
+
+func (p *fixedTransportProvider) Shutdown() {
+}
+
+type requestHelperFactoryOptions struct {
+	transport http.RoundTripper
+}
+
+type RequestHelperFactoryOption func(*requestHelperFactoryOptions)
+
+// WithTransport sends all downstream requests via the given transport, instead of the transports bound to the local addresses,
+// e.g. to send the requests to a local test server
+func WithTransport(transport http.RoundTripper) RequestHelperFactoryOption {
+	return func(options *requestHelperFactoryOptions) {
+		options.transport = transport
+	}
 }
 
 type RequestHelperFactory struct {
 	requestHelperCommon
+	clientDataCaches map[string]*ClientDataCache // ClientLimitKey -> cache
+	rateLimitStore   *RequestRateLimitStore      // nil if the request counters are local
+	geoIp            *utils.MaxMindDb            // nil if GeoIP is disabled
+	banList          *BanList                    // nil if ban is disabled
 }
 
-func NewRequestHelperFactory(cfg *config.Config) (*RequestHelperFactory, error) {
+func NewRequestHelperFactory(cfg *config.Config, opts ...RequestHelperFactoryOption) (*RequestHelperFactory, error) {
+	options := &requestHelperFactoryOptions{}
+	for _, opt := range opts {
+		opt(options)
+	}
 	ipPoolCfg := cfg.Request.IpPool
 
 	var ipPool *utils.IpPool = nil
@@ -37,45 +99,136 @@ func NewRequestHelperFactory(cfg *config.Config) (*RequestHelperFactory, error)
 		}
 	}
 
-	clientDataCache := NewClientDataCache(cfg)
-	var requestProxy *url.URL = nil
-	if cfg.Request.Proxy != "" {
+	var ipPoolHealth *IpPoolHealth
+	if ipPool != nil && ipPoolCfg.Health.Enabled {
+		ipPoolHealth = newIpPoolHealth(ipPoolCfg.Health)
+	}
+
+	// the client data should live longer than any request
+	clientDataTtl := *cfg.ResourceLimit.RequestTimeout
+	for _, siteCfg := range cfg.Sites {
+		clientDataTtl = max(clientDataTtl, *siteCfg.ResourceLimit.RequestTimeout)
+	}
+	clientDataTtl += 1 * time.Minute
+
+	rateLimitStore := NewRequestRateLimitStore(cfg.RateLimitStore)
+
+	// sites with the same per-client limits share the cache, so a client is limited across these sites as a whole
+	clientDataCaches := make(map[string]*ClientDataCache)
+	clientDataCache := NewClientDataCache(cfg.ResourceLimit, clientDataTtl, rateLimitStore)
+	clientDataCaches[cfg.ResourceLimit.ClientLimitKey()] = clientDataCache
+	for _, siteCfg := range cfg.Sites {
+		key := siteCfg.ResourceLimit.ClientLimitKey()
+		if _, ok := clientDataCaches[key]; !ok {
+			clientDataCaches[key] = NewClientDataCache(siteCfg.ResourceLimit, clientDataTtl, rateLimitStore)
+		}
+	}
+
+	var apiKeys *ApiKeyStore
+	if cfg.ApiKey.Enabled {
 		var err error
-		requestProxy, err = url.Parse(cfg.Request.Proxy)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse proxy url %q: %v", cfg.Request.Proxy, err)
+		if apiKeys, err = NewApiKeyStore(cfg.ApiKey, rateLimitStore); err != nil {
+			return nil, err
 		}
 	}
 
+	var banList *BanList
+	if cfg.Ban.Enabled {
+		banList = newBanList(cfg.Ban, clientDataCache)
+	}
+
+	var geoIp *utils.MaxMindDb
+	if cfg.GeoIp.Database != "" {
+		var err error
+		if geoIp, err = utils.OpenMaxMindDb(cfg.GeoIp.Database); err != nil {
+			return nil, fmt.Errorf("failed to load the GeoIP database %+q: %v", cfg.GeoIp.Database, err)
+		}
+		log.Infof("Loaded GeoIP database %+q, type %s", cfg.GeoIp.Database, geoIp.DatabaseType)
+	}
+
+	var transports transportProvider
+	if options.transport != nil {
+		transports = &fixedTransportProvider{transport: options.transport}
+	} else {
+		var requestProxy *url.URL = nil
+		if cfg.Request.Proxy != "" {
+			var err error
+			requestProxy, err = url.Parse(cfg.Request.Proxy)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse proxy url %q: %v", cfg.Request.Proxy, err)
+			}
+		}
+		transports = &transportCacheProvider{cache: utils.NewHttpTransportCache(1024, 60*time.Second, requestProxy)}
+	}
+
 	return &RequestHelperFactory{
 		requestHelperCommon: requestHelperCommon{
-			cfg:                  cfg,
-			ipPool:               ipPool,
-			transportCache:       utils.NewHttpTransportCache(1024, 60*time.Second, requestProxy),
-			clientDataCache:      clientDataCache,
-			globalTrafficLimiter: nil, // TODO
+			cfg:                      cfg,
+			ipPool:                   ipPool,
+			ipPoolHealth:             ipPoolHealth,
+			transports:               transports,
+			clientDataCache:          clientDataCache,
+			globalTrafficLimiter:     utils.CreateTrafficPool(cfg.ResourceLimit.PoolTrafficAvgMibps, cfg.ResourceLimit.PoolTrafficBurstMib),
+			apiKeys:                  apiKeys,
+			inFlight:                 newInFlightTracker(),
+			globalConcurrencyLimiter: utils.CreateConcurrencyLimiter(cfg.ResourceLimit.PoolMaxConcurrentRequests),
 		},
+		clientDataCaches: clientDataCaches,
+		rateLimitStore:   rateLimitStore,
+		geoIp:            geoIp,
+		banList:          banList,
 	}, nil
 }
 
-func (f *RequestHelperFactory) NewRequestHelper(siteIpPoolStrategy *config.IpPoolStrategy) *RequestHelper {
+func (f *RequestHelperFactory) NewRequestHelper(siteCfg *config.SiteConfig) *RequestHelper {
 	ipPoolCfg := f.cfg.Request.IpPool
 
 	ipPoolStrategy := config.IpPoolStrategyNone
 	if ipPoolCfg.Enabled {
 		ipPoolStrategy = *ipPoolCfg.DefaultStrategy
-		if siteIpPoolStrategy != nil {
-			ipPoolStrategy = *siteIpPoolStrategy
+		if siteCfg.IpPoolStrategy != nil {
+			ipPoolStrategy = *siteCfg.IpPoolStrategy
 		}
 	}
 
+	helperCommon := f.requestHelperCommon
+	helperCommon.clientDataCache = f.clientDataCaches[siteCfg.ResourceLimit.ClientLimitKey()]
+
 	return &RequestHelper{
-		requestHelperCommon: f.requestHelperCommon,
+		requestHelperCommon: helperCommon,
 		ipPoolStrategy:      ipPoolStrategy,
+		siteTrafficLimiter:  utils.CreateTrafficPool(siteCfg.ResourceLimit.PoolTrafficAvgMibps, siteCfg.ResourceLimit.PoolTrafficBurstMib),
+
+		siteId:                  siteCfg.Id,
+		siteConcurrencyLimiter:  utils.CreateConcurrencyLimiter(siteCfg.ResourceLimit.PoolMaxConcurrentRequests),
+		concurrencyQueueTimeout: *siteCfg.ResourceLimit.ConcurrencyQueueTimeout,
 	}
 }
 
+func (f *RequestHelperFactory) NewAccessController(siteCfg *config.SiteConfig) (*AccessController, error) {
+	return newAccessController(siteCfg, f.geoIp)
+}
+
+// GetApiKeyStore returns the api key store, or nil if api key is disabled
+func (f *RequestHelperFactory) GetApiKeyStore() *ApiKeyStore {
+	return f.apiKeys
+}
+
+// GetBanList returns the ban list, or nil if ban is disabled
+func (f *RequestHelperFactory) GetBanList() *BanList {
+	return f.banList
+}
+
 func (f *RequestHelperFactory) Shutdown() {
-	f.transportCache.Shutdown()
-	f.clientDataCache.Clear()
+	f.transports.Shutdown()
+	if f.apiKeys != nil {
+		f.apiKeys.Shutdown()
+	}
+	if f.banList != nil {
+		f.banList.Shutdown()
+	}
+	for _, clientDataCache := range f.clientDataCaches {
+		clientDataCache.Clear()
+	}
+	f.rateLimitStore.Close()
 }
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestSiteResourceLimitOverrides(t *testing.T) {
+	newSite := func(rlc *config.ResourceLimitConfig) *config.SiteConfig {
+		return &config.SiteConfig{
+			Mode:          utils.ToPtr(config.SiteModeSpeedTest),
+			ResourceLimit: rlc,
+		}
+	}
+	cfg := &config.Config{
+		ResourceLimit: &config.ResourceLimitConfig{
+			RequestPerSecond: utils.ToPtr(10.0),
+			TrafficAvgMibps:  utils.ToPtr(5.0),
+		},
+		Sites: []*config.SiteConfig{
+			newSite(nil),
+			newSite(&config.ResourceLimitConfig{RequestTimeout: utils.ToPtr(6 * time.Hour)}),
+			newSite(&config.ResourceLimitConfig{RequestPerSecond: utils.ToPtr(1.0)}),
+		},
+	}
+	require.NoError(t, cfg.Init())
+
+	// unset fields are inherited
+	site2 := cfg.Sites[2].ResourceLimit
+	assert.Equal(t, 1.0, *site2.RequestPerSecond)
+	assert.Equal(t, 5.0, *site2.TrafficAvgMibps)
+	assert.Equal(t, 1*time.Hour, *site2.RequestTimeout)
+	assert.Equal(t, 6*time.Hour, *cfg.Sites[1].ResourceLimit.RequestTimeout)
+
+	factory, err := NewRequestHelperFactory(cfg)
+	require.NoError(t, err)
+	defer factory.Shutdown()
+	helpers := make([]*RequestHelper, len(cfg.Sites))
+	for i, siteCfg := range cfg.Sites {
+		helpers[i] = factory.NewRequestHelper(siteCfg)
+	}
+
+	// the timeout is not a per-client limit, so the client limiters are still shared
+	assert.Same(t, helpers[0].clientDataCache, helpers[1].clientDataCache)
+	assert.NotSame(t, helpers[0].clientDataCache, helpers[2].clientDataCache)
+
+	key := ClientKey("192.0.2.1")
+	assert.True(t, helpers[2].clientDataCache.GetData(key).RequestRateLimiter.Allow())
+	assert.False(t, helpers[2].clientDataCache.GetData(key).RequestRateLimiter.Allow())
+	assert.True(t, helpers[0].clientDataCache.GetData(key).RequestRateLimiter.Allow())
+}
@@ -0,0 +1,17 @@
+package common
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+)
+
+// newTestRequestHelper creates a RequestHelper of the global limits, which sends all downstream requests via the given transport
+// See commontest.NewRequestHelper for the tests of the other packages
+func newTestRequestHelper(t *testing.T, cfg *config.Config, transport http.RoundTripper) *RequestHelper {
+	factory, err := NewRequestHelperFactory(cfg, WithTransport(transport))
+	require.NoError(t, err)
+	t.Cleanup(factory.Shutdown)
+	return factory.NewRequestHelper(&config.SiteConfig{Id: "test", ResourceLimit: cfg.ResourceLimit})
+}
@@ -1,8 +1,14 @@
 package common
 
+import (
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"net/http"
+)
+
 type HttpError struct {
-	Status  int
-	Message string
+	Status    int
+	Message   string
+	Rejection bool // if the error is a rejection made by pavonis itself, see RequestContext.Rejected
 }
 
 var _ error = &HttpError{}
@@ -17,3 +23,25 @@ func NewHttpError(status int, message string) *HttpError {
 		Message: message,
 	}
 }
+
+// NewRejectionError creates the error of the rejected requests, e.g. rate limited or access denied
+func NewRejectionError(status int, message string) *HttpError {
+	return &HttpError{
+		Status:    status,
+		Message:   message,
+		Rejection: true,
+	}
+}
+
+// WriteHttpError writes the error to the client, and marks the request as rejected if the error is a rejection
+func WriteHttpError(ctx *context.RequestContext, w http.ResponseWriter, err *HttpError) {
+	if err.Rejection {
+		ctx.Rejected = true
+	}
+	http.Error(w, err.Message, err.Status)
+}
+
+// WriteRejection rejects the request with the given message, e.g. when the requested resource is not whitelisted
+func WriteRejection(ctx *context.RequestContext, w http.ResponseWriter, message string, status int) {
+	WriteHttpError(ctx, w, NewRejectionError(status, message))
+}
@@ -0,0 +1,130 @@
+package common
+
+import (
+	gocontext "context"
+	"errors"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"sync"
+)
+
+const (
+	concurrencyScopeClient = "client"
+	concurrencyScopeSite   = "site"
+	concurrencyScopeGlobal = "global"
+)
+
+// statusClientClosedRequest is the non-standard status of nginx, for the requests whose client is gone before the response
+const statusClientClosedRequest = 499
+
+// inFlightTracker makes the concurrent request slots re-entrant for a client request,
+// so the handlers that issue multiple, maybe parallel, downstream requests for one client request only take one slot of each limiter
+type inFlightTracker struct {
+	mu   sync.Mutex
+	refs map[*context.RequestContext]*inFlightRef
+}
+
+type inFlightRef struct {
+	count   int
+	ready   chan struct{} // closed when the slots are acquired, or failed to acquire
+	err     error
+	release func()
+}
+
+func newInFlightTracker() *inFlightTracker {
+	return &inFlightTracker{
+		refs: make(map[*context.RequestContext]*inFlightRef),
+	}
+}
+
+func (t *inFlightTracker) acquire(ctx *context.RequestContext, acquireSlots func() (func(), error)) (func(), error) {
+	t.mu.Lock()
+	ref, ok := t.refs[ctx]
+	if !ok {
+		ref = &inFlightRef{ready: make(chan struct{})}
+		t.refs[ctx] = ref
+	}
+	ref.count++
+	t.mu.Unlock()
+
+	if !ok {
+		ref.release, ref.err = acquireSlots()
+		close(ref.ready)
+	} else {
+		<-ref.ready
+	}
+
+	if ref.err != nil {
+		t.mu.Lock()
+		if t.refs[ctx] == ref {
+			delete(t.refs, ctx)
+		}
+		t.mu.Unlock()
+		return nil, ref.err
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			t.mu.Lock()
+			ref.count--
+			last := ref.count == 0
+			if last {
+				delete(t.refs, ctx)
+			}
+			t.mu.Unlock()
+			if last {
+				ref.release()
+			}
+		})
+	}, nil
+}
+
+// acquireInFlightSlots takes a slot from the client, site and global concurrency limiters, in order
+// The wait for the slots ends when reqCtx is done, e.g. the client is gone
+func (h *RequestHelper) acquireInFlightSlots(ctx *context.RequestContext, reqCtx gocontext.Context, clientData *ClientData) (func(), error) {
+	return h.inFlight.acquire(ctx, func() (func(), error) {
+		limiters := []struct {
+			scope   string
+			limiter *utils.ConcurrencyLimiter
+		}{
+			{concurrencyScopeClient, clientData.ConcurrencyLimiter},
+			{concurrencyScopeSite, h.siteConcurrencyLimiter},
+			{concurrencyScopeGlobal, h.globalConcurrencyLimiter},
+		}
+
+		var acquired []*utils.ConcurrencyLimiter
+		releaseAll := func() {
+			for _, limiter := range acquired {
+				limiter.Release()
+			}
+		}
+		for _, item := range limiters {
+			if item.limiter == nil {
+				continue
+			}
+			queueDepth := metricConcurrencyQueueDepth.WithLabelValues(h.siteId, item.scope)
+			ok := item.limiter.Acquire(reqCtx, h.concurrencyQueueTimeout, func() func() {
+				queueDepth.Inc()
+				return queueDepth.Dec
+			})
+			if !ok {
+				releaseAll()
+				if err := reqCtx.Err(); err != nil {
+					if errors.Is(err, gocontext.Canceled) {
+						// not a server error, the response is not going to be read anyway
+						return nil, NewHttpError(statusClientClosedRequest, "Client closed request")
+					}
+					return nil, err
+				}
+				metricConcurrencyRejected.WithLabelValues(h.siteId, item.scope).Inc()
+				log.Debugf("%sNo free %s concurrent request slot after %s", ctx.LogPrefix, item.scope, h.concurrencyQueueTimeout)
+				return nil, NewRejectionError(http.StatusTooManyRequests, "Too many concurrent requests")
+			}
+			acquired = append(acquired, item.limiter)
+		}
+		return releaseAll, nil
+	})
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	gocontext "context"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestConcurrentRequestLimit(t *testing.T) {
+	cfg := &config.Config{
+		ResourceLimit: &config.ResourceLimitConfig{
+			MaxConcurrentRequests:   utils.ToPtr(1),
+			ConcurrencyQueueTimeout: utils.ToPtr(50 * time.Millisecond),
+		},
+	}
+	require.NoError(t, cfg.Init())
+	helper := newTestRequestHelper(t, cfg, http.DefaultTransport)
+
+	ctx1 := context.NewRequestContext("localhost", "192.0.2.1")
+	_, release1, err := helper.getTransportForClientIp(ctx1, gocontext.Background())
+	require.NoError(t, err)
+
+	// the same client request only takes one slot
+	_, release1b, err := helper.getTransportForClientIp(ctx1, gocontext.Background())
+	require.NoError(t, err)
+
+	// another request of the same client waits, then gets rejected
+	ctx2 := context.NewRequestContext("localhost", "192.0.2.1")
+	start := time.Now()
+	_, _, err = helper.getTransportForClientIp(ctx2, gocontext.Background())
+	var httpErr *HttpError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, http.StatusTooManyRequests, httpErr.Status)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	// the wait ends when the client request is gone, which is not a rejection
+	reqCtx, cancel := gocontext.WithCancel(gocontext.Background())
+	cancel()
+	_, _, err = helper.getTransportForClientIp(context.NewRequestContext("localhost", "192.0.2.1"), reqCtx)
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, statusClientClosedRequest, httpErr.Status)
+	assert.False(t, httpErr.Rejection)
+
+	// other clients are not affected
+	_, release3, err := helper.getTransportForClientIp(context.NewRequestContext("localhost", "192.0.2.2"), gocontext.Background())
+	require.NoError(t, err)
+	release3()
+
+	// the slot is freed after all downstream requests of the client request are done
+	release1()
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		release1b()
+	}()
+	_, release2, err := helper.getTransportForClientIp(ctx2, gocontext.Background())
+	require.NoError(t, err)
+	release2()
+}
+
+func TestBackgroundClientTakesNoSlot(t *testing.T) {
+	cfg := &config.Config{
+		ResourceLimit: &config.ResourceLimitConfig{
+			MaxConcurrentRequests:   utils.ToPtr(1),
+			ConcurrencyQueueTimeout: utils.ToPtr(50 * time.Millisecond),
+		},
+	}
+	require.NoError(t, cfg.Init())
+	helper := newTestRequestHelper(t, cfg, http.DefaultTransport)
+
+	// e.g. a disk cache fill, which outlives the client request that starts it
+	client := helper.NewBackgroundClient(context.NewRequestContext("localhost", "192.0.2.1"))
+	defer client.Close()
+
+	_, release, err := helper.getTransportForClientIp(context.NewRequestContext("localhost", "192.0.2.1"), gocontext.Background())
+	require.NoError(t, err)
+	release()
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	gocontext "context"
+	"errors"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	expirelru "github.com/hashicorp/golang-lru/v2/expirable"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type upstreamOutcome string
+
+const (
+	upstreamOutcomeSuccess     upstreamOutcome = "success"
+	upstreamOutcomeFailure     upstreamOutcome = "failure" // connection errors and 403
+	upstreamOutcomeRateLimited upstreamOutcome = "rate_limited"
+)
+
+func classifyUpstreamOutcome(resp *http.Response, err error) (upstreamOutcome, bool) {
+	if err != nil {
+		// the request is cancelled by the client or the timeout, which says nothing about the address
+		if errors.Is(err, gocontext.Canceled) || errors.Is(err, gocontext.DeadlineExceeded) {
+			return "", false
+		}
+		return upstreamOutcomeFailure, true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return upstreamOutcomeRateLimited, true
+	case http.StatusForbidden:
+		return upstreamOutcomeFailure, true
+	default:
+		return upstreamOutcomeSuccess, true
+	}
+}
+
+type addressHealth struct {
+	mu               sync.Mutex
+	windowStart      time.Time
+	requests         int
+	failures         int
+	rateLimited      int
+	quarantinedUntil time.Time
+}
+
+// IpPoolHealth tracks the upstream outcomes of the ip pool addresses, and quarantines the unhealthy addresses
+type IpPoolHealth struct {
+	cfg       *config.IpPoolHealthConfig
+	addresses *expirelru.LRU[string, *addressHealth]
+}
+
+func newIpPoolHealth(cfg *config.IpPoolHealthConfig) *IpPoolHealth {
+	// an address is forgotten if it's not used for a while, so a huge pool won't blow the memory and the metrics
+	ttl := *cfg.Window + *cfg.QuarantineDuration + 1*time.Minute
+	onEvict := func(address string, _ *addressHealth) {
+		metricIpPoolAddressQuarantined.DeleteLabelValues(address)
+		for _, outcome := range []upstreamOutcome{upstreamOutcomeSuccess, upstreamOutcomeFailure, upstreamOutcomeRateLimited} {
+			metricIpPoolAddressRequests.DeleteLabelValues(address, string(outcome))
+		}
+	}
+	return &IpPoolHealth{
+		cfg:       cfg,
+		addresses: expirelru.NewLRU[string, *addressHealth](4096, onEvict, ttl),
+	}
+}
+
+// IsHealthy returns false if the address is quarantined
+func (h *IpPoolHealth) IsHealthy(ip net.IP) bool {
+	address := ip.String()
+	health, ok := h.addresses.Peek(address)
+	if !ok {
+		return true
+	}
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	if health.quarantinedUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(health.quarantinedUntil) {
+		return false
+	}
+	health.quarantinedUntil = time.Time{}
+	metricIpPoolAddressQuarantined.WithLabelValues(address).Set(0)
+	log.Infof("IP pool address %s is released from quarantine", address)
+	return true
+}
+
+// RecordOutcome counts the outcome of an upstream request from the address, and quarantines the address if it's unhealthy
+func (h *IpPoolHealth) RecordOutcome(ip net.IP, outcome upstreamOutcome) {
+	address := ip.String()
+	health, ok := h.addresses.Get(address)
+	if !ok {
+		health = &addressHealth{}
+	}
+	h.addresses.Add(address, health) // renews the ttl
+	metricIpPoolAddressRequests.WithLabelValues(address, string(outcome)).Inc()
+
+	health.mu.Lock()
+	defer health.mu.Unlock()
+	now := time.Now()
+	if now.Sub(health.windowStart) >= *h.cfg.Window {
+		health.windowStart = now
+		health.requests, health.failures, health.rateLimited = 0, 0, 0
+	}
+	health.requests++
+	switch outcome {
+	case upstreamOutcomeFailure:
+		health.failures++
+	case upstreamOutcomeRateLimited:
+		health.rateLimited++
+	}
+
+	if health.requests < *h.cfg.MinRequests || now.Before(health.quarantinedUntil) {
+		return
+	}
+	failureRate := float64(health.failures) / float64(health.requests)
+	rateLimitedRate := float64(health.rateLimited) / float64(health.requests)
+	if failureRate > *h.cfg.MaxFailureRate || rateLimitedRate > *h.cfg.MaxRateLimitedRate {
+		health.quarantinedUntil = now.Add(*h.cfg.QuarantineDuration)
+		metricIpPoolAddressQuarantined.WithLabelValues(address).Set(1)
+		metricIpPoolQuarantineTotal.Inc()
+		log.Warnf("IP pool address %s is quarantined for %s, failure rate %.2f, 429 rate %.2f in %d requests",
+			address, *h.cfg.QuarantineDuration, failureRate, rateLimitedRate, health.requests)
+		health.windowStart = now
+		health.requests, health.failures, health.rateLimited = 0, 0, 0
+	}
+}
+
+// healthTrackingTransport records the outcomes of the requests sent from the local address
+type healthTrackingTransport struct {
+	base      http.RoundTripper
+	localAddr net.IP
+	health    *IpPoolHealth
+}
+
+var _ http.RoundTripper = &healthTrackingTransport{}
+
+func (t *healthTrackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if outcome, ok := classifyUpstreamOutcome(resp, err); ok {
+		t.health.RecordOutcome(t.localAddr, outcome)
+	}
+	return resp, err
+}
+
+// wrapTransport wraps the transport of the local address to track its health. Nothing is done if localAddr is nil
+func (h *IpPoolHealth) wrapTransport(transport http.RoundTripper, localAddr net.IP) http.RoundTripper {
+	if h == nil || localAddr == nil {
+		return transport
+	}
+	return &healthTrackingTransport{base: transport, localAddr: localAddr, health: h}
+}
+
+func (h *IpPoolHealth) pickRandomly(ipPool *utils.IpPool) net.IP {
+	if h == nil {
+		return ipPool.GetRandomly()
+	}
+	return ipPool.GetRandomlyAccepted(h.IsHealthy)
+}
+
+func (h *IpPoolHealth) pickByKey(ipPool *utils.IpPool, key string) net.IP {
+	if h == nil {
+		return ipPool.GetByKey(key)
+	}
+	return ipPool.GetByKeyAccepted(key, h.IsHealthy)
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type fakeRoundTripper func(req *http.Request) (*http.Response, error)
+
+func (f fakeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func readQuarantinedGauge(t *testing.T, ip net.IP) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, metricIpPoolAddressQuarantined.WithLabelValues(ip.String()).Write(m))
+	return m.GetGauge().GetValue()
+}
+
+func TestIpPoolHealth(t *testing.T) {
+	cfg := &config.Config{
+		Request: &config.RequestConfig{
+			IpPool: &config.IpPoolConfig{
+				Enabled: true,
+				Subnets: []string{"192.0.2.0/28"},
+				Health: &config.IpPoolHealthConfig{
+					Enabled:            true,
+					MinRequests:        utils.ToPtr(4),
+					QuarantineDuration: utils.ToPtr(100 * time.Millisecond),
+				},
+			},
+		},
+	}
+	require.NoError(t, cfg.Init())
+	ipPool, err := utils.NewIpPool(cfg.Request.IpPool.Subnets)
+	require.NoError(t, err)
+	health := newIpPoolHealth(cfg.Request.IpPool.Health)
+
+	bucket := "client-bucket"
+	stickyIp := health.pickByKey(ipPool, bucket)
+	assert.Equal(t, ipPool.GetByKey(bucket), stickyIp)
+
+	// the upstream rate limits the address
+	transport := health.wrapTransport(fakeRoundTripper(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Body: http.NoBody}, nil
+	}), stickyIp)
+	for i := 0; i < 3; i++ {
+		_, _ = transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+	assert.True(t, health.IsHealthy(stickyIp))
+	_, _ = transport.RoundTrip(httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.False(t, health.IsHealthy(stickyIp))
+	assert.Equal(t, 1.0, readQuarantinedGauge(t, stickyIp))
+
+	// the key is re-hashed to another address, which is sticky as well
+	rehashedIp := health.pickByKey(ipPool, bucket)
+	assert.NotEqual(t, stickyIp, rehashedIp)
+	assert.Equal(t, rehashedIp, health.pickByKey(ipPool, bucket))
+	for i := 0; i < 20; i++ {
+		assert.NotEqual(t, stickyIp, health.pickRandomly(ipPool))
+	}
+
+	// back to the original address after the quarantine
+	time.Sleep(150 * time.Millisecond)
+	assert.Equal(t, stickyIp, health.pickByKey(ipPool, bucket))
+	assert.Equal(t, 0.0, readQuarantinedGauge(t, stickyIp))
+}
+
+func TestClassifyUpstreamOutcome(t *testing.T) {
+	classify := func(resp *http.Response, err error) upstreamOutcome {
+		outcome, _ := classifyUpstreamOutcome(resp, err)
+		return outcome
+	}
+	assert.Equal(t, upstreamOutcomeSuccess, classify(&http.Response{StatusCode: http.StatusOK}, nil))
+	assert.Equal(t, upstreamOutcomeSuccess, classify(&http.Response{StatusCode: http.StatusNotFound}, nil))
+	assert.Equal(t, upstreamOutcomeFailure, classify(&http.Response{StatusCode: http.StatusForbidden}, nil))
+	assert.Equal(t, upstreamOutcomeRateLimited, classify(&http.Response{StatusCode: http.StatusTooManyRequests}, nil))
+	assert.Equal(t, upstreamOutcomeFailure, classify(nil, errors.New("connection refused")))
+
+	_, ok := classifyUpstreamOutcome(nil, fmt.Errorf("read body: %w", gocontext.Canceled))
+	assert.False(t, ok)
+}
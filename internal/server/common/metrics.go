@@ -0,0 +1,57 @@
+package common
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricConcurrencyQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pavonis",
+		Subsystem: "limit",
+		Name:      "concurrency_queue_depth",
+		Help:      "Number of the requests waiting for a concurrent request slot",
+	}, []string{"site", "scope"})
+	metricConcurrencyRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pavonis",
+		Subsystem: "limit",
+		Name:      "concurrency_rejected_total",
+		Help:      "Total number of the requests rejected for no free concurrent request slot",
+	}, []string{"site", "scope"})
+	metricAccessDecision = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pavonis",
+		Subsystem: "access",
+		Name:      "decision_total",
+		Help:      "Total number of the access control decisions, by the matched rule index or \"default\"",
+	}, []string{"site", "action", "rule"})
+	metricIpPoolAddressQuarantined = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pavonis",
+		Subsystem: "ip_pool",
+		Name:      "address_quarantined",
+		Help:      "Whether the ip pool address is quarantined, for the recently used addresses",
+	}, []string{"address"})
+	metricIpPoolAddressRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pavonis",
+		Subsystem: "ip_pool",
+		Name:      "address_requests_total",
+		Help:      "Total number of the upstream requests sent from the ip pool address, by the outcome, for the recently used addresses",
+	}, []string{"address", "outcome"})
+	metricIpPoolQuarantineTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pavonis",
+		Subsystem: "ip_pool",
+		Name:      "quarantines_total",
+		Help:      "Total number of the ip pool address quarantines",
+	})
+	metricBanActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "pavonis",
+		Subsystem: "ban",
+		Name:      "active_bans",
+		Help:      "Number of the currently banned clients",
+	})
+	metricBanTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pavonis",
+		Subsystem: "ban",
+		Name:      "bans_total",
+		Help:      "Total number of the client bans",
+	})
+)
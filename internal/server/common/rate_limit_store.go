@@ -0,0 +1,45 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"time"
+)
+
+// RequestRateLimitStore creates the request rate limiters whose counters are in a shared store.
+// A nil RequestRateLimitStore creates the local limiters
+type RequestRateLimitStore struct {
+	store   utils.RateLimitStore
+	timeout time.Duration
+	close   func()
+}
+
+// NewRequestRateLimitStore returns nil if the counters are local
+func NewRequestRateLimitStore(cfg *config.RateLimitStoreConfig) *RequestRateLimitStore {
+	switch *cfg.Type {
+	case config.RateLimitStoreTypeRedis:
+		store := utils.NewRedisRateLimitStore(cfg.Address, cfg.Password, cfg.Db, *cfg.KeyPrefix)
+		return &RequestRateLimitStore{store: store, timeout: *cfg.Timeout, close: store.Close}
+	default:
+		return nil
+	}
+}
+
+// createRequestRateLimiter creates the limiter of the client with the given key.
+// Clients with different limits use different counters, so the instances with the same config share the counters
+func (s *RequestRateLimitStore) createRequestRateLimiter(rlc *config.ResourceLimitConfig, clientKey string) utils.RateLimiter {
+	if s == nil {
+		return utils.CreateRequestRateLimiter(rlc.RequestPerSecond, rlc.RequestPerMinute, rlc.RequestPerHour)
+	}
+	limitHash := sha256.Sum256([]byte(rlc.ClientLimitKey()))
+	key := hex.EncodeToString(limitHash[:4]) + ":" + clientKey
+	return utils.CreateDistributedRequestRateLimiter(s.store, key, s.timeout, rlc.RequestPerSecond, rlc.RequestPerMinute, rlc.RequestPerHour)
+}
+
+func (s *RequestRateLimitStore) Close() {
+	if s != nil && s.close != nil {
+		s.close()
+	}
+}
@@ -0,0 +1,104 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils/ioutils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const maxJsonBodySize = 16 * 1024 * 1024
+
+// ModifyResponseJson decodes the whole json response body, applies the modifier, and writes the re-encoded result back
+// Numbers are kept as json.Number, so large integers (e.g. ids) are not affected
+func ModifyResponseJson(ctx *context.RequestContext, resp *http.Response, modifier func(data interface{}) (interface{}, error)) error {
+	if resp.ContentLength > maxJsonBodySize {
+		return NewHttpError(http.StatusBadGateway, "Response json too large")
+	}
+
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	decompressedReader, err := ioutils.NewDecompressReader(resp.Body, encoding)
+	if err != nil {
+		if errors.Is(err, ioutils.UnsupportedEncodingError) {
+			return NewHttpError(http.StatusNotImplemented, fmt.Sprintf("Unsupported Content-Encoding %s", encoding))
+		}
+		return err
+	}
+	defer func() {
+		_ = decompressedReader.Close()
+		_ = resp.Body.Close()
+	}()
+
+	buf, err := io.ReadAll(io.LimitReader(decompressedReader, maxJsonBodySize+1))
+	if err != nil {
+		return err
+	}
+	if len(buf) > maxJsonBodySize {
+		return NewHttpError(http.StatusBadGateway, "Response json too large")
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+	var data interface{}
+	if err := decoder.Decode(&data); err != nil {
+		return fmt.Errorf("failed to decode response json: %v", err)
+	}
+	if data, err = modifier(data); err != nil {
+		return err
+	}
+	newBuf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode response json: %v", err)
+	}
+	log.Debugf("%sModified response json, size %d -> %d", ctx.LogPrefix, len(buf), len(newBuf))
+
+	resp.Body = io.NopCloser(bytes.NewReader(newBuf))
+	resp.ContentLength = int64(len(newBuf))
+	resp.TransferEncoding = nil
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Transfer-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(newBuf)))
+	return nil
+}
+
+// RewriteJsonStringFields recursively walks through the decoded json data,
+// and calls the rewriter for each string value whose object key is in the given keys
+func RewriteJsonStringFields(data interface{}, keys []string, rewriter func(key, value string) string) interface{} {
+	switch value := data.(type) {
+	case map[string]interface{}:
+		for k, v := range value {
+			if str, ok := v.(string); ok {
+				for _, key := range keys {
+					if k == key {
+						value[k] = rewriter(k, str)
+						break
+					}
+				}
+			} else {
+				value[k] = RewriteJsonStringFields(v, keys, rewriter)
+			}
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = RewriteJsonStringFields(v, keys, rewriter)
+		}
+	}
+	return data
+}
+
+func IsJsonContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	mediaType = strings.ToLower(mediaType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
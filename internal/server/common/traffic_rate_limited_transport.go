@@ -3,6 +3,7 @@ package common
 import (
 	"context"
 	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/felixge/httpsnoop"
 	"io"
 	"net/http"
 )
@@ -72,3 +73,29 @@ func (r *rateLimitedReadCloser) Read(p []byte) (int, error) {
 func (r *rateLimitedReadCloser) Close() error {
 	return r.reader.Close()
 }
+
+// NewTrafficRateLimitedResponseWriter returns the writer that waits for the limiter before writing,
+// for the responses that are not read from a TrafficRateLimitedTransport, e.g. the cached files
+func NewTrafficRateLimitedResponseWriter(ctx context.Context, w http.ResponseWriter, limiter utils.RateLimiter) http.ResponseWriter {
+	return httpsnoop.Wrap(w, httpsnoop.Hooks{
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				if len(b) > 0 {
+					if err := limiter.WaitN(ctx, len(b)); err != nil {
+						return 0, err
+					}
+				}
+				return next(b)
+			}
+		},
+		ReadFrom: func(next httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+			return func(src io.Reader) (int64, error) {
+				return next(&rateLimitedReadCloser{
+					reader:  io.NopCloser(src),
+					limiter: limiter,
+					ctx:     ctx,
+				})
+			}
+		},
+	})
+}
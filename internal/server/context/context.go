@@ -27,7 +27,9 @@ type RequestContext struct {
 	StartTime  time.Time
 	Host       string
 	ClientAddr string // Applied http proxy header
+	ApiKeyName string // empty if the client is not authenticated with an api key
 	LogPrefix  string
+	Rejected   bool // if the request is rejected by pavonis itself, e.g. rate limited or not whitelisted, instead of by the upstream
 }
 
 func NewRequestContext(host, clientAddr string) *RequestContext {
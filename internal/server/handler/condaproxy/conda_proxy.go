@@ -0,0 +1,141 @@
+package condaproxy
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type proxyHandler struct {
+	info     *handler.Info
+	helper   *common.RequestHelper
+	settings *config.CondaProxySettings
+
+	upstreamUrl *url.URL
+	channels    map[string]*url.URL // channel name -> channel url. Empty means all channels under upstreamUrl are allowed
+
+	whitelist packagePatterns
+	blacklist packagePatterns
+}
+
+var _ handler.HttpHandler = &proxyHandler{}
+
+func NewProxyHandler(info *handler.Info, helper *common.RequestHelper, settings *config.CondaProxySettings) (handler.HttpHandler, error) {
+	upstreamUrl, err := url.Parse(*settings.UpstreamUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UpstreamUrl %v: %v", *settings.UpstreamUrl, err)
+	}
+
+	channels := make(map[string]*url.URL)
+	for _, channel := range settings.Channels {
+		channelUrl := defaultChannelUrl(upstreamUrl, channel.Name)
+		if channel.UpstreamUrl != "" {
+			if channelUrl, err = url.Parse(channel.UpstreamUrl); err != nil {
+				return nil, fmt.Errorf("invalid UpstreamUrl %v of channel %s: %v", channel.UpstreamUrl, channel.Name, err)
+			}
+		}
+		channels[channel.Name] = channelUrl
+	}
+
+	return &proxyHandler{
+		info:        info,
+		helper:      helper,
+		settings:    settings,
+		upstreamUrl: upstreamUrl,
+		channels:    channels,
+		whitelist:   settings.PackagesWhitelist,
+		blacklist:   settings.PackagesBlacklist,
+	}, nil
+}
+
+func (h *proxyHandler) Info() *handler.Info {
+	return h.info
+}
+
+func (h *proxyHandler) Shutdown() {
+}
+
+// e.g. "/conda-forge/linux-64/repodata.json", "/conda-forge/label/main/noarch/current_repodata.json.zst"
+var repodataFilePattern = regexp.MustCompile(`^(current_)?repodata\.json(\.zst|\.bz2)?$`)
+
+func defaultChannelUrl(upstreamUrl *url.URL, channel string) *url.URL {
+	channelUrl := *upstreamUrl
+	channelUrl.Path = upstreamUrl.Path + "/" + channel
+	channelUrl.RawPath = ""
+	return &channelUrl
+}
+
+// getChannelUrl returns the upstream url of the channel, or nil if the channel is not allowed
+func (h *proxyHandler) getChannelUrl(channel string) *url.URL {
+	if len(h.channels) == 0 {
+		return defaultChannelUrl(h.upstreamUrl, channel)
+	}
+	return h.channels[channel]
+}
+
+func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request) {
+	settingPathPrefix := h.info.PathPrefix
+	if !strings.HasPrefix(r.URL.Path, settingPathPrefix) {
+		panic(fmt.Errorf("r.URL.Path %v not started with prefix %v", r.URL.Path, settingPathPrefix))
+	}
+	reqPath := r.URL.Path[len(settingPathPrefix):]
+
+	// "/<channel>/<subPath>"
+	channel, subPath, _ := strings.Cut(strings.TrimPrefix(reqPath, "/"), "/")
+	if channel == "" || subPath == "" {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	channelUrl := h.getChannelUrl(channel)
+	if channelUrl == nil {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Channel '%s' is not allowed", channel), http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var responseModifier common.ResponseModifier
+	fileName := path.Base(subPath)
+	if matches := repodataFilePattern.FindStringSubmatch(fileName); matches != nil {
+		if h.hasPackageFilter() {
+			fileEncoding := repodataFileEncodings[matches[2]]
+			if fileEncoding == "" {
+				// there's no bzip2 encoder in the standard library. Clients will fall back to the plain repodata.json
+				http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+				return
+			}
+			responseModifier = func(_ *http.Request, resp *http.Response) error {
+				if resp.StatusCode != http.StatusOK {
+					return nil
+				}
+				return h.filterRepodataResponse(ctx, resp, fileEncoding)
+			}
+		}
+	} else if name, ok := parsePackageName(fileName); ok {
+		if !h.checkPackage(ctx, w, name) {
+			return
+		}
+	}
+
+	downstreamUrl := *r.URL
+	downstreamUrl.Scheme = channelUrl.Scheme
+	downstreamUrl.Host = channelUrl.Host
+	downstreamUrl.Path = channelUrl.Path + "/" + subPath
+	downstreamUrl.RawPath = ""
+
+	// anaconda.org redirects package downloads to its CDN, follow it, so the client doesn't need to access the CDN directly
+	opts := []common.ReverseProxyOption{common.WithRedirectFollowAll()}
+	if responseModifier != nil {
+		opts = append(opts, common.WithResponseModifier(responseModifier))
+	}
+	h.helper.RunReverseProxy(ctx, w, r, &downstreamUrl, opts...)
+}
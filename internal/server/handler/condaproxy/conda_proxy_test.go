@@ -0,0 +1,159 @@
+package condaproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const testRepodata = `{"info": {"subdir": "noarch"}, "packages": {"foo-1.0-0.tar.bz2": {"name": "foo", "version": "1.0"}, "bar-2.0-0.tar.bz2": {"name": "bar", "version": "2.0"}}, "packages.conda": {"foo-1.1-0.conda": {"name": "foo", "version": "1.1"}, "py-bar-3.0-py_0.conda": {"name": "py-bar", "version": "3.0"}}, "removed": [], "repodata_version": 1}`
+
+func newTestUpstream(t *testing.T) string {
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("package " + r.URL.Path))
+	}))
+	t.Cleanup(cdn.Close)
+
+	zstdRepodata := func() []byte {
+		encoder, err := zstd.NewWriter(nil)
+		require.NoError(t, err)
+		return encoder.EncodeAll([]byte(testRepodata), nil)
+	}()
+
+	mux := http.NewServeMux()
+	for _, channel := range []string{"conda-forge", "bioconda"} {
+		mux.HandleFunc("/"+channel+"/noarch/repodata.json", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(testRepodata))
+		})
+		mux.HandleFunc("/"+channel+"/noarch/repodata.json.zst", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write(zstdRepodata)
+		})
+		mux.HandleFunc("/"+channel+"/noarch/", func(w http.ResponseWriter, r *http.Request) {
+			// anaconda.org redirects package downloads to its CDN
+			http.Redirect(w, r, cdn.URL+r.URL.Path, http.StatusFound)
+		})
+	}
+	upstream := httptest.NewServer(mux)
+	t.Cleanup(upstream.Close)
+	return upstream.URL
+}
+
+func newTestProxy(t *testing.T, settings *config.CondaProxySettings) string {
+	return commontest.NewProxy(t, nil, config.SiteModeCondaProxy, settings, NewProxyHandler, http.DefaultTransport)
+}
+
+func packageFilenames(t *testing.T, repodata string) []string {
+	var data struct {
+		Packages      map[string]json.RawMessage `json:"packages"`
+		PackagesConda map[string]json.RawMessage `json:"packages.conda"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(repodata), &data))
+	var filenames []string
+	for filename := range data.Packages {
+		filenames = append(filenames, filename)
+	}
+	for filename := range data.PackagesConda {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+func TestChannels(t *testing.T) {
+	upstreamUrl := newTestUpstream(t)
+	proxyUrl := newTestProxy(t, &config.CondaProxySettings{
+		UpstreamUrl: utils.ToPtr(upstreamUrl),
+		Channels: []*config.CondaChannelConfig{
+			{Name: "conda-forge"},
+			{Name: "bio", UpstreamUrl: upstreamUrl + "/bioconda"},
+		},
+	})
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/conda-forge/noarch/repodata.json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, testRepodata, body)
+
+	resp, body = commontest.HttpGet(t, proxyUrl+"/bio/noarch/repodata.json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, testRepodata, body)
+
+	// the redirect to the CDN is followed
+	resp, body = commontest.HttpGet(t, proxyUrl+"/conda-forge/noarch/foo-1.0-0.tar.bz2", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "package /conda-forge/noarch/foo-1.0-0.tar.bz2", body)
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/bioconda/noarch/repodata.json", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/conda-forge", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestPackageFiltering(t *testing.T) {
+	upstreamUrl := newTestUpstream(t)
+	proxyUrl := newTestProxy(t, &config.CondaProxySettings{
+		UpstreamUrl:       utils.ToPtr(upstreamUrl),
+		PackagesBlacklist: []string{"py-*", "BAR"},
+	})
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/bioconda/noarch/repodata.json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"foo-1.0-0.tar.bz2", "foo-1.1-0.conda"}, packageFilenames(t, body))
+	assert.Contains(t, body, `"repodata_version":1`)
+
+	resp, body = commontest.HttpGet(t, proxyUrl+"/bioconda/noarch/repodata.json.zst", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	decoder, err := zstd.NewReader(strings.NewReader(body))
+	require.NoError(t, err)
+	defer decoder.Close()
+	decoded, err := io.ReadAll(decoder)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"foo-1.0-0.tar.bz2", "foo-1.1-0.conda"}, packageFilenames(t, string(decoded)))
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/bioconda/noarch/repodata.json.bz2", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/bioconda/noarch/py-bar-3.0-py_0.conda", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/bioconda/noarch/foo-1.1-0.conda", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestParsePackageName(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"numpy-1.26.4-py312h8753938_0.conda":        "numpy",
+		"r-base-4.3.3-hf0d99cb_1.tar.bz2":           "r-base",
+		"python_abi-3.12-4_cp312.conda":             "python_abi",
+		"ca-certificates-2024.2.2-hbcca054_0.conda": "ca-certificates",
+	} {
+		name, ok := parsePackageName(filename)
+		assert.True(t, ok, filename)
+		assert.Equal(t, expected, name, filename)
+	}
+	for _, filename := range []string{"repodata.json", "foo-1.0.conda", "foo-1.0-0.zip"} {
+		_, ok := parsePackageName(filename)
+		assert.False(t, ok, filename)
+	}
+}
+
+func TestFilterRepodataNullPackages(t *testing.T) {
+	var buf bytes.Buffer
+	removed, err := filterRepodata(&buf, bytes.NewReader([]byte(`{"packages": null, "packages.conda": {}}`)), func(string) bool { return false })
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+	assert.Equal(t, `{"packages":null,"packages.conda":{}}`, buf.String())
+
+	_, err = filterRepodata(io.Discard, bytes.NewReader([]byte(`{"packages": [`)), func(string) bool { return true })
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package condaproxy
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// packagePatterns is a list of package name patterns, where "*" matches any sequence of characters
+type packagePatterns []string
+
+func (p packagePatterns) Match(name string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range p {
+		if ok, _ := path.Match(strings.ToLower(pattern), name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *proxyHandler) hasPackageFilter() bool {
+	return len(h.whitelist) > 0 || len(h.blacklist) > 0
+}
+
+func (h *proxyHandler) isPackageAllowed(name string) bool {
+	if len(h.whitelist) > 0 && !h.whitelist.Match(name) {
+		return false
+	}
+	if len(h.blacklist) > 0 && h.blacklist.Match(name) {
+		return false
+	}
+	return true
+}
+
+func (h *proxyHandler) checkPackage(ctx *context.RequestContext, w http.ResponseWriter, name string) bool {
+	if len(h.whitelist) > 0 && !h.whitelist.Match(name) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Package '%s' is not whitelisted", name), http.StatusForbidden)
+		return false
+	}
+	if len(h.blacklist) > 0 && h.blacklist.Match(name) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Package '%s' is blacklisted", name), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+var packageExtensions = []string{".conda", ".tar.bz2"}
+
+// parsePackageName extracts the package name from the package filename
+//
+// The filename is "{name}-{version}-{build}.conda" or "{name}-{version}-{build}.tar.bz2",
+// where the name might contain '-', but the version and the build don't
+func parsePackageName(filename string) (string, bool) {
+	for _, ext := range packageExtensions {
+		if base, ok := strings.CutSuffix(filename, ext); ok {
+			parts := strings.Split(base, "-")
+			if len(parts) < 3 {
+				return "", false
+			}
+			return strings.Join(parts[:len(parts)-2], "-"), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,219 @@
+package condaproxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils/ioutils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// repodata file suffix -> the encoding of the file itself. An empty encoding means the re-encoding is unsupported
+var repodataFileEncodings = map[string]string{
+	"":     "identity",
+	".zst": "zstd",
+	".bz2": "",
+}
+
+// repodataPackageKeys are the keys of the filename -> package info mappings in the repodata
+// https://github.com/conda-incubator/ceps/blob/main/cep-0016.md
+var repodataPackageKeys = map[string]bool{
+	"packages":       true,
+	"packages.conda": true,
+}
+
+type multiCloser []io.Closer
+
+func (c multiCloser) Close() error {
+	var errs []error
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// filterRepodataResponse removes the disallowed packages from the repodata in the response body
+// The repodata is filtered in a streaming way, since it can be hundreds of MiB large for channels like conda-forge
+func (h *proxyHandler) filterRepodataResponse(ctx *context.RequestContext, resp *http.Response, fileEncoding string) error {
+	body := resp.Body
+	contentEncoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	decompressedReader, err := ioutils.NewDecompressReader(body, contentEncoding)
+	if err != nil {
+		if errors.Is(err, ioutils.UnsupportedEncodingError) {
+			return common.NewHttpError(http.StatusNotImplemented, fmt.Sprintf("Unsupported Content-Encoding %s", contentEncoding))
+		}
+		return err
+	}
+	fileReader, err := ioutils.NewDecompressReader(decompressedReader, fileEncoding)
+	if err != nil {
+		_ = decompressedReader.Close()
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer func() {
+			_ = multiCloser{fileReader, decompressedReader, body}.Close()
+		}()
+		removed, err := filterRepodata(pw, fileReader, h.isPackageAllowed)
+		if err != nil {
+			log.Errorf("%sFailed to filter repodata: %v", ctx.LogPrefix, err)
+		} else {
+			log.Debugf("%sFiltered %d packages from repodata", ctx.LogPrefix, removed)
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	fileWriter, err := ioutils.NewCompressReader(pr, fileEncoding)
+	if err != nil {
+		_ = pr.Close()
+		return err
+	}
+	newBody, err := ioutils.NewCompressReader(fileWriter, contentEncoding)
+	if err != nil {
+		_ = fileWriter.Close()
+		return err
+	}
+
+	resp.Body = newBody
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Length")
+	return nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("expected %s, got %v", delim, token)
+	}
+	return nil
+}
+
+func readKey(decoder *json.Decoder) (string, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return "", err
+	}
+	key, ok := token.(string)
+	if !ok {
+		return "", fmt.Errorf("expected object key, got %v", token)
+	}
+	return key, nil
+}
+
+func writeKey(writer *bufio.Writer, key string, first bool) error {
+	if !first {
+		if err := writer.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	buf, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(buf); err != nil {
+		return err
+	}
+	return writer.WriteByte(':')
+}
+
+// filterRepodata copies the repodata json from r to w, with the disallowed packages removed
+// Returns the amount of the removed packages
+func filterRepodata(w io.Writer, r io.Reader, isAllowed func(name string) bool) (int, error) {
+	decoder := json.NewDecoder(r)
+	writer := bufio.NewWriter(w)
+	removed := 0
+
+	if err := expectDelim(decoder, '{'); err != nil {
+		return 0, err
+	}
+	_ = writer.WriteByte('{')
+	for first := true; decoder.More(); first = false {
+		key, err := readKey(decoder)
+		if err != nil {
+			return removed, err
+		}
+		if err := writeKey(writer, key, first); err != nil {
+			return removed, err
+		}
+		if repodataPackageKeys[key] {
+			n, err := filterPackages(decoder, writer, isAllowed)
+			removed += n
+			if err != nil {
+				return removed, err
+			}
+		} else {
+			var value json.RawMessage
+			if err := decoder.Decode(&value); err != nil {
+				return removed, err
+			}
+			if _, err := writer.Write(value); err != nil {
+				return removed, err
+			}
+		}
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return removed, err
+	}
+	_ = writer.WriteByte('}')
+	return removed, writer.Flush()
+}
+
+// filterPackages copies the filename -> package info mapping, with the disallowed packages removed
+func filterPackages(decoder *json.Decoder, writer *bufio.Writer, isAllowed func(name string) bool) (int, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return 0, err
+	}
+	if token == nil {
+		_, err := writer.WriteString("null")
+		return 0, err
+	}
+	if d, ok := token.(json.Delim); !ok || d != '{' {
+		return 0, fmt.Errorf("expected packages object, got %v", token)
+	}
+
+	removed := 0
+	_ = writer.WriteByte('{')
+	first := true
+	for decoder.More() {
+		filename, err := readKey(decoder)
+		if err != nil {
+			return removed, err
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return removed, err
+		}
+		var info struct {
+			Name string `json:"name"`
+		}
+		if err := json.Unmarshal(value, &info); err != nil {
+			return removed, fmt.Errorf("invalid package info of %+q: %v", filename, err)
+		}
+		if !isAllowed(info.Name) {
+			removed++
+			continue
+		}
+		if err := writeKey(writer, filename, first); err != nil {
+			return removed, err
+		}
+		if _, err := writer.Write(value); err != nil {
+			return removed, err
+		}
+		first = false
+	}
+	if err := expectDelim(decoder, '}'); err != nil {
+		return removed, err
+	}
+	return removed, writer.WriteByte('}')
+}
@@ -2,6 +2,7 @@ package crproxy
 
 import (
 	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
 	"github.com/Fallen-Breath/pavonis/internal/server/context"
 	"github.com/Fallen-Breath/pavonis/internal/utils"
 	log "github.com/sirupsen/logrus"
@@ -113,13 +114,13 @@ func extractReposNameFromV2Path(path string) *[]string {
 	return nil
 }
 
-func (h *proxyHandler) checkAndApplyWhitelists(w http.ResponseWriter, reposName []string) bool {
+func (h *proxyHandler) checkAndApplyWhitelists(ctx *context.RequestContext, w http.ResponseWriter, reposName []string) bool {
 	if len(*h.whitelist) > 0 && !h.whitelist.Check(reposName) {
-		http.Error(w, fmt.Sprintf("Repository '%s' is not whitelisted", strings.Join(reposName, "/")), http.StatusForbidden)
+		common.WriteRejection(ctx, w, fmt.Sprintf("Repository '%s' is not whitelisted", strings.Join(reposName, "/")), http.StatusForbidden)
 		return false
 	}
 	if len(*h.blacklist) > 0 && h.blacklist.Check(reposName) {
-		http.Error(w, fmt.Sprintf("Repository '%s' is blacklisted", strings.Join(reposName, "/")), http.StatusForbidden)
+		common.WriteRejection(ctx, w, fmt.Sprintf("Repository '%s' is blacklisted", strings.Join(reposName, "/")), http.StatusForbidden)
 		return false
 	}
 	return true
@@ -140,7 +141,7 @@ func (h *proxyHandler) checkReposWhitelist(ctx *context.RequestContext, w http.R
 	}
 
 	log.Debugf("%sExtracted reposName from reqPath %+q: %+v", ctx.LogPrefix, reqPath, reposName)
-	if reposName != nil && !h.checkAndApplyWhitelists(w, *reposName) {
+	if reposName != nil && !h.checkAndApplyWhitelists(ctx, w, *reposName) {
 		return false
 	}
 
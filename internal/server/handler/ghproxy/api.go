@@ -0,0 +1,46 @@
+package ghproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+)
+
+// Fields in the release api json that contain urls for downloading, which should go through the proxy
+// e.g. "browser_download_url": "https://github.com/foo/bar/releases/download/v1.0/bar.zip"
+var apiDownloadUrlJsonKeys = []string{"browser_download_url"}
+
+func (h *proxyHandler) prepareApiRequest(r *http.Request) {
+	if h.settings.Api.Token != "" && r.Header.Get("Authorization") == "" {
+		r.Header.Set("Authorization", "Bearer "+h.settings.Api.Token)
+	}
+}
+
+func (h *proxyHandler) rewriteApiResponse(ctx *context.RequestContext, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK || !common.IsJsonContentType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	return common.ModifyResponseJson(ctx, resp, func(data interface{}) (interface{}, error) {
+		return common.RewriteJsonStringFields(data, apiDownloadUrlJsonKeys, func(key, value string) string {
+			if newValue, ok := h.rewriteUrlToSelf(value); ok {
+				return newValue
+			}
+			log.Debugf("%sSkipping unknown url %+q in json field %+q", ctx.LogPrefix, value, key)
+			return value
+		}), nil
+	})
+}
+
+// rewriteUrlToSelf makes the given url go through the proxy, if its host is allowed
+func (h *proxyHandler) rewriteUrlToSelf(urlStr string) (string, bool) {
+	u, err := url.Parse(urlStr)
+	if err != nil || u == nil || u.Scheme != "https" {
+		return "", false
+	}
+	if _, ok := h.getHost(u.Host); !ok {
+		return "", false
+	}
+	return h.info.SelfUrl + h.info.PathPrefix + "/" + urlStr, true
+}
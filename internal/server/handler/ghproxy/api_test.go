@@ -0,0 +1,107 @@
+package ghproxy
+
+import (
+	"encoding/json"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+)
+
+const testReleaseJson = `{
+  "id": 123456789012345678,
+  "tag_name": "v1.0",
+  "assets": [
+    {
+      "name": "bar.zip",
+      "browser_download_url": "https://github.com/foo/bar/releases/download/v1.0/bar.zip"
+    },
+    {
+      "name": "other.zip",
+      "browser_download_url": "https://example.com/other.zip"
+    }
+  ]
+}`
+
+func newTestApiUpstream(authHeaders *[]string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != githubApiHost {
+			http.Error(w, "unexpected host "+r.Host, http.StatusBadGateway)
+			return
+		}
+		*authHeaders = append(*authHeaders, r.Header.Get("Authorization"))
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write([]byte(testReleaseJson))
+	})
+}
+
+func TestApiProxy(t *testing.T) {
+	var authHeaders []string
+	proxyUrl := newTestProxy(t, &config.GithubDownloadProxySettings{
+		Api:            &config.GithubApiConfig{Enabled: true, Token: "server-token"},
+		ReposBlacklist: []string{"evil/*"},
+	}, newTestApiUpstream(&authHeaders))
+
+	resp, err := http.Get(proxyUrl + "/https://api.github.com/repos/foo/bar/releases/latest")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+
+	var release struct {
+		Id     json.Number `json:"id"`
+		Assets []struct {
+			BrowserDownloadUrl string `json:"browser_download_url"`
+		} `json:"assets"`
+	}
+	require.NoError(t, json.Unmarshal(body, &release))
+	assert.Equal(t, "123456789012345678", release.Id.String())
+	require.Len(t, release.Assets, 2)
+	assert.Equal(t, proxyUrl+"/https://github.com/foo/bar/releases/download/v1.0/bar.zip", release.Assets[0].BrowserDownloadUrl)
+	assert.Equal(t, "https://example.com/other.zip", release.Assets[1].BrowserDownloadUrl)
+
+	// client-provided token has the priority
+	req, _ := http.NewRequest(http.MethodGet, proxyUrl+"/https://api.github.com/repos/foo/bar/tags", nil)
+	req.Header.Set("Authorization", "Bearer client-token")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	assert.Equal(t, []string{"Bearer server-token", "Bearer client-token"}, authHeaders)
+
+	for _, tc := range []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"Non-whitelisted api", http.MethodGet, "/https://api.github.com/user", http.StatusNotFound},
+		{"Non-whitelisted repo api", http.MethodGet, "/https://api.github.com/repos/foo/bar/collaborators", http.StatusNotFound},
+		{"Write api", http.MethodPost, "/https://api.github.com/repos/foo/bar/releases", http.StatusMethodNotAllowed},
+		{"Blacklisted repo", http.MethodGet, "/https://api.github.com/repos/evil/bar/releases/latest", http.StatusForbidden},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tc.method, proxyUrl+tc.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			_ = resp.Body.Close()
+			assert.Equal(t, tc.status, resp.StatusCode)
+		})
+	}
+	assert.Len(t, authHeaders, 2)
+}
+
+func TestApiProxyDisabled(t *testing.T) {
+	var authHeaders []string
+	proxyUrl := newTestProxy(t, &config.GithubDownloadProxySettings{}, newTestApiUpstream(&authHeaders))
+
+	resp, err := http.Get(proxyUrl + "/https://api.github.com/repos/foo/bar/releases/latest")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Empty(t, authHeaders)
+}
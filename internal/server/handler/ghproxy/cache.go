@@ -0,0 +1,201 @@
+package ghproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils/diskcache"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+// Release assets and tag archives are effectively immutable
+//
+//	"/{author}/{repos}/releases/download/{tag}/{filename}"
+//	"/{author}/{repos}/archive/refs/tags/{tag}.tar.gz"
+var cacheablePathPattern = regexp.MustCompile(`^/[^/]+/[^/]+/(releases/download/[^/]+/[^/]+|archive/refs/tags/[^/]+)$`)
+
+// the headers to store with the cached file, and to send with the cached responses
+var cachedAssetHeaders = []string{"Content-Type", "Content-Disposition", "ETag", "Last-Modified"}
+
+func isCacheableRequest(r *http.Request, targetUrl *url.URL) bool {
+	return r.Method == http.MethodGet &&
+		r.Header.Get("Range") == "" &&
+		targetUrl.Host == "github.com" &&
+		cacheablePathPattern.MatchString(targetUrl.Path)
+}
+
+// The key is the final redirected url of the asset, e.g. "https://release-assets.githubusercontent.com/github-production-release-asset/123/456",
+// which changes when the asset is re-uploaded. The query is excluded, since it's the signature that changes on every redirect
+func cacheKeyOf(finalUrl *url.URL) string {
+	keyUrl := url.URL{
+		Scheme: finalUrl.Scheme,
+		Host:   finalUrl.Host,
+		Path:   finalUrl.Path,
+	}
+	return keyUrl.String()
+}
+
+// resolvedAsset is the result of following the redirects of a requested asset url
+type resolvedAsset struct {
+	key        string
+	size       int64  // -1 if unknown
+	etag       string // might be empty
+	resolvedAt time.Time
+}
+
+// matches checks if the cached entry is the resolved asset
+func (a *resolvedAsset) matches(meta *diskcache.Meta) bool {
+	if a.size >= 0 && a.size != meta.Size {
+		return false
+	}
+	if etag := meta.Header.Get("ETag"); a.etag != "" && etag != "" && a.etag != etag {
+		return false
+	}
+	return true
+}
+
+// serveCachedAsset serves the release asset or the tag archive from the disk cache, and returns false if the asset is not cacheable
+//
+// The requested url is resolved to the final redirected url, which is the cache key, with a HEAD request.
+// The resolved urls are reused without any upstream request within CacheRevalidateInterval.
+// Uncached assets are fetched in a background fill, which keeps going even if the client that starts it is gone
+func (h *proxyHandler) serveCachedAsset(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, targetUrl *url.URL) bool {
+	asset, fresh := h.resolveAsset(ctx, r, targetUrl)
+	if asset == nil {
+		return false
+	}
+
+	if file, meta, ok := h.cache.Get(asset.key); ok {
+		if !fresh || asset.matches(meta) {
+			log.Debugf("%sServing %+q from cache (%d bytes)", ctx.LogPrefix, asset.key, meta.Size)
+			h.helper.ServeCachedContent(ctx, w, r, file, meta.Header, cachedAssetHeaders)
+			return true
+		}
+		log.Debugf("%sCached %+q is outdated, refilling", ctx.LogPrefix, asset.key)
+		_ = file.Close()
+		h.cache.Remove(asset.key)
+	}
+
+	h.helper.ServeFromDiskCache(ctx, w, r, h.cache, asset.key, cachedAssetHeaders, func() (int64, http.Header, io.ReadCloser, error) {
+		log.Debugf("%sFetching %+q for the cache", ctx.LogPrefix, asset.key)
+		return h.fetchAsset(ctx, r, targetUrl, asset.key)
+	})
+	return true
+}
+
+// resolveAsset follows the redirects of the requested asset url with a HEAD request, and returns nil if the asset is not cacheable.
+// fresh is false if the returned asset is the previous result, which is either resolved within CacheRevalidateInterval,
+// or kept since the upstream is unavailable, e.g. network errors, server errors or rate limited
+func (h *proxyHandler) resolveAsset(ctx *context.RequestContext, r *http.Request, targetUrl *url.URL) (asset *resolvedAsset, fresh bool) {
+	requestedKey := cacheKeyOf(targetUrl)
+	previous, _ := h.resolvedAssets.Get(requestedKey)
+	if previous != nil && time.Since(previous.resolvedAt) < *h.settings.CacheRevalidateInterval {
+		return previous, false
+	}
+
+	client, err := h.helper.NewSubrequestClient(ctx, r.Context())
+	if err != nil {
+		log.Debugf("%sFailed to resolve %+q: %v", ctx.LogPrefix, requestedKey, err)
+		return previous, false
+	}
+	defer client.Close()
+
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodHead, targetUrl.String(), nil)
+	if err != nil {
+		return nil, false
+	}
+	req.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Warnf("%sFailed to resolve %+q: %v", ctx.LogPrefix, requestedKey, err)
+		return previous, false
+	}
+	_ = resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		finalUrl := targetUrl
+		if resp.Request != nil {
+			finalUrl = resp.Request.URL
+		}
+		asset = &resolvedAsset{
+			key:        cacheKeyOf(finalUrl),
+			size:       resp.ContentLength,
+			etag:       resp.Header.Get("ETag"),
+			resolvedAt: time.Now(),
+		}
+		log.Debugf("%sResolved %+q to %+q", ctx.LogPrefix, requestedKey, asset.key)
+		h.resolvedAssets.Add(requestedKey, asset)
+		return asset, true
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		log.Warnf("%sFailed to resolve %+q: %s", ctx.LogPrefix, requestedKey, resp.Status)
+		return previous, false
+	default:
+		log.Debugf("%sResolved %+q to an uncacheable response (%s)", ctx.LogPrefix, requestedKey, resp.Status)
+		h.resolvedAssets.Remove(requestedKey)
+		return nil, false
+	}
+}
+
+// fetchAsset downloads the whole asset, with the redirects followed. The response is not cached if it's not redirected to the given key
+// The download is not bound to the client request, or limited by its client, since other clients might be reading from it
+func (h *proxyHandler) fetchAsset(ctx *context.RequestContext, r *http.Request, targetUrl *url.URL, key string) (int64, http.Header, io.ReadCloser, error) {
+	client := h.helper.NewBackgroundClient(ctx)
+	ok := false
+	defer func() {
+		if !ok {
+			client.Close()
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(h.cacheCtx, http.MethodGet, targetUrl.String(), nil)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	req.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if err := h.limitResponseSize(resp); err != nil {
+		_ = resp.Body.Close()
+		return 0, nil, nil, err
+	}
+
+	finalUrl := targetUrl
+	if resp.Request != nil {
+		finalUrl = resp.Request.URL
+	}
+	redirected := cacheKeyOf(finalUrl) == key
+	if !redirected {
+		// the asset has changed since it was resolved
+		log.Debugf("%sAsset %+q is now at %+q, not caching", ctx.LogPrefix, key, cacheKeyOf(finalUrl))
+		h.resolvedAssets.Remove(cacheKeyOf(targetUrl))
+	}
+	finalHost := finalUrl.Host
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 || !redirected || h.isTextUrlRewritable(finalHost, resp) {
+		// not cached, e.g. errors, and the text files whose urls are rewritten
+		if err := h.rewriteTextUrls(ctx, finalHost, resp); err != nil {
+			_ = resp.Body.Close()
+			return 0, nil, nil, err
+		}
+		ok = true
+		resp.Body = client.CloseWithBody(resp.Body)
+		return 0, nil, nil, &common.PassthroughResponseError{Response: resp}
+	}
+
+	header := http.Header{}
+	for _, key := range cachedAssetHeaders {
+		if value := resp.Header.Get(key); value != "" {
+			header.Set(key, value)
+		}
+	}
+	ok = true
+	return resp.ContentLength, header, client.CloseWithBody(resp.Body), nil
+}
@@ -0,0 +1,171 @@
+package ghproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIsCacheableRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		url      string
+		rangeHdr string
+		expected bool
+	}{
+		{"Release asset", "GET", "https://github.com/foo/bar/releases/download/v1.0/bar.zip", "", true},
+		{"Tag archive", "GET", "https://github.com/foo/bar/archive/refs/tags/v1.0.tar.gz", "", true},
+		{"HEAD request", "HEAD", "https://github.com/foo/bar/releases/download/v1.0/bar.zip", "", false},
+		{"Range request", "GET", "https://github.com/foo/bar/releases/download/v1.0/bar.zip", "bytes=0-1", false},
+		{"Branch archive", "GET", "https://github.com/foo/bar/archive/refs/heads/main.zip", "", false},
+		{"Latest release", "GET", "https://github.com/foo/bar/releases/latest/download/bar.zip", "", false},
+		{"Raw file", "GET", "https://raw.githubusercontent.com/foo/bar/main/README.md", "", false},
+		{"Blob", "GET", "https://github.com/foo/bar/blob/main/README.md", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetUrl := utils.MustParseUrl(tt.url)
+			r, _ := http.NewRequest(tt.method, "/"+tt.url, nil)
+			if tt.rangeHdr != "" {
+				r.Header.Set("Range", tt.rangeHdr)
+			}
+			assert.Equal(t, tt.expected, isCacheableRequest(r, targetUrl))
+		})
+	}
+}
+
+func TestCacheKeyOf(t *testing.T) {
+	u := utils.MustParseUrl("https://github.com/foo/bar/releases/download/v1.0/bar.zip?foo=bar")
+	assert.Equal(t, "https://github.com/foo/bar/releases/download/v1.0/bar.zip", cacheKeyOf(u))
+}
+
+// newAssetTestUpstream redirects "/foo/bar/releases/download/v1.0/bar.zip" to "/assets/{version}" with a new signature every time,
+// where the asset is served with the version as the etag, and the requests are counted by the method.
+// The GET response body is blocked until release is closed
+func newAssetTestUpstream(data string, version *atomic.Value, requests map[string]*atomic.Int32, release chan struct{}) http.Handler {
+	var signature atomic.Int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		currentVersion := version.Load().(string)
+		if r.URL.Path == "/foo/bar/releases/download/v1.0/bar.zip" {
+			http.Redirect(w, r, "/assets/"+currentVersion+"?sig="+strconv.Itoa(int(signature.Add(1))), http.StatusFound)
+			return
+		}
+		if r.URL.Path != "/assets/"+currentVersion {
+			http.NotFound(w, r)
+			return
+		}
+		requests[r.Method].Add(1)
+		w.Header().Set("ETag", `"`+currentVersion+`"`)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodHead {
+			return
+		}
+		half := len(data) / 2
+		_, _ = w.Write([]byte(data[:half]))
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write([]byte(data[half:]))
+	})
+}
+
+func newCacheTestSettings(t *testing.T, revalidateInterval time.Duration) *config.GithubDownloadProxySettings {
+	return &config.GithubDownloadProxySettings{
+		Cache:                   &config.DiskCacheConfig{Enabled: true, Directory: t.TempDir()},
+		CacheRevalidateInterval: &revalidateInterval,
+	}
+}
+
+func readAsset(t *testing.T, assetUrl string) (*http.Response, string) {
+	resp, err := http.Get(assetUrl)
+	require.NoError(t, err)
+	defer func() { _ = resp.Body.Close() }()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp, string(body)
+}
+
+func TestCacheHitWithoutUpstreamRequest(t *testing.T) {
+	version := &atomic.Value{}
+	version.Store("v1")
+	requests := map[string]*atomic.Int32{http.MethodGet: {}, http.MethodHead: {}}
+	release := make(chan struct{})
+	close(release)
+	proxyUrl := newTestProxy(t, newCacheTestSettings(t, time.Hour), newAssetTestUpstream("hello world", version, requests, release))
+	assetUrl := proxyUrl + "/https://github.com/foo/bar/releases/download/v1.0/bar.zip"
+
+	for i := 0; i < 3; i++ {
+		resp, body := readAsset(t, assetUrl)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "hello world", body)
+		assert.Equal(t, `"v1"`, resp.Header.Get("ETag"))
+	}
+	// only the first request resolves the redirect
+	assert.Equal(t, int32(1), requests[http.MethodGet].Load())
+	assert.Equal(t, int32(1), requests[http.MethodHead].Load())
+}
+
+func TestCacheKeyedByRedirectTarget(t *testing.T) {
+	version := &atomic.Value{}
+	version.Store("v1")
+	requests := map[string]*atomic.Int32{http.MethodGet: {}, http.MethodHead: {}}
+	release := make(chan struct{})
+	close(release)
+	proxyUrl := newTestProxy(t, newCacheTestSettings(t, time.Nanosecond), newAssetTestUpstream("hello world", version, requests, release))
+	assetUrl := proxyUrl + "/https://github.com/foo/bar/releases/download/v1.0/bar.zip"
+
+	_, body := readAsset(t, assetUrl)
+	assert.Equal(t, "hello world", body)
+
+	// redirected to the same asset with another signature, served from the cache
+	_, body = readAsset(t, assetUrl)
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, int32(1), requests[http.MethodGet].Load())
+	assert.Equal(t, int32(2), requests[http.MethodHead].Load())
+
+	// re-uploaded, redirected to another asset
+	version.Store("v2")
+	resp, body := readAsset(t, assetUrl)
+	assert.Equal(t, "hello world", body)
+	assert.Equal(t, `"v2"`, resp.Header.Get("ETag"))
+	assert.Equal(t, int32(2), requests[http.MethodGet].Load())
+	assert.Equal(t, int32(3), requests[http.MethodHead].Load())
+}
+
+func TestCacheFillSurvivesLeaderDisconnect(t *testing.T) {
+	version := &atomic.Value{}
+	version.Store("v1")
+	requests := map[string]*atomic.Int32{http.MethodGet: {}, http.MethodHead: {}}
+	release := make(chan struct{})
+	data := strings.Repeat("0123456789", 1000)
+	proxyUrl := newTestProxy(t, newCacheTestSettings(t, time.Hour), newAssetTestUpstream(data, version, requests, release))
+	assetUrl := proxyUrl + "/https://github.com/foo/bar/releases/download/v1.0/bar.zip"
+
+	// the client that starts the fill disconnects in the middle of the download
+	leaderResp, err := http.Get(assetUrl)
+	require.NoError(t, err)
+	_, err = io.ReadFull(leaderResp.Body, make([]byte, 10))
+	require.NoError(t, err)
+	_ = leaderResp.Body.Close()
+
+	followerDone := make(chan string)
+	go func() {
+		_, body := readAsset(t, assetUrl)
+		followerDone <- body
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	assert.Equal(t, data, <-followerDone)
+	assert.Equal(t, int32(1), requests[http.MethodGet].Load())
+}
@@ -0,0 +1,102 @@
+package ghproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	expirelru "github.com/hashicorp/golang-lru/v2/expirable"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"regexp"
+	"time"
+)
+
+type gitService string
+
+const (
+	gitServiceNone        gitService = ""
+	gitServiceUploadPack  gitService = "git-upload-pack"  // clone, fetch, ls-remote
+	gitServiceReceivePack gitService = "git-receive-pack" // push
+)
+
+// Git smart HTTP protocol, see https://git-scm.com/docs/http-protocol
+//
+//	GET  "/{author}/{repos}/info/refs?service=git-upload-pack" (ref discovery, every clone / fetch / ls-remote starts with this)
+//	POST "/{author}/{repos}/git-upload-pack"
+//	GET  "/{author}/{repos}/info/refs?service=git-receive-pack"
+//	POST "/{author}/{repos}/git-receive-pack"
+//
+// The {repos} might have a ".git" suffix
+var gitPathPattern = regexp.MustCompile(`^/[^/]+/[^/]+/(info/refs|git-upload-pack|git-receive-pack)$`)
+
+func parseGitRequest(path string, query url.Values) (service gitService, refsDiscovery bool) {
+	matches := gitPathPattern.FindStringSubmatch(path)
+	if matches == nil {
+		return gitServiceNone, false
+	}
+	if matches[1] == "info/refs" {
+		return gitService(query.Get("service")), true
+	}
+	return gitService(matches[1]), false
+}
+
+type gitCloneLimiters struct {
+	perMinute *float64
+	perHour   *float64
+	cache     *expirelru.LRU[string, utils.RateLimiter]
+}
+
+func newGitCloneLimiters(perMinute, perHour *float64) *gitCloneLimiters {
+	if perMinute == nil && perHour == nil {
+		return nil
+	}
+	return &gitCloneLimiters{
+		perMinute: perMinute,
+		perHour:   perHour,
+		cache:     expirelru.NewLRU[string, utils.RateLimiter](10240, nil, 1*time.Hour),
+	}
+}
+
+func (l *gitCloneLimiters) Allow(clientIp string) bool {
+	key := utils.GetBucketForIpString(clientIp)
+	limiter, ok := l.cache.Get(key)
+	if !ok {
+		limiter = utils.CreateRequestRateLimiter(nil, l.perMinute, l.perHour)
+		l.cache.Add(key, limiter)
+	}
+	return limiter.Allow()
+}
+
+// checkGitRequest returns false if the request is rejected
+func (h *proxyHandler) checkGitRequest(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, targetUrl *url.URL) bool {
+	service, refsDiscovery := parseGitRequest(targetUrl.Path, r.URL.Query())
+	switch service {
+	case gitServiceNone:
+		return true
+	case gitServiceUploadPack:
+		// pass
+	case gitServiceReceivePack:
+		http.Error(w, "Git push is not supported", http.StatusForbidden)
+		return false
+	default:
+		http.Error(w, "Unknown git service", http.StatusForbidden)
+		return false
+	}
+
+	if refsDiscovery {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return false
+		}
+		if h.gitCloneLimiters != nil && !h.gitCloneLimiters.Allow(ctx.ClientAddr) {
+			common.WriteRejection(ctx, w, "Too many git clone requests", http.StatusTooManyRequests)
+			return false
+		}
+		log.Debugf("%sGit %s ref discovery, Git-Protocol %+q", ctx.LogPrefix, service, r.Header.Get("Git-Protocol"))
+	} else if r.Method != http.MethodPost {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
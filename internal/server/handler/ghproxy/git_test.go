@@ -0,0 +1,227 @@
+package ghproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/cgi"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseGitRequest(t *testing.T) {
+	tests := []struct {
+		name          string
+		path          string
+		query         string
+		service       gitService
+		refsDiscovery bool
+	}{
+		{"Upload pack discovery", "/foo/bar/info/refs", "service=git-upload-pack", gitServiceUploadPack, true},
+		{"Upload pack discovery .git", "/foo/bar.git/info/refs", "service=git-upload-pack", gitServiceUploadPack, true},
+		{"Upload pack", "/foo/bar/git-upload-pack", "", gitServiceUploadPack, false},
+		{"Receive pack discovery", "/foo/bar/info/refs", "service=git-receive-pack", gitServiceReceivePack, true},
+		{"Receive pack", "/foo/bar.git/git-receive-pack", "", gitServiceReceivePack, false},
+		{"Dumb discovery", "/foo/bar/info/refs", "", gitServiceNone, true},
+		{"Release", "/foo/bar/releases/download/v1/a.zip", "", gitServiceNone, false},
+		{"Nested", "/foo/bar/baz/git-upload-pack", "", gitServiceNone, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			require.NoError(t, err)
+			service, refsDiscovery := parseGitRequest(tt.path, query)
+			assert.Equal(t, tt.service, service)
+			assert.Equal(t, tt.refsDiscovery, refsDiscovery)
+		})
+	}
+}
+
+type gitTestEnv struct {
+	t            *testing.T
+	workDir      string
+	upstreamRepo string
+	proxyUrl     string
+
+	gitProtocolsMu sync.Mutex
+	gitProtocols   []string // Git-Protocol header values received by the upstream
+}
+
+func (e *gitTestEnv) git(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_NOSYSTEM=1",
+		"GIT_CONFIG_GLOBAL=/dev/null",
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME=pavonis", "GIT_AUTHOR_EMAIL=pavonis@example.com",
+		"GIT_COMMITTER_NAME=pavonis", "GIT_COMMITTER_EMAIL=pavonis@example.com",
+	)
+	output, err := cmd.CombinedOutput()
+	return strings.TrimSpace(string(output)), err
+}
+
+func (e *gitTestEnv) mustGit(dir string, args ...string) string {
+	output, err := e.git(dir, args...)
+	require.NoError(e.t, err, "git %v: %s", args, output)
+	return output
+}
+
+func (e *gitTestEnv) commitToUpstream(fileName, content string) {
+	tmpRepo := filepath.Join(e.workDir, "upstream-writer")
+	if _, err := os.Stat(tmpRepo); os.IsNotExist(err) {
+		e.mustGit(e.workDir, "clone", "-q", e.upstreamRepo, tmpRepo)
+	}
+	require.NoError(e.t, os.WriteFile(filepath.Join(tmpRepo, fileName), []byte(content), 0644))
+	e.mustGit(tmpRepo, "add", fileName)
+	e.mustGit(tmpRepo, "commit", "-q", "-m", "update "+fileName)
+	e.mustGit(tmpRepo, "push", "-q", "origin", "HEAD:main")
+}
+
+func newGitTestEnv(t *testing.T, settings *config.GithubDownloadProxySettings) *gitTestEnv {
+	gitPath, err := exec.LookPath("git")
+	if err != nil {
+		t.Skip("git not found")
+	}
+
+	env := &gitTestEnv{
+		t:       t,
+		workDir: t.TempDir(),
+	}
+	projectRoot := filepath.Join(env.workDir, "upstream")
+	env.upstreamRepo = filepath.Join(projectRoot, "foo", "bar")
+	require.NoError(t, os.MkdirAll(env.upstreamRepo, 0755))
+	env.mustGit(env.upstreamRepo, "init", "-q", "--bare", "-b", "main")
+	env.mustGit(env.upstreamRepo, "config", "uploadpack.allowFilter", "true")
+	env.mustGit(env.upstreamRepo, "config", "http.receivepack", "true") // make sure the rejection comes from pavonis
+	env.commitToUpstream("a.txt", "hello")
+	env.commitToUpstream("b.txt", "world")
+
+	// upstream: git http-backend, acts as github.com
+	backend := &cgi.Handler{
+		Path: gitPath,
+		Args: []string{"http-backend"},
+		Env:  []string{"GIT_PROJECT_ROOT=" + projectRoot, "GIT_HTTP_EXPORT_ALL=1"},
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "github.com" {
+			http.Error(w, "unexpected host "+r.Host, http.StatusBadGateway)
+			return
+		}
+		if gitProtocol := r.Header.Get("Git-Protocol"); gitProtocol != "" {
+			env.gitProtocolsMu.Lock()
+			env.gitProtocols = append(env.gitProtocols, gitProtocol)
+			env.gitProtocolsMu.Unlock()
+		}
+		backend.ServeHTTP(w, r)
+	})
+	env.proxyUrl = newTestProxy(t, settings, upstream) + "/https://github.com/foo/bar"
+	return env
+}
+
+func TestGitClone(t *testing.T) {
+	env := newGitTestEnv(t, &config.GithubDownloadProxySettings{})
+
+	for _, protocolVersion := range []string{"0", "1", "2"} {
+		t.Run("ProtocolV"+protocolVersion, func(t *testing.T) {
+			dir := filepath.Join(env.workDir, "clone-v"+protocolVersion)
+			env.mustGit(env.workDir, "-c", "protocol.version="+protocolVersion, "clone", "-q", env.proxyUrl, dir)
+			content, err := os.ReadFile(filepath.Join(dir, "b.txt"))
+			require.NoError(t, err)
+			assert.Equal(t, "world", string(content))
+		})
+	}
+
+	env.gitProtocolsMu.Lock()
+	defer env.gitProtocolsMu.Unlock()
+	assert.Contains(t, env.gitProtocols, "version=2")
+}
+
+func TestGitCloneWithGitSuffix(t *testing.T) {
+	env := newGitTestEnv(t, &config.GithubDownloadProxySettings{
+		ReposWhitelist: []string{"foo/bar"},
+	})
+	require.NoError(t, os.Symlink(env.upstreamRepo, env.upstreamRepo+".git"))
+
+	dir := filepath.Join(env.workDir, "clone")
+	env.mustGit(env.workDir, "clone", "-q", env.proxyUrl+".git", dir)
+	assert.FileExists(t, filepath.Join(dir, "a.txt"))
+}
+
+func TestGitShallowAndPartialClone(t *testing.T) {
+	env := newGitTestEnv(t, &config.GithubDownloadProxySettings{})
+
+	shallowDir := filepath.Join(env.workDir, "shallow")
+	env.mustGit(env.workDir, "clone", "-q", "--depth", "1", env.proxyUrl, shallowDir)
+	assert.Equal(t, "1", env.mustGit(shallowDir, "rev-list", "--count", "HEAD"))
+	assert.Equal(t, "true", env.mustGit(shallowDir, "rev-parse", "--is-shallow-repository"))
+
+	partialDir := filepath.Join(env.workDir, "partial")
+	env.mustGit(env.workDir, "clone", "-q", "--filter=blob:none", env.proxyUrl, partialDir)
+	assert.Equal(t, "blob:none", env.mustGit(partialDir, "config", "remote.origin.partialclonefilter"))
+	assert.Equal(t, "2", env.mustGit(partialDir, "rev-list", "--count", "HEAD"))
+}
+
+func TestGitFetchAndLsRemote(t *testing.T) {
+	env := newGitTestEnv(t, &config.GithubDownloadProxySettings{})
+
+	dir := filepath.Join(env.workDir, "clone")
+	env.mustGit(env.workDir, "clone", "-q", env.proxyUrl, dir)
+
+	env.commitToUpstream("c.txt", "new")
+	upstreamHead := env.mustGit(env.upstreamRepo, "rev-parse", "main")
+
+	lsRemote := env.mustGit(env.workDir, "ls-remote", env.proxyUrl, "refs/heads/main")
+	assert.Equal(t, upstreamHead+"\trefs/heads/main", lsRemote)
+
+	env.mustGit(dir, "fetch", "-q", "origin")
+	assert.Equal(t, upstreamHead, env.mustGit(dir, "rev-parse", "origin/main"))
+}
+
+func TestGitPushRejected(t *testing.T) {
+	env := newGitTestEnv(t, &config.GithubDownloadProxySettings{})
+
+	dir := filepath.Join(env.workDir, "clone")
+	env.mustGit(env.workDir, "clone", "-q", env.proxyUrl, dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "d.txt"), []byte("push"), 0644))
+	env.mustGit(dir, "add", "d.txt")
+	env.mustGit(dir, "commit", "-q", "-m", "push")
+
+	upstreamHead := env.mustGit(env.upstreamRepo, "rev-parse", "main")
+	output, err := env.git(dir, "push", "origin", "HEAD:main")
+	assert.Error(t, err, output)
+	assert.Contains(t, output, "403")
+	assert.Equal(t, upstreamHead, env.mustGit(env.upstreamRepo, "rev-parse", "main"))
+
+	resp, err := http.Post(env.proxyUrl+"/git-receive-pack", "application/x-git-receive-pack-request", strings.NewReader(""))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+}
+
+func TestGitCloneRateLimit(t *testing.T) {
+	env := newGitTestEnv(t, &config.GithubDownloadProxySettings{
+		GitClonePerHour: utils.ToPtr(2.0),
+	})
+
+	for i := 0; i < 2; i++ {
+		env.mustGit(env.workDir, "ls-remote", env.proxyUrl)
+	}
+	output, err := env.git(env.workDir, "ls-remote", env.proxyUrl)
+	assert.Error(t, err, output)
+	assert.Contains(t, output, "429")
+
+	// non-git downloads are not affected
+	resp, err := http.Get(env.proxyUrl + "/info/refs")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.NotEqual(t, http.StatusTooManyRequests, resp.StatusCode)
+}
@@ -1,11 +1,14 @@
 package ghproxy
 
 import (
+	gocontext "context"
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/config"
 	"github.com/Fallen-Breath/pavonis/internal/server/common"
 	"github.com/Fallen-Breath/pavonis/internal/server/context"
 	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"github.com/Fallen-Breath/pavonis/internal/utils/diskcache"
+	lru "github.com/hashicorp/golang-lru/v2"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"net/url"
@@ -19,17 +22,53 @@ type proxyHandler struct {
 
 	whitelist *reposList
 	blacklist *reposList
+	cache     *diskcache.Cache // might be nil
+
+	resolvedAssets *lru.Cache[string, *resolvedAsset] // cacheKeyOf the requested url -> resolved asset
+
+	cacheCtx    gocontext.Context
+	cacheCancel gocontext.CancelFunc
+
+	gitCloneLimiters *gitCloneLimiters // might be nil
+
+	hosts               map[string]hostDefinition
+	rewriteContentTypes map[string]bool // lower-cased media types
 }
 
 var _ handler.HttpHandler = &proxyHandler{}
 
 func NewGithubProxyHandler(info *handler.Info, helper *common.RequestHelper, settings *config.GithubDownloadProxySettings) (handler.HttpHandler, error) {
+	hosts, err := buildHostDefinitions(settings.Hosts, settings.RawTextUrlRewriteHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to init hosts: %v", err)
+	}
+
+	var cache *diskcache.Cache
+	if settings.Cache.Enabled {
+		if cache, err = diskcache.NewCache(settings.Cache.Directory, settings.Cache.MaxTotalSize); err != nil {
+			return nil, fmt.Errorf("failed to init cache: %v", err)
+		}
+	}
+	resolvedAssets, _ := lru.New[string, *resolvedAsset](10240)
+	cacheCtx, cacheCancel := gocontext.WithCancel(gocontext.Background())
+
 	return &proxyHandler{
 		info:      info,
 		helper:    helper,
 		settings:  settings,
 		whitelist: newReposList(settings.ReposWhitelist),
 		blacklist: newReposList(settings.ReposBlacklist),
+		cache:     cache,
+
+		resolvedAssets: resolvedAssets,
+
+		cacheCtx:    cacheCtx,
+		cacheCancel: cacheCancel,
+
+		gitCloneLimiters: newGitCloneLimiters(settings.GitClonePerMinute, settings.GitClonePerHour),
+
+		hosts:               hosts,
+		rewriteContentTypes: toLowerStringSet(settings.RawTextUrlRewriteContentTypes),
 	}, nil
 }
 
@@ -38,6 +77,7 @@ func (h *proxyHandler) Info() *handler.Info {
 }
 
 func (h *proxyHandler) Shutdown() {
+	h.cacheCancel()
 }
 
 func (h *proxyHandler) parseTargetUrl(w http.ResponseWriter, reqPath string) (*url.URL, bool) {
@@ -74,21 +114,28 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 		return
 	}
 
-	hd, ok := allowedHosts[targetUrl.Host]
+	hd, ok := h.getHost(targetUrl.Host)
 	if !ok {
 		http.Error(w, "Forbidden host", http.StatusNotFound)
 		return
 	}
+	if hd.ReadOnly && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if targetUrl.Host == "github.com" && !h.checkGitRequest(ctx, w, r, targetUrl) {
+		return
+	}
 
 	// whitelist && blacklist check
-	if len(*h.whitelist) > 0 || len(*h.blacklist) > 0 {
+	if hd.Strict || len(*h.whitelist) > 0 || len(*h.blacklist) > 0 {
 		author, repos, ok := hd.Parse(targetUrl)
 		if !ok {
 			http.Error(w, "Forbidden url", http.StatusNotFound)
 			return
 		}
 		log.Debugf("%sExtracted author + repos from reqPath %+q: %+q / %+q", ctx.LogPrefix, reqPath, author, repos)
-		if !h.checkAndApplyWhitelists(w, author, repos) {
+		if !h.checkAndApplyWhitelists(ctx, w, author, repos) {
 			return
 		}
 	}
@@ -96,49 +143,100 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 	targetUrl.User = r.URL.User
 	targetUrl.RawQuery = r.URL.RawQuery
 	targetUrl.RawFragment = r.URL.RawFragment
+	if h.cache != nil && isCacheableRequest(r, targetUrl) && h.serveCachedAsset(ctx, w, r, targetUrl) {
+		return
+	}
+	if targetUrl.Host == githubApiHost {
+		h.prepareApiRequest(r)
+	}
 
 	responseModifier := func(lastReq *http.Request, resp *http.Response) error {
-		if h.settings.SizeLimit > 0 {
-			if resp.ContentLength > h.settings.SizeLimit {
-				return common.NewHttpError(http.StatusBadGateway, "Response ContentLength too large")
-			}
-			if isChunkedEncoding(resp.TransferEncoding) {
-				resp.Body = NewTrafficSizeLimitedReadCloser(resp.Body, h.settings.SizeLimit)
-			}
+		if err := h.limitResponseSize(resp); err != nil {
+			return err
 		}
-		if h.settings.RawTextUrlRewrite {
-			reqHost := lastReq.URL.Host
-			if _, exists := rawTextUrlRewriteHosts[reqHost]; exists {
-				contentType := resp.Header.Get("Content-Type")
-				if isUtf8TextType(contentType) {
-					src := fmt.Sprintf("https://%s/", reqHost)
-					dst := fmt.Sprintf("%s/https://%s/", h.info.SelfUrl, reqHost)
-					searchFunc := createHttpsUrlPrefixSearchFunc(src, dst)
-					log.Debugf("%sRewriting url inside the raw text content, src %+q, dst %+q", ctx.LogPrefix, src, dst)
-					if err := common.ModifyResponseBodyAdvanced(ctx, resp, searchFunc, len(src)+1, 1); err != nil {
-						return err
-					}
-				}
+		if lastReq.URL.Host == githubApiHost {
+			if err := h.rewriteApiResponse(ctx, resp); err != nil {
+				return err
 			}
 		}
-		return nil
+		return h.rewriteTextUrls(ctx, lastReq.URL.Host, resp)
 	}
 
 	h.helper.RunReverseProxy(ctx, w, r, targetUrl, common.WithResponseModifier(responseModifier))
 }
 
-func (h *proxyHandler) checkAndApplyWhitelists(w http.ResponseWriter, author string, repos string) bool {
+func (h *proxyHandler) limitResponseSize(resp *http.Response) error {
+	if h.settings.SizeLimit > 0 {
+		if resp.ContentLength > h.settings.SizeLimit {
+			return common.NewHttpError(http.StatusBadGateway, "Response ContentLength too large")
+		}
+		if isChunkedEncoding(resp.TransferEncoding) {
+			resp.Body = NewTrafficSizeLimitedReadCloser(resp.Body, h.settings.SizeLimit)
+		}
+	}
+	return nil
+}
+
+// isTextUrlRewritable checks if the urls inside the response from the given host should be rewritten
+func (h *proxyHandler) isTextUrlRewritable(host string, resp *http.Response) bool {
+	hd, ok := h.getHost(host)
+	return h.settings.RawTextUrlRewrite && ok && hd.RawTextUrlRewrite && isRewritableTextType(resp.Header.Get("Content-Type"), h.rewriteContentTypes)
+}
+
+// rewriteTextUrls rewrites the urls of the proxyable hosts inside the response from the given host, if rewritable
+func (h *proxyHandler) rewriteTextUrls(ctx *context.RequestContext, host string, resp *http.Response) error {
+	if !h.isTextUrlRewritable(host, resp) {
+		return nil
+	}
+	rewrites := h.getTextUrlRewrites()
+	log.Debugf("%sRewriting urls of %d hosts inside the raw text content, content type %+q", ctx.LogPrefix, len(rewrites), resp.Header.Get("Content-Type"))
+	return common.ModifyResponseBodyAdvanced(ctx, resp, createHttpsUrlPrefixesSearchFunc(rewrites), maxSearchLenOfRewrites(rewrites), 1)
+}
+
+func (h *proxyHandler) checkAndApplyWhitelists(ctx *context.RequestContext, w http.ResponseWriter, author string, repos string) bool {
 	if len(*h.whitelist) > 0 && !h.whitelist.Check(author, repos) {
-		http.Error(w, fmt.Sprintf("Repository %s/%s is not whitelisted", author, repos), http.StatusForbidden)
+		common.WriteRejection(ctx, w, fmt.Sprintf("Repository %s/%s is not whitelisted", author, repos), http.StatusForbidden)
 		return false
 	}
 	if len(*h.blacklist) > 0 && h.blacklist.Check(author, repos) {
-		http.Error(w, fmt.Sprintf("Repository %s/%s is blacklisted", author, repos), http.StatusForbidden)
+		common.WriteRejection(ctx, w, fmt.Sprintf("Repository %s/%s is blacklisted", author, repos), http.StatusForbidden)
 		return false
 	}
 	return true
 }
 
+// getHost returns the definition of the given host, if the host is allowed to be proxied
+func (h *proxyHandler) getHost(host string) (hostDefinition, bool) {
+	if host == githubApiHost && !h.settings.Api.Enabled {
+		return hostDefinition{}, false
+	}
+	hd, ok := h.hosts[strings.ToLower(host)]
+	return hd, ok
+}
+
+// getTextUrlRewrites returns the url prefix rewrites for all proxyable hosts
+func (h *proxyHandler) getTextUrlRewrites() []urlPrefixRewrite {
+	var rewrites []urlPrefixRewrite
+	for host := range h.hosts {
+		if _, ok := h.getHost(host); !ok {
+			continue
+		}
+		rewrites = append(rewrites, urlPrefixRewrite{
+			Src: fmt.Sprintf("https://%s/", host),
+			Dst: fmt.Sprintf("%s%s/https://%s/", h.info.SelfUrl, h.info.PathPrefix, host),
+		})
+	}
+	return rewrites
+}
+
+func toLowerStringSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[strings.ToLower(value)] = true
+	}
+	return set
+}
+
 func isChunkedEncoding(te []string) bool {
 	// golang stdlib, net/http transfer.go:603
 	return len(te) > 0 && strings.ToLower(te[0]) == "chunked"
@@ -1,18 +1,47 @@
 package ghproxy
 
 import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
 	"net/url"
 	"regexp"
+	"strings"
 )
 
 type hostDefinition struct {
-	Parse func(url *url.URL) (author, repos string, ok bool)
+	Parse             func(url *url.URL) (author, repos string, ok bool)
+	Strict            bool // if true, only urls that can be parsed by Parse are allowed
+	ReadOnly          bool // if true, only GET and HEAD are allowed
+	RawTextUrlRewrite bool // if true, text contents from this host can be rewritten. notes: remember to check req.Host after following-redirect
 }
 
 var githubMainPathPattern = regexp.MustCompile("^/([^/]+)/([^/]+)/((releases|archive|blob|raw|info)/|git-upload-pack$)")
 var githubRawPathPattern = regexp.MustCompile("^/([^/]+)/([^/]+)/[^/]+/") // author, repos, branch
 var gistPathPattern = regexp.MustCompile("^/([^/]+)/[^/]+/")              // author, hash
 
+// A read-only subset of the GitHub REST API, see https://docs.github.com/en/rest/releases and https://docs.github.com/en/rest/repos/contents
+//
+//	"/repos/{owner}/{repo}/releases", "/repos/{owner}/{repo}/releases/latest", "/repos/{owner}/{repo}/releases/tags/{tag}"
+//	"/repos/{owner}/{repo}/releases/assets/{asset_id}"
+//	"/repos/{owner}/{repo}/tags"
+//	"/repos/{owner}/{repo}/contents/{path}"
+var githubApiPathPattern = regexp.MustCompile("^/repos/([^/]+)/([^/]+)/(releases(/.*)?|tags|contents(/.*)?)$")
+
+// GitLab projects might be inside nested groups, e.g. "/group/subgroup/project/-/raw/main/a.sh",
+// where the author is "group" and the repos is "subgroup/project"
+//
+//	"/{owner}/{repo}/-/raw/{ref}/{path}", "/{owner}/{repo}/-/archive/{ref}/{file}"
+//	"/{owner}/{repo}/-/releases/{tag}/downloads/{file}", "/{owner}/{repo}/uploads/{hash}/{file}"
+var gitlabPathPattern = regexp.MustCompile("^/([^/]+)/((?:[^/]+/)*?[^/]+)/(-/(raw|blob|archive|releases|jobs|package_files)|uploads)/")
+
+// "/{owner}/{repo}/releases/download/{tag}/{file}", "/{owner}/{repo}/archive/{file}", "/{owner}/{repo}/raw/branch/{branch}/{path}"
+var giteaPathPattern = regexp.MustCompile("^/([^/]+)/([^/]+)/(releases/download|archive|raw|media)/")
+
+// "/{owner}/{repo}/downloads/{file}", "/{owner}/{repo}/raw/{ref}/{path}", "/{owner}/{repo}/get/{file}"
+var bitbucketPathPattern = regexp.MustCompile("^/([^/]+)/([^/]+)/(downloads|raw|get)/")
+
+const githubApiHost = "api.github.com"
+
 func hostDefinition1(pattern *regexp.Regexp) hostDefinition {
 	return hostDefinition{
 		Parse: func(url *url.URL) (author, repos string, ok bool) {
@@ -32,20 +61,132 @@ func hostDefinition2(pattern *regexp.Regexp) hostDefinition {
 			if matches == nil {
 				return "", "", false
 			}
-			return matches[1], matches[2], true
+			// git clone urls might have a ".git" suffix, e.g. "https://github.com/foo/bar.git"
+			return matches[1], strings.TrimSuffix(matches[2], ".git"), true
 		},
 	}
 }
 
-var allowedHosts = map[string]hostDefinition{
-	"github.com":                 hostDefinition2(githubMainPathPattern),
-	"raw.githubusercontent.com":  hostDefinition2(githubRawPathPattern),
-	"gist.github.com":            hostDefinition1(gistPathPattern),
-	"gist.githubusercontent.com": hostDefinition1(gistPathPattern),
+// hostDefinitionOfPatterns uses the first matched pattern for parsing
+// For each pattern, the group 1 is the author, and the optional group 2 is the repos
+func hostDefinitionOfPatterns(patterns []*regexp.Regexp) hostDefinition {
+	parsers := make([]hostDefinition, 0, len(patterns))
+	for _, pattern := range patterns {
+		if pattern.NumSubexp() >= 2 {
+			parsers = append(parsers, hostDefinition2(pattern))
+		} else {
+			parsers = append(parsers, hostDefinition1(pattern))
+		}
+	}
+	return hostDefinition{
+		Parse: func(url *url.URL) (author, repos string, ok bool) {
+			for _, parser := range parsers {
+				if author, repos, ok = parser.Parse(url); ok {
+					return
+				}
+			}
+			return "", "", false
+		},
+	}
+}
+
+func withFlags(hd hostDefinition, strict bool, rawTextUrlRewrite bool) hostDefinition {
+	hd.Strict = strict
+	hd.RawTextUrlRewrite = rawTextUrlRewrite
+	return hd
+}
+
+func githubApiHostDefinition() hostDefinition {
+	hd := hostDefinition2(githubApiPathPattern)
+	hd.Strict = true
+	hd.ReadOnly = true
+	return hd
 }
 
-// notes: remember to check req.Host after following-redirect
-var rawTextUrlRewriteHosts = map[string]bool{
-	"raw.githubusercontent.com":  true,
-	"gist.githubusercontent.com": true,
+func presetHostDefinitions(preset config.GithubProxyHostPreset, host string) (map[string]hostDefinition, error) {
+	orDefault := func(defaultHost string) string {
+		if host != "" {
+			return host
+		}
+		return defaultHost
+	}
+
+	switch preset {
+	case config.GithubProxyHostPresetGithub:
+		return map[string]hostDefinition{
+			"github.com":                 hostDefinition2(githubMainPathPattern),
+			"raw.githubusercontent.com":  withFlags(hostDefinition2(githubRawPathPattern), false, true),
+			"gist.github.com":            withFlags(hostDefinition1(gistPathPattern), false, true),
+			"gist.githubusercontent.com": withFlags(hostDefinition1(gistPathPattern), false, true),
+			githubApiHost:                githubApiHostDefinition(),
+		}, nil
+	case config.GithubProxyHostPresetGitlab:
+		return map[string]hostDefinition{
+			orDefault("gitlab.com"): withFlags(hostDefinition2(gitlabPathPattern), true, true),
+		}, nil
+	case config.GithubProxyHostPresetGitea:
+		return map[string]hostDefinition{
+			host: withFlags(hostDefinition2(giteaPathPattern), true, true),
+		}, nil
+	case config.GithubProxyHostPresetCodeberg:
+		return map[string]hostDefinition{
+			orDefault("codeberg.org"): withFlags(hostDefinition2(giteaPathPattern), true, true),
+		}, nil
+	case config.GithubProxyHostPresetBitbucket:
+		return map[string]hostDefinition{
+			orDefault("bitbucket.org"): withFlags(hostDefinition2(bitbucketPathPattern), true, true),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown host preset %+q", preset)
+	}
+}
+
+// buildHostDefinitions creates the host -> definition mapping from the config. Custom hosts are always strict
+// If rewriteHosts is not empty, only these hosts have RawTextUrlRewrite enabled, for both the preset and the custom hosts
+func buildHostDefinitions(hostCfgs []*config.GithubProxyHostConfig, rewriteHosts []string) (map[string]hostDefinition, error) {
+	hosts := make(map[string]hostDefinition)
+	for _, hostCfg := range hostCfgs {
+		var definitions map[string]hostDefinition
+		if hostCfg.Preset != nil {
+			var err error
+			if definitions, err = presetHostDefinitions(*hostCfg.Preset, strings.ToLower(hostCfg.Host)); err != nil {
+				return nil, err
+			}
+		} else {
+			var patterns []*regexp.Regexp
+			for _, patternStr := range hostCfg.PathPatterns {
+				pattern, err := regexp.Compile(patternStr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid path pattern %+q: %v", patternStr, err)
+				}
+				patterns = append(patterns, pattern)
+			}
+			definitions = map[string]hostDefinition{
+				strings.ToLower(hostCfg.Host): withFlags(hostDefinitionOfPatterns(patterns), true, hostCfg.RawTextUrlRewrite),
+			}
+		}
+
+		for host, hd := range definitions {
+			if _, exists := hosts[host]; exists {
+				return nil, fmt.Errorf("duplicated host %+q", host)
+			}
+			hosts[host] = hd
+		}
+	}
+
+	if len(rewriteHosts) > 0 {
+		rewriteHostSet := make(map[string]bool)
+		for _, host := range rewriteHosts {
+			host = strings.ToLower(host)
+			if _, exists := hosts[host]; !exists {
+				return nil, fmt.Errorf("raw text url rewrite host %+q is not a proxied host", host)
+			}
+			rewriteHostSet[host] = true
+		}
+		for host, hd := range hosts {
+			hd.RawTextUrlRewrite = rewriteHostSet[host]
+			hosts[host] = hd
+		}
+	}
+	return hosts, nil
 }
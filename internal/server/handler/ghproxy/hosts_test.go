@@ -0,0 +1,122 @@
+package ghproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestHostDefinitionParse(t *testing.T) {
+	hosts, err := buildHostDefinitions([]*config.GithubProxyHostConfig{
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetGithub)},
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetGitlab)},
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetGitea), Host: "Gitea.Example.com"},
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetCodeberg)},
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetBitbucket)},
+		{Host: "dl.example.com", PathPatterns: []string{"^/files/([^/]+)/([^/]+)/", "^/users/([^/]+)/"}},
+	}, nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		url    string
+		ok     bool
+		author string
+		repos  string
+	}{
+		{"https://github.com/foo/bar/releases/download/v1/a.zip", true, "foo", "bar"},
+		{"https://raw.githubusercontent.com/foo/bar/main/a.sh", true, "foo", "bar"},
+		{"https://gitlab.com/foo/bar/-/raw/main/a.sh", true, "foo", "bar"},
+		{"https://gitlab.com/foo/sub/bar/-/releases/v1/downloads/a.zip", true, "foo", "sub/bar"},
+		{"https://gitlab.com/foo/bar/uploads/0123abcd/a.zip", true, "foo", "bar"},
+		{"https://gitlab.com/foo/bar/-/issues/1", false, "", ""},
+		{"https://gitea.example.com/foo/bar/releases/download/v1/a.zip", true, "foo", "bar"},
+		{"https://codeberg.org/foo/bar/raw/branch/main/a.sh", true, "foo", "bar"},
+		{"https://codeberg.org/foo/bar/issues", false, "", ""},
+		{"https://bitbucket.org/foo/bar/downloads/a.zip", true, "foo", "bar"},
+		{"https://bitbucket.org/foo/bar/pull-requests/1", false, "", ""},
+		{"https://dl.example.com/files/foo/bar/a.zip", true, "foo", "bar"},
+		{"https://dl.example.com/users/foo/a.zip", true, "foo", ""},
+		{"https://dl.example.com/other/a.zip", false, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			u := utils.MustParseUrl(tt.url)
+			hd, exists := hosts[u.Host]
+			require.True(t, exists)
+			author, repos, ok := hd.Parse(u)
+			assert.Equal(t, tt.ok, ok)
+			assert.Equal(t, tt.author, author)
+			assert.Equal(t, tt.repos, repos)
+		})
+	}
+
+	assert.False(t, hosts["github.com"].Strict)
+	assert.True(t, hosts["raw.githubusercontent.com"].RawTextUrlRewrite)
+	assert.False(t, hosts["github.com"].RawTextUrlRewrite)
+	assert.True(t, hosts["gitlab.com"].Strict)
+	assert.False(t, hosts["dl.example.com"].RawTextUrlRewrite)
+}
+
+func TestBuildHostDefinitionsDuplicated(t *testing.T) {
+	_, err := buildHostDefinitions([]*config.GithubProxyHostConfig{
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetCodeberg)},
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetGitea), Host: "codeberg.org"},
+	}, nil)
+	assert.Error(t, err)
+}
+
+func TestBuildHostDefinitionsRewriteHosts(t *testing.T) {
+	hosts, err := buildHostDefinitions([]*config.GithubProxyHostConfig{
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetGithub)},
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetCodeberg)},
+		{Host: "dl.example.com", PathPatterns: []string{"^/files/([^/]+)/([^/]+)/"}},
+	}, []string{"raw.githubusercontent.com", "DL.example.com"})
+	require.NoError(t, err)
+	assert.True(t, hosts["raw.githubusercontent.com"].RawTextUrlRewrite)
+	assert.True(t, hosts["dl.example.com"].RawTextUrlRewrite)
+	assert.False(t, hosts["gist.github.com"].RawTextUrlRewrite)
+	assert.False(t, hosts["codeberg.org"].RawTextUrlRewrite)
+
+	_, err = buildHostDefinitions([]*config.GithubProxyHostConfig{
+		{Preset: utils.ToPtr(config.GithubProxyHostPresetGithub)},
+	}, []string{"gitlab.com"})
+	assert.Error(t, err)
+}
+
+func TestMultiHostProxy(t *testing.T) {
+	proxyUrl := newTestProxy(t, &config.GithubDownloadProxySettings{
+		RawTextUrlRewrite: true,
+		ReposBlacklist:    []string{"evil/*"},
+		Hosts: []*config.GithubProxyHostConfig{
+			{Preset: utils.ToPtr(config.GithubProxyHostPresetGitlab)},
+			{Preset: utils.ToPtr(config.GithubProxyHostPresetCodeberg)},
+		},
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("curl https://codeberg.org/foo/bar/releases/download/v1/a.zip https://github.com/foo/bar"))
+	}))
+
+	get := func(path string) (int, string) {
+		resp, err := http.Get(proxyUrl + path)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := get("/https://gitlab.com/foo/bar/-/raw/main/a.sh")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "curl "+proxyUrl+"/https://codeberg.org/foo/bar/releases/download/v1/a.zip https://github.com/foo/bar", body)
+
+	status, _ = get("/https://codeberg.org/evil/bar/releases/download/v1/a.zip")
+	assert.Equal(t, http.StatusForbidden, status)
+	status, _ = get("/https://gitlab.com/foo/bar/-/issues")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = get("/https://github.com/foo/bar/releases/download/v1/a.zip") // github preset not enabled
+	assert.Equal(t, http.StatusNotFound, status)
+}
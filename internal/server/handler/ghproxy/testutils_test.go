@@ -0,0 +1,17 @@
+package ghproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestProxy starts a gh proxy server, whose downstream requests to all hosts are sent to the given upstream handler
+// The upstream handler can check r.Host for the original host. Returns the url of the proxy server
+func newTestProxy(t *testing.T, settings *config.GithubDownloadProxySettings, upstreamHandler http.Handler) string {
+	upstream := httptest.NewServer(upstreamHandler)
+	t.Cleanup(upstream.Close)
+	return commontest.NewProxy(t, nil, config.SiteModeGithubDownloadProxy, settings, NewGithubProxyHandler, commontest.NewUpstreamTransport(upstream.URL))
+}
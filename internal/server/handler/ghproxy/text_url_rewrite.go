@@ -2,13 +2,17 @@ package ghproxy
 
 import (
 	"bytes"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
 	"github.com/Fallen-Breath/pavonis/internal/utils/ioutils"
 	"mime"
 	"strings"
 )
 
+// isRewritableTextType checks if the content type is one of the given media types, with a utf-8 compatible charset
+// A missing charset is treated as utf-8, e.g. "application/x-sh" or "application/json"
+//
 // https://developer.mozilla.org/en-US/docs/Web/HTTP/Reference/Headers/Content-Type
-func isUtf8TextType(contentType string) bool {
+func isRewritableTextType(contentType string, mediaTypes map[string]bool) bool {
 	if contentType == "" {
 		return false
 	}
@@ -18,17 +22,17 @@ func isUtf8TextType(contentType string) bool {
 		return false
 	}
 
-	if strings.ToLower(mediaType) != "text/plain" {
+	if !mediaTypes[strings.ToLower(mediaType)] {
 		return false
 	}
 
 	charset, ok := params["charset"]
 	if !ok {
-		return false
+		return true
 	}
 
 	switch strings.ToLower(charset) {
-	case "utf-8", "utf8", "utf_8":
+	case "utf-8", "utf8", "utf_8", "us-ascii":
 		return true
 	default:
 		return false
@@ -48,20 +52,46 @@ func isBadPrevCharForRewrite(b byte) bool {
 		b == '}'
 }
 
+type urlPrefixRewrite struct {
+	Src string
+	Dst string
+}
+
 func createHttpsUrlPrefixSearchFunc(src, dst string) ioutils.SearchFunc {
-	srcBuf := []byte(src)
-	dstBuf := []byte(dst)
-	return func(buf []byte, lookBehindBuf []byte, eof bool) (int, int, []byte) {
+	return createHttpsUrlPrefixesSearchFunc([]urlPrefixRewrite{{Src: src, Dst: dst}})
+}
+
+// maxSearchLenOfRewrites returns the maxSearchLen to be used with the search func, including the look-behind char
+func maxSearchLenOfRewrites(rewrites []urlPrefixRewrite) int {
+	maxLen := 0
+	for _, rewrite := range rewrites {
+		maxLen = utils.Max(maxLen, len(rewrite.Src))
+	}
+	return maxLen + 1
+}
+
+func createHttpsUrlPrefixesSearchFunc(rewrites []urlPrefixRewrite) ioutils.SearchFunc {
+	type rewriteBuf struct {
+		src []byte
+		dst []byte
+	}
+	rewriteBufs := make([]rewriteBuf, 0, len(rewrites))
+	for _, rewrite := range rewrites {
+		rewriteBufs = append(rewriteBufs, rewriteBuf{[]byte(rewrite.Src), []byte(rewrite.Dst)})
+	}
+
+	// returns the index of the first acceptable occurrence of src in buf
+	findFirst := func(buf []byte, lookBehindBuf []byte, src []byte) int {
 		start := 0
 		for {
-			idx := bytes.Index(buf[start:], srcBuf)
+			idx := bytes.Index(buf[start:], src)
 			if idx == -1 {
-				return -1, 0, nil
+				return -1
 			}
 			idx = idx + start // absolute index
 
 			if idx == 0 && len(lookBehindBuf) == 0 { // start of the reader
-				return 0, len(srcBuf), dstBuf
+				return 0
 			}
 
 			// look-behind the previous 1 char
@@ -74,11 +104,31 @@ func createHttpsUrlPrefixSearchFunc(src, dst string) ioutils.SearchFunc {
 
 			if !isBadPrevCharForRewrite(prevChar) {
 				// if it's not a bad char, accept this
-				replacement := []byte{prevChar}
-				replacement = append(replacement, dstBuf...)
-				return idx - 1, len(srcBuf) + 1, replacement
+				return idx
+			}
+			start = idx + len(src)
+		}
+	}
+
+	return func(buf []byte, lookBehindBuf []byte, eof bool) (int, int, []byte) {
+		bestIdx := -1
+		var best *rewriteBuf
+		for i := range rewriteBufs {
+			rb := &rewriteBufs[i]
+			if idx := findFirst(buf, lookBehindBuf, rb.src); idx != -1 && (bestIdx == -1 || idx < bestIdx) {
+				bestIdx, best = idx, rb
 			}
-			start = idx + len(srcBuf)
 		}
+		if best == nil {
+			return -1, 0, nil
+		}
+
+		if bestIdx == 0 {
+			return 0, len(best.src), best.dst
+		}
+		// keep the previous char in the replacement
+		replacement := []byte{buf[bestIdx-1]}
+		replacement = append(replacement, best.dst...)
+		return bestIdx - 1, len(best.src) + 1, replacement
 	}
 }
@@ -2,10 +2,12 @@ package ghproxy
 
 import (
 	"bytes"
+	"github.com/Fallen-Breath/pavonis/internal/config"
 	"github.com/Fallen-Breath/pavonis/internal/utils/ioutils"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
+	"net/http"
 	"testing"
 )
 
@@ -84,3 +86,112 @@ func TestHttpsUrlPrefixSearchFunc(t *testing.T) {
 		})
 	}
 }
+
+func TestHttpsUrlPrefixesSearchFunc(t *testing.T) {
+	rewrites := []urlPrefixRewrite{
+		{Src: "https://github.com/", Dst: "https://p.com/https://github.com/"},
+		{Src: "https://raw.githubusercontent.com/", Dst: "https://p.com/https://raw.githubusercontent.com/"},
+	}
+	tt := []struct {
+		name     string
+		data     string
+		expected string
+	}{
+		{
+			name:     "Shell",
+			data:     "curl -L https://raw.githubusercontent.com/a/b/main/x.sh | sh\nwget \"https://github.com/a/b/releases/download/v1/x.zip\"",
+			expected: "curl -L https://p.com/https://raw.githubusercontent.com/a/b/main/x.sh | sh\nwget \"https://p.com/https://github.com/a/b/releases/download/v1/x.zip\"",
+		},
+		{
+			name:     "Json",
+			data:     `{"a":"https://github.com/a/b","b":"https://raw.githubusercontent.com/a/b/c"}`,
+			expected: `{"a":"https://p.com/https://github.com/a/b","b":"https://p.com/https://raw.githubusercontent.com/a/b/c"}`,
+		},
+		{
+			name:     "Html",
+			data:     `<a href="https://github.com/a/b">https://github.com/a/b</a>`,
+			expected: `<a href="https://p.com/https://github.com/a/b">https://p.com/https://github.com/a/b</a>`,
+		},
+		{
+			name:     "BadPrevChar",
+			data:     "https://x.com/https://github.com/a ${P}https://raw.githubusercontent.com/a git+https://github.com/a",
+			expected: "https://x.com/https://github.com/a ${P}https://raw.githubusercontent.com/a git+https://github.com/a",
+		},
+		{
+			name:     "OtherHost",
+			data:     "https://github.com.evil.com/a https://example.com/",
+			expected: "https://github.com.evil.com/a https://example.com/",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			searchFunc := createHttpsUrlPrefixesSearchFunc(rewrites)
+			maxSearchLen := maxSearchLenOfRewrites(rewrites)
+			for readBufSize := 1; readBufSize < len(tc.data)+2; readBufSize++ {
+				dataReader := io.NopCloser(bytes.NewReader([]byte(tc.data)))
+
+				reader := ioutils.NewReplacingReaderWithBufSize(dataReader, searchFunc, readBufSize, maxSearchLen, 1)
+				newDataBuf, err := io.ReadAll(reader)
+				require.NoError(t, err)
+
+				assert.Equal(t, tc.expected, string(newDataBuf), "readBufSize=%d", readBufSize)
+			}
+		})
+	}
+}
+
+func TestIsRewritableTextType(t *testing.T) {
+	mediaTypes := map[string]bool{"text/plain": true, "application/json": true}
+	tt := []struct {
+		contentType string
+		expected    bool
+	}{
+		{"text/plain", true},
+		{"text/plain; charset=utf-8", true},
+		{"Text/Plain; charset=UTF-8", true},
+		{"application/json", true},
+		{"text/plain; charset=us-ascii", true},
+		{"text/plain; charset=iso-8859-1", false},
+		{"text/html", false},
+		{"application/octet-stream", false},
+		{"", false},
+		{";;", false},
+	}
+
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, isRewritableTextType(tc.contentType, mediaTypes), tc.contentType)
+	}
+}
+
+func TestRawTextUrlRewrite(t *testing.T) {
+	const script = "curl -L https://github.com/foo/bar/releases/download/v1/x.zip\ncurl https://gist.githubusercontent.com/foo/abc/raw/y.sh"
+	proxyUrl := newTestProxy(t, &config.GithubDownloadProxySettings{
+		RawTextUrlRewrite: true,
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/foo/bar/main/install.sh":
+			w.Header().Set("Content-Type", "text/x-shellscript")
+		case "/foo/bar/main/install.bin":
+			w.Header().Set("Content-Type", "application/octet-stream")
+		}
+		_, _ = w.Write([]byte(script))
+	}))
+
+	get := func(path string) string {
+		resp, err := http.Get(proxyUrl + path)
+		require.NoError(t, err)
+		defer func() { _ = resp.Body.Close() }()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		require.Equal(t, http.StatusOK, resp.StatusCode, string(body))
+		return string(body)
+	}
+
+	assert.Equal(t,
+		"curl -L "+proxyUrl+"/https://github.com/foo/bar/releases/download/v1/x.zip\ncurl "+proxyUrl+"/https://gist.githubusercontent.com/foo/abc/raw/y.sh",
+		get("/https://raw.githubusercontent.com/foo/bar/main/install.sh"),
+	)
+	assert.Equal(t, script, get("/https://raw.githubusercontent.com/foo/bar/main/install.bin"))
+	assert.Equal(t, script, get("/https://github.com/foo/bar/raw/main/install.sh")) // host not in the rewrite list
+}
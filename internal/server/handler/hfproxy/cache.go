@@ -0,0 +1,153 @@
+package hfproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+)
+
+// Files resolved with a commit hash are immutable
+//
+//	"/HuggingFaceH4/zephyr-7b-beta/resolve/892b3d7a7b1cf10c7a701c60881cd93df615734c/model.safetensors"
+//	"/datasets/HuggingFaceH4/ultrachat_200k/resolve/8049631c405ae6576f93f445c6b8166f76f5505a/data/train.parquet"
+var cacheableResolvePathPattern = regexp.MustCompile(`^` + hfRepoTypePrefix + `/` + hfRepoId + `/resolve/[0-9a-f]{40}/.+$`)
+
+// the headers to store with the cached file, and to send with the cached responses
+var cachedResolveHeaders = []string{"Content-Type", "Content-Disposition", "ETag", "X-Repo-Commit", "X-Linked-Etag", "X-Linked-Size"}
+
+func (h *proxyHandler) isCacheableRequest(r *http.Request, reqPath string) bool {
+	return h.cache != nil &&
+		(r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		cacheableResolvePathPattern.MatchString(reqPath)
+}
+
+// isCacheFillingRequest checks if the request is allowed to fill the cache.
+// Only anonymous requests fill the cache, and the fill is fetched anonymously as well,
+// so the cached files are always the public ones, which are safe to be served to any client.
+// Requests with the server-side gated token have the Authorization header too
+func isCacheFillingRequest(r *http.Request) bool {
+	return r.Header.Get("Authorization") == ""
+}
+
+// serveCachedResolve serves the resolve request from the disk cache, with Range requests supported
+//
+// Anonymous GET requests of an uncached file start a background fill, which the client reads along with.
+// Partially cached ranges are sent once the fill reaches them, e.g. for the parallel range downloads of hf_transfer
+//
+// HEAD requests never trigger a fill. See unwrapLfsRedirect for uncached ones
+func (h *proxyHandler) serveCachedResolve(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, reqPath string) bool {
+	if r.Method == http.MethodHead || !isCacheFillingRequest(r) {
+		file, meta, ok := h.cache.Get(reqPath)
+		if !ok {
+			return false
+		}
+		h.helper.ServeCachedContent(ctx, w, r, file, meta.Header, cachedResolveHeaders)
+		return true
+	}
+
+	h.helper.ServeFromDiskCache(ctx, w, r, h.cache, reqPath, cachedResolveHeaders, func() (int64, http.Header, io.ReadCloser, error) {
+		log.Debugf("%sFetching %+q for the cache", ctx.LogPrefix, reqPath)
+		return h.fetchResolveFile(ctx, r, reqPath)
+	})
+	return true
+}
+
+// fetchResolveFile downloads the whole file anonymously, with the LFS / Xet bridge redirect followed.
+// Files of the private and gated repos are not downloadable, and their error responses are sent to the client as-is
+// The download is not bound to the client request, or limited by its client, since other clients might be reading from it
+func (h *proxyHandler) fetchResolveFile(ctx *context.RequestContext, r *http.Request, reqPath string) (int64, http.Header, io.ReadCloser, error) {
+	client := h.helper.NewBackgroundClient(ctx)
+	ok := false
+	defer func() {
+		if !ok {
+			client.Close()
+		}
+	}()
+
+	newRequest := func(urlStr string) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(h.cacheCtx, http.MethodGet, urlStr, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+		req.Header.Set("Accept-Encoding", "identity")
+		return req, nil
+	}
+
+	req, err := newRequest(hfUrl.String() + reqPath)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	resolveResp, err := client.DoNoRedirect(req)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if err := h.checkResponseSize(resolveResp); err != nil {
+		_ = resolveResp.Body.Close()
+		return 0, nil, nil, err
+	}
+
+	resp := resolveResp
+	if common.IsStatusCodeRedirect(resolveResp.StatusCode) {
+		location, err := resolveResp.Location()
+		_ = resolveResp.Body.Close()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		if req, err = newRequest(location.String()); err != nil {
+			return 0, nil, nil, err
+		}
+		if resp, err = client.Do(req); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		ok = true
+		resp.Body = client.CloseWithBody(resp.Body)
+		return 0, nil, nil, &common.PassthroughResponseError{Response: resp}
+	}
+	if err := h.checkResponseSize(resp); err != nil {
+		_ = resp.Body.Close()
+		return 0, nil, nil, err
+	}
+
+	header := http.Header{}
+	for _, key := range cachedResolveHeaders {
+		if value := resolveResp.Header.Get(key); value != "" {
+			header.Set(key, value)
+		}
+	}
+	// prefer the headers of the actual file
+	for _, key := range []string{"Content-Type", "Content-Disposition"} {
+		if value := resp.Header.Get(key); value != "" {
+			header.Set(key, value)
+		}
+	}
+	// the linked etag is the sha256 of the LFS file, which is what the client sees in the HEAD response
+	if linkedEtag := header.Get("X-Linked-Etag"); linkedEtag != "" {
+		header.Set("ETag", linkedEtag)
+	}
+
+	ok = true
+	return resp.ContentLength, header, client.CloseWithBody(resp.Body), nil
+}
+
+// unwrapLfsRedirect turns the LFS / Xet bridge redirect of an uncached resolve HEAD request into a plain 200 response,
+// so the client downloads the file with the resolve url, which goes through the cache, instead of the redirected location.
+// The Xet hash is removed as well, otherwise the Xet client would download the file with the Xet protocol
+func unwrapLfsRedirect(resp *http.Response) {
+	linkedSize, err := strconv.ParseInt(resp.Header.Get("X-Linked-Size"), 10, 64)
+	if !common.IsStatusCodeRedirect(resp.StatusCode) || err != nil {
+		return
+	}
+	resp.StatusCode = http.StatusOK
+	resp.Status = "200 OK"
+	resp.Header.Del("Location")
+	resp.Header.Del("X-Xet-Hash")
+	resp.Header.Set("Content-Length", strconv.FormatInt(linkedSize, 10))
+}
@@ -0,0 +1,239 @@
+package hfproxy
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const testCommit = "892b3d7a7b1cf10c7a701c60881cd93df615734c"
+
+type cacheTestUpstream struct {
+	content   []byte
+	fetches   atomic.Int32
+	released  chan struct{} // the file body is sent after it's closed
+	mux       *http.ServeMux
+	resolvers atomic.Int32
+}
+
+func newCacheTestUpstream(size int) *cacheTestUpstream {
+	u := &cacheTestUpstream{
+		content:  make([]byte, size),
+		released: make(chan struct{}),
+		mux:      http.NewServeMux(),
+	}
+	for i := range u.content {
+		u.content[i] = byte(i * 7)
+	}
+	u.mux.HandleFunc("/foo/bar/resolve/", func(w http.ResponseWriter, r *http.Request) {
+		u.resolvers.Add(1)
+		w.Header().Set("X-Repo-Commit", testCommit)
+		w.Header().Set("X-Linked-Etag", `"abcdef"`)
+		w.Header().Set("X-Linked-Size", strconv.Itoa(len(u.content)))
+		w.Header().Set("X-Xet-Hash", "1234")
+		w.Header().Set("Location", "https://cas-bridge.xethub.hf.co/xet-bridge-us/abcd?sig=xxx")
+		w.WriteHeader(http.StatusFound)
+	})
+	u.mux.HandleFunc("/xet-bridge-us/abcd", func(w http.ResponseWriter, r *http.Request) {
+		u.fetches.Add(1)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(u.content)))
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-u.released
+		_, _ = w.Write(u.content)
+	})
+	return u
+}
+
+func newCacheTestProxy(t *testing.T, upstream *cacheTestUpstream) string {
+	return newTestProxy(t, &config.HuggingFaceProxySettings{
+		Cache: &config.DiskCacheConfig{
+			Enabled:   true,
+			Directory: t.TempDir(),
+		},
+	}, upstream.mux)
+}
+
+func TestCacheFullAndRangeRequests(t *testing.T) {
+	upstream := newCacheTestUpstream(100000)
+	close(upstream.released)
+	proxyUrl := newCacheTestProxy(t, upstream)
+	fileUrl := proxyUrl + "/foo/bar/resolve/" + testCommit + "/model.bin"
+
+	resp, body := commontest.HttpGet(t, fileUrl, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(upstream.content), body)
+	assert.Equal(t, testCommit, resp.Header.Get("X-Repo-Commit"))
+	assert.Equal(t, `"abcdef"`, resp.Header.Get("ETag"))
+
+	resp, body = commontest.HttpGet(t, fileUrl, http.Header{"Range": {"bytes=100-199"}})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, string(upstream.content[100:200]), body)
+	assert.Equal(t, "bytes 100-199/100000", resp.Header.Get("Content-Range"))
+
+	resp, body = commontest.HttpGet(t, fileUrl, http.Header{"Range": {"bytes=99990-"}})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, string(upstream.content[99990:]), body)
+
+	assert.Equal(t, int32(1), upstream.fetches.Load())
+}
+
+func TestCacheConcurrentRangeRequests(t *testing.T) {
+	upstream := newCacheTestUpstream(1000000)
+	proxyUrl := newCacheTestProxy(t, upstream)
+	fileUrl := proxyUrl + "/foo/bar/resolve/" + testCommit + "/model.bin"
+
+	// hf_transfer style parallel chunk downloads, while the file is being fetched
+	const chunks = 8
+	chunkSize := len(upstream.content) / chunks
+	var wg sync.WaitGroup
+	for i := 0; i < chunks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start, end := i*chunkSize, (i+1)*chunkSize-1
+			resp, body := commontest.HttpGet(t, fileUrl, http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", start, end)}})
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			assert.Equal(t, string(upstream.content[start:end+1]), body)
+		}()
+	}
+	for upstream.fetches.Load() == 0 {
+		runtime.Gosched()
+	}
+	close(upstream.released)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), upstream.fetches.Load())
+}
+
+func TestCacheHeadRequest(t *testing.T) {
+	upstream := newCacheTestUpstream(1000)
+	close(upstream.released)
+	proxyUrl := newCacheTestProxy(t, upstream)
+	fileUrl := proxyUrl + "/foo/bar/resolve/" + testCommit + "/model.bin"
+
+	head := func() *http.Response {
+		resp, err := http.Head(fileUrl)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		return resp
+	}
+
+	// the LFS redirect is unwrapped, so the client downloads the file from the resolve url
+	resp := head()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("Location"))
+	assert.Equal(t, "", resp.Header.Get("X-Xet-Hash"))
+	assert.Equal(t, int64(1000), resp.ContentLength)
+	assert.Equal(t, testCommit, resp.Header.Get("X-Repo-Commit"))
+	assert.Equal(t, int32(0), upstream.fetches.Load())
+
+	_, _ = commontest.HttpGet(t, fileUrl, nil)
+	resolvers := upstream.resolvers.Load()
+
+	// served from the cache
+	resp = head()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(1000), resp.ContentLength)
+	assert.Equal(t, `"abcdef"`, resp.Header.Get("X-Linked-Etag"))
+	assert.Equal(t, resolvers, upstream.resolvers.Load())
+}
+
+func TestCacheNotCacheable(t *testing.T) {
+	upstream := newCacheTestUpstream(1000)
+	close(upstream.released)
+	proxyUrl := newCacheTestProxy(t, upstream)
+
+	// branch names are mutable
+	resp, _ := commontest.HttpGet(t, proxyUrl+"/foo/bar/resolve/main/model.bin", nil)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), proxyUrl+"/.cbxhc/"))
+
+	// upstream errors are returned as-is
+	resp, body := commontest.HttpGet(t, proxyUrl+"/foo/missing/resolve/"+testCommit+"/model.bin", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Contains(t, body, "not found")
+}
+
+func TestCachePrivateRepo(t *testing.T) {
+	upstream := newCacheTestUpstream(1000)
+	close(upstream.released)
+	upstream.mux.HandleFunc("/private/repo/resolve/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hf_user" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, _ = w.Write([]byte("secret"))
+	})
+	proxyUrl := newTestProxy(t, &config.HuggingFaceProxySettings{
+		Cache: &config.DiskCacheConfig{
+			Enabled:   true,
+			Directory: t.TempDir(),
+		},
+	}, upstream.mux)
+	fileUrl := proxyUrl + "/private/repo/resolve/" + testCommit + "/secret.txt"
+
+	// files fetched with credentials are not cached for the others
+	resp, body := commontest.HttpGet(t, fileUrl, http.Header{"Authorization": {"Bearer hf_user"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "secret", body)
+	resp, body = commontest.HttpGet(t, fileUrl, nil)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotContains(t, body, "secret")
+	headResp, err := http.Head(fileUrl)
+	require.NoError(t, err)
+	_ = headResp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, headResp.StatusCode)
+
+	// public files cached by anonymous requests are served to the clients with credentials as well
+	publicUrl := proxyUrl + "/foo/bar/resolve/" + testCommit + "/model.bin"
+	_, _ = commontest.HttpGet(t, publicUrl, nil)
+	resp, body = commontest.HttpGet(t, publicUrl, http.Header{"Authorization": {"Bearer hf_user"}})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(upstream.content), body)
+	assert.Equal(t, int32(1), upstream.fetches.Load())
+}
+
+func TestCacheGatedRepoWithServerToken(t *testing.T) {
+	upstream := newCacheTestUpstream(1000)
+	close(upstream.released)
+	privateFetches := &atomic.Int32{}
+	upstream.mux.HandleFunc("/private/repo/resolve/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer hf_server" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		privateFetches.Add(1)
+		_, _ = w.Write([]byte("gated"))
+	})
+	proxyUrl := newTestProxy(t, &config.HuggingFaceProxySettings{
+		Cache: &config.DiskCacheConfig{
+			Enabled:   true,
+			Directory: t.TempDir(),
+		},
+		Gated: &config.HuggingFaceGatedConfig{
+			Policy: utils.ToPtr(config.HuggingFaceGatedPolicyToken),
+			Token:  "hf_server",
+			Repos:  []string{"private/*"},
+		},
+	}, upstream.mux)
+
+	// requests with the server-side token are never cached
+	for i := 0; i < 2; i++ {
+		resp, body := commontest.HttpGet(t, proxyUrl+"/private/repo/resolve/"+testCommit+"/file.txt", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "gated", body)
+	}
+	assert.Equal(t, int32(2), privateFetches.Load())
+}
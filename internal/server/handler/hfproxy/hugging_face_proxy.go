@@ -1,16 +1,20 @@
 package hfproxy
 
 import (
+	gocontext "context"
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/config"
 	"github.com/Fallen-Breath/pavonis/internal/server/common"
 	"github.com/Fallen-Breath/pavonis/internal/server/context"
 	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"github.com/Fallen-Breath/pavonis/internal/utils/diskcache"
+	expirelru "github.com/hashicorp/golang-lru/v2/expirable"
 	log "github.com/sirupsen/logrus"
 	"net/http"
 	"net/url"
-	"regexp"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type proxyHandler struct {
@@ -18,7 +22,17 @@ type proxyHandler struct {
 	helper   *common.RequestHelper
 	settings *config.HuggingFaceProxySettings
 
-	selfUrl *url.URL
+	selfUrl   *url.URL
+	pathRules []*pathRule
+
+	whitelist       *reposList
+	blacklist       *reposList
+	gatedTokenRepos *reposList
+	gatedCache      *expirelru.LRU[string, bool] // repo -> gated
+
+	cache       *diskcache.Cache // might be nil
+	cacheCtx    gocontext.Context
+	cacheCancel gocontext.CancelFunc
 }
 
 var _ handler.HttpHandler = &proxyHandler{}
@@ -30,12 +44,30 @@ func NewHuggingFaceProxyHandler(info *handler.Info, helper *common.RequestHelper
 		return nil, fmt.Errorf("invalid SelfUrl %v: %v", info.SelfUrl, err)
 	}
 
+	var cache *diskcache.Cache
+	if settings.Cache.Enabled {
+		if cache, err = diskcache.NewCache(settings.Cache.Directory, settings.Cache.MaxTotalSize); err != nil {
+			return nil, fmt.Errorf("failed to init cache: %v", err)
+		}
+	}
+	cacheCtx, cacheCancel := gocontext.WithCancel(gocontext.Background())
+
 	h := &proxyHandler{
 		info:     info,
 		helper:   helper,
 		settings: settings,
 
-		selfUrl: selfUrl,
+		selfUrl:   selfUrl,
+		pathRules: buildPathRules(settings),
+
+		whitelist:       newReposList(settings.ReposWhitelist),
+		blacklist:       newReposList(settings.ReposBlacklist),
+		gatedTokenRepos: newReposList(settings.Gated.Repos),
+		gatedCache:      expirelru.NewLRU[string, bool](10240, nil, 10*time.Minute),
+
+		cache:       cache,
+		cacheCtx:    cacheCtx,
+		cacheCancel: cacheCancel,
 	}
 
 	return h, nil
@@ -46,29 +78,7 @@ func (h *proxyHandler) Info() *handler.Info {
 }
 
 func (h *proxyHandler) Shutdown() {
-}
-
-// A Hugging Face model/dataset download needs to access these paths
-//
-//	"/api/models/HuggingFaceH4/zephyr-7b-beta/revision/main" (model)
-//	"/api/datasets/HuggingFaceH4/ultrachat_200k/revision/main" (dataset)
-//	"/HuggingFaceH4/zephyr-7b-beta/resolve/892b3d7a7b1cf10c7a701c60881cd93df615734c/foo" (model)
-//	"/datasets/HuggingFaceH4/ultrachat_200k/resolve/8049631c405ae6576f93f445c6b8166f76f5505a/bar" (dataset)
-//
-// See: https://github.com/huggingface/huggingface_hub/blob/cadb7a9e2d425c9ee5e893968ec311dfe0742683/src/huggingface_hub/constants.py#L68
-// i.e. `HUGGINGFACE_CO_URL_TEMPLATE = ENDPOINT + "/{repo_id}/resolve/{revision}/{filename}"`
-var hfPathWhitelist = []*regexp.Regexp{
-	regexp.MustCompile(`^/api/(models|datasets)/[a-zA-Z0-9._-]+/[a-zA-Z0-9._-]+/.*$`),
-	regexp.MustCompile(`^(/datasets)?/[a-zA-Z0-9._-]+/[a-zA-Z0-9._-]+/resolve/[0-9a-f]+(/.*)?$`),
-}
-
-func isValidHfPath(path string) bool {
-	for _, pattern := range hfPathWhitelist {
-		if pattern.MatchString(path) {
-			return true
-		}
-	}
-	return false
+	h.cacheCancel()
 }
 
 func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request) {
@@ -77,39 +87,61 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 	}
 	reqPath := r.URL.Path[len(h.info.PathPrefix):]
 
-	// it's currently just a download proxy
-	if r.Method != "GET" && r.Method != "HEAD" {
-		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
-		return
-	}
-
+	var mapping *pathMapping
 	var targetUrl *url.URL
 	var remainingPath string
 	var opts []common.ReverseProxyOption
 	for _, pm := range pathMappings {
 		if pm.PathPrefix != "" && strings.HasPrefix(reqPath, pm.PathPrefix) {
+			mapping = pm
 			targetUrl = pm.Destination
 			remainingPath = reqPath[len(pm.PathPrefix):]
 		}
 	}
-	if targetUrl == nil {
-		if !isValidHfPath(reqPath) {
+	if targetUrl != nil {
+		isUpload := r.Method == http.MethodPost && *h.settings.AllowUpload && mapping.UploadPathPattern != nil && mapping.UploadPathPattern.MatchString(remainingPath)
+		if r.Method != http.MethodGet && r.Method != http.MethodHead && !isUpload {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+	} else {
+		repo, ok := h.matchHfPath(r.Method, reqPath)
+		if !ok {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 			return
 		}
+		if repo != nil {
+			if r, ok = h.prepareRepoRequest(ctx, w, r, repo); !ok {
+				return
+			}
+		}
 
+		cacheable := h.isCacheableRequest(r, reqPath)
+		if cacheable && h.serveCachedResolve(ctx, w, r, reqPath) {
+			return
+		}
+		unwrapRedirect := cacheable && isCacheFillingRequest(r)
+
+		mapping = pmHuggingFace
 		targetUrl = hfUrl
 		remainingPath = reqPath
 
 		// rewrite those self-redirect response (e.g. for repos rename redirection)
 		// do nothing for other redirects
 		opts = append(opts, common.WithRedirectRewriteOnly(hfUrl, func(location *url.URL) bool {
-			return location.Scheme == h.selfUrl.Scheme && location.Host == h.selfUrl.Host && isValidHfPath(location.Path)
+			return location.Scheme == h.selfUrl.Scheme && location.Host == h.selfUrl.Host && h.isValidHfPath(r.Method, location.Path)
 		}))
 
 		// rewrite redirect location of those download requests
 		// we cannot follow the redirect here, since the hf client might rely on header values in the redirect response header (e.g. x-repo-commit)
 		opts = append(opts, common.WithResponseModifier(func(_ *http.Request, resp *http.Response) error {
+			if err := h.checkResponseSize(resp); err != nil {
+				return err
+			}
+			if unwrapRedirect {
+				unwrapLfsRedirect(resp)
+			}
+
 			redirected := false
 			if resp.StatusCode == http.StatusFound {
 				if location, err := resp.Location(); err == nil && location != nil {
@@ -131,8 +163,7 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 			})
 
 			// this header exists in links like "/api/models/HuggingFaceH4/zephyr-7b-beta/xet-read-token/892b3d7a7b1cf10c7a701c60881cd93df615734c"
-			// see https://github.com/huggingface/huggingface_hub/blob/cadb7a9e2d425c9ee5e893968ec311dfe0742683/src/huggingface_hub/utils/_xet.py#L62
-			// TODO: should we rewrite the "casUrl" field in the response json body as well?
+			// the same url is in the "casUrl" field of the response json body
 			if xetCasUrlStr := resp.Header.Get("X-Xet-Cas-Url"); xetCasUrlStr != "" {
 				if xetCasUrl, err := url.Parse(xetCasUrlStr); err == nil && xetCasUrl != nil {
 					if newUrl := h.tryRewriteUrlToSelf(xetCasUrl); newUrl != nil {
@@ -140,25 +171,31 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 					}
 				}
 			}
+			if xetTokenPathPattern.MatchString(remainingPath) {
+				return h.rewriteXetJsonUrls(ctx, resp, xetTokenJsonUrlKeys)
+			}
 
 			return nil
 		}))
 	}
-	if targetUrl == pmCasServer.Destination {
-		// modify the reconstruction json result
+	if targetUrl == pmCasServer.Destination && xetReconstructionPathPattern.MatchString(remainingPath) {
+		// rewrite the data urls in the reconstruction json result
 		// e.g. for path "/.cas-server.xethub/reconstruction/21938ae6f4b5ccb1b8ef2e633a81d6cf4382fea439ef18a579013f9d5399b8dd"
 		opts = append(opts, common.WithResponseModifier(func(_ *http.Request, resp *http.Response) error {
-			if regexp.MustCompile(`^/reconstruction/[0-9a-f]+$`).MatchString(remainingPath) {
-				return common.ModifyResponseBody(
-					ctx, resp,
-					fmt.Sprintf(`"url":"%s/`, pmTransfer.Destination.String()),
-					fmt.Sprintf(`"url":"%s%s/`, h.selfUrl.String(), pmTransfer.PathPrefix),
-				)
-			}
-			return nil
+			return h.rewriteReconstructionJson(ctx, resp)
+		}))
+	} else if targetUrl != hfUrl {
+		opts = append(opts, common.WithResponseModifier(func(_ *http.Request, resp *http.Response) error {
+			return h.checkResponseSize(resp)
 		}))
 	}
 
+	// the token of the user should only be sent to huggingface.co
+	if !mapping.KeepAuthorization && r.Header.Get("Authorization") != "" {
+		r = r.Clone(r.Context())
+		r.Header.Del("Authorization")
+	}
+
 	downstreamUrl := *r.URL
 	downstreamUrl.Scheme = targetUrl.Scheme
 	downstreamUrl.Host = targetUrl.Host
@@ -180,3 +217,19 @@ func (h *proxyHandler) tryRewriteUrlToSelf(oldUrl *url.URL) (newUrl *url.URL) {
 	}
 	return
 }
+
+// checkResponseSize checks the file size of the response against the size limit
+// For files stored in LFS / Xet, the "X-Linked-Size" header in the resolve response is the actual file size
+func (h *proxyHandler) checkResponseSize(resp *http.Response) error {
+	if h.settings.SizeLimit <= 0 {
+		return nil
+	}
+	size := resp.ContentLength
+	if linkedSize, err := strconv.ParseInt(resp.Header.Get("X-Linked-Size"), 10, 64); err == nil {
+		size = linkedSize
+	}
+	if size > h.settings.SizeLimit {
+		return common.NewHttpError(http.StatusBadGateway, "File too large")
+	}
+	return nil
+}
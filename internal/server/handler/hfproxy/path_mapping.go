@@ -4,18 +4,31 @@ import (
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/utils"
 	"net/url"
+	"regexp"
 )
 
 type pathMapping struct {
 	PathPrefix  string
 	Destination *url.URL
+
+	KeepAuthorization bool           // if false, the Authorization header from the client is not sent to the destination
+	UploadPathPattern *regexp.Regexp // paths that accept POST requests when uploading is allowed, might be nil
 }
 
 var hfUrl = utils.MustParseUrl("https://huggingface.co")
 
+var pmHuggingFace = &pathMapping{
+	PathPrefix:        "",
+	Destination:       hfUrl,
+	KeepAuthorization: true,
+}
+
+// the client uses the Xet access token from the xet-read-token / xet-write-token api as the Authorization for the CAS server
 var pmCasServer = &pathMapping{
-	PathPrefix:  "/.csxhc",
-	Destination: utils.MustParseUrl("https://cas-server.xethub.hf.co"),
+	PathPrefix:        "/.csxhc",
+	Destination:       utils.MustParseUrl("https://cas-server.xethub.hf.co"),
+	KeepAuthorization: true,
+	UploadPathPattern: regexp.MustCompile(`^(/v1)?/(xorbs?|shards?)(/.*)?$`),
 }
 var pmTransfer = &pathMapping{
 	PathPrefix:  "/.txhc",
@@ -29,10 +42,7 @@ var pathMappings = []*pathMapping{
 	},
 	pmCasServer,
 	pmTransfer,
-	{
-		PathPrefix:  "",
-		Destination: hfUrl,
-	},
+	pmHuggingFace,
 }
 
 func init() {
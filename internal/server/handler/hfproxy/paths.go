@@ -0,0 +1,109 @@
+package hfproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"net/http"
+	"regexp"
+	"slices"
+)
+
+type pathRule struct {
+	Pattern *regexp.Regexp
+	Methods []string
+}
+
+// Match checks if the request matches the rule. The returned repo is nil if the rule has no "repo" group
+func (r *pathRule) Match(method, path string) (*repoRef, bool) {
+	if !slices.Contains(r.Methods, method) {
+		return nil, false
+	}
+	matches := r.Pattern.FindStringSubmatch(path)
+	if matches == nil {
+		return nil, false
+	}
+	repo := &repoRef{Type: repoTypeModels}
+	if idx := r.Pattern.SubexpIndex("type"); idx != -1 && matches[idx] != "" {
+		repo.Type = matches[idx]
+	}
+	idx := r.Pattern.SubexpIndex("repo")
+	if idx == -1 {
+		return nil, true
+	}
+	repo.Id = matches[idx]
+	return repo, true
+}
+
+// hfRepoTypes is the repo type part in api paths
+const hfRepoTypes = `(?P<type>models|datasets|spaces)`
+
+// hfRepoTypePrefix is the repo type part in non-api paths, where models have no prefix
+const hfRepoTypePrefix = `(/(?P<type>datasets|spaces))?`
+
+// hfRepoId matches "namespace/name", or "name" for legacy repos like "gpt2"
+const hfRepoId = `(?P<repo>[a-zA-Z0-9._-]+(/[a-zA-Z0-9._-]+)?)`
+
+var readMethods = []string{http.MethodGet, http.MethodHead}
+var writeMethods = []string{http.MethodPost}
+
+func newPathRule(pattern string, methods []string) *pathRule {
+	return &pathRule{
+		Pattern: regexp.MustCompile(pattern),
+		Methods: methods,
+	}
+}
+
+// The paths that a Hugging Face model/dataset/space download needs to access
+//
+//	"/api/models/HuggingFaceH4/zephyr-7b-beta/revision/main" (model info)
+//	"/api/datasets/HuggingFaceH4/ultrachat_200k/tree/main/data" (list files)
+//	"/api/models/HuggingFaceH4/zephyr-7b-beta/paths-info/main" (get paths info, POST)
+//	"/api/whoami-v2" (token check)
+//	"/HuggingFaceH4/zephyr-7b-beta/resolve/892b3d7a7b1cf10c7a701c60881cd93df615734c/foo" (model)
+//	"/datasets/HuggingFaceH4/ultrachat_200k/resolve/8049631c405ae6576f93f445c6b8166f76f5505a/bar" (dataset)
+//	"/spaces/HuggingFaceH4/zephyr-chat/resolve/main/app.py" (space)
+//
+// See: https://github.com/huggingface/huggingface_hub/blob/cadb7a9e2d425c9ee5e893968ec311dfe0742683/src/huggingface_hub/constants.py#L68
+// i.e. `HUGGINGFACE_CO_URL_TEMPLATE = ENDPOINT + "/{repo_id}/resolve/{revision}/{filename}"`
+var hfDownloadPathRules = []*pathRule{
+	newPathRule(`^/api/`+hfRepoTypes+`/`+hfRepoId+`(/(revision|tree|refs|commits|xet-read-token)(/.*)?)?$`, readMethods),
+	newPathRule(`^/api/`+hfRepoTypes+`/`+hfRepoId+`/paths-info/[^/]+$`, writeMethods),
+	newPathRule(`^/api/whoami-v2$`, readMethods),
+	newPathRule(`^`+hfRepoTypePrefix+`/`+hfRepoId+`/resolve/[^/]+(/.*)?$`, readMethods),
+}
+
+// The paths that `huggingface-cli upload` needs to access, i.e. the create_commit API of huggingface_hub
+//
+//	"/api/models/foo/bar/preupload/main", "/api/models/foo/bar/commit/main"
+//	"/api/models/foo/bar/xet-write-token/main" (Xet upload)
+//	"/foo/bar.git/info/lfs/objects/batch" (LFS upload, files are uploaded to the returned pre-signed urls directly)
+var hfUploadPathRules = []*pathRule{
+	newPathRule(`^/api/`+hfRepoTypes+`/`+hfRepoId+`/(preupload|commit)/[^/]+$`, writeMethods),
+	newPathRule(`^/api/`+hfRepoTypes+`/`+hfRepoId+`/xet-write-token/[^/]+$`, readMethods),
+	newPathRule(`^`+hfRepoTypePrefix+`/`+hfRepoId+`\.git/info/lfs/objects/batch$`, writeMethods),
+}
+
+func buildPathRules(settings *config.HuggingFaceProxySettings) []*pathRule {
+	rules := slices.Clone(hfDownloadPathRules)
+	if *settings.AllowUpload {
+		rules = append(rules, hfUploadPathRules...)
+	}
+	for _, pathCfg := range settings.ExtraPaths {
+		rules = append(rules, newPathRule(pathCfg.Pattern, pathCfg.Methods))
+	}
+	return rules
+}
+
+// matchHfPath returns if the path is allowed, and the repo it belongs to. The repo might be nil
+func (h *proxyHandler) matchHfPath(method, path string) (*repoRef, bool) {
+	for _, rule := range h.pathRules {
+		if repo, ok := rule.Match(method, path); ok {
+			return repo, true
+		}
+	}
+	return nil, false
+}
+
+func (h *proxyHandler) isValidHfPath(method, path string) bool {
+	_, ok := h.matchHfPath(method, path)
+	return ok
+}
@@ -0,0 +1,82 @@
+package hfproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+)
+
+func TestPathRules(t *testing.T) {
+	h := &proxyHandler{pathRules: buildPathRules(&config.HuggingFaceProxySettings{
+		AllowUpload: utils.ToPtr(false),
+		ExtraPaths: []*config.HuggingFacePathConfig{
+			{Pattern: `^/api/models/[^/]+/[^/]+/discussions$`, Methods: []string{http.MethodGet}},
+		},
+	})}
+
+	for _, path := range []string{
+		"/api/models/HuggingFaceH4/zephyr-7b-beta",
+		"/api/models/HuggingFaceH4/zephyr-7b-beta/revision/main",
+		"/api/models/gpt2/revision/main",
+		"/api/datasets/HuggingFaceH4/ultrachat_200k/tree/main/data",
+		"/api/spaces/foo/bar/refs",
+		"/api/models/foo/bar/xet-read-token/892b3d7a7b1cf10c7a701c60881cd93df615734c",
+		"/api/whoami-v2",
+		"/HuggingFaceH4/zephyr-7b-beta/resolve/892b3d7a7b1cf10c7a701c60881cd93df615734c/config.json",
+		"/gpt2/resolve/main/config.json",
+		"/datasets/HuggingFaceH4/ultrachat_200k/resolve/main/data/train.parquet",
+		"/spaces/foo/bar/resolve/main/app.py",
+		"/api/models/foo/bar/discussions",
+	} {
+		assert.True(t, h.isValidHfPath(http.MethodGet, path), path)
+	}
+	assert.True(t, h.isValidHfPath(http.MethodPost, "/api/models/foo/bar/paths-info/main"))
+
+	for _, path := range []string{
+		"/",
+		"/foo/bar",
+		"/api/models/foo/bar/settings",
+		"/api/repos/create",
+		"/api/models/foo/bar/xet-write-token/main",
+		"/foo/bar/blob/main/config.json",
+	} {
+		assert.False(t, h.isValidHfPath(http.MethodGet, path), path)
+	}
+	for _, path := range []string{
+		"/api/models/foo/bar/paths-info/main",
+		"/api/models/foo/bar/preupload/main",
+		"/api/models/foo/bar/commit/main",
+		"/foo/bar.git/info/lfs/objects/batch",
+		"/api/models/foo/bar/discussions",
+		"/foo/bar/resolve/main/config.json",
+	} {
+		assert.False(t, h.isValidHfPath(http.MethodPut, path), path)
+	}
+	assert.False(t, h.isValidHfPath(http.MethodPost, "/api/models/foo/bar/commit/main"))
+}
+
+func TestUploadPathRules(t *testing.T) {
+	h := &proxyHandler{pathRules: buildPathRules(&config.HuggingFaceProxySettings{
+		AllowUpload: utils.ToPtr(true),
+	})}
+
+	for _, path := range []string{
+		"/api/models/foo/bar/preupload/main",
+		"/api/datasets/foo/bar/commit/main",
+		"/foo/bar.git/info/lfs/objects/batch",
+		"/datasets/foo/bar.git/info/lfs/objects/batch",
+	} {
+		assert.True(t, h.isValidHfPath(http.MethodPost, path), path)
+	}
+	assert.True(t, h.isValidHfPath(http.MethodGet, "/api/models/foo/bar/xet-write-token/main"))
+	assert.False(t, h.isValidHfPath(http.MethodGet, "/api/models/foo/bar/commit/main"))
+}
+
+func TestCasServerUploadPaths(t *testing.T) {
+	for _, path := range []string{"/xorb/default/abcd", "/v1/xorbs/default/abcd", "/shard/abcd", "/v1/shards"} {
+		assert.True(t, pmCasServer.UploadPathPattern.MatchString(path), path)
+	}
+	assert.False(t, pmCasServer.UploadPathPattern.MatchString("/reconstruction/abcd"))
+}
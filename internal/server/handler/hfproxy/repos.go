@@ -0,0 +1,145 @@
+package hfproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const repoTypeModels = "models"
+const maxRepoInfoSize = 16 * 1024 * 1024
+
+// repoRef is a model, dataset or space repo
+type repoRef struct {
+	Type string // "models", "datasets" or "spaces"
+	Id   string // "namespace/repo", or "repo" for legacy repos
+}
+
+func (r *repoRef) String() string {
+	return r.Type + "/" + r.Id
+}
+
+// Split returns the namespace and the repo name. For legacy repos like "gpt2", the name is empty
+func (r *repoRef) Split() (namespace, name string) {
+	namespace, name, _ = strings.Cut(r.Id, "/")
+	return
+}
+
+type reposListEntry struct {
+	Namespace string
+	Name      string
+}
+type reposList []reposListEntry
+
+func (le *reposListEntry) Check(namespace, name string) bool {
+	return (le.Namespace == "*" || le.Namespace == namespace) && (le.Name == "*" || le.Name == name)
+}
+
+func (l *reposList) Check(repo *repoRef) bool {
+	namespace, name := repo.Split()
+	for _, ent := range *l {
+		if ent.Check(namespace, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func newReposList(list []string) *reposList {
+	reposList := make(reposList, 0, len(list))
+	for _, ent := range list {
+		namespace, name, _ := strings.Cut(ent, "/")
+		reposList = append(reposList, reposListEntry{
+			Namespace: namespace,
+			Name:      name,
+		})
+	}
+	return &reposList
+}
+
+// prepareRepoRequest applies the repo whitelist, blacklist and the gated policy to the request of the given repo
+// Returns the request to be sent, or false if the request is rejected
+func (h *proxyHandler) prepareRepoRequest(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, repo *repoRef) (*http.Request, bool) {
+	if len(*h.whitelist) > 0 && !h.whitelist.Check(repo) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Repository %s is not whitelisted", repo.Id), http.StatusForbidden)
+		return nil, false
+	}
+	if len(*h.blacklist) > 0 && h.blacklist.Check(repo) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Repository %s is blacklisted", repo.Id), http.StatusForbidden)
+		return nil, false
+	}
+
+	switch *h.settings.Gated.Policy {
+	case config.HuggingFaceGatedPolicyBlock:
+		gated, err := h.isRepoGated(ctx, r, repo)
+		if err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return nil, false
+		}
+		if gated {
+			common.WriteRejection(ctx, w, fmt.Sprintf("Repository %s is gated", repo.Id), http.StatusForbidden)
+			return nil, false
+		}
+	case config.HuggingFaceGatedPolicyToken:
+		if r.Header.Get("Authorization") == "" && h.gatedTokenRepos.Check(repo) {
+			log.Debugf("%sUsing the server-side token for repo %s", ctx.LogPrefix, repo)
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+h.settings.Gated.Token)
+		}
+	}
+	return r, true
+}
+
+// isRepoGated checks the "gated" field in the repo info api, e.g. "/api/models/meta-llama/Llama-3.1-8B"
+// The results are cached, since the gating of a repo rarely changes.
+// The check is a part of the client request, so the request rate of the client is not charged again
+func (h *proxyHandler) isRepoGated(ctx *context.RequestContext, r *http.Request, repo *repoRef) (bool, error) {
+	key := repo.String()
+	if gated, ok := h.gatedCache.Get(key); ok {
+		return gated, nil
+	}
+
+	client, err := h.helper.NewSubrequestClient(ctx, r.Context())
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+
+	infoUrl := hfUrl.JoinPath("api", repo.Type, repo.Id)
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, infoUrl.String(), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var gated bool
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var info struct {
+			Gated interface{} `json:"gated"` // false, "auto" or "manual"
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxRepoInfoSize)).Decode(&info); err != nil {
+			return false, fmt.Errorf("failed to decode repo info of %s: %v", repo, err)
+		}
+		gated = info.Gated != nil && info.Gated != false
+	case http.StatusUnauthorized, http.StatusNotFound:
+		// the repo does not exist, or is private. Let the actual request fail
+		gated = false
+	default:
+		return false, fmt.Errorf("failed to get repo info of %s: %s", repo, resp.Status)
+	}
+
+	log.Debugf("%sRepo %s gated: %v", ctx.LogPrefix, repo, gated)
+	h.gatedCache.Add(key, gated)
+	return gated, nil
+}
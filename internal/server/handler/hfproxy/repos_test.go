@@ -0,0 +1,156 @@
+package hfproxy
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReposList(t *testing.T) {
+	list := newReposList([]string{"HuggingFaceH4/*", "*/zephyr-7b-beta", "meta-llama/Llama-3.1-8B", "gpt2"})
+
+	for _, id := range []string{"HuggingFaceH4/ultrachat_200k", "foo/zephyr-7b-beta", "meta-llama/Llama-3.1-8B", "gpt2"} {
+		assert.True(t, list.Check(&repoRef{Type: repoTypeModels, Id: id}), id)
+	}
+	for _, id := range []string{"meta-llama/Llama-3.1-70B", "foo/bar", "gpt2/foo", "bert-base-uncased"} {
+		assert.False(t, list.Check(&repoRef{Type: repoTypeModels, Id: id}), id)
+	}
+}
+
+func newRepoTestUpstream(infoRequests *atomic.Int32) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/models/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if !strings.Contains(r.URL.Path, "/revision/") {
+			infoRequests.Add(1)
+		}
+		gated := `false`
+		if strings.HasPrefix(r.URL.Path, "/api/models/meta-llama/") {
+			gated = `"manual"`
+		}
+		_, _ = fmt.Fprintf(w, `{"id": "foo", "gated": %s}`, gated)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/resolve/") {
+			w.Header().Set("X-Authorization", r.Header.Get("Authorization"))
+			_, _ = w.Write([]byte("file " + r.URL.Path))
+			return
+		}
+		if r.URL.Path == "/api/whoami-v2" {
+			_, _ = w.Write([]byte(`{"name": "foo"}`))
+			return
+		}
+		http.NotFound(w, r)
+	})
+	return mux
+}
+
+func TestReposWhitelistBlacklist(t *testing.T) {
+	infoRequests := &atomic.Int32{}
+	proxyUrl := newTestProxy(t, &config.HuggingFaceProxySettings{
+		ReposWhitelist: []string{"HuggingFaceH4/*", "gpt2"},
+		ReposBlacklist: []string{"*/secret"},
+	}, newRepoTestUpstream(infoRequests))
+
+	for path, expected := range map[string]int{
+		"/api/models/HuggingFaceH4/zephyr-7b-beta/revision/main":           http.StatusOK,
+		"/datasets/HuggingFaceH4/ultrachat_200k/resolve/main/data.parquet": http.StatusOK,
+		"/gpt2/resolve/main/config.json":                                   http.StatusOK,
+		"/api/whoami-v2":                                                   http.StatusOK,
+		"/api/models/meta-llama/Llama-3.1-8B/revision/main":                http.StatusForbidden,
+		"/spaces/foo/bar/resolve/main/app.py":                              http.StatusForbidden,
+		"/HuggingFaceH4/secret/resolve/main/config.json":                   http.StatusForbidden,
+	} {
+		resp, _ := commontest.HttpGet(t, proxyUrl+path, nil)
+		assert.Equal(t, expected, resp.StatusCode, path)
+	}
+}
+
+func TestGatedPolicyBlock(t *testing.T) {
+	infoRequests := &atomic.Int32{}
+	proxyUrl := newTestProxy(t, &config.HuggingFaceProxySettings{
+		Gated: &config.HuggingFaceGatedConfig{
+			Policy: utils.ToPtr(config.HuggingFaceGatedPolicyBlock),
+		},
+	}, newRepoTestUpstream(infoRequests))
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/meta-llama/Llama-3.1-8B/resolve/main/config.json", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Contains(t, body, "gated")
+
+	for i := 0; i < 3; i++ {
+		resp, body = commontest.HttpGet(t, proxyUrl+"/HuggingFaceH4/zephyr-7b-beta/resolve/main/config.json", nil)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "file /HuggingFaceH4/zephyr-7b-beta/resolve/main/config.json", body)
+	}
+
+	// the gated results are cached
+	assert.Equal(t, int32(2), infoRequests.Load())
+}
+
+func TestGatedPolicyBlockRequestRate(t *testing.T) {
+	cfg := &config.Config{
+		ResourceLimit: &config.ResourceLimitConfig{RequestPerSecond: utils.ToPtr(1.0)},
+	}
+	proxyUrl := newTestProxyWithConfig(t, cfg, &config.HuggingFaceProxySettings{
+		Gated: &config.HuggingFaceGatedConfig{
+			Policy: utils.ToPtr(config.HuggingFaceGatedPolicyBlock),
+		},
+	}, newRepoTestUpstream(&atomic.Int32{}))
+
+	// the gated check is not charged as another request of the client
+	resp, _ := commontest.HttpGet(t, proxyUrl+"/HuggingFaceH4/zephyr-7b-beta/resolve/main/config.json", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/HuggingFaceH4/zephyr-7b-beta/resolve/main/config.json", nil)
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+}
+
+func TestGatedPolicyToken(t *testing.T) {
+	proxyUrl := newTestProxy(t, &config.HuggingFaceProxySettings{
+		Gated: &config.HuggingFaceGatedConfig{
+			Policy: utils.ToPtr(config.HuggingFaceGatedPolicyToken),
+			Token:  "hf_server",
+			Repos:  []string{"meta-llama/*"},
+		},
+	}, newRepoTestUpstream(&atomic.Int32{}))
+
+	resp, _ := commontest.HttpGet(t, proxyUrl+"/meta-llama/Llama-3.1-8B/resolve/main/config.json", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Bearer hf_server", resp.Header.Get("X-Authorization"))
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/meta-llama/Llama-3.1-8B/resolve/main/config.json", http.Header{"Authorization": {"Bearer hf_user"}})
+	assert.Equal(t, "Bearer hf_user", resp.Header.Get("X-Authorization"))
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/HuggingFaceH4/zephyr-7b-beta/resolve/main/config.json", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "", resp.Header.Get("X-Authorization"))
+}
+
+func TestSizeLimit(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/foo/bar/resolve/main/", func(w http.ResponseWriter, r *http.Request) {
+		size := "100"
+		if strings.HasSuffix(r.URL.Path, "/large.bin") {
+			size = "2000"
+		}
+		w.Header().Set("X-Linked-Size", size)
+		w.Header().Set("Location", "https://cas-bridge.xethub.hf.co/xet-bridge-us/abcd")
+		w.WriteHeader(http.StatusFound)
+	})
+	proxyUrl := newTestProxy(t, &config.HuggingFaceProxySettings{
+		SizeLimit: 1000,
+	}, mux)
+
+	resp, _ := commontest.HttpGet(t, proxyUrl+"/foo/bar/resolve/main/small.bin", nil)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.Equal(t, proxyUrl+"/.cbxhc/xet-bridge-us/abcd", resp.Header.Get("Location"))
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/foo/bar/resolve/main/large.bin", nil)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
@@ -0,0 +1,22 @@
+package hfproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestProxy starts a hugging face proxy server, whose downstream requests all go to the given upstream handler
+// The upstream handler can check the X-Original-Host header for the original host. Returns the url of the proxy server
+func newTestProxy(t *testing.T, settings *config.HuggingFaceProxySettings, upstreamHandler http.Handler) string {
+	return newTestProxyWithConfig(t, &config.Config{}, settings, upstreamHandler)
+}
+
+// newTestProxyWithConfig is the same as newTestProxy, with the site added to the given uninitialized cfg
+func newTestProxyWithConfig(t *testing.T, cfg *config.Config, settings *config.HuggingFaceProxySettings, upstreamHandler http.Handler) string {
+	upstream := httptest.NewServer(upstreamHandler)
+	t.Cleanup(upstream.Close)
+	return commontest.NewProxy(t, cfg, config.SiteModeHuggingFaceProxy, settings, NewHuggingFaceProxyHandler, commontest.NewUpstreamTransport(upstream.URL))
+}
@@ -0,0 +1,83 @@
+package hfproxy
+
+import (
+	"encoding/json"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+// e.g. "/api/models/HuggingFaceH4/zephyr-7b-beta/xet-read-token/892b3d7a7b1cf10c7a701c60881cd93df615734c"
+// see https://github.com/huggingface/huggingface_hub/blob/cadb7a9e2d425c9ee5e893968ec311dfe0742683/src/huggingface_hub/utils/_xet.py#L62
+var xetTokenPathPattern = regexp.MustCompile(`^/api/[^/]+/.+/xet-(read|write)-token/[^/]+$`)
+
+// e.g. "/reconstruction/21938ae6f4b5ccb1b8ef2e633a81d6cf4382fea439ef18a579013f9d5399b8dd" on the CAS server
+var xetReconstructionPathPattern = regexp.MustCompile(`^(/v1)?/reconstructions?/[0-9a-f]+$`)
+
+// The xet token json, e.g. {"accessToken": "xxx", "exp": 1745000000, "casUrl": "https://cas-server.xethub.hf.co"}
+var xetTokenJsonUrlKeys = []string{"casUrl"}
+
+// The reconstruction json, where the "url" fields in "fetch_info" are the urls of the data to download, e.g.
+//
+//	{"terms": [...], "fetch_info": {"<hash>": [{"range": {...}, "url": "https://transfer.xethub.hf.co/xorbs/default/<hash>?X-Xet-Signed-Range=...", "url_range": {...}}]}}
+var xetReconstructionJsonUrlKeys = []string{"url"}
+
+// rewriteUrlStrToSelf is the string version of tryRewriteUrlToSelf. Returns the original string if it cannot be rewritten
+func (h *proxyHandler) rewriteUrlStrToSelf(ctx *context.RequestContext, key string, urlStr string) string {
+	if u, err := url.Parse(urlStr); err == nil && u != nil {
+		if newUrl := h.tryRewriteUrlToSelf(u); newUrl != nil {
+			return newUrl.String()
+		}
+	}
+	log.Debugf("%sSkipping unknown url %+q in json field %+q", ctx.LogPrefix, urlStr, key)
+	return urlStr
+}
+
+func (h *proxyHandler) rewriteJsonUrls(ctx *context.RequestContext, data interface{}, keys []string) interface{} {
+	return common.RewriteJsonStringFields(data, keys, func(key, value string) string {
+		return h.rewriteUrlStrToSelf(ctx, key, value)
+	})
+}
+
+func (h *proxyHandler) rewriteXetJsonUrls(ctx *context.RequestContext, resp *http.Response, keys []string) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	return common.ModifyResponseJson(ctx, resp, func(data interface{}) (interface{}, error) {
+		return h.rewriteJsonUrls(ctx, data, keys), nil
+	})
+}
+
+// rewriteReconstructionJson rewrites the data urls in the reconstruction json, and checks the total file size
+func (h *proxyHandler) rewriteReconstructionJson(ctx *context.RequestContext, resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+	return common.ModifyResponseJson(ctx, resp, func(data interface{}) (interface{}, error) {
+		if h.settings.SizeLimit > 0 {
+			if size := getReconstructionFileSize(data); size > h.settings.SizeLimit {
+				return nil, common.NewHttpError(http.StatusBadGateway, "File too large")
+			}
+		}
+		return h.rewriteJsonUrls(ctx, data, xetReconstructionJsonUrlKeys), nil
+	})
+}
+
+// getReconstructionFileSize returns the size of the reconstructed file, i.e. the sum of "unpacked_length" of all "terms"
+func getReconstructionFileSize(data interface{}) int64 {
+	obj, _ := data.(map[string]interface{})
+	terms, _ := obj["terms"].([]interface{})
+	var size int64
+	for _, term := range terms {
+		termObj, _ := term.(map[string]interface{})
+		if length, ok := termObj["unpacked_length"].(json.Number); ok {
+			if n, err := length.Int64(); err == nil {
+				size += n
+			}
+		}
+	}
+	return size
+}
@@ -0,0 +1,77 @@
+package hfproxy
+
+import (
+	"encoding/json"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func newTestResponse(body string) *http.Response {
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{"Content-Type": []string{"application/json"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+}
+
+func readJson(t *testing.T, resp *http.Response) map[string]interface{} {
+	var data map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&data))
+	return data
+}
+
+func TestRewriteXetJsonUrls(t *testing.T) {
+	h := &proxyHandler{
+		info:    &handler.Info{PathPrefix: "/hf", SelfUrl: "https://pavonis.example.com"},
+		selfUrl: utils.MustParseUrl("https://pavonis.example.com"),
+	}
+	ctx := context.NewRequestContext("pavonis.example.com", "127.0.0.1")
+
+	// whitespaces should not matter
+	resp := newTestResponse(`{ "accessToken" : "xxx", "exp" : 1745000000, "casUrl" : "https://cas-server.xethub.hf.co" }`)
+	require.NoError(t, h.rewriteXetJsonUrls(ctx, resp, xetTokenJsonUrlKeys))
+	data := readJson(t, resp)
+	assert.Equal(t, "https://pavonis.example.com/hf/.csxhc", data["casUrl"])
+	assert.Equal(t, "xxx", data["accessToken"])
+
+	resp = newTestResponse(`{
+		"offset_into_first_range": 0,
+		"terms": [{"hash": "abcd", "unpacked_length": 123, "range": {"start": 0, "end": 1}}],
+		"fetch_info": {
+			"abcd": [
+				{"range": {"start": 0, "end": 1}, "url": "https://transfer.xethub.hf.co/xorbs/default/abcd?X-Xet-Signed-Range=bytes%3D0-99&Signature=xyz", "url_range": {"start": 0, "end": 99}},
+				{"range": {"start": 1, "end": 2}, "url": "https://unknown.example.com/abcd", "url_range": {"start": 100, "end": 199}}
+			]
+		}
+	}`)
+	require.NoError(t, h.rewriteXetJsonUrls(ctx, resp, xetReconstructionJsonUrlKeys))
+	data = readJson(t, resp)
+	fetchInfo := data["fetch_info"].(map[string]interface{})["abcd"].([]interface{})
+	assert.Equal(t, "https://pavonis.example.com/hf/.txhc/xorbs/default/abcd?X-Xet-Signed-Range=bytes%3D0-99&Signature=xyz", fetchInfo[0].(map[string]interface{})["url"])
+	assert.Equal(t, "https://unknown.example.com/abcd", fetchInfo[1].(map[string]interface{})["url"])
+
+	// non-200 responses are kept as-is
+	resp = newTestResponse(`{"error": "not found"}`)
+	resp.StatusCode = http.StatusNotFound
+	require.NoError(t, h.rewriteXetJsonUrls(ctx, resp, xetTokenJsonUrlKeys))
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, `{"error": "not found"}`, string(body))
+}
+
+func TestXetPathPatterns(t *testing.T) {
+	assert.True(t, xetTokenPathPattern.MatchString("/api/models/HuggingFaceH4/zephyr-7b-beta/xet-read-token/892b3d7a7b1cf10c7a701c60881cd93df615734c"))
+	assert.True(t, xetTokenPathPattern.MatchString("/api/datasets/foo/bar/xet-write-token/main"))
+	assert.False(t, xetTokenPathPattern.MatchString("/api/models/foo/bar/revision/main"))
+	assert.True(t, xetReconstructionPathPattern.MatchString("/reconstruction/21938ae6f4b5ccb1b8ef2e633a81d6cf4382fea439ef18a579013f9d5399b8dd"))
+	assert.True(t, xetReconstructionPathPattern.MatchString("/v1/reconstructions/21938ae6f4b5ccb1b8ef2e633a81d6cf4382fea439ef18a579013f9d5399b8dd"))
+	assert.False(t, xetReconstructionPathPattern.MatchString("/xorb/default/abcd"))
+}
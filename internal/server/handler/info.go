@@ -1,17 +1,24 @@
 package handler
 
-import "github.com/Fallen-Breath/pavonis/internal/config"
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"time"
+)
 
 type Info struct {
-	Id         string
-	PathPrefix string
-	SelfUrl    string
+	Id             string
+	PathPrefix     string
+	SelfUrl        string
+	RequestTimeout time.Duration
+	ApiKeyRequired bool
 }
 
 func NewSiteInfo(id string, siteCfg *config.SiteConfig) *Info {
 	return &Info{
-		Id:         id,
-		PathPrefix: siteCfg.PathPrefix,
-		SelfUrl:    siteCfg.SelfUrl,
+		Id:             id,
+		PathPrefix:     siteCfg.PathPrefix,
+		SelfUrl:        siteCfg.SelfUrl,
+		RequestTimeout: *siteCfg.ResourceLimit.RequestTimeout,
+		ApiKeyRequired: *siteCfg.ApiKeyRequired,
 	}
 }
@@ -0,0 +1,69 @@
+package ollamaproxy
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"net/http"
+	"strings"
+)
+
+const defaultNamespace = "library"
+
+// modelRef is the "namespace/model" of a model, e.g. "library/qwen3" for "ollama pull qwen3"
+type modelRef [2]string
+
+func (m modelRef) String() string {
+	return m[0] + "/" + m[1]
+}
+
+func parseModelRef(name string) modelRef {
+	namespace, model, ok := strings.Cut(name, "/")
+	if !ok {
+		return modelRef{defaultNamespace, name}
+	}
+	return modelRef{namespace, model}
+}
+
+// modelsListEntry follows the pattern rules of the container registry repos list, i.e. "*" matches a whole segment
+type modelsListEntry modelRef
+type modelsList []modelsListEntry
+
+func (le *modelsListEntry) Check(model modelRef) bool {
+	for i := range le {
+		if le[i] != "*" && le[i] != model[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *modelsList) Check(model modelRef) bool {
+	for _, ent := range *l {
+		if ent.Check(model) {
+			return true
+		}
+	}
+	return false
+}
+
+// newModelsList creates the list from "namespace/model" patterns. The namespace defaults to "library", like what ollama does
+func newModelsList(list []string) *modelsList {
+	modelsList := make(modelsList, 0, len(list))
+	for _, ent := range list {
+		modelsList = append(modelsList, modelsListEntry(parseModelRef(ent)))
+	}
+	return &modelsList
+}
+
+func (h *proxyHandler) checkModelsList(ctx *context.RequestContext, w http.ResponseWriter, model modelRef) bool {
+	if len(*h.whitelist) > 0 && !h.whitelist.Check(model) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Model '%s' is not whitelisted", model), http.StatusForbidden)
+		return false
+	}
+	if len(*h.blacklist) > 0 && h.blacklist.Check(model) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Model '%s' is blacklisted", model), http.StatusForbidden)
+		return false
+	}
+	return true
+}
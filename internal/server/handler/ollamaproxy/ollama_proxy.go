@@ -0,0 +1,172 @@
+package ollamaproxy
+
+import (
+	gocontext "context"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"github.com/Fallen-Breath/pavonis/internal/utils/diskcache"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// The ollama registry speaks a subset of the registry v2 api, with its own manifest layer media types,
+// e.g. "application/vnd.ollama.image.model". ollama pull only reads the manifests and blobs
+//
+//	"/v2/library/qwen3/manifests/latest"
+//	"/v2/library/qwen3/blobs/sha256:a3de86cd1c132c822487ededd47a324c50491393e6565cd14bafa40d0b8e686f"
+//
+// Unlike the container registries, the auth of the ollama registry is not the docker token auth,
+// where the token request is signed by the ollama key of the user, with the realm url included.
+// The realm cannot be proxied, so only the public models can be pulled
+var manifestPathPattern = regexp.MustCompile(`^/v2/(?P<model>[a-zA-Z0-9._-]+/[a-zA-Z0-9._-]+)/manifests/[a-zA-Z0-9._-]+$`)
+var blobPathPattern = regexp.MustCompile(`^/v2/(?P<model>[a-zA-Z0-9._-]+/[a-zA-Z0-9._-]+)/blobs/(?P<digest>sha256:[0-9a-f]{64})$`)
+
+// the headers to store with the cached blob, and to send with the cached responses
+var cachedBlobHeaders = []string{"Content-Type", "Docker-Content-Digest"}
+
+type proxyHandler struct {
+	info     *handler.Info
+	helper   *common.RequestHelper
+	settings *config.OllamaProxySettings
+
+	upstreamUrl *url.URL
+	whitelist   *modelsList
+	blacklist   *modelsList
+
+	cache       *diskcache.Cache // might be nil
+	cacheCtx    gocontext.Context
+	cacheCancel gocontext.CancelFunc
+}
+
+var _ handler.HttpHandler = &proxyHandler{}
+
+func NewProxyHandler(info *handler.Info, helper *common.RequestHelper, settings *config.OllamaProxySettings) (handler.HttpHandler, error) {
+	upstreamUrl, err := url.Parse(*settings.UpstreamUrl)
+	if err != nil {
+		return nil, fmt.Errorf("invalid UpstreamUrl %v: %v", *settings.UpstreamUrl, err)
+	}
+
+	var cache *diskcache.Cache
+	if settings.Cache.Enabled {
+		if cache, err = diskcache.NewCache(settings.Cache.Directory, settings.Cache.MaxTotalSize); err != nil {
+			return nil, fmt.Errorf("failed to init cache: %v", err)
+		}
+	}
+	cacheCtx, cacheCancel := gocontext.WithCancel(gocontext.Background())
+
+	return &proxyHandler{
+		info:     info,
+		helper:   helper,
+		settings: settings,
+
+		upstreamUrl: upstreamUrl,
+		whitelist:   newModelsList(settings.ModelsWhitelist),
+		blacklist:   newModelsList(settings.ModelsBlacklist),
+
+		cache:       cache,
+		cacheCtx:    cacheCtx,
+		cacheCancel: cacheCancel,
+	}, nil
+}
+
+func (h *proxyHandler) Info() *handler.Info {
+	return h.info
+}
+
+func (h *proxyHandler) Shutdown() {
+	h.cacheCancel()
+}
+
+func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, h.info.PathPrefix) {
+		panic(fmt.Errorf("r.URL.Path %v not started with prefix %v", r.URL.Path, h.info.PathPrefix))
+	}
+	reqPath := r.URL.Path[len(h.info.PathPrefix):]
+
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var digest string
+	if reqPath != "/v2/" {
+		var matches []string
+		pattern := manifestPathPattern
+		if matches = pattern.FindStringSubmatch(reqPath); matches == nil {
+			pattern = blobPathPattern
+			if matches = pattern.FindStringSubmatch(reqPath); matches != nil {
+				digest = matches[pattern.SubexpIndex("digest")]
+			}
+		}
+		if matches == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if !h.checkModelsList(ctx, w, parseModelRef(matches[pattern.SubexpIndex("model")])) {
+			return
+		}
+	}
+
+	downstreamUrl := *r.URL
+	downstreamUrl.Scheme = h.upstreamUrl.Scheme
+	downstreamUrl.Host = h.upstreamUrl.Host
+	downstreamUrl.Path = h.upstreamUrl.Path + reqPath
+
+	if digest != "" && h.cache != nil {
+		if r.Method == http.MethodGet {
+			h.helper.ServeFromDiskCache(ctx, w, r, h.cache, digest, cachedBlobHeaders, func() (int64, http.Header, io.ReadCloser, error) {
+				log.Debugf("%sFetching blob %s for the cache", ctx.LogPrefix, digest)
+				return h.fetchBlob(ctx, r, downstreamUrl.String(), digest)
+			})
+			return
+		}
+		if file, meta, ok := h.cache.Get(digest); ok {
+			h.helper.ServeCachedContent(ctx, w, r, file, meta.Header, cachedBlobHeaders)
+			return
+		}
+	}
+
+	// the registry redirects blob fetches to the CDN, which is followed here,
+	// so the client still sees the blob from the registry url, and the Range header is sent to the CDN
+	h.helper.RunReverseProxy(ctx, w, r, &downstreamUrl, common.WithRedirectFollowAll())
+}
+
+// fetchBlob downloads the whole blob, with the CDN redirect followed
+// The download is not bound to the client request, or limited by its client, since other clients might be reading from it
+func (h *proxyHandler) fetchBlob(ctx *context.RequestContext, r *http.Request, blobUrl string, digest string) (int64, http.Header, io.ReadCloser, error) {
+	client := h.helper.NewBackgroundClient(ctx)
+
+	req, err := http.NewRequestWithContext(h.cacheCtx, http.MethodGet, blobUrl, nil)
+	if err != nil {
+		client.Close()
+		return 0, nil, nil, err
+	}
+	req.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+	req.Header.Set("Accept-Encoding", "identity")
+	resp, err := client.Do(req)
+	if err != nil {
+		client.Close()
+		return 0, nil, nil, err
+	}
+	resp.Body = client.CloseWithBody(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength < 0 {
+		return 0, nil, nil, &common.PassthroughResponseError{Response: resp}
+	}
+
+	contentType := resp.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header := http.Header{}
+	header.Set("Content-Type", contentType)
+	header.Set("Docker-Content-Digest", digest)
+	return resp.ContentLength, header, resp.Body, nil
+}
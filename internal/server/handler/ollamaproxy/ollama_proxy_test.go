@@ -0,0 +1,131 @@
+package ollamaproxy
+
+import (
+	"bytes"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testDigest = "sha256:a3de86cd1c132c822487ededd47a324c50491393e6565cd14bafa40d0b8e686f"
+const testCdnHost = "dd20bb891979d25aebc8bec07b2b3bbc.r2.cloudflarestorage.com"
+
+type testUpstream struct {
+	blob       []byte
+	blobReads  atomic.Int32
+	cdnHeaders chan http.Header
+}
+
+func (u *testUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Header.Get("X-Original-Host") == testCdnHost:
+		u.blobReads.Add(1)
+		select {
+		case u.cdnHeaders <- r.Header.Clone():
+		default:
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(u.blob))
+	case strings.HasSuffix(r.URL.Path, "/manifests/latest"):
+		w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+		_, _ = w.Write([]byte(`{"schemaVersion": 2, "layers": [{"mediaType": "application/vnd.ollama.image.model", "digest": "` + testDigest + `"}]}`))
+	case strings.HasSuffix(r.URL.Path, "/blobs/"+testDigest):
+		w.Header().Set("Location", "https://"+testCdnHost+"/ollama/docker/registry/v2/blobs/sha256/a3/data?X-Amz-Signature=xxx")
+		w.WriteHeader(http.StatusTemporaryRedirect)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestProxy(t *testing.T, settings *config.OllamaProxySettings, upstream http.Handler) string {
+	upstreamServer := httptest.NewServer(upstream)
+	t.Cleanup(upstreamServer.Close)
+	return commontest.NewProxy(t, nil, config.SiteModeOllamaProxy, settings, NewProxyHandler, commontest.NewUpstreamTransport(upstreamServer.URL))
+}
+
+func newTestUpstream(size int) *testUpstream {
+	u := &testUpstream{
+		blob:       make([]byte, size),
+		cdnHeaders: make(chan http.Header, 1),
+	}
+	for i := range u.blob {
+		u.blob[i] = byte(i * 13)
+	}
+	return u
+}
+
+func TestModelsList(t *testing.T) {
+	list := newModelsList([]string{"qwen3", "someone/*", "*/gemma3"})
+
+	for _, name := range []string{"qwen3", "library/qwen3", "someone/foo", "bar/gemma3", "gemma3"} {
+		assert.True(t, list.Check(parseModelRef(name)), name)
+	}
+	for _, name := range []string{"llama3", "qwen3-coder", "other/qwen3", "someone"} {
+		assert.False(t, list.Check(parseModelRef(name)), name)
+	}
+}
+
+func TestPull(t *testing.T) {
+	upstream := newTestUpstream(10000)
+	proxyUrl := newTestProxy(t, &config.OllamaProxySettings{
+		ModelsWhitelist: []string{"qwen3", "someone/*"},
+	}, upstream)
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/v2/library/qwen3/manifests/latest", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "application/vnd.ollama.image.model")
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/v2/library/llama3/manifests/latest", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	// the CDN redirect is followed, with the range kept
+	resp, body = commontest.HttpGet(t, proxyUrl+"/v2/library/qwen3/blobs/"+testDigest, http.Header{"Range": {"bytes=100-199"}})
+	require.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, string(upstream.blob[100:200]), body)
+	assert.Equal(t, "bytes=100-199", (<-upstream.cdnHeaders).Get("Range"))
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/v2/library/qwen3/blobs/uploads/", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestBlobCache(t *testing.T) {
+	upstream := newTestUpstream(1000000)
+	proxyUrl := newTestProxy(t, &config.OllamaProxySettings{
+		Cache: &config.DiskCacheConfig{
+			Enabled:   true,
+			Directory: t.TempDir(),
+		},
+	}, upstream)
+	blobUrl := proxyUrl + "/v2/library/qwen3/blobs/" + testDigest
+
+	// ollama downloads a blob in parallel parts
+	const parts = 8
+	partSize := len(upstream.blob) / parts
+	var wg sync.WaitGroup
+	for i := 0; i < parts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start, end := i*partSize, (i+1)*partSize-1
+			resp, body := commontest.HttpGet(t, blobUrl, http.Header{"Range": {"bytes=" + strconv.Itoa(start) + "-" + strconv.Itoa(end)}})
+			assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+			assert.Equal(t, string(upstream.blob[start:end+1]), body)
+		}()
+	}
+	wg.Wait()
+
+	resp, body := commontest.HttpGet(t, blobUrl, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(upstream.blob), body)
+	assert.Equal(t, testDigest, resp.Header.Get("Docker-Content-Digest"))
+
+	assert.Equal(t, int32(1), upstream.blobReads.Load())
+}
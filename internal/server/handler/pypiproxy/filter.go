@@ -0,0 +1,313 @@
+package pypiproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	log "github.com/sirupsen/logrus"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// projectPatterns is a list of normalized project name patterns, where "*" matches any sequence of characters
+type projectPatterns []string
+
+func newProjectPatterns(patterns []string) projectPatterns {
+	result := make(projectPatterns, 0, len(patterns))
+	for _, pattern := range patterns {
+		result = append(result, normalizeProjectName(pattern))
+	}
+	return result
+}
+
+func (p projectPatterns) Match(normalizedProject string) bool {
+	for _, pattern := range p {
+		if ok, _ := path.Match(pattern, normalizedProject); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *proxyHandler) isProjectAllowed(normalizedProject string) bool {
+	if len(h.whitelist) > 0 && !h.whitelist.Match(normalizedProject) {
+		return false
+	}
+	if len(h.blacklist) > 0 && h.blacklist.Match(normalizedProject) {
+		return false
+	}
+	return true
+}
+
+func (h *proxyHandler) checkProjectWhitelist(ctx *context.RequestContext, w http.ResponseWriter, project string) bool {
+	normalizedProject := normalizeProjectName(project)
+	if len(h.whitelist) > 0 && !h.whitelist.Match(normalizedProject) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Project '%s' is not whitelisted", normalizedProject), http.StatusForbidden)
+		return false
+	}
+	if len(h.blacklist) > 0 && h.blacklist.Match(normalizedProject) {
+		common.WriteRejection(ctx, w, fmt.Sprintf("Project '%s' is blacklisted", normalizedProject), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (h *proxyHandler) hasProjectFilter() bool {
+	return len(h.whitelist) > 0 || len(h.blacklist) > 0
+}
+
+func (h *proxyHandler) hasVersionFilter() bool {
+	return h.settings.HideYanked || h.settings.Quarantine != nil || h.settings.VulnerabilitiesFile != ""
+}
+
+// vulnerabilities is the normalized project -> normalized version set mapping
+type vulnerabilities map[string]map[string]bool
+
+func (v vulnerabilities) Contains(normalizedProject, version string) bool {
+	return v[normalizedProject][normalizeVersion(version)]
+}
+
+func normalizeVersion(version string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "v")
+}
+
+// parseVulnerabilities parses lines like "foo==1.2.3". Empty lines and comments starting with "#" are ignored
+func parseVulnerabilities(buf []byte) (vulnerabilities, error) {
+	result := make(vulnerabilities)
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		project, version, ok := strings.Cut(line, "==")
+		project, version = strings.TrimSpace(project), strings.TrimSpace(version)
+		if !ok || project == "" || version == "" {
+			return nil, fmt.Errorf("invalid line %d: %+q", lineNum, line)
+		}
+		normalizedProject := normalizeProjectName(project)
+		if result[normalizedProject] == nil {
+			result[normalizedProject] = make(map[string]bool)
+		}
+		result[normalizedProject][normalizeVersion(version)] = true
+	}
+	return result, scanner.Err()
+}
+
+func (h *proxyHandler) loadVulnerabilities() (vulnerabilities, error) {
+	if h.settings.VulnerabilitiesFile == "" {
+		return vulnerabilities{}, nil
+	}
+	buf, err := os.ReadFile(h.settings.VulnerabilitiesFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read vulnerabilities file: %v", err)
+	}
+	result, err := parseVulnerabilities(buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse vulnerabilities file: %v", err)
+	}
+	log.Debugf("(%s) loaded vulnerable versions of %d projects from file %+q", h.info.Id, len(result), h.settings.VulnerabilitiesFile)
+	return result, nil
+}
+
+func (h *proxyHandler) backgroundReloadThread() {
+	interval := h.settings.VulnerabilitiesFileReloadInterval
+	if h.settings.VulnerabilitiesFile == "" || interval == nil {
+		return
+	}
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			newVulnerabilities, err := h.loadVulnerabilities()
+			if err != nil {
+				log.Errorf("(%s) Failed to reload vulnerabilities: %v", h.info.Id, err)
+				continue
+			}
+			h.vulnerabilities.Store(&newVulnerabilities)
+
+		case <-h.shutdownChannel:
+			return
+		}
+	}
+}
+
+var sdistExtensions = []string{".tar.gz", ".tar.bz2", ".tar.xz", ".tgz", ".zip"}
+
+// parseFileVersion extracts the version from the distribution filename
+func parseFileVersion(filename string) (string, bool) {
+	_, version, ok := parseFilename(filename)
+	return version, ok
+}
+
+// parseFilename extracts the project name and the version from the distribution filename
+//
+// https://packaging.python.org/en/latest/specifications/binary-distribution-format/#file-name-convention
+// https://packaging.python.org/en/latest/specifications/source-distribution-format/#source-distribution-file-name
+func parseFilename(filename string) (name string, version string, ok bool) {
+	for _, ext := range []string{".whl", ".egg"} {
+		if base, ok := strings.CutSuffix(filename, ext); ok {
+			// {distribution}-{version}(-{build tag})?-{python tag}-{abi tag}-{platform tag}.whl
+			// {distribution}-{version}(-{python tag})?(-{platform})?.egg
+			parts := strings.Split(base, "-")
+			if len(parts) < 2 {
+				return "", "", false
+			}
+			return parts[0], parts[1], true
+		}
+	}
+	lowerFilename := strings.ToLower(filename)
+	for _, ext := range sdistExtensions {
+		if strings.HasSuffix(lowerFilename, ext) {
+			// {name}-{version}.tar.gz, legacy sdists might contain '-' in the name
+			base := filename[:len(filename)-len(ext)]
+			idx := strings.LastIndex(base, "-")
+			if idx == -1 {
+				return "", "", false
+			}
+			return base[:idx], base[idx+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// checkFileDownload applies the project filters and the version filters to the requested file of the upstream,
+// so the hidden files cannot be downloaded with the direct urls either.
+// For the yanked and quarantined files, the file should be listed in the filtered project detail page of the upstream
+func (h *proxyHandler) checkFileDownload(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, u *upstream, filename string) bool {
+	if !h.hasProjectFilter() && !h.hasVersionFilter() {
+		return true
+	}
+
+	// PEP 658 metadata files share the visibility of their distribution files
+	filename = strings.TrimSuffix(filename, ".metadata")
+	project, version, ok := parseFilename(filename)
+	if !ok {
+		if h.hasProjectFilter() {
+			common.WriteRejection(ctx, w, fmt.Sprintf("Unknown project of file '%s'", filename), http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if !h.checkProjectWhitelist(ctx, w, project) {
+		return false
+	}
+	if !h.hasVersionFilter() {
+		return true
+	}
+
+	normalizedProject := normalizeProjectName(project)
+	if h.vulnerabilities.Load().Contains(normalizedProject, version) {
+		log.Debugf("%sHiding vulnerable file %+q", ctx.LogPrefix, filename)
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return false
+	}
+	if !h.settings.HideYanked && h.settings.Quarantine == nil {
+		return true
+	}
+
+	client, err := h.helper.NewSubrequestClient(ctx, r.Context())
+	if err != nil {
+		h.helper.WriteError(ctx, w, err)
+		return false
+	}
+	defer client.Close()
+
+	// the Accept header of the file download is not for the simple api
+	pageReq := r.Clone(r.Context())
+	pageReq.Header.Del("Accept")
+	page, err := h.fetchSimplePage(client, pageReq, u, "/"+normalizedProject+"/", maxProjectDetailSize)
+	if err != nil {
+		h.helper.WriteError(ctx, w, err)
+		return false
+	}
+	if page != nil {
+		detail, err := h.parseProjectDetail(page)
+		if err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return false
+		}
+		h.filterProjectDetail(ctx, normalizedProject, detail)
+		for _, file := range detail.Files {
+			if file.Filename == filename {
+				return true
+			}
+		}
+	}
+	log.Debugf("%sFile %+q is not listed in the filtered project detail page", ctx.LogPrefix, filename)
+	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	return false
+}
+
+// filterProjectDetail removes the files of the hidden versions in place, according to the version filtering settings
+func (h *proxyHandler) filterProjectDetail(ctx *context.RequestContext, normalizedProject string, detail *projectDetail) {
+	vulns := *h.vulnerabilities.Load()
+	now := time.Now()
+
+	// release time is the earliest upload time of all files of the version
+	releaseTimes := make(map[string]time.Time)
+	for _, file := range detail.Files {
+		version, ok := parseFileVersion(file.Filename)
+		if !ok || file.UploadTime == nil {
+			continue
+		}
+		uploadTime, err := time.Parse(time.RFC3339Nano, *file.UploadTime)
+		if err != nil {
+			continue
+		}
+		version = normalizeVersion(version)
+		if t, ok := releaseTimes[version]; !ok || uploadTime.Before(t) {
+			releaseTimes[version] = uploadTime
+		}
+	}
+
+	hiddenVersions := make(map[string]string) // version -> reason
+	checkVersion := func(version string) {
+		version = normalizeVersion(version)
+		if _, ok := hiddenVersions[version]; ok {
+			return
+		}
+		if vulns.Contains(normalizedProject, version) {
+			hiddenVersions[version] = "vulnerable"
+		} else if releaseTime, ok := releaseTimes[version]; ok && h.settings.Quarantine != nil && now.Sub(releaseTime) < *h.settings.Quarantine {
+			hiddenVersions[version] = "quarantined"
+		}
+	}
+
+	files := make([]*projectFile, 0, len(detail.Files))
+	for _, file := range detail.Files {
+		if h.settings.HideYanked && file.Yanked != nil {
+			log.Debugf("%sHiding yanked file %+q", ctx.LogPrefix, file.Filename)
+			continue
+		}
+		if version, ok := parseFileVersion(file.Filename); ok {
+			checkVersion(version)
+			if reason, hidden := hiddenVersions[normalizeVersion(version)]; hidden {
+				log.Debugf("%sHiding %s file %+q", ctx.LogPrefix, reason, file.Filename)
+				continue
+			}
+		}
+		files = append(files, file)
+	}
+	detail.Files = files
+
+	versions := make([]string, 0, len(detail.Versions))
+	for _, version := range detail.Versions {
+		checkVersion(version)
+		if _, hidden := hiddenVersions[normalizeVersion(version)]; !hidden {
+			versions = append(versions, version)
+		}
+	}
+	detail.Versions = versions
+}
@@ -0,0 +1,218 @@
+package pypiproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFileVersion(t *testing.T) {
+	tests := []struct {
+		filename string
+		version  string
+		ok       bool
+	}{
+		{"foo-1.0-py3-none-any.whl", "1.0", true},
+		{"foo_bar-2.0rc1-1-cp312-cp312-manylinux_2_17_x86_64.whl", "2.0rc1", true},
+		{"foo-1.0.tar.gz", "1.0", true},
+		{"foo-bar-1.0.post1.TAR.GZ", "1.0.post1", true},
+		{"foo-1.0.zip", "1.0", true},
+		{"foo-1.0-py2.7.egg", "1.0", true},
+		{"foo.exe", "", false},
+		{"foo.tar.gz", "", false},
+	}
+	for _, tt := range tests {
+		version, ok := parseFileVersion(tt.filename)
+		assert.Equal(t, tt.ok, ok, tt.filename)
+		assert.Equal(t, tt.version, version, tt.filename)
+	}
+
+	name, version, ok := parseFilename("foo_bar-2.0rc1-1-cp312-cp312-manylinux_2_17_x86_64.whl")
+	assert.True(t, ok)
+	assert.Equal(t, "foo_bar", name)
+	assert.Equal(t, "2.0rc1", version)
+	name, version, ok = parseFilename("foo-bar-1.0.post1.TAR.GZ")
+	assert.True(t, ok)
+	assert.Equal(t, "foo-bar", name)
+	assert.Equal(t, "1.0.post1", version)
+}
+
+func TestParseVulnerabilities(t *testing.T) {
+	vulns, err := parseVulnerabilities([]byte("# comment\nFoo_Bar==1.0\n\nbaz == v2.0  # CVE-xxx\n"))
+	require.NoError(t, err)
+	assert.True(t, vulns.Contains("foo-bar", "1.0"))
+	assert.True(t, vulns.Contains("baz", "2.0"))
+	assert.False(t, vulns.Contains("foo-bar", "1.1"))
+
+	_, err = parseVulnerabilities([]byte("foo>=1.0"))
+	assert.Error(t, err)
+}
+
+func newFilterTestUpstream(t *testing.T) string {
+	now := time.Now().UTC()
+	recent := now.Add(-1 * time.Hour).Format(time.RFC3339Nano)
+	old := now.Add(-30 * 24 * time.Hour).Format(time.RFC3339Nano)
+	return newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filesUrl := "http://" + r.Host + "/files"
+		switch r.URL.Path {
+		case "/simple/":
+			w.Header().Set("Content-Type", "text/html")
+			_, _ = w.Write([]byte(`<a href="/simple/foo/">foo</a><a href="/simple/evil/">evil</a>`))
+		case "/simple/foo/":
+			if !strings.Contains(r.Header.Get("Accept"), simpleJsonContentType) {
+				w.Header().Set("Content-Type", "text/html")
+				_, _ = fmt.Fprintf(w, `<a href="%s/foo-1.0.tar.gz">foo-1.0.tar.gz</a>`, filesUrl)
+				return
+			}
+			w.Header().Set("Content-Type", simpleJsonContentType)
+			_, _ = fmt.Fprintf(w, `{"meta": {"api-version": "1.1"}, "name": "foo", "versions": ["1.0", "1.1", "1.2", "2.0"], "files": [
+				{"filename": "foo-1.0.tar.gz", "url": "%[1]s/foo-1.0.tar.gz", "hashes": {}, "upload-time": "%[2]s"},
+				{"filename": "foo-1.1.tar.gz", "url": "%[1]s/foo-1.1.tar.gz", "hashes": {}, "upload-time": "%[2]s", "yanked": "broken"},
+				{"filename": "foo-1.2.tar.gz", "url": "%[1]s/foo-1.2.tar.gz", "hashes": {}, "upload-time": "%[2]s"},
+				{"filename": "foo-1.2-py3-none-any.whl", "url": "%[1]s/foo-1.2-py3-none-any.whl", "hashes": {}, "upload-time": "%[2]s"},
+				{"filename": "foo-2.0.tar.gz", "url": "%[1]s/foo-2.0.tar.gz", "hashes": {}, "upload-time": "%[3]s"}
+			]}`, filesUrl, old, recent)
+		case "/pypi/foo/json":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"info": {"name": "foo", "version": "2.0"}, "releases": {
+				"1.0": [{"filename": "foo-1.0.tar.gz", "url": "%[1]s/foo-1.0.tar.gz", "yanked": false, "yanked_reason": null, "upload_time_iso_8601": "%[2]s"}],
+				"1.1": [{"filename": "foo-1.1.tar.gz", "url": "%[1]s/foo-1.1.tar.gz", "yanked": true, "yanked_reason": "broken", "upload_time_iso_8601": "%[2]s"}],
+				"1.2": [{"filename": "foo-1.2.tar.gz", "url": "%[1]s/foo-1.2.tar.gz", "yanked": false, "yanked_reason": null, "upload_time_iso_8601": "%[2]s"}],
+				"2.0": [{"filename": "foo-2.0.tar.gz", "url": "%[1]s/foo-2.0.tar.gz", "yanked": false, "yanked_reason": null, "upload_time_iso_8601": "%[3]s"}]
+			}, "urls": [{"filename": "foo-2.0.tar.gz", "url": "%[1]s/foo-2.0.tar.gz", "yanked": false, "yanked_reason": null, "upload_time_iso_8601": "%[3]s"}]}`, filesUrl, old, recent)
+		case "/pypi/foo/1.0/json", "/pypi/foo/1.1/json", "/pypi/foo/1.2/json", "/pypi/foo/2.0/json":
+			version := strings.Split(r.URL.Path, "/")[3]
+			uploadTime := old
+			if version == "2.0" {
+				uploadTime = recent
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"info": {"name": "foo", "version": "%[2]s"}, "urls": [{"filename": "foo-%[2]s.tar.gz", "url": "%[1]s/foo-%[2]s.tar.gz", "yanked": %[3]v, "upload_time_iso_8601": "%[4]s"}]}`, filesUrl, version, version == "1.1", uploadTime)
+		case "/pypi/evil/json":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{}`))
+		default:
+			if filename, ok := strings.CutPrefix(r.URL.Path, "/files/"); ok {
+				_, _ = w.Write([]byte("content of " + filename))
+				return
+			}
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func TestVersionFilter(t *testing.T) {
+	upstreamUrl := newFilterTestUpstream(t)
+	vulnFile := filepath.Join(t.TempDir(), "vulns.txt")
+	require.NoError(t, os.WriteFile(vulnFile, []byte("foo==1.2\n"), 0644))
+
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		UpstreamSimpleUrl:   utils.ToPtr(upstreamUrl + "/simple"),
+		UpstreamFilesUrl:    utils.ToPtr(upstreamUrl + "/files"),
+		UpstreamJsonApiUrl:  utils.ToPtr(upstreamUrl + "/pypi"),
+		HideYanked:          true,
+		Quarantine:          utils.ToPtr(72 * time.Hour),
+		VulnerabilitiesFile: vulnFile,
+	})
+
+	// json
+	resp, body := commontest.HttpGet(t, proxyUrl+"/simple/foo/", http.Header{"Accept": {simpleJsonContentType}})
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	var detail jsonProjectDetail
+	require.NoError(t, json.Unmarshal([]byte(body), &detail))
+	require.Len(t, detail.Files, 1)
+	assert.Equal(t, "foo-1.0.tar.gz", detail.Files[0].Filename)
+	assert.Equal(t, []string{"1.0", "1.1"}, detail.Versions) // yanked files are hidden, but the version is kept
+
+	// html. The upstream is still requested with the json format for the upload time
+	resp, body = commontest.HttpGet(t, proxyUrl+"/simple/foo/", http.Header{"Accept": {"text/html"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html"))
+	htmlDetail, err := parseProjectDetailHtml([]byte(body), utils.MustParseUrl(proxyUrl))
+	require.NoError(t, err)
+	require.Len(t, htmlDetail.Files, 1)
+	assert.Equal(t, "foo-1.0.tar.gz", htmlDetail.Files[0].Filename)
+
+	// JSON API
+	type jsonApiFile struct {
+		Filename string `json:"filename"`
+	}
+	var project struct {
+		Releases map[string][]jsonApiFile `json:"releases"`
+		Urls     []jsonApiFile            `json:"urls"`
+	}
+	resp, body = commontest.HttpGet(t, proxyUrl+"/pypi/foo/json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &project))
+	assert.Equal(t, map[string][]jsonApiFile{"1.0": {{"foo-1.0.tar.gz"}}, "1.1": {}}, project.Releases)
+	assert.Empty(t, project.Urls) // the latest version 2.0 is quarantined
+
+	resp, body = commontest.HttpGet(t, proxyUrl+"/pypi/foo/1.0/json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &project))
+	assert.Equal(t, []jsonApiFile{{"foo-1.0.tar.gz"}}, project.Urls)
+	resp, body = commontest.HttpGet(t, proxyUrl+"/pypi/foo/1.1/json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	require.NoError(t, json.Unmarshal([]byte(body), &project))
+	assert.Empty(t, project.Urls)
+	for _, version := range []string{"1.2", "2.0"} {
+		resp, _ = commontest.HttpGet(t, proxyUrl+"/pypi/foo/"+version+"/json", nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, version)
+	}
+
+	// the hidden files cannot be downloaded with the direct urls either
+	resp, body = commontest.HttpGet(t, proxyUrl+"/files/foo-1.0.tar.gz", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "content of foo-1.0.tar.gz", body)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/files/foo-1.0.tar.gz.metadata", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, filename := range []string{"foo-1.1.tar.gz", "foo-1.2.tar.gz", "foo-1.2-py3-none-any.whl", "foo-2.0.tar.gz", "foo-2.0.tar.gz.metadata", "foo-3.0.tar.gz"} {
+		resp, _ = commontest.HttpGet(t, proxyUrl+"/files/"+filename, nil)
+		assert.Equal(t, http.StatusNotFound, resp.StatusCode, filename)
+	}
+}
+
+func TestProjectWhitelist(t *testing.T) {
+	upstreamUrl := newFilterTestUpstream(t)
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		UpstreamSimpleUrl:  utils.ToPtr(upstreamUrl + "/simple"),
+		UpstreamFilesUrl:   utils.ToPtr(upstreamUrl + "/files"),
+		UpstreamJsonApiUrl: utils.ToPtr(upstreamUrl + "/pypi"),
+		ProjectsBlacklist:  []string{"Evil*"},
+	})
+
+	resp, _ := commontest.HttpGet(t, proxyUrl+"/simple/foo/", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/simple/evil/", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/pypi/evil/json", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/files/foo-1.0.tar.gz", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/files/Evil_Thing-1.0-py3-none-any.whl", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/simple/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"foo"}, parseProjectListHtml([]byte(body)).Projects)
+
+	proxyUrl = newTestProxy(t, &config.PypiRegistrySettings{
+		UpstreamSimpleUrl: utils.ToPtr(upstreamUrl + "/simple"),
+		UpstreamFilesUrl:  utils.ToPtr(upstreamUrl + "/files"),
+		ProjectsWhitelist: []string{"bar", "acme-*"},
+	})
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/simple/foo/", nil)
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/simple/acme.foo/", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode) // allowed, but not in the upstream
+}
@@ -0,0 +1,180 @@
+package pypiproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"net/http"
+)
+
+// file urls in the JSON API responses
+var jsonFileUrlKeys = []string{"url"}
+
+// serveJsonApi serves the JSON API of the project, e.g. subPath "/foo/json" or "/foo/1.0/json", from the upstreams that are allowed to serve the project
+// The upstreams are tried in priority order, until one of them has the project. The lookup stops at the first upstream without a JSON API,
+// so the lower priority upstreams are never used instead of it, to prevent dependency confusion
+//
+// version is the requested version, or empty for the whole project
+func (h *proxyHandler) serveJsonApi(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, project string, version string, subPath string) {
+	normalizedProject := normalizeProjectName(project)
+	var candidates []*upstream
+	for _, u := range upstreamsFor(h.upstreams, normalizedProject) {
+		if u.jsonApiUrl == nil {
+			break
+		}
+		candidates = append(candidates, u)
+	}
+	if len(candidates) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	urlPrefix := h.info.SelfUrl + h.info.PathPrefix
+
+	if len(candidates) == 1 {
+		u := candidates[0]
+		downstreamUrl := *r.URL
+		downstreamUrl.Scheme = u.jsonApiUrl.Scheme
+		downstreamUrl.Host = u.jsonApiUrl.Host
+		downstreamUrl.Path = u.jsonApiUrl.Path + subPath
+		responseModifier := func(_ *http.Request, resp *http.Response) error {
+			if resp.StatusCode != http.StatusOK {
+				return nil
+			}
+			return h.modifyJsonApiResponse(ctx, u, resp, urlPrefix, normalizedProject, version)
+		}
+		h.helper.RunReverseProxy(ctx, w, r, &downstreamUrl, common.WithResponseModifier(responseModifier))
+		return
+	}
+
+	client, err := h.helper.NewDownstreamClient(ctx, r.Context())
+	if err != nil {
+		h.helper.WriteError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	for i, u := range candidates {
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u.jsonApiUrl.String()+subPath, nil)
+		if err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return
+		}
+		req.Header.Set("User-Agent", r.Header.Get("User-Agent"))
+		resp, err := client.Do(req)
+		if err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return
+		}
+		if (resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone) && i < len(candidates)-1 {
+			_ = resp.Body.Close()
+			continue
+		}
+		if resp.StatusCode == http.StatusOK {
+			if err := h.modifyJsonApiResponse(ctx, u, resp, urlPrefix, normalizedProject, version); err != nil {
+				_ = resp.Body.Close()
+				h.helper.WriteError(ctx, w, err)
+				return
+			}
+		}
+		common.WriteResponse(w, resp)
+		return
+	}
+}
+
+// modifyJsonApiResponse rewrites the file urls of the upstream in the json response to the proxied file urls with the given prefix,
+// and hides the files of the filtered versions like the simple api does, see filterProjectDetail
+func (h *proxyHandler) modifyJsonApiResponse(ctx *context.RequestContext, u *upstream, resp *http.Response, urlPrefix string, normalizedProject string, version string) error {
+	if !common.IsJsonContentType(resp.Header.Get("Content-Type")) {
+		return nil
+	}
+	return common.ModifyResponseJson(ctx, resp, func(data interface{}) (interface{}, error) {
+		data = h.rewriteJsonFileUrls(data, u, urlPrefix)
+		if obj, ok := data.(map[string]interface{}); ok && h.hasVersionFilter() {
+			if !h.filterJsonApiData(ctx, normalizedProject, version, obj) {
+				return nil, common.NewHttpError(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+			}
+		}
+		return data, nil
+	})
+}
+
+// filterJsonApiData removes the hidden files from "urls" and "releases" of the decoded json response in place,
+// as well as the releases of the hidden versions. Returns false if the requested version is hidden
+func (h *proxyHandler) filterJsonApiData(ctx *context.RequestContext, normalizedProject string, version string, data map[string]interface{}) bool {
+	releases, _ := data["releases"].(map[string]interface{})
+	urls, _ := data["urls"].([]interface{})
+
+	detail := &projectDetail{}
+	addFiles := func(files []interface{}) {
+		for _, file := range files {
+			if obj, ok := file.(map[string]interface{}); ok {
+				detail.Files = append(detail.Files, parseJsonApiFile(obj))
+			}
+		}
+	}
+	for releaseVersion, files := range releases {
+		detail.Versions = append(detail.Versions, releaseVersion)
+		files, _ := files.([]interface{})
+		addFiles(files)
+	}
+	if version != "" {
+		detail.Versions = append(detail.Versions, version)
+	}
+	addFiles(urls)
+	h.filterProjectDetail(ctx, normalizedProject, detail)
+
+	keptFiles := make(map[string]bool)
+	for _, file := range detail.Files {
+		keptFiles[file.Filename] = true
+	}
+	keptVersions := make(map[string]bool)
+	for _, v := range detail.Versions {
+		keptVersions[v] = true
+	}
+	filterFiles := func(files []interface{}) []interface{} {
+		result := make([]interface{}, 0, len(files))
+		for _, file := range files {
+			if obj, ok := file.(map[string]interface{}); ok {
+				if filename, ok := obj["filename"].(string); ok && !keptFiles[filename] {
+					continue
+				}
+			}
+			result = append(result, file)
+		}
+		return result
+	}
+
+	for releaseVersion, files := range releases {
+		if !keptVersions[releaseVersion] {
+			delete(releases, releaseVersion)
+		} else if files, ok := files.([]interface{}); ok {
+			releases[releaseVersion] = filterFiles(files)
+		}
+	}
+	if urls != nil {
+		data["urls"] = filterFiles(urls)
+	}
+	return version == "" || keptVersions[version]
+}
+
+// parseJsonApiFile reads the fields used in the version filtering from the file of the JSON API
+//
+// https://docs.pypi.org/api/json/#get-a-project
+func parseJsonApiFile(obj map[string]interface{}) *projectFile {
+	file := &projectFile{}
+	file.Filename, _ = obj["filename"].(string)
+	if yanked, _ := obj["yanked"].(bool); yanked {
+		reason, _ := obj["yanked_reason"].(string)
+		file.Yanked = &reason
+	}
+	if uploadTime, ok := obj["upload_time_iso_8601"].(string); ok {
+		file.UploadTime = &uploadTime
+	}
+	return file
+}
+
+// rewriteJsonFileUrls rewrites the file urls of the upstream in the decoded json to the proxied file urls with the given prefix
+func (h *proxyHandler) rewriteJsonFileUrls(data interface{}, u *upstream, urlPrefix string) interface{} {
+	return common.RewriteJsonStringFields(data, jsonFileUrlKeys, func(_, value string) string {
+		return h.toProxiedFileUrl(u, value, urlPrefix)
+	})
+}
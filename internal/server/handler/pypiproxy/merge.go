@@ -0,0 +1,347 @@
+package pypiproxy
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const maxProjectDetailSize = 64 * 1024 * 1024
+const maxProjectListSize = 256 * 1024 * 1024
+
+const preferJsonAccept = simpleJsonContentType + ", application/vnd.pypi.simple.v1+html;q=0.1, text/html;q=0.01"
+
+// upstreamPage is a successfully fetched simple api page
+type upstreamPage struct {
+	upstream    *upstream
+	pageUrl     *url.URL // the url after following redirects
+	contentType string
+	body        []byte
+}
+
+func (p *upstreamPage) isJson() bool {
+	return strings.HasPrefix(strings.ToLower(p.contentType), simpleJsonContentType)
+}
+
+// fetchSimplePage fetches the page from the upstream. Returns nil if the page does not exist
+// Other non-200 responses are treated as errors, so lower priority upstreams are not used as a fallback by mistake
+func (h *proxyHandler) fetchSimplePage(client *common.DownstreamClient, r *http.Request, u *upstream, subPath string, maxSize int64) (*upstreamPage, error) {
+	pageUrl := *u.simpleUrl
+	pageUrl.Path += subPath
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, pageUrl.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if h.settings.Quarantine != nil {
+		// the upload-time field is json only
+		req.Header.Set("Accept", preferJsonAccept)
+	} else if accept := r.Header.Get("Accept"); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	if authorization := r.Header.Get("Authorization"); authorization != "" && u.forwardAuthorize {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("upstream %+q responded %s for %s", u.name, resp.Status, pageUrl.String())
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxSize {
+		return nil, common.NewHttpError(http.StatusBadGateway, "Response too large")
+	}
+	return &upstreamPage{
+		upstream:    u,
+		pageUrl:     resp.Request.URL,
+		contentType: resp.Header.Get("Content-Type"),
+		body:        body,
+	}, nil
+}
+
+// fetchSimplePages fetches the page from all given upstreams concurrently. The results are in the same order
+func (h *proxyHandler) fetchSimplePages(client *common.DownstreamClient, r *http.Request, upstreams []*upstream, subPath string, maxSize int64) ([]*upstreamPage, error) {
+	pages := make([]*upstreamPage, len(upstreams))
+	errs := make([]error, len(upstreams))
+	var wg sync.WaitGroup
+	for i, u := range upstreams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pages[i], errs[i] = h.fetchSimplePage(client, r, u, subPath, maxSize)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pages, nil
+}
+
+func (h *proxyHandler) parseProjectDetail(page *upstreamPage) (*projectDetail, error) {
+	var detail *projectDetail
+	var err error
+	if page.isJson() {
+		detail, err = parseProjectDetailJson(page.body, page.pageUrl)
+	} else {
+		detail, err = parseProjectDetailHtml(page.body, page.pageUrl)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse project detail page from upstream %+q: %v", page.upstream.name, err)
+	}
+	for _, file := range detail.Files {
+		file.Url = h.toProxiedFileUrl(page.upstream, file.Url, h.info.PathPrefix)
+	}
+	return detail, nil
+}
+
+// toProxiedFileUrl rewrites the file url of the upstream to "<urlPrefix>/files/...", if it's under the files url of the upstream
+func (h *proxyHandler) toProxiedFileUrl(u *upstream, fileUrl string, urlPrefix string) string {
+	if rest, ok := strings.CutPrefix(fileUrl, u.filesUrlStr+"/"); ok {
+		return urlPrefix + u.filesPath() + "/" + rest
+	}
+	return fileUrl
+}
+
+// mergeProjectDetails merges the pages in priority order. For files with the same name, the first one wins
+func mergeProjectDetails(details []*projectDetail) *projectDetail {
+	merged := &projectDetail{
+		Name:       details[0].Name,
+		ApiVersion: details[0].ApiVersion,
+	}
+	seenFiles := make(map[string]bool)
+	seenVersions := make(map[string]bool)
+	for _, detail := range details {
+		if compareApiVersion(detail.ApiVersion, merged.ApiVersion) < 0 {
+			merged.ApiVersion = detail.ApiVersion
+		}
+		for _, file := range detail.Files {
+			if !seenFiles[file.Filename] {
+				seenFiles[file.Filename] = true
+				merged.Files = append(merged.Files, file)
+			}
+		}
+		for _, version := range detail.Versions {
+			if !seenVersions[version] {
+				seenVersions[version] = true
+				merged.Versions = append(merged.Versions, version)
+			}
+		}
+	}
+	return merged
+}
+
+func (h *proxyHandler) serveProjectDetail(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request, project string) {
+	normalizedProject := normalizeProjectName(project)
+	candidates := upstreamsFor(h.upstreams, normalizedProject)
+
+	client, err := h.helper.NewDownstreamClient(ctx, r.Context())
+	if err != nil {
+		h.helper.WriteError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	subPath := "/" + normalizedProject + "/"
+	var pages []*upstreamPage
+	if *h.settings.IndexStrategy == config.PypiIndexStrategyMerge {
+		if pages, err = h.fetchSimplePages(client, r, candidates, subPath, maxProjectDetailSize); err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return
+		}
+	} else {
+		for _, u := range candidates {
+			page, err := h.fetchSimplePage(client, r, u, subPath, maxProjectDetailSize)
+			if err != nil {
+				h.helper.WriteError(ctx, w, err)
+				return
+			}
+			if page != nil {
+				pages = append(pages, page)
+				break
+			}
+		}
+	}
+
+	var details []*projectDetail
+	var primaryPage *upstreamPage
+	for _, page := range pages {
+		if page == nil {
+			continue
+		}
+		detail, err := h.parseProjectDetail(page)
+		if err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return
+		}
+		if detail.Name == "" {
+			detail.Name = normalizedProject
+		}
+		if primaryPage == nil {
+			primaryPage = page
+		}
+		details = append(details, detail)
+	}
+	if len(details) == 0 {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	log.Debugf("%sServing project %+q from %d upstream(s)", ctx.LogPrefix, normalizedProject, len(details))
+
+	detail := mergeProjectDetails(details)
+	if h.hasVersionFilter() {
+		h.filterProjectDetail(ctx, normalizedProject, detail)
+	}
+
+	var body []byte
+	if clientPrefersJson(r) {
+		if body, err = renderProjectDetailJson(detail); err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return
+		}
+		writePage(w, simpleJsonContentType, body)
+	} else {
+		body = renderProjectDetailHtml(detail)
+		writePage(w, htmlContentTypeOf(primaryPage), body)
+	}
+}
+
+// clientPrefersJson checks if the client prefers the PEP 691 json format to the html format, according to the Accept header
+func clientPrefersJson(r *http.Request) bool {
+	jsonQ, htmlQ := 0.0, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qStr, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qStr, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case simpleJsonContentType, "application/vnd.pypi.simple.latest+json":
+			jsonQ = utils.Max(jsonQ, q)
+		case "text/html", "application/vnd.pypi.simple.v1+html", "application/vnd.pypi.simple.latest+html":
+			htmlQ = utils.Max(htmlQ, q)
+		}
+	}
+	return jsonQ > 0 && jsonQ >= htmlQ
+}
+
+func htmlContentTypeOf(page *upstreamPage) string {
+	if page.isJson() {
+		return "text/html"
+	}
+	return page.contentType
+}
+
+func (h *proxyHandler) serveMergedProjectList(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request) {
+	client, err := h.helper.NewDownstreamClient(ctx, r.Context())
+	if err != nil {
+		h.helper.WriteError(ctx, w, err)
+		return
+	}
+	defer client.Close()
+
+	pages, err := h.fetchSimplePages(client, r, h.upstreams, "/", maxProjectListSize)
+	if err != nil {
+		h.helper.WriteError(ctx, w, err)
+		return
+	}
+
+	var primaryPage *upstreamPage
+	merged := &projectList{}
+	seen := make(map[string]bool)
+	for _, page := range pages {
+		if page == nil {
+			continue
+		}
+		var list *projectList
+		if page.isJson() {
+			if list, err = parseProjectListJson(page.body); err != nil {
+				h.helper.WriteError(ctx, w, fmt.Errorf("failed to parse project list page from upstream %+q: %v", page.upstream.name, err))
+				return
+			}
+		} else {
+			list = parseProjectListHtml(page.body)
+		}
+		if primaryPage == nil {
+			primaryPage = page
+			merged.ApiVersion = list.ApiVersion
+		} else if compareApiVersion(list.ApiVersion, merged.ApiVersion) < 0 {
+			merged.ApiVersion = list.ApiVersion
+		}
+
+		for _, name := range list.Projects {
+			normalized := normalizeProjectName(name)
+			if seen[normalized] || !h.isProjectAllowed(normalized) {
+				continue
+			}
+			// only list the projects that the upstream is allowed to serve
+			for _, u := range upstreamsFor(h.upstreams, normalized) {
+				if u == page.upstream {
+					seen[normalized] = true
+					merged.Projects = append(merged.Projects, name)
+					break
+				}
+			}
+		}
+	}
+	if primaryPage == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	sort.Slice(merged.Projects, func(i, j int) bool {
+		return normalizeProjectName(merged.Projects[i]) < normalizeProjectName(merged.Projects[j])
+	})
+
+	var body []byte
+	if primaryPage.isJson() {
+		if body, err = renderProjectListJson(merged); err != nil {
+			h.helper.WriteError(ctx, w, err)
+			return
+		}
+	} else {
+		body = renderProjectListHtml(merged, func(name string) string {
+			return h.info.PathPrefix + "/simple/" + normalizeProjectName(name) + "/"
+		})
+	}
+	writePage(w, primaryPage.contentType, body)
+}
+
+func writePage(w http.ResponseWriter, contentType string, body []byte) {
+	if contentType == "" {
+		contentType = "text/html"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,245 @@
+package pypiproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newTestIndex creates a simple index upstream with the given project -> files mapping. It serves html only, and the JSON API
+func newTestIndex(t *testing.T, name string, projects map[string][]string, broken *atomic.Bool) string {
+	return newTestUpstream(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if broken != nil && broken.Load() {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		filesUrl := "http://" + r.Host + "/files"
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/simple/" {
+			for project := range projects {
+				_, _ = fmt.Fprintf(w, `<a href="/simple/%s/">%s</a>`, project, project)
+			}
+			return
+		}
+		if project, ok := strings.CutPrefix(r.URL.Path, "/simple/"); ok {
+			files, ok := projects[strings.TrimSuffix(project, "/")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			for _, file := range files {
+				_, _ = fmt.Fprintf(w, `<a href="%s/%s#sha256=%s">%s</a>`, filesUrl, file, name, file)
+			}
+			return
+		}
+		if project, ok := strings.CutPrefix(r.URL.Path, "/pypi/"); ok {
+			files, ok := projects[strings.TrimSuffix(project, "/json")]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			var urls []string
+			for _, file := range files {
+				urls = append(urls, fmt.Sprintf(`{"filename": "%s", "url": "%s/%s"}`, file, filesUrl, file))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"info": {"name": "%s"}, "urls": [%s]}`, name, strings.Join(urls, ", "))
+			return
+		}
+		if file, ok := strings.CutPrefix(r.URL.Path, "/files/"); ok {
+			_, _ = w.Write([]byte(name + ":" + file))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+}
+
+type mergeTestEnv struct {
+	proxyUrl      string
+	privateBroken *atomic.Bool
+}
+
+func newMergeTestEnv(t *testing.T, strategy config.PypiIndexStrategy) *mergeTestEnv {
+	env := &mergeTestEnv{privateBroken: &atomic.Bool{}}
+	privateUrl := newTestIndex(t, "private", map[string][]string{
+		"acme-foo": {"acme_foo-1.0.tar.gz"},
+		"requests": {"requests-2.0.tar.gz"},
+	}, env.privateBroken)
+	publicUrl := newTestIndex(t, "public", map[string][]string{
+		"acme-foo": {"acme_foo-99.0.tar.gz"}, // dependency confusion
+		"requests": {"requests-2.0.tar.gz", "requests-3.0.tar.gz"},
+		"numpy":    {"numpy-2.0.tar.gz"},
+	}, nil)
+
+	env.proxyUrl = newTestProxy(t, &config.PypiRegistrySettings{
+		Upstreams: []*config.PypiUpstreamConfig{
+			{Name: "private", SimpleUrl: privateUrl + "/simple", FilesUrl: privateUrl + "/files", JsonApiUrl: privateUrl + "/pypi", Projects: []string{"acme-*"}},
+			{Name: "public", SimpleUrl: publicUrl + "/simple", FilesUrl: publicUrl + "/files", JsonApiUrl: publicUrl + "/pypi"},
+		},
+		IndexStrategy: utils.ToPtr(strategy),
+	})
+	return env
+}
+
+func getJsonApiFiles(t *testing.T, proxyUrl string, project string) (int, []string) {
+	resp, body := commontest.HttpGet(t, proxyUrl+"/pypi/"+project+"/json", nil)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	var data struct {
+		Info struct {
+			Name string `json:"name"`
+		} `json:"info"`
+		Urls []struct {
+			Url string `json:"url"`
+		} `json:"urls"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &data))
+	var files []string
+	for _, file := range data.Urls {
+		files = append(files, strings.TrimPrefix(file.Url, proxyUrl)+"#"+data.Info.Name)
+	}
+	return resp.StatusCode, files
+}
+
+func (e *mergeTestEnv) getFiles(t *testing.T, project string) (int, []string) {
+	resp, body := commontest.HttpGet(t, e.proxyUrl+"/simple/"+project+"/", nil)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	detail, err := parseProjectDetailHtml([]byte(body), utils.MustParseUrl(e.proxyUrl))
+	require.NoError(t, err)
+	var files []string
+	for _, file := range detail.Files {
+		files = append(files, strings.TrimPrefix(file.Url, e.proxyUrl)+"#"+file.Hashes["sha256"])
+	}
+	return resp.StatusCode, files
+}
+
+func TestIndexFirstMatch(t *testing.T) {
+	env := newMergeTestEnv(t, config.PypiIndexStrategyFirstMatch)
+
+	status, files := env.getFiles(t, "acme-foo")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/private/acme_foo-1.0.tar.gz#private"}, files)
+
+	status, files = env.getFiles(t, "Requests")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/private/requests-2.0.tar.gz#private"}, files)
+
+	status, files = env.getFiles(t, "numpy")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/public/numpy-2.0.tar.gz#public"}, files)
+
+	status, _ = env.getFiles(t, "acme-bar") // pinned, not in private
+	assert.Equal(t, http.StatusNotFound, status)
+
+	resp, body := commontest.HttpGet(t, env.proxyUrl+"/files/private/acme_foo-1.0.tar.gz", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "private:acme_foo-1.0.tar.gz", body)
+	resp, _ = commontest.HttpGet(t, env.proxyUrl+"/files/unknown/a.tar.gz", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestIndexMerge(t *testing.T) {
+	env := newMergeTestEnv(t, config.PypiIndexStrategyMerge)
+
+	status, files := env.getFiles(t, "requests")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/private/requests-2.0.tar.gz#private", "/files/public/requests-3.0.tar.gz#public"}, files)
+
+	status, files = env.getFiles(t, "acme-foo")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/private/acme_foo-1.0.tar.gz#private"}, files)
+}
+
+func TestIndexUpstreamFailure(t *testing.T) {
+	env := newMergeTestEnv(t, config.PypiIndexStrategyFirstMatch)
+	env.privateBroken.Store(true)
+
+	// must not fall back to the lower priority upstream
+	status, _ := env.getFiles(t, "requests")
+	assert.Equal(t, http.StatusBadGateway, status)
+	status, _ = env.getFiles(t, "acme-foo")
+	assert.Equal(t, http.StatusBadGateway, status)
+}
+
+func TestIndexProjectListMerge(t *testing.T) {
+	env := newMergeTestEnv(t, config.PypiIndexStrategyFirstMatch)
+
+	resp, body := commontest.HttpGet(t, env.proxyUrl+"/simple/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	list := parseProjectListHtml([]byte(body))
+	assert.Equal(t, []string{"acme-foo", "numpy", "requests"}, list.Projects)
+	assert.Contains(t, body, `href="/simple/numpy/"`)
+}
+
+func TestIndexJsonFormat(t *testing.T) {
+	upstreamUrl, _ := newTestPypiUpstream(t)
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		Upstreams: []*config.PypiUpstreamConfig{
+			{Name: "main", SimpleUrl: upstreamUrl + "/simple", FilesUrl: upstreamUrl + "/files"},
+		},
+	})
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/simple/foo/", http.Header{"Accept": {simpleJsonContentType}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, simpleJsonContentType, resp.Header.Get("Content-Type"))
+	var detail jsonProjectDetail
+	require.NoError(t, json.Unmarshal([]byte(body), &detail))
+	require.Len(t, detail.Files, 1)
+	assert.Equal(t, "/files/main"+testWheelPath, detail.Files[0].Url)
+}
+
+func TestIndexJsonApi(t *testing.T) {
+	env := newMergeTestEnv(t, config.PypiIndexStrategyFirstMatch)
+
+	status, files := getJsonApiFiles(t, env.proxyUrl, "acme-foo")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/private/acme_foo-1.0.tar.gz#private"}, files)
+
+	status, files = getJsonApiFiles(t, env.proxyUrl, "requests")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/private/requests-2.0.tar.gz#private"}, files)
+
+	status, files = getJsonApiFiles(t, env.proxyUrl, "numpy")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []string{"/files/public/numpy-2.0.tar.gz#public"}, files)
+
+	status, _ = getJsonApiFiles(t, env.proxyUrl, "acme-bar") // pinned, not in private
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestIndexJsonApiPinnedWithoutJsonApi(t *testing.T) {
+	privateUrl := newTestIndex(t, "private", map[string][]string{
+		"acme-foo": {"acme_foo-1.0.tar.gz"},
+	}, nil)
+	publicUrl := newTestIndex(t, "public", map[string][]string{
+		"acme-foo": {"acme_foo-99.0.tar.gz"}, // dependency confusion
+		"numpy":    {"numpy-2.0.tar.gz"},
+	}, nil)
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		Upstreams: []*config.PypiUpstreamConfig{
+			{Name: "private", SimpleUrl: privateUrl + "/simple", FilesUrl: privateUrl + "/files", Projects: []string{"acme-*"}},
+			{Name: "public", SimpleUrl: publicUrl + "/simple", FilesUrl: publicUrl + "/files", JsonApiUrl: publicUrl + "/pypi"},
+		},
+	})
+
+	// the pinned upstream has no JSON API, the public one must not be used instead
+	status, _ := getJsonApiFiles(t, proxyUrl, "acme-foo")
+	assert.Equal(t, http.StatusNotFound, status)
+	status, _ = getJsonApiFiles(t, proxyUrl, "acme-bar")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	// same for the projects that are not pinned, since the private upstream has the higher priority
+	status, _ = getJsonApiFiles(t, proxyUrl, "numpy")
+	assert.Equal(t, http.StatusNotFound, status)
+}
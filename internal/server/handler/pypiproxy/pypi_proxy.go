@@ -8,8 +8,10 @@ import (
 	"github.com/Fallen-Breath/pavonis/internal/server/handler"
 	"net/http"
 	"net/url"
+	"path"
 	"regexp"
 	"strings"
+	"sync/atomic"
 )
 
 type proxyHandler struct {
@@ -17,29 +19,49 @@ type proxyHandler struct {
 	helper   *common.RequestHelper
 	settings *config.PypiRegistrySettings
 
-	upstreamSimpleUrl *url.URL
-	upstreamFilesUrl  *url.URL
+	upstreams []*upstream // in priority order, at least 1 element
+	uploadUrl *url.URL    // might be nil
+
+	whitelist       projectPatterns
+	blacklist       projectPatterns
+	vulnerabilities atomic.Pointer[vulnerabilities]
+	shutdownChannel chan bool
 }
 
 var _ handler.HttpHandler = &proxyHandler{}
 
 func NewProxyHandler(info *handler.Info, helper *common.RequestHelper, settings *config.PypiRegistrySettings) (handler.HttpHandler, error) {
-	var err error
-	var upstreamSimpleUrl, upstreamTokenUrl *url.URL
-	if upstreamSimpleUrl, err = url.Parse(*settings.UpstreamSimpleUrl); err != nil {
-		return nil, fmt.Errorf("invalid UpstreamSimpleUrl %v: %v", settings.UpstreamSimpleUrl, err)
+	upstreams, err := newUpstreams(settings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstreams: %v", err)
+	}
+	var uploadUrl *url.URL
+	if settings.UploadUrl != nil {
+		if uploadUrl, err = url.Parse(*settings.UploadUrl); err != nil {
+			return nil, fmt.Errorf("invalid UploadUrl %v: %v", settings.UploadUrl, err)
+		}
 	}
-	if upstreamTokenUrl, err = url.Parse(*settings.UpstreamFilesUrl); err != nil {
-		return nil, fmt.Errorf("invalid UpstreamFilesUrl %v: %v", settings.UpstreamFilesUrl, err)
+
+	h := &proxyHandler{
+		info:            info,
+		helper:          helper,
+		settings:        settings,
+		upstreams:       upstreams,
+		uploadUrl:       uploadUrl,
+		whitelist:       newProjectPatterns(settings.ProjectsWhitelist),
+		blacklist:       newProjectPatterns(settings.ProjectsBlacklist),
+		shutdownChannel: make(chan bool, 1),
 	}
 
-	return &proxyHandler{
-		info:              info,
-		helper:            helper,
-		settings:          settings,
-		upstreamSimpleUrl: upstreamSimpleUrl,
-		upstreamFilesUrl:  upstreamTokenUrl,
-	}, nil
+	vulns, err := h.loadVulnerabilities()
+	if err != nil {
+		return nil, err
+	}
+	h.vulnerabilities.Store(&vulns)
+
+	go h.backgroundReloadThread()
+
+	return h, nil
 }
 
 func (h *proxyHandler) Info() *handler.Info {
@@ -47,6 +69,7 @@ func (h *proxyHandler) Info() *handler.Info {
 }
 
 func (h *proxyHandler) Shutdown() {
+	h.shutdownChannel <- true
 }
 
 // https://peps.python.org/pep-0691/#project-list
@@ -54,6 +77,23 @@ func (h *proxyHandler) Shutdown() {
 var projectListPathPattern = regexp.MustCompile("^/simple/?$")
 var projectDetailPathPattern = regexp.MustCompile("^/simple/[^/]+/?$")
 
+// https://docs.pypi.org/api/json/
+var jsonApiPathPattern = regexp.MustCompile("^/pypi/([^/]+)(/[^/]+)?/json/?$")
+
+// https://docs.pypi.org/api/upload/, e.g. "twine upload --repository-url https://pavonis.example.com/legacy/"
+var uploadPathPattern = regexp.MustCompile("^/legacy/?$")
+
+// findFilesUpstream returns the upstream whose proxied files path contains the given path
+func (h *proxyHandler) findFilesUpstream(reqPath string) *upstream {
+	for _, u := range h.upstreams {
+		filesPath := u.filesPath()
+		if reqPath == filesPath || strings.HasPrefix(reqPath, filesPath+"/") {
+			return u
+		}
+	}
+	return nil
+}
+
 func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWriter, r *http.Request) {
 	settingPathPrefix := h.info.PathPrefix
 	if !strings.HasPrefix(r.URL.Path, settingPathPrefix) {
@@ -61,14 +101,47 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 	}
 	reqPath := r.URL.Path[len(settingPathPrefix):]
 
+	if projectDetailPathPattern.MatchString(reqPath) {
+		project := strings.Trim(reqPath[len("/simple/"):], "/")
+		if !h.checkProjectWhitelist(ctx, w, project) {
+			return
+		}
+		// with nothing to merge or to filter, the page is passed through, so the caching headers are kept for conditional requests
+		if len(h.upstreams) > 1 || h.hasVersionFilter() {
+			h.serveProjectDetail(ctx, w, r, project)
+			return
+		}
+	}
+	if projectListPathPattern.MatchString(reqPath) && (len(h.upstreams) > 1 || h.hasProjectFilter()) {
+		h.serveMergedProjectList(ctx, w, r)
+		return
+	}
+	if matches := jsonApiPathPattern.FindStringSubmatch(reqPath); matches != nil {
+		if h.checkProjectWhitelist(ctx, w, matches[1]) {
+			h.serveJsonApi(ctx, w, r, matches[1], strings.TrimPrefix(matches[2], "/"), reqPath[len("/pypi"):])
+		}
+		return
+	}
+
 	var targetUrl *url.URL
 	var pathPrefix string
 	if strings.HasPrefix(reqPath, "/simple") {
-		targetUrl = h.upstreamSimpleUrl
+		targetUrl = h.upstreams[0].simpleUrl
 		pathPrefix = "/simple"
-	} else if strings.HasPrefix(reqPath, "/files") {
-		targetUrl = h.upstreamFilesUrl
-		pathPrefix = "/files"
+	} else if u := h.findFilesUpstream(reqPath); u != nil {
+		if !h.checkFileDownload(ctx, w, r, u, path.Base(reqPath)) {
+			return
+		}
+		targetUrl = u.filesUrl
+		pathPrefix = u.filesPath()
+	} else if h.uploadUrl != nil && uploadPathPattern.MatchString(reqPath) {
+		if r.Method != http.MethodPost {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		uploadUrl := *h.uploadUrl
+		h.helper.RunReverseProxy(ctx, w, r, &uploadUrl)
+		return
 	} else {
 		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 		return
@@ -84,7 +157,7 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 			return nil
 		}
 
-		isPypiJson := resp.Header.Get("Content-Type") == "application/vnd.pypi.simple.v1+json"
+		isPypiJson := common.IsJsonContentType(resp.Header.Get("Content-Type"))
 		if projectListPathPattern.MatchString(reqPath) {
 			if isPypiJson {
 				// do nothing
@@ -96,17 +169,16 @@ func (h *proxyHandler) ServeHttp(ctx *context.RequestContext, w http.ResponseWri
 				)
 			}
 		} else if projectDetailPathPattern.MatchString(reqPath) {
+			u := h.upstreams[0]
 			if isPypiJson {
-				return common.ModifyResponseBody(
-					ctx, resp,
-					fmt.Sprintf(`"url":"%s/`, *h.settings.UpstreamFilesUrl),
-					fmt.Sprintf(`"url":"%s/files/`, settingPathPrefix),
-				)
+				return common.ModifyResponseJson(ctx, resp, func(data interface{}) (interface{}, error) {
+					return h.rewriteJsonFileUrls(data, u, settingPathPrefix), nil
+				})
 			} else {
 				return common.ModifyResponseBody(
 					ctx, resp,
-					fmt.Sprintf(`href="%s/`, *h.settings.UpstreamFilesUrl),
-					fmt.Sprintf(`href="%s/files/`, settingPathPrefix),
+					fmt.Sprintf(`href="%s/`, u.filesUrlStr),
+					fmt.Sprintf(`href="%s%s/`, settingPathPrefix, u.filesPath()),
 				)
 			}
 		}
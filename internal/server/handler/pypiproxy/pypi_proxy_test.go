@@ -0,0 +1,152 @@
+package pypiproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testWheelPath = "/packages/ab/cd/foo-1.0-py3-none-any.whl"
+
+func newTestPypiUpstream(t *testing.T) (upstreamUrl string, uploads *[]string) {
+	uploads = &[]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/simple/foo/", func(w http.ResponseWriter, r *http.Request) {
+		filesUrl := "http://" + r.Host + "/files"
+		w.Header().Set("ETag", `"foo-1"`)
+		if r.Header.Get("If-None-Match") == `"foo-1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		if strings.Contains(r.Header.Get("Accept"), "json") {
+			w.Header().Set("Content-Type", "application/vnd.pypi.simple.v1+json")
+			_, _ = fmt.Fprintf(w, `{"meta": {"api-version": "1.1"}, "name": "foo", "files": [{"filename": "foo-1.0-py3-none-any.whl", "url": "%s%s", "hashes": {"sha256": "aaa"}, "core-metadata": {"sha256": "bbb"}, "dist-info-metadata": {"sha256": "bbb"}}]}`, filesUrl, testWheelPath)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		_, _ = fmt.Fprintf(w, `<a href="%s%s#sha256=aaa" data-dist-info-metadata="sha256=bbb" data-core-metadata="sha256=bbb">foo-1.0-py3-none-any.whl</a>`, filesUrl, testWheelPath)
+	})
+	mux.HandleFunc("/files"+testWheelPath, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("wheel"))
+	})
+	mux.HandleFunc("/files"+testWheelPath+".metadata", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("Metadata-Version: 2.1\nName: foo\nVersion: 1.0\n"))
+	})
+	mux.HandleFunc("/pypi/foo/json", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprintf(w, `{"info": {"name": "foo", "version": "1.0", "project_url": "https://pypi.org/project/foo/"}, "last_serial": 12345678901234567, "urls": [{"url": "http://%s/files%s", "digests": {"sha256": "aaa"}}]}`, r.Host, testWheelPath)
+	})
+	mux.HandleFunc("/legacy/", func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ := r.BasicAuth()
+		*uploads = append(*uploads, r.Method+" "+user+" "+r.FormValue(":action")+" "+r.FormValue("name"))
+		w.WriteHeader(http.StatusOK)
+	})
+	upstreamUrl = newTestUpstream(t, mux)
+	return upstreamUrl, uploads
+}
+
+func TestSimpleAndMetadata(t *testing.T) {
+	upstreamUrl, _ := newTestPypiUpstream(t)
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		UpstreamSimpleUrl: utils.ToPtr(upstreamUrl + "/simple"),
+		UpstreamFilesUrl:  utils.ToPtr(upstreamUrl + "/files"),
+	})
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/simple/foo/", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, `href="/files`+testWheelPath+`#sha256=aaa"`)
+	assert.Contains(t, body, `data-dist-info-metadata="sha256=bbb"`)
+	assert.Contains(t, body, `data-core-metadata="sha256=bbb"`)
+
+	resp, body = commontest.HttpGet(t, proxyUrl+"/simple/foo/", http.Header{"Accept": {"application/vnd.pypi.simple.v1+json"}})
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var detail struct {
+		Files []struct {
+			Url              string            `json:"url"`
+			Hashes           map[string]string `json:"hashes"`
+			CoreMetadata     map[string]string `json:"core-metadata"`
+			DistInfoMetadata map[string]string `json:"dist-info-metadata"`
+		} `json:"files"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &detail))
+	require.Len(t, detail.Files, 1)
+	assert.Equal(t, "/files"+testWheelPath, detail.Files[0].Url)
+	assert.Equal(t, "aaa", detail.Files[0].Hashes["sha256"])
+	assert.Equal(t, "bbb", detail.Files[0].CoreMetadata["sha256"])
+	assert.Equal(t, "bbb", detail.Files[0].DistInfoMetadata["sha256"])
+
+	// passed through, with the conditional requests supported
+	assert.Equal(t, `"foo-1"`, resp.Header.Get("ETag"))
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/simple/foo/", http.Header{"If-None-Match": {`"foo-1"`}})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, body = commontest.HttpGet(t, proxyUrl+"/files"+testWheelPath+".metadata", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "Metadata-Version: 2.1\nName: foo\nVersion: 1.0\n", body)
+}
+
+func TestJsonApi(t *testing.T) {
+	upstreamUrl, _ := newTestPypiUpstream(t)
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		UpstreamSimpleUrl:  utils.ToPtr(upstreamUrl + "/simple"),
+		UpstreamFilesUrl:   utils.ToPtr(upstreamUrl + "/files"),
+		UpstreamJsonApiUrl: utils.ToPtr(upstreamUrl + "/pypi"),
+	})
+
+	resp, body := commontest.HttpGet(t, proxyUrl+"/pypi/foo/json", nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode, body)
+	assert.Contains(t, body, `"url":"`+proxyUrl+"/files"+testWheelPath+`"`)
+	assert.Contains(t, body, `"project_url":"https://pypi.org/project/foo/"`)
+	assert.Contains(t, body, `12345678901234567`)
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/pypi/foo/1.0/json", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode) // not served by the test upstream, but routed
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/pypi/foo/bar/baz/json", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestJsonApiDisabled(t *testing.T) {
+	upstreamUrl, _ := newTestPypiUpstream(t)
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		UpstreamSimpleUrl: utils.ToPtr(upstreamUrl + "/simple"),
+		UpstreamFilesUrl:  utils.ToPtr(upstreamUrl + "/files"),
+	})
+
+	resp, _ := commontest.HttpGet(t, proxyUrl+"/pypi/foo/json", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp, err := http.Post(proxyUrl+"/legacy/", "text/plain", strings.NewReader(""))
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestUpload(t *testing.T) {
+	upstreamUrl, uploads := newTestPypiUpstream(t)
+	proxyUrl := newTestProxy(t, &config.PypiRegistrySettings{
+		UpstreamSimpleUrl: utils.ToPtr(upstreamUrl + "/simple"),
+		UpstreamFilesUrl:  utils.ToPtr(upstreamUrl + "/files"),
+		UploadUrl:         utils.ToPtr(upstreamUrl + "/legacy/"),
+	})
+
+	req, err := http.NewRequest(http.MethodPost, proxyUrl+"/legacy/", strings.NewReader(":action=file_upload&name=foo"))
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("__token__", "pypi-xxx")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"POST __token__ file_upload foo"}, *uploads)
+
+	resp, _ = commontest.HttpGet(t, proxyUrl+"/legacy/", nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
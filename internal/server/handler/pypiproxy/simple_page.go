@@ -0,0 +1,416 @@
+package pypiproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Models and codecs of the simple repository API pages
+//
+// HTML: https://peps.python.org/pep-0503/, with https://peps.python.org/pep-0592/ (yanked), https://peps.python.org/pep-0658/ and https://peps.python.org/pep-0714/ (metadata)
+// JSON: https://peps.python.org/pep-0691/, with https://peps.python.org/pep-0700/ (versions, size, upload-time)
+
+const simpleJsonContentType = "application/vnd.pypi.simple.v1+json"
+
+type fileMetadata struct {
+	Hashes map[string]string // might be empty, if the metadata file exists but the hash is unknown
+}
+
+type projectFile struct {
+	Filename       string
+	Url            string // absolute, without the fragment
+	Hashes         map[string]string
+	RequiresPython string
+	Yanked         *string // nil if not yanked, otherwise the reason, which might be empty
+	Metadata       *fileMetadata
+	GpgSig         *bool
+	Size           *int64  // json only
+	UploadTime     *string // json only, ISO 8601
+}
+
+type projectDetail struct {
+	Name       string
+	ApiVersion string
+	Files      []*projectFile
+	Versions   []string // json only, since api version 1.1
+}
+
+type projectList struct {
+	ApiVersion string
+	Projects   []string
+}
+
+func compareApiVersion(a, b string) int {
+	var aMajor, aMinor, bMajor, bMinor int
+	_, _ = fmt.Sscanf(a, "%d.%d", &aMajor, &aMinor)
+	_, _ = fmt.Sscanf(b, "%d.%d", &bMajor, &bMinor)
+	if aMajor != bMajor {
+		return aMajor - bMajor
+	}
+	return aMinor - bMinor
+}
+
+func resolveUrl(baseUrl *url.URL, ref string) (string, string, error) {
+	u, err := baseUrl.Parse(ref)
+	if err != nil {
+		return "", "", err
+	}
+	fragment := u.Fragment
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String(), fragment, nil
+}
+
+// ---------------------------------- HTML ----------------------------------
+
+var htmlAnchorPattern = regexp.MustCompile(`(?is)<a\s([^>]*)>(.*?)</a\s*>`)
+var htmlMetaPattern = regexp.MustCompile(`(?is)<meta\s([^>]*)>`)
+var htmlAttrPattern = regexp.MustCompile(`([a-zA-Z_:][-a-zA-Z0-9_:.]*)(?:\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'=<>` + "`" + `]+)))?`)
+var htmlTagPattern = regexp.MustCompile(`<[^>]*>`)
+
+func parseHtmlAttrs(attrsStr string) map[string]string {
+	attrs := make(map[string]string)
+	for _, match := range htmlAttrPattern.FindAllStringSubmatch(attrsStr, -1) {
+		value := match[2] + match[3] + match[4] // at most one of them is non-empty
+		attrs[strings.ToLower(match[1])] = html.UnescapeString(value)
+	}
+	return attrs
+}
+
+func parseHtmlApiVersion(body []byte) string {
+	for _, match := range htmlMetaPattern.FindAllSubmatch(body, -1) {
+		attrs := parseHtmlAttrs(string(match[1]))
+		if attrs["name"] == "pypi:repository-version" && attrs["content"] != "" {
+			return attrs["content"]
+		}
+	}
+	return "1.0"
+}
+
+type htmlAnchor struct {
+	Attrs map[string]string
+	Text  string
+}
+
+func parseHtmlAnchors(body []byte) []htmlAnchor {
+	var anchors []htmlAnchor
+	for _, match := range htmlAnchorPattern.FindAllSubmatch(body, -1) {
+		anchors = append(anchors, htmlAnchor{
+			Attrs: parseHtmlAttrs(string(match[1])),
+			Text:  strings.TrimSpace(html.UnescapeString(htmlTagPattern.ReplaceAllString(string(match[2]), ""))),
+		})
+	}
+	return anchors
+}
+
+// parseHashFragment parses "sha256=abc"
+func parseHashFragment(fragment string) map[string]string {
+	hashes := make(map[string]string)
+	if name, value, ok := strings.Cut(fragment, "="); ok && name != "" && value != "" {
+		hashes[strings.ToLower(name)] = value
+	}
+	return hashes
+}
+
+func parseProjectDetailHtml(body []byte, pageUrl *url.URL) (*projectDetail, error) {
+	detail := &projectDetail{
+		ApiVersion: parseHtmlApiVersion(body),
+	}
+	for _, anchor := range parseHtmlAnchors(body) {
+		href, ok := anchor.Attrs["href"]
+		if !ok {
+			continue
+		}
+		fileUrl, fragment, err := resolveUrl(pageUrl, href)
+		if err != nil {
+			return nil, fmt.Errorf("invalid href %+q: %v", href, err)
+		}
+
+		file := &projectFile{
+			Filename:       anchor.Text,
+			Url:            fileUrl,
+			Hashes:         parseHashFragment(fragment),
+			RequiresPython: anchor.Attrs["data-requires-python"],
+		}
+		if file.Filename == "" {
+			file.Filename = path.Base(fileUrl)
+		}
+		if reason, ok := anchor.Attrs["data-yanked"]; ok {
+			file.Yanked = &reason
+		}
+		metadata, ok := anchor.Attrs["data-core-metadata"]
+		if !ok {
+			metadata, ok = anchor.Attrs["data-dist-info-metadata"]
+		}
+		if ok && metadata != "false" {
+			file.Metadata = &fileMetadata{Hashes: parseHashFragment(metadata)}
+		}
+		if gpgSig, ok := anchor.Attrs["data-gpg-sig"]; ok {
+			value := gpgSig == "true"
+			file.GpgSig = &value
+		}
+		detail.Files = append(detail.Files, file)
+	}
+	return detail, nil
+}
+
+func parseProjectListHtml(body []byte) *projectList {
+	list := &projectList{
+		ApiVersion: parseHtmlApiVersion(body),
+	}
+	for _, anchor := range parseHtmlAnchors(body) {
+		if anchor.Text != "" {
+			list.Projects = append(list.Projects, anchor.Text)
+		}
+	}
+	return list
+}
+
+// selectFragmentHash selects the hash to be put in the url fragment, sha256 is preferred
+func selectFragmentHash(hashes map[string]string) (string, bool) {
+	if value, ok := hashes["sha256"]; ok {
+		return "sha256=" + value, true
+	}
+	names := make([]string, 0, len(hashes))
+	for name := range hashes {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	sort.Strings(names)
+	return names[0] + "=" + hashes[names[0]], true
+}
+
+func writeHtmlHeader(buf *bytes.Buffer, apiVersion string, title string) {
+	buf.WriteString("<!DOCTYPE html>\n<html>\n  <head>\n")
+	_, _ = fmt.Fprintf(buf, "    <meta name=\"pypi:repository-version\" content=\"%s\">\n", html.EscapeString(apiVersion))
+	_, _ = fmt.Fprintf(buf, "    <title>%s</title>\n  </head>\n  <body>\n", html.EscapeString(title))
+	_, _ = fmt.Fprintf(buf, "    <h1>%s</h1>\n", html.EscapeString(title))
+}
+
+func writeHtmlFooter(buf *bytes.Buffer) {
+	buf.WriteString("  </body>\n</html>\n")
+}
+
+func renderProjectDetailHtml(detail *projectDetail) []byte {
+	buf := &bytes.Buffer{}
+	writeHtmlHeader(buf, detail.ApiVersion, "Links for "+detail.Name)
+	for _, file := range detail.Files {
+		href := file.Url
+		if fragment, ok := selectFragmentHash(file.Hashes); ok {
+			href += "#" + fragment
+		}
+		_, _ = fmt.Fprintf(buf, `    <a href="%s"`, html.EscapeString(href))
+		if file.RequiresPython != "" {
+			_, _ = fmt.Fprintf(buf, ` data-requires-python="%s"`, html.EscapeString(file.RequiresPython))
+		}
+		if file.Metadata != nil {
+			value := "true"
+			if fragment, ok := selectFragmentHash(file.Metadata.Hashes); ok {
+				value = fragment
+			}
+			// both attributes for compatibility, see PEP 714
+			_, _ = fmt.Fprintf(buf, ` data-dist-info-metadata="%s" data-core-metadata="%s"`, html.EscapeString(value), html.EscapeString(value))
+		}
+		if file.GpgSig != nil {
+			_, _ = fmt.Fprintf(buf, ` data-gpg-sig="%v"`, *file.GpgSig)
+		}
+		if file.Yanked != nil {
+			_, _ = fmt.Fprintf(buf, ` data-yanked="%s"`, html.EscapeString(*file.Yanked))
+		}
+		_, _ = fmt.Fprintf(buf, ">%s</a><br />\n", html.EscapeString(file.Filename))
+	}
+	writeHtmlFooter(buf)
+	return buf.Bytes()
+}
+
+// renderProjectListHtml renders the project list page. projectUrl returns the url of the project detail page
+func renderProjectListHtml(list *projectList, projectUrl func(name string) string) []byte {
+	buf := &bytes.Buffer{}
+	writeHtmlHeader(buf, list.ApiVersion, "Simple index")
+	for _, name := range list.Projects {
+		_, _ = fmt.Fprintf(buf, "    <a href=\"%s\">%s</a><br />\n", html.EscapeString(projectUrl(name)), html.EscapeString(name))
+	}
+	writeHtmlFooter(buf)
+	return buf.Bytes()
+}
+
+// ---------------------------------- JSON ----------------------------------
+
+type jsonMeta struct {
+	ApiVersion string `json:"api-version"`
+}
+
+type jsonFile struct {
+	Filename         string            `json:"filename"`
+	Url              string            `json:"url"`
+	Hashes           map[string]string `json:"hashes"`
+	RequiresPython   *string           `json:"requires-python,omitempty"`
+	CoreMetadata     interface{}       `json:"core-metadata,omitempty"`      // bool, or a hash dict
+	DistInfoMetadata interface{}       `json:"dist-info-metadata,omitempty"` // bool, or a hash dict
+	GpgSig           *bool             `json:"gpg-sig,omitempty"`
+	Yanked           interface{}       `json:"yanked,omitempty"` // bool, or the reason string
+	Size             *int64            `json:"size,omitempty"`
+	UploadTime       *string           `json:"upload-time,omitempty"`
+}
+
+type jsonProjectDetail struct {
+	Meta     jsonMeta   `json:"meta"`
+	Name     string     `json:"name"`
+	Files    []jsonFile `json:"files"`
+	Versions []string   `json:"versions,omitempty"`
+}
+
+type jsonProjectList struct {
+	Meta     jsonMeta `json:"meta"`
+	Projects []struct {
+		Name string `json:"name"`
+	} `json:"projects"`
+}
+
+func parseJsonMetadata(value interface{}) *fileMetadata {
+	switch v := value.(type) {
+	case bool:
+		if v {
+			return &fileMetadata{Hashes: map[string]string{}}
+		}
+	case map[string]interface{}:
+		metadata := &fileMetadata{Hashes: map[string]string{}}
+		for name, hash := range v {
+			if hashStr, ok := hash.(string); ok {
+				metadata.Hashes[name] = hashStr
+			}
+		}
+		return metadata
+	}
+	return nil
+}
+
+func parseProjectDetailJson(body []byte, pageUrl *url.URL) (*projectDetail, error) {
+	var data jsonProjectDetail
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+
+	detail := &projectDetail{
+		Name:       data.Name,
+		ApiVersion: data.Meta.ApiVersion,
+		Versions:   data.Versions,
+	}
+	for _, f := range data.Files {
+		fileUrl, _, err := resolveUrl(pageUrl, f.Url)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url %+q: %v", f.Url, err)
+		}
+		file := &projectFile{
+			Filename:   f.Filename,
+			Url:        fileUrl,
+			Hashes:     f.Hashes,
+			GpgSig:     f.GpgSig,
+			Size:       f.Size,
+			UploadTime: f.UploadTime,
+		}
+		if file.Hashes == nil {
+			file.Hashes = map[string]string{}
+		}
+		if f.RequiresPython != nil {
+			file.RequiresPython = *f.RequiresPython
+		}
+		switch yanked := f.Yanked.(type) {
+		case bool:
+			if yanked {
+				file.Yanked = new(string)
+			}
+		case string:
+			file.Yanked = &yanked
+		}
+		if file.Metadata = parseJsonMetadata(f.CoreMetadata); file.Metadata == nil {
+			file.Metadata = parseJsonMetadata(f.DistInfoMetadata)
+		}
+		detail.Files = append(detail.Files, file)
+	}
+	return detail, nil
+}
+
+func parseProjectListJson(body []byte) (*projectList, error) {
+	var data jsonProjectList
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+	list := &projectList{
+		ApiVersion: data.Meta.ApiVersion,
+	}
+	for _, project := range data.Projects {
+		list.Projects = append(list.Projects, project.Name)
+	}
+	return list, nil
+}
+
+func renderProjectDetailJson(detail *projectDetail) ([]byte, error) {
+	data := jsonProjectDetail{
+		Meta:  jsonMeta{ApiVersion: detail.ApiVersion},
+		Name:  detail.Name,
+		Files: make([]jsonFile, 0, len(detail.Files)),
+	}
+	if compareApiVersion(detail.ApiVersion, "1.1") >= 0 {
+		data.Versions = detail.Versions
+		if data.Versions == nil {
+			data.Versions = []string{}
+		}
+	}
+	for _, file := range detail.Files {
+		f := jsonFile{
+			Filename:   file.Filename,
+			Url:        file.Url,
+			Hashes:     file.Hashes,
+			GpgSig:     file.GpgSig,
+			Size:       file.Size,
+			UploadTime: file.UploadTime,
+		}
+		if f.Hashes == nil {
+			f.Hashes = map[string]string{}
+		}
+		if file.RequiresPython != "" {
+			f.RequiresPython = &file.RequiresPython
+		}
+		if file.Yanked != nil {
+			if *file.Yanked != "" {
+				f.Yanked = *file.Yanked
+			} else {
+				f.Yanked = true
+			}
+		}
+		if file.Metadata != nil {
+			var metadata interface{} = true
+			if len(file.Metadata.Hashes) > 0 {
+				metadata = file.Metadata.Hashes
+			}
+			// both fields for compatibility, see PEP 714
+			f.CoreMetadata = metadata
+			f.DistInfoMetadata = metadata
+		}
+		data.Files = append(data.Files, f)
+	}
+	return json.Marshal(data)
+}
+
+func renderProjectListJson(list *projectList) ([]byte, error) {
+	data := jsonProjectList{
+		Meta: jsonMeta{ApiVersion: list.ApiVersion},
+	}
+	data.Projects = make([]struct {
+		Name string `json:"name"`
+	}, len(list.Projects))
+	for i, name := range list.Projects {
+		data.Projects[i].Name = name
+	}
+	return json.Marshal(data)
+}
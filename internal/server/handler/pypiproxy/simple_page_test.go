@@ -0,0 +1,94 @@
+package pypiproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+const testDetailHtml = `<!DOCTYPE html>
+<html>
+  <head>
+    <meta name="pypi:repository-version" content="1.1">
+    <title>Links for foo</title>
+  </head>
+  <body>
+    <h1>Links for foo</h1>
+    <a href="../../packages/foo-1.0.tar.gz#sha256=aaa" data-requires-python="&gt;=3.8">foo-1.0.tar.gz</a><br />
+    <a href="https://files.example.com/foo-1.1-py3-none-any.whl#sha256=bbb" data-dist-info-metadata="sha256=ccc" data-core-metadata="sha256=ccc" data-yanked="broken &amp; bad">foo-1.1-py3-none-any.whl</a><br />
+    <a href='https://files.example.com/foo-1.2.tar.gz' data-yanked data-core-metadata="true">foo-1.2.tar.gz</a>
+  </body>
+</html>`
+
+func TestProjectDetailHtml(t *testing.T) {
+	detail, err := parseProjectDetailHtml([]byte(testDetailHtml), utils.MustParseUrl("https://pypi.example.com/simple/foo/"))
+	require.NoError(t, err)
+	assert.Equal(t, "1.1", detail.ApiVersion)
+	require.Len(t, detail.Files, 3)
+
+	f := detail.Files[0]
+	assert.Equal(t, "foo-1.0.tar.gz", f.Filename)
+	assert.Equal(t, "https://pypi.example.com/packages/foo-1.0.tar.gz", f.Url)
+	assert.Equal(t, map[string]string{"sha256": "aaa"}, f.Hashes)
+	assert.Equal(t, ">=3.8", f.RequiresPython)
+	assert.Nil(t, f.Yanked)
+	assert.Nil(t, f.Metadata)
+
+	f = detail.Files[1]
+	require.NotNil(t, f.Yanked)
+	assert.Equal(t, "broken & bad", *f.Yanked)
+	require.NotNil(t, f.Metadata)
+	assert.Equal(t, map[string]string{"sha256": "ccc"}, f.Metadata.Hashes)
+
+	f = detail.Files[2]
+	require.NotNil(t, f.Yanked)
+	assert.Equal(t, "", *f.Yanked)
+	require.NotNil(t, f.Metadata)
+	assert.Empty(t, f.Metadata.Hashes)
+
+	// round trip
+	detail.Name = "foo"
+	reparsed, err := parseProjectDetailHtml(renderProjectDetailHtml(detail), utils.MustParseUrl("https://pypi.example.com/simple/foo/"))
+	require.NoError(t, err)
+	assert.Equal(t, detail.Files, reparsed.Files)
+	assert.Equal(t, detail.ApiVersion, reparsed.ApiVersion)
+}
+
+func TestProjectDetailJson(t *testing.T) {
+	const body = `{"meta": {"api-version": "1.1"}, "name": "foo", "versions": ["1.0", "1.1"], "files": [
+		{"filename": "foo-1.0.tar.gz", "url": "/packages/foo-1.0.tar.gz", "hashes": {"sha256": "aaa"}, "requires-python": ">=3.8", "size": 123, "upload-time": "2025-01-01T00:00:00.000000Z"},
+		{"filename": "foo-1.1-py3-none-any.whl", "url": "https://files.example.com/foo-1.1-py3-none-any.whl", "hashes": {}, "yanked": "bad", "dist-info-metadata": {"sha256": "ccc"}},
+		{"filename": "foo-1.1.tar.gz", "url": "https://files.example.com/foo-1.1.tar.gz", "hashes": {}, "yanked": true, "core-metadata": true}
+	]}`
+	detail, err := parseProjectDetailJson([]byte(body), utils.MustParseUrl("https://pypi.example.com/simple/foo/"))
+	require.NoError(t, err)
+	assert.Equal(t, "foo", detail.Name)
+	assert.Equal(t, []string{"1.0", "1.1"}, detail.Versions)
+	require.Len(t, detail.Files, 3)
+
+	f := detail.Files[0]
+	assert.Equal(t, "https://pypi.example.com/packages/foo-1.0.tar.gz", f.Url)
+	assert.Equal(t, ">=3.8", f.RequiresPython)
+	require.NotNil(t, f.Size)
+	assert.Equal(t, int64(123), *f.Size)
+	require.NotNil(t, f.UploadTime)
+	assert.Nil(t, f.Yanked)
+
+	f = detail.Files[1]
+	require.NotNil(t, f.Yanked)
+	assert.Equal(t, "bad", *f.Yanked)
+	assert.Equal(t, map[string]string{"sha256": "ccc"}, f.Metadata.Hashes)
+
+	f = detail.Files[2]
+	require.NotNil(t, f.Yanked)
+	assert.Equal(t, "", *f.Yanked)
+	require.NotNil(t, f.Metadata)
+
+	// round trip
+	rendered, err := renderProjectDetailJson(detail)
+	require.NoError(t, err)
+	reparsed, err := parseProjectDetailJson(rendered, utils.MustParseUrl("https://pypi.example.com/simple/foo/"))
+	require.NoError(t, err)
+	assert.Equal(t, detail, reparsed)
+}
@@ -0,0 +1,21 @@
+package pypiproxy
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newTestUpstream starts an upstream server, and returns its url
+func newTestUpstream(t *testing.T, upstreamHandler http.Handler) string {
+	upstream := httptest.NewServer(upstreamHandler)
+	t.Cleanup(upstream.Close)
+	return upstream.URL
+}
+
+// newTestProxy starts a pypi proxy server with the given settings. Returns the url of the proxy server
+func newTestProxy(t *testing.T, settings *config.PypiRegistrySettings) string {
+	return commontest.NewProxy(t, nil, config.SiteModePypiProxy, settings, NewProxyHandler, http.DefaultTransport)
+}
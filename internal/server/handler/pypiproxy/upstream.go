@@ -0,0 +1,99 @@
+package pypiproxy
+
+import (
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+type upstream struct {
+	name             string // empty for the single upstream defined by UpstreamSimpleUrl and UpstreamFilesUrl
+	simpleUrl        *url.URL
+	filesUrl         *url.URL
+	filesUrlStr      string   // no trailing '/'
+	jsonApiUrl       *url.URL // nil if the upstream has no JSON API
+	projectPatterns  projectPatterns
+	forwardAuthorize bool // if the Authorization header from the client can be sent to this upstream
+}
+
+func newUpstream(name, simpleUrlStr, filesUrlStr, jsonApiUrlStr string, projectPatterns []string) (*upstream, error) {
+	simpleUrl, err := url.Parse(simpleUrlStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid simple url %+q: %v", simpleUrlStr, err)
+	}
+	filesUrl, err := url.Parse(filesUrlStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid files url %+q: %v", filesUrlStr, err)
+	}
+	var jsonApiUrl *url.URL
+	if jsonApiUrlStr != "" {
+		if jsonApiUrl, err = url.Parse(jsonApiUrlStr); err != nil {
+			return nil, fmt.Errorf("invalid json api url %+q: %v", jsonApiUrlStr, err)
+		}
+	}
+	return &upstream{
+		name:            name,
+		simpleUrl:       simpleUrl,
+		filesUrl:        filesUrl,
+		filesUrlStr:     filesUrlStr,
+		jsonApiUrl:      jsonApiUrl,
+		projectPatterns: newProjectPatterns(projectPatterns),
+	}, nil
+}
+
+func newUpstreams(settings *config.PypiRegistrySettings) ([]*upstream, error) {
+	if len(settings.Upstreams) == 0 {
+		jsonApiUrl := ""
+		if settings.UpstreamJsonApiUrl != nil {
+			jsonApiUrl = *settings.UpstreamJsonApiUrl
+		}
+		u, err := newUpstream("", *settings.UpstreamSimpleUrl, *settings.UpstreamFilesUrl, jsonApiUrl, nil)
+		if err != nil {
+			return nil, err
+		}
+		u.forwardAuthorize = true
+		return []*upstream{u}, nil
+	}
+
+	var upstreams []*upstream
+	for _, upstreamCfg := range settings.Upstreams {
+		u, err := newUpstream(upstreamCfg.Name, upstreamCfg.SimpleUrl, upstreamCfg.FilesUrl, upstreamCfg.JsonApiUrl, upstreamCfg.Projects)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %+q: %v", upstreamCfg.Name, err)
+		}
+		upstreams = append(upstreams, u)
+	}
+	return upstreams, nil
+}
+
+// filesPath is the path of the proxied files of the upstream, relative to the site path prefix
+func (u *upstream) filesPath() string {
+	if u.name == "" {
+		return "/files"
+	}
+	return "/files/" + u.name
+}
+
+// upstreamsFor returns the upstreams that are allowed to serve the given project, in priority order
+// If the project is pinned to some upstreams, other upstreams are never used, to prevent dependency confusion
+func upstreamsFor(upstreams []*upstream, normalizedProject string) []*upstream {
+	var pinned []*upstream
+	for _, u := range upstreams {
+		if u.projectPatterns.Match(normalizedProject) {
+			pinned = append(pinned, u)
+		}
+	}
+	if len(pinned) > 0 {
+		return pinned
+	}
+	return upstreams
+}
+
+// https://packaging.python.org/en/latest/specifications/name-normalization/
+var projectNameNormalizePattern = regexp.MustCompile(`[-_.]+`)
+
+func normalizeProjectName(name string) string {
+	return strings.ToLower(projectNameNormalizePattern.ReplaceAllString(name, "-"))
+}
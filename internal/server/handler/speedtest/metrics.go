@@ -0,0 +1,27 @@
+package speedtest
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricUpstreamTtfb = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pavonis",
+		Subsystem: "speedtest",
+		Name:      "upstream_ttfb_seconds",
+		Help:      "Time to the first response byte from the upstream, in the latest measurement of each ip pool address",
+	}, []string{"site", "ip"})
+	metricUpstreamThroughput = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pavonis",
+		Subsystem: "speedtest",
+		Name:      "upstream_download_bytes_per_second",
+		Help:      "Download throughput from the upstream, in the latest measurement of each ip pool address",
+	}, []string{"site", "ip"})
+	metricUpstreamSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "pavonis",
+		Subsystem: "speedtest",
+		Name:      "upstream_success",
+		Help:      "Whether the latest measurement of each ip pool address succeeded (1) or not (0)",
+	}, []string{"site", "ip"})
+)
@@ -1,31 +1,48 @@
 package speedtest
 
 import (
-	"bytes"
+	gocontext "context"
+	"encoding/binary"
+	"encoding/json"
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/config"
 	"github.com/Fallen-Breath/pavonis/internal/server/common"
 	"github.com/Fallen-Breath/pavonis/internal/server/context"
 	"github.com/Fallen-Breath/pavonis/internal/server/handler"
 	"io"
+	"math/rand/v2"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type speedTestHandler struct {
 	info     *handler.Info
 	helper   *common.RequestHelper
 	settings *config.SpeedTestSettings
+
+	upstream       *upstreamTester // nil if the upstream measurement is disabled
+	upstreamCancel gocontext.CancelFunc
 }
 
 var _ handler.HttpHandler = &speedTestHandler{}
 
 func NewSpeedTestHandler(info *handler.Info, helper *common.RequestHelper, settings *config.SpeedTestSettings) (handler.HttpHandler, error) {
+	upstreamCtx, upstreamCancel := gocontext.WithCancel(gocontext.Background())
+	var upstream *upstreamTester
+	if settings.Upstream != nil {
+		upstream = newUpstreamTester(upstreamCtx, info.Id, helper, settings.Upstream)
+	}
+
 	return &speedTestHandler{
 		info:     info,
 		helper:   helper,
 		settings: settings,
+
+		upstream:       upstream,
+		upstreamCancel: upstreamCancel,
 	}, nil
 }
 
@@ -34,9 +51,31 @@ func (h *speedTestHandler) Info() *handler.Info {
 }
 
 func (h *speedTestHandler) Shutdown() {
+	h.upstreamCancel()
 }
 
 func (h *speedTestHandler) ServeHttp(_ *context.RequestContext, w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, h.info.PathPrefix) {
+		panic(fmt.Errorf("r.URL.Path %v not started with prefix %v", r.URL.Path, h.info.PathPrefix))
+	}
+	reqPath := r.URL.Path[len(h.info.PathPrefix):]
+
+	// the results must not be cached by the browser or any intermediary
+	w.Header().Set("Cache-Control", "no-store")
+
+	if reqPath == "/ping" {
+		h.servePing(w)
+		return
+	}
+	if reqPath == "/upstream" && h.upstream != nil {
+		h.serveUpstream(w, r)
+		return
+	}
+	if *h.settings.WebUi && r.Method == http.MethodGet && r.URL.RawQuery == "" && (reqPath == "" || reqPath == "/") {
+		h.serveWebUi(w)
+		return
+	}
+
 	if r.ContentLength > 0 {
 		if *h.settings.MaxUploadBytes < 0 {
 			http.Error(w, "Upload test is disabled", http.StatusBadRequest)
@@ -82,7 +121,7 @@ func (h *speedTestHandler) ServeHttp(_ *context.RequestContext, w http.ResponseW
 	}
 }
 
-var drainReaderBufPool = sync.Pool{
+var bufPool = sync.Pool{
 	New: func() interface{} {
 		return make([]byte, 16384)
 	},
@@ -93,8 +132,8 @@ func (h *speedTestHandler) drainReader(body io.ReadCloser) error {
 		_ = body.Close()
 	}()
 
-	buf := drainReaderBufPool.Get().([]byte)
-	defer drainReaderBufPool.Put(buf)
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
 
 	for {
 		_, err := body.Read(buf)
@@ -106,16 +145,25 @@ func (h *speedTestHandler) drainReader(body io.ReadCloser) error {
 	}
 }
 
-var zeroChunk = bytes.Repeat([]byte{'0'}, 16384)
-
+// fillWriter writes random bytes, which cannot be compressed by the intermediaries
 func (h *speedTestHandler) fillWriter(w io.Writer, size int64) error {
+	var seed [32]byte
+	for i := 0; i < len(seed); i += 8 {
+		binary.LittleEndian.PutUint64(seed[i:], rand.Uint64())
+	}
+	random := rand.NewChaCha8(seed)
+
+	buf := bufPool.Get().([]byte)
+	defer bufPool.Put(buf)
+
 	remaining := size
 	for remaining > 0 {
-		chunkSize := int64(len(zeroChunk))
+		chunkSize := int64(len(buf))
 		if remaining < chunkSize {
 			chunkSize = remaining
 		}
-		writeNum, err := w.Write(zeroChunk[:chunkSize])
+		_, _ = random.Read(buf[:chunkSize])
+		writeNum, err := w.Write(buf[:chunkSize])
 		if err != nil {
 			return err
 		}
@@ -123,3 +171,45 @@ func (h *speedTestHandler) fillWriter(w io.Writer, size int64) error {
 	}
 	return nil
 }
+
+type pingResponse struct {
+	ReceivedAt int64 `json:"received_at"` // unix timestamp in microseconds
+	SentAt     int64 `json:"sent_at"`     // unix timestamp in microseconds
+}
+
+// servePing responds with the server timestamps. The client measures the RTT and the jitter with consecutive pings
+func (h *speedTestHandler) servePing(w http.ResponseWriter) {
+	receivedAt := time.Now()
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(&pingResponse{
+		ReceivedAt: receivedAt.UnixMicro(),
+		SentAt:     time.Now().UnixMicro(),
+	})
+}
+
+// serveUpstream responds with the latest upstream measurement report. A POST request starts a new measurement,
+// and waits for its report. The first GET request also waits for the first measurement
+func (h *speedTestHandler) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	var done <-chan struct{}
+	switch r.Method {
+	case http.MethodGet:
+		if h.upstream.Latest() == nil {
+			done = h.upstream.Start()
+		}
+	case http.MethodPost:
+		done = h.upstream.Start()
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if done != nil {
+		select {
+		case <-done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.upstream.Latest())
+}
@@ -0,0 +1,84 @@
+package speedtest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/context"
+	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newTestHandler(t *testing.T, settings *config.SpeedTestSettings) handler.HttpHandler {
+	cfg := &config.Config{
+		Sites: []*config.SiteConfig{{
+			Mode:     utils.ToPtr(config.SiteModeSpeedTest),
+			Settings: settings,
+		}},
+	}
+	require.NoError(t, cfg.Init())
+	hdl, err := NewSpeedTestHandler(handler.NewSiteInfo("test", cfg.Sites[0]), nil, cfg.Sites[0].Settings.(*config.SpeedTestSettings))
+	require.NoError(t, err)
+	return hdl
+}
+
+func serve(hdl handler.HttpHandler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	hdl.ServeHttp(context.NewRequestContext(r.Host, "127.0.0.1"), w, r)
+	return w
+}
+
+func TestPing(t *testing.T) {
+	hdl := newTestHandler(t, &config.SpeedTestSettings{})
+
+	w := serve(hdl, httptest.NewRequest(http.MethodGet, "/ping", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	var resp pingResponse
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Greater(t, resp.ReceivedAt, int64(0))
+	assert.GreaterOrEqual(t, resp.SentAt, resp.ReceivedAt)
+}
+
+func TestDownloadIncompressible(t *testing.T) {
+	hdl := newTestHandler(t, &config.SpeedTestSettings{})
+
+	const size = 1024 * 1024
+	w := serve(hdl, httptest.NewRequest(http.MethodGet, "/?bytes=1048576", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, size, w.Body.Len())
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err := gz.Write(w.Body.Bytes())
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	assert.Greater(t, compressed.Len(), size)
+
+	// different payload for each request
+	w2 := serve(hdl, httptest.NewRequest(http.MethodGet, "/?bytes=1048576", nil))
+	assert.NotEqual(t, w.Body.Bytes()[:1024], w2.Body.Bytes()[:1024])
+}
+
+func TestWebUi(t *testing.T) {
+	hdl := newTestHandler(t, &config.SpeedTestSettings{MaxUploadBytes: utils.ToPtr(int64(-1))})
+
+	w := serve(hdl, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, strings.HasPrefix(w.Header().Get("Content-Type"), "text/html"))
+	assert.Regexp(t, `const maxDownloadBytes = +1073741824 *;`, w.Body.String())
+	assert.Regexp(t, `const maxUploadBytes = +-1 *;`, w.Body.String())
+
+	hdl = newTestHandler(t, &config.SpeedTestSettings{WebUi: utils.ToPtr(false)})
+	w = serve(hdl, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+}
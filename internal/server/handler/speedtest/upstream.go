@@ -0,0 +1,201 @@
+package speedtest
+
+import (
+	gocontext "context"
+	"errors"
+	"fmt"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the ip label of the default address, when the ip pool is disabled
+const defaultAddressLabel = "default"
+
+type upstreamResult struct {
+	Ip             string  `json:"ip"`
+	Error          string  `json:"error,omitempty"`
+	StatusCode     int     `json:"status_code,omitempty"`
+	TtfbMs         float64 `json:"ttfb_ms"`
+	Bytes          int64   `json:"bytes"`
+	DurationMs     float64 `json:"duration_ms"` // the duration of the body download, after the first byte
+	BytesPerSecond float64 `json:"bytes_per_second"`
+}
+
+type upstreamReport struct {
+	Url        string            `json:"url"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Results    []*upstreamResult `json:"results"`
+}
+
+// upstreamTester measures the upstream download through the ip pool addresses, one address at a time,
+// so the addresses do not compete for the bandwidth of the server
+type upstreamTester struct {
+	siteId string
+	helper *common.RequestHelper
+	cfg    *config.SpeedTestUpstreamConfig
+	ctx    gocontext.Context
+
+	mu      sync.Mutex
+	report  *upstreamReport // nil before the first measurement
+	running chan struct{}   // closed when the running measurement finishes, nil if there's none
+}
+
+func newUpstreamTester(ctx gocontext.Context, siteId string, helper *common.RequestHelper, cfg *config.SpeedTestUpstreamConfig) *upstreamTester {
+	t := &upstreamTester{
+		siteId: siteId,
+		helper: helper,
+		cfg:    cfg,
+		ctx:    ctx,
+	}
+	if cfg.Interval != nil {
+		go t.intervalRoutine(*cfg.Interval)
+	}
+	return t
+}
+
+func (t *upstreamTester) intervalRoutine(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		t.Run()
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Latest returns the latest report, or nil if there's none yet
+func (t *upstreamTester) Latest() *upstreamReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.report
+}
+
+// Start starts a measurement if there's no running one, and returns a channel that is closed when the measurement finishes
+func (t *upstreamTester) Start() <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.running == nil {
+		running := make(chan struct{})
+		t.running = running
+		go func() {
+			report := t.measureAll()
+			t.mu.Lock()
+			t.report = report
+			t.running = nil
+			t.mu.Unlock()
+			close(running)
+		}()
+	}
+	return t.running
+}
+
+// Run starts a measurement if there's no running one, waits for it and returns the report
+func (t *upstreamTester) Run() *upstreamReport {
+	<-t.Start()
+	return t.Latest()
+}
+
+func (t *upstreamTester) measureAll() *upstreamReport {
+	var addresses []net.IP
+	if ipPool := t.helper.GetIpPool(); ipPool != nil {
+		addresses = ipPool.Sample(*t.cfg.SampleSize)
+	} else {
+		addresses = []net.IP{nil}
+	}
+
+	report := &upstreamReport{
+		Url:       t.cfg.Url,
+		StartedAt: time.Now(),
+	}
+	log.Debugf("[%s] Measuring upstream %s through %d addresses", t.siteId, t.cfg.Url, len(addresses))
+	for _, address := range addresses {
+		if t.ctx.Err() != nil {
+			break
+		}
+		report.Results = append(report.Results, t.measure(address))
+	}
+	report.FinishedAt = time.Now()
+
+	// addresses of the previous measurement might not be sampled this time
+	for _, metric := range []*prometheus.GaugeVec{metricUpstreamTtfb, metricUpstreamThroughput, metricUpstreamSuccess} {
+		metric.DeletePartialMatch(prometheus.Labels{"site": t.siteId})
+	}
+	for _, result := range report.Results {
+		success := 0.0
+		if result.Error == "" {
+			success = 1
+			metricUpstreamTtfb.WithLabelValues(t.siteId, result.Ip).Set(result.TtfbMs / 1000)
+			metricUpstreamThroughput.WithLabelValues(t.siteId, result.Ip).Set(result.BytesPerSecond)
+		}
+		metricUpstreamSuccess.WithLabelValues(t.siteId, result.Ip).Set(success)
+	}
+	return report
+}
+
+func (t *upstreamTester) measure(address net.IP) *upstreamResult {
+	result := &upstreamResult{Ip: defaultAddressLabel}
+	if address != nil {
+		result.Ip = address.String()
+	}
+	if err := t.download(address, result); err != nil {
+		log.Debugf("[%s] Upstream measurement through %s failed: %v", t.siteId, result.Ip, err)
+		result.Error = err.Error()
+	}
+	return result
+}
+
+func (t *upstreamTester) download(address net.IP, result *upstreamResult) error {
+	transport, transportReleaser, err := t.helper.GetTransportForLocalAddr(address)
+	if err != nil {
+		return err
+	}
+	defer transportReleaser()
+
+	ctx, cancel := gocontext.WithTimeout(t.ctx, *t.cfg.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, t.cfg.Url, nil)
+	if err != nil {
+		return err
+	}
+	// measure the bytes on the wire
+	req.Header.Set("Accept-Encoding", "identity")
+
+	start := time.Now()
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	ttfb := time.Since(start)
+	result.StatusCode = resp.StatusCode
+	result.TtfbMs = float64(ttfb.Microseconds()) / 1000
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	result.Bytes, err = io.Copy(io.Discard, resp.Body)
+	duration := time.Since(start) - ttfb
+	result.DurationMs = float64(duration.Microseconds()) / 1000
+	if duration > 0 {
+		result.BytesPerSecond = float64(result.Bytes) / duration.Seconds()
+	}
+	// the download is truncated at the timeout, which is still a valid measurement
+	if err != nil && !errors.Is(ctx.Err(), gocontext.DeadlineExceeded) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package speedtest
+
+import (
+	"encoding/json"
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/server/common/commontest"
+	"github.com/Fallen-Breath/pavonis/internal/server/handler"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newUpstreamTestHandler(t *testing.T, upstreamCfg *config.SpeedTestUpstreamConfig, ipPool *config.IpPoolConfig) handler.HttpHandler {
+	cfg := &config.Config{
+		Request: &config.RequestConfig{IpPool: ipPool},
+		Sites: []*config.SiteConfig{{
+			Mode:     utils.ToPtr(config.SiteModeSpeedTest),
+			Settings: &config.SpeedTestSettings{Upstream: upstreamCfg},
+		}},
+	}
+	require.NoError(t, cfg.Init())
+	helper := commontest.NewRequestHelper(t, cfg, http.DefaultTransport)
+	hdl, err := NewSpeedTestHandler(handler.NewSiteInfo("test_upstream", cfg.Sites[0]), helper, cfg.Sites[0].Settings.(*config.SpeedTestSettings))
+	require.NoError(t, err)
+	t.Cleanup(hdl.Shutdown)
+	return hdl
+}
+
+func readGauge(t *testing.T, ip string) float64 {
+	m := &dto.Metric{}
+	require.NoError(t, metricUpstreamThroughput.WithLabelValues("test_upstream", ip).Write(m))
+	return m.GetGauge().GetValue()
+}
+
+func TestUpstreamMeasurement(t *testing.T) {
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		assert.Equal(t, "identity", r.Header.Get("Accept-Encoding"))
+		_, _ = w.Write(make([]byte, 100000))
+	}))
+	defer upstream.Close()
+
+	hdl := newUpstreamTestHandler(t, &config.SpeedTestUpstreamConfig{Url: upstream.URL + "/file"}, &config.IpPoolConfig{
+		Enabled: true,
+		Subnets: []string{"192.0.2.1", "198.51.100.0/30"},
+	})
+
+	// the first GET waits for the first measurement
+	w := serve(hdl, httptest.NewRequest(http.MethodGet, "/upstream", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var report upstreamReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.Equal(t, upstream.URL+"/file", report.Url)
+	require.Len(t, report.Results, 5)
+	assert.Equal(t, "192.0.2.1", report.Results[0].Ip)
+	assert.Equal(t, "198.51.100.3", report.Results[4].Ip)
+	for _, result := range report.Results {
+		assert.Equal(t, "", result.Error)
+		assert.Equal(t, http.StatusOK, result.StatusCode)
+		assert.Equal(t, int64(100000), result.Bytes)
+		assert.Greater(t, result.BytesPerSecond, 0.0)
+		assert.Equal(t, result.BytesPerSecond, readGauge(t, result.Ip))
+	}
+	assert.Equal(t, int32(5), requests.Load())
+
+	// GET returns the latest report, POST runs a new measurement
+	w = serve(hdl, httptest.NewRequest(http.MethodGet, "/upstream", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(5), requests.Load())
+	w = serve(hdl, httptest.NewRequest(http.MethodPost, "/upstream", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int32(10), requests.Load())
+}
+
+func TestUpstreamMeasurementErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		// a slow upstream, which is truncated at the timeout
+		for i := 0; i < 100; i++ {
+			if _, err := w.Write(make([]byte, 1000)); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+			time.Sleep(10 * time.Millisecond)
+		}
+	}))
+	defer upstream.Close()
+
+	run := func(url string) *upstreamResult {
+		hdl := newUpstreamTestHandler(t, &config.SpeedTestUpstreamConfig{Url: url, Timeout: utils.ToPtr(200 * time.Millisecond)}, &config.IpPoolConfig{})
+		w := serve(hdl, httptest.NewRequest(http.MethodPost, "/upstream", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+		var report upstreamReport
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+		require.Len(t, report.Results, 1)
+		assert.Equal(t, defaultAddressLabel, report.Results[0].Ip)
+		return report.Results[0]
+	}
+
+	result := run(upstream.URL + "/missing")
+	assert.Equal(t, http.StatusNotFound, result.StatusCode)
+	assert.Contains(t, result.Error, "404")
+
+	result = run(upstream.URL + "/slow")
+	assert.Equal(t, "", result.Error)
+	assert.Greater(t, result.Bytes, int64(0))
+	assert.Less(t, result.Bytes, int64(100000))
+}
+
+func TestUpstreamDisabled(t *testing.T) {
+	hdl := newTestHandler(t, &config.SpeedTestSettings{})
+	w := serve(hdl, httptest.NewRequest(http.MethodGet, "/upstream", nil))
+	// not a special path if disabled
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 0, w.Body.Len())
+}
@@ -0,0 +1,26 @@
+package speedtest
+
+import (
+	_ "embed"
+	"html/template"
+	"net/http"
+)
+
+//go:embed web_ui.html
+var webUiHtml string
+
+var webUiTemplate = template.Must(template.New("web_ui").Parse(webUiHtml))
+
+type webUiData struct {
+	MaxDownloadBytes int64 // < 0 means disabled
+	MaxUploadBytes   int64 // < 0 means disabled
+}
+
+// serveWebUi serves a librespeed-like page, which runs the latency, download and upload tests against this site
+func (h *speedTestHandler) serveWebUi(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_ = webUiTemplate.Execute(w, &webUiData{
+		MaxDownloadBytes: *h.settings.MaxDownloadBytes,
+		MaxUploadBytes:   *h.settings.MaxUploadBytes,
+	})
+}
@@ -12,4 +12,10 @@ var (
 		Name:      "http_request_total",
 		Help:      "Total number of HTTP requests served",
 	}, []string{"code"})
+	metricBannedRequest = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "pavonis",
+		Subsystem: "ban",
+		Name:      "rejected_requests_total",
+		Help:      "Total number of the requests rejected for the client is banned",
+	})
 )
@@ -2,6 +2,7 @@ package server
 
 import (
 	gocontext "context"
+	"errors"
 	"fmt"
 	"github.com/Fallen-Breath/pavonis/internal/config"
 	"github.com/Fallen-Breath/pavonis/internal/server/common"
@@ -26,6 +27,9 @@ type PavonisServer struct {
 	allHandlers        []handler.HttpHandler
 	handlersByHost     map[string][]handler.HttpHandler
 	handlersDefault    []handler.HttpHandler
+	apiKeys            *common.ApiKeyStore                 // nil if api key is disabled
+	accessControllers  map[string]*common.AccessController // site id -> controller
+	banList            *common.BanList                     // nil if ban is disabled
 	shutdownFunctions  []func()
 }
 
@@ -38,15 +42,26 @@ func (s *PavonisServer) createRequestContext(r *http.Request) *context.RequestCo
 	}
 
 	clientIp, clientAddr := utils.GetIpFromHostPort(r.RemoteAddr)
-	if clientIp != nil && (s.trustedProxiesAll || s.trustedProxiesPool.Contains(clientIp)) {
-		if realClientIp, ok := utils.GetRequestClientIpFromProxyHeader(r, *s.cfg.Server.TrustedProxyHeaders); ok {
-			clientAddr = realClientIp
+	if clientIp != nil && s.isTrustedProxy(clientIp) {
+		// only the first header present is used, the malformed ones are not skipped for the next header
+		for _, header := range *s.cfg.Server.TrustedProxyHeaders {
+			if len(r.Header.Values(header)) == 0 {
+				continue
+			}
+			if realClientIp, ok := utils.GetRequestClientIpFromProxyHeader(r, header, s.isTrustedProxy); ok {
+				clientAddr = realClientIp
+			}
+			break
 		}
 	}
 
 	return context.NewRequestContext(host, clientAddr)
 }
 
+func (s *PavonisServer) isTrustedProxy(ip net.IP) bool {
+	return s.trustedProxiesAll || s.trustedProxiesPool.Contains(ip)
+}
+
 func sll(s string, limit int) string {
 	if len(s) <= limit {
 		return s
@@ -78,12 +93,18 @@ func NewPavonisServer(cfg *config.Config) (*PavonisServer, error) {
 		trustedProxiesPool: trustedProxies,
 		trustedProxiesAll:  trustedProxiesAll,
 		handlersByHost:     make(map[string][]handler.HttpHandler),
+		apiKeys:            helperFactory.GetApiKeyStore(),
+		accessControllers:  make(map[string]*common.AccessController),
+		banList:            helperFactory.GetBanList(),
 	}
 	server.shutdownFunctions = append(server.shutdownFunctions, helperFactory.Shutdown)
 
 	for sideIdx, siteCfg := range cfg.Sites {
 		siteInfo := handler.NewSiteInfo(siteCfg.Id, siteCfg)
-		helper := helperFactory.NewRequestHelper(siteCfg.IpPoolStrategy)
+		helper := helperFactory.NewRequestHelper(siteCfg)
+		if server.accessControllers[siteCfg.Id], err = helperFactory.NewAccessController(siteCfg); err != nil {
+			return nil, err
+		}
 
 		hdl, err := createSiteHttpHandler(*siteCfg.Mode, siteInfo, helper, siteCfg.Settings)
 		if err != nil {
@@ -116,6 +137,18 @@ func NewPavonisServer(cfg *config.Config) (*PavonisServer, error) {
 func (s *PavonisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// init
 	ctx := s.createRequestContext(r)
+
+	// banned clients are rejected before doing anything else
+	if s.banList != nil {
+		if ban := s.banList.GetBan(common.ClientKey(ctx.ClientAddr)); ban != nil {
+			w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(ban.Until).Seconds())+1))
+			http.Error(w, "Temporarily banned", http.StatusForbidden)
+			metricRequestServed.WithLabelValues(strconv.Itoa(http.StatusForbidden)).Inc()
+			metricBannedRequest.Inc()
+			return
+		}
+	}
+
 	targetHandler := s.selectHandler(ctx.Host, r.URL.Path) // result might be nil
 	handlerNamePrefix := ""
 	if targetHandler != nil {
@@ -123,8 +156,28 @@ func (s *PavonisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	ctx.LogPrefix = fmt.Sprintf("(%s%s) ", handlerNamePrefix, ctx.RequestId)
 
+	// access control by the client address
+	var accessErr error
+	if targetHandler != nil {
+		accessErr = s.accessControllers[targetHandler.Info().Id].Check(ctx, r)
+	}
+
+	// api key, which is removed from the request here
+	var apiKey *common.ApiKey
+	var apiKeyErr error
+	if s.apiKeys != nil {
+		apiKey, apiKeyErr = s.authenticate(r, targetHandler)
+		if apiKey != nil {
+			ctx.ApiKeyName = apiKey.Name
+		}
+	}
+
 	// start logging
-	logLine := ctx.LogPrefix + fmt.Sprintf("%s - %s %s", ctx.ClientAddr, r.Method, r.URL.Path)
+	clientDesc := ctx.ClientAddr
+	if ctx.ApiKeyName != "" {
+		clientDesc += fmt.Sprintf(" (%s)", ctx.ApiKeyName)
+	}
+	logLine := ctx.LogPrefix + fmt.Sprintf("%s - %s %s", clientDesc, r.Method, r.URL.Path)
 	log.
 		WithField("Host", ctx.Host).
 		WithField("UA", sll(r.UserAgent(), 24)).
@@ -133,7 +186,11 @@ func (s *PavonisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// adjust request context
 	rContext := r.Context()
 	rContext = gocontext.WithValue(rContext, context.Key, ctx)
-	reqContext, cancel := gocontext.WithTimeout(rContext, *s.cfg.ResourceLimit.RequestTimeout) // total timeout
+	requestTimeout := *s.cfg.ResourceLimit.RequestTimeout
+	if targetHandler != nil {
+		requestTimeout = targetHandler.Info().RequestTimeout
+	}
+	reqContext, cancel := gocontext.WithTimeout(rContext, requestTimeout) // total timeout
 	defer cancel()
 	r = r.WithContext(reqContext)
 
@@ -155,6 +212,9 @@ func (s *PavonisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Info(logLine)
 
 		metricRequestServed.WithLabelValues(strconv.Itoa(hm.Code)).Inc()
+		if s.banList != nil {
+			s.banList.OnResponse(ctx, hm.Code)
+		}
 
 		if panicErr != nil {
 			panic(panicErr)
@@ -167,7 +227,14 @@ func (s *PavonisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, "WebSocket connections are not allowed", http.StatusForbidden)
 		}
 
-		if targetHandler != nil {
+		var httpErr *common.HttpError
+		if errors.As(accessErr, &httpErr) || errors.As(apiKeyErr, &httpErr) {
+			common.WriteHttpError(ctx, w, httpErr)
+		} else if targetHandler != nil {
+			if apiKey != nil {
+				// the quota is charged during the transfer, so a large download cannot go far beyond the quota
+				w = s.apiKeys.WrapResponseWriter(apiKey, w)
+			}
 			targetHandler.ServeHttp(ctx, w, r)
 		} else {
 			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
@@ -175,6 +242,29 @@ func (s *PavonisServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// authenticate extracts the api key from the request. The returned error is a HttpError, if the request should be rejected
+func (s *PavonisServer) authenticate(r *http.Request, targetHandler handler.HttpHandler) (*common.ApiKey, error) {
+	apiKey, provided := s.apiKeys.Authenticate(r)
+	if provided && apiKey == nil {
+		return nil, common.NewRejectionError(http.StatusUnauthorized, "Invalid api key")
+	}
+	if apiKey == nil {
+		if targetHandler != nil && targetHandler.Info().ApiKeyRequired {
+			return nil, common.NewRejectionError(http.StatusUnauthorized, "Api key required")
+		}
+		return nil, nil
+	}
+	if err := apiKey.CheckQuota(); err != nil {
+		return apiKey, err
+	}
+	return apiKey, nil
+}
+
+// GetBanList returns the ban list, or nil if ban is disabled
+func (s *PavonisServer) GetBanList() *common.BanList {
+	return s.banList
+}
+
 func (s *PavonisServer) Shutdown() {
 	for _, hdl := range s.allHandlers {
 		hdl.Shutdown()
@@ -208,3 +298,15 @@ func (s *PavonisServer) CreateHttpServer() *http.Server {
 		Handler: s,
 	}
 }
+
+// Listen creates the listener of the http server, which accepts the PROXY protocol if enabled
+func (s *PavonisServer) Listen() (net.Listener, error) {
+	listener, err := net.Listen("tcp", *s.cfg.Server.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.Server.ProxyProtocol {
+		listener = utils.NewProxyProtocolListener(listener, s.isTrustedProxy)
+	}
+	return listener, nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"github.com/Fallen-Breath/pavonis/internal/config"
+	"github.com/Fallen-Breath/pavonis/internal/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCreateRequestContextClientAddr(t *testing.T) {
+	cfg := &config.Config{
+		Server: &config.ServerConfig{
+			TrustedProxyIps: utils.ToPtr([]string{"10.0.0.0/8"}),
+		},
+	}
+	require.NoError(t, cfg.Init())
+	s, err := NewPavonisServer(cfg)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	clientAddrOf := func(remoteAddr string, header http.Header) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header = header
+		return s.createRequestContext(r).ClientAddr
+	}
+
+	assert.Equal(t, "192.0.2.1", clientAddrOf("10.0.0.1:1234", http.Header{"X-Forwarded-For": {"192.0.2.1"}}))
+
+	// spoofing with the headers that are not set by the proxy, e.g. CF-Connecting-IP without Cloudflare
+	assert.Equal(t, "192.0.2.1", clientAddrOf("10.0.0.1:1234", http.Header{
+		"X-Forwarded-For":  {"192.0.2.1"},
+		"Cf-Connecting-Ip": {"1.2.3.4"},
+		"X-Real-Ip":        {"1.2.3.4"},
+	}))
+	assert.Equal(t, "10.0.0.1", clientAddrOf("10.0.0.1:1234", http.Header{"Cf-Connecting-Ip": {"1.2.3.4"}}))
+
+	// spoofing with a malformed hop, the other headers are not used
+	assert.Equal(t, "10.0.0.1", clientAddrOf("10.0.0.1:1234", http.Header{
+		"X-Forwarded-For": {"1.2.3.4, garbage"},
+		"X-Real-Ip":       {"1.2.3.4"},
+	}))
+
+	// the headers from untrusted peers are ignored
+	assert.Equal(t, "192.0.2.9", clientAddrOf("192.0.2.9:1234", http.Header{"X-Forwarded-For": {"1.2.3.4"}}))
+}
+
+func TestCreateRequestContextClientAddrMultipleHeaders(t *testing.T) {
+	// deprecated, but still accepted
+	cfg := &config.Config{
+		Server: &config.ServerConfig{
+			TrustedProxyIps:     utils.ToPtr([]string{"10.0.0.0/8"}),
+			TrustedProxyHeaders: utils.ToPtr([]string{"CF-Connecting-IP", "X-Forwarded-For"}),
+		},
+	}
+	require.NoError(t, cfg.Init())
+	s, err := NewPavonisServer(cfg)
+	require.NoError(t, err)
+	defer s.Shutdown()
+
+	clientAddrOf := func(header http.Header) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header = header
+		return s.createRequestContext(r).ClientAddr
+	}
+
+	// the first header present is used
+	assert.Equal(t, "192.0.2.1", clientAddrOf(http.Header{
+		"Cf-Connecting-Ip": {"192.0.2.1"},
+		"X-Forwarded-For":  {"1.2.3.4"},
+	}))
+	assert.Equal(t, "192.0.2.2", clientAddrOf(http.Header{"X-Forwarded-For": {"192.0.2.2"}}))
+
+	// the rightmost untrusted walk applies to the header used
+	assert.Equal(t, "192.0.2.1", clientAddrOf(http.Header{"Cf-Connecting-Ip": {"1.2.3.4, 192.0.2.1, 10.0.0.2"}}))
+
+	// a malformed first header does not fall back to the next one
+	assert.Equal(t, "10.0.0.1", clientAddrOf(http.Header{
+		"Cf-Connecting-Ip": {"garbage"},
+		"X-Forwarded-For":  {"1.2.3.4"},
+	}))
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// ConcurrencyLimiter limits the number of the in-flight operations, with a bounded wait for a free slot
+type ConcurrencyLimiter struct {
+	slots   chan struct{}
+	waiting atomic.Int64
+}
+
+func NewConcurrencyLimiter(maxConcurrency int) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		slots: make(chan struct{}, maxConcurrency),
+	}
+}
+
+// CreateConcurrencyLimiter creates the limiter, or returns nil if maxConcurrency is nil
+func CreateConcurrencyLimiter(maxConcurrency *int) *ConcurrencyLimiter {
+	if maxConcurrency == nil {
+		return nil
+	}
+	return NewConcurrencyLimiter(*maxConcurrency)
+}
+
+// Acquire takes a slot, waiting for at most the given timeout, or until ctx is done. Returns false if no slot is taken
+// onQueued is called when the caller starts waiting, and the returned function is called when the wait ends
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, timeout time.Duration, onQueued func() func()) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	if onQueued != nil {
+		defer onQueued()()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Release frees a slot taken by Acquire
+func (l *ConcurrencyLimiter) Release() {
+	<-l.slots
+}
+
+// InFlight returns the number of the taken slots
+func (l *ConcurrencyLimiter) InFlight() int {
+	return len(l.slots)
+}
+
+// Waiting returns the number of the callers waiting for a slot
+func (l *ConcurrencyLimiter) Waiting() int {
+	return int(l.waiting.Load())
+}
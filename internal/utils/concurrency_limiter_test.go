@@ -0,0 +1,49 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := NewConcurrencyLimiter(2)
+	assert.True(t, limiter.Acquire(context.Background(), 0, nil))
+	assert.True(t, limiter.Acquire(context.Background(), 0, nil))
+	assert.Equal(t, 2, limiter.InFlight())
+
+	// no queueing
+	assert.False(t, limiter.Acquire(context.Background(), 0, nil))
+
+	// queued until timeout
+	queued := 0
+	start := time.Now()
+	assert.False(t, limiter.Acquire(context.Background(), 50*time.Millisecond, func() func() {
+		queued++
+		assert.Equal(t, 1, limiter.Waiting())
+		return func() {}
+	}))
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 1, queued)
+	assert.Equal(t, 0, limiter.Waiting())
+
+	// queued until a slot is released
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		limiter.Release()
+	}()
+	assert.True(t, limiter.Acquire(context.Background(), 5*time.Second, nil))
+	assert.Equal(t, 2, limiter.InFlight())
+
+	// the wait ends when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+	start = time.Now()
+	assert.False(t, limiter.Acquire(ctx, 5*time.Second, nil))
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 0, limiter.Waiting())
+}
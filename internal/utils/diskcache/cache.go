@@ -0,0 +1,253 @@
+package diskcache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A data file is the content, followed by the json meta and the 8-byte big-endian length of the meta,
+// so the content and its meta are committed together with a single rename
+const (
+	dataFileSuffix = ".data"
+	partFileSuffix = ".part"
+	metaLengthSize = 8
+)
+
+type Meta struct {
+	Key     string      `json:"key"`
+	Size    int64       `json:"size"`
+	Header  http.Header `json:"header"`
+	Created time.Time   `json:"created"`
+}
+
+// Cache is a simple on-disk object cache for immutable contents
+// Concurrent fills of the same key are collapsed into a single fill, other readers tail the in-progress file
+type Cache struct {
+	dir          string
+	maxTotalSize int64 // <= 0 means unlimited
+
+	mu      sync.Mutex
+	fills   map[string]*fill
+	fetches map[string]chan struct{} // closed when the fetch of Open is done
+}
+
+func NewCache(dir string, maxTotalSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %+q: %v", dir, err)
+	}
+
+	// clean up leftovers from the previous run
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list cache directory %+q: %v", dir, err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), partFileSuffix) {
+			_ = os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return &Cache{
+		dir:          dir,
+		maxTotalSize: maxTotalSize,
+		fills:        make(map[string]*fill),
+		fetches:      make(map[string]chan struct{}),
+	}, nil
+}
+
+func (c *Cache) pathOf(key string, suffix string) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(hash[:])+suffix)
+}
+
+// Get returns the cached content and its meta. The caller is responsible for closing the content
+func (c *Cache) Get(key string) (io.ReadSeekCloser, *Meta, bool) {
+	dataPath := c.pathOf(key, dataFileSuffix)
+	file, err := os.Open(dataPath)
+	if err != nil {
+		return nil, nil, false
+	}
+	meta, err := readMeta(file, key)
+	if err != nil {
+		// not removed here, since it might have been replaced by a new fill. The next fill replaces it anyway
+		log.Warnf("Disk cache read meta %+q failed: %v", key, err)
+		_ = file.Close()
+		return nil, nil, false
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(dataPath, now, now) // for LRU eviction
+	return &cachedContent{SectionReader: io.NewSectionReader(file, 0, meta.Size), file: file}, meta, true
+}
+
+// cachedContent is the content part of an opened data file
+type cachedContent struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (c *cachedContent) Close() error {
+	return c.file.Close()
+}
+
+// readMeta reads the meta at the end of the data file
+func readMeta(file *os.File, key string) (*Meta, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	fileSize := stat.Size()
+	if fileSize < metaLengthSize {
+		return nil, errors.New("data file too small")
+	}
+
+	var lengthBuf [metaLengthSize]byte
+	if _, err := file.ReadAt(lengthBuf[:], fileSize-metaLengthSize); err != nil {
+		return nil, err
+	}
+	metaLength := binary.BigEndian.Uint64(lengthBuf[:])
+	if metaLength > uint64(fileSize-metaLengthSize) {
+		return nil, fmt.Errorf("invalid meta length %d", metaLength)
+	}
+	contentSize := fileSize - metaLengthSize - int64(metaLength)
+
+	buf := make([]byte, metaLength)
+	if _, err := file.ReadAt(buf, contentSize); err != nil {
+		return nil, err
+	}
+	meta := &Meta{}
+	if err := json.Unmarshal(buf, meta); err != nil {
+		return nil, err
+	}
+	if meta.Key != key {
+		return nil, fmt.Errorf("key mismatch, expected %+q, found %+q", key, meta.Key)
+	}
+	if meta.Size != contentSize {
+		return nil, fmt.Errorf("size mismatch, expected %d, found %d", meta.Size, contentSize)
+	}
+	return meta, nil
+}
+
+// writeMeta appends the meta to the data file, after the content
+func writeMeta(file *os.File, meta *Meta) error {
+	buf, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	buf = binary.BigEndian.AppendUint64(buf, uint64(len(buf)))
+	_, err = file.Write(buf)
+	return err
+}
+
+func (c *Cache) Remove(key string) {
+	_ = os.Remove(c.pathOf(key, dataFileSuffix))
+}
+
+// Fill starts caching the given body with the given key
+//
+// If there's no in-progress fill for the key, the returned reader tees the body into the cache,
+// and the cache entry is committed when the returned reader reaches EOF.
+// Otherwise, the body is closed, and the returned reader tails the in-progress fill.
+//
+// ctx is used by followers to stop waiting. size might be -1 if unknown.
+// The returned meta belongs to the fill that the returned reader is reading from
+//
+// The fill is driven by the leader reader, so closing it before EOF aborts the fill for all followers.
+// Use Open instead if the fill should not depend on the reader that starts it
+func (c *Cache) Fill(ctx context.Context, key string, size int64, header http.Header, body io.ReadCloser) (io.ReadCloser, *Meta, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.fills[key]; ok {
+		reader, err := f.newFollower(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		_ = body.Close()
+		return reader, f.meta, nil
+	}
+
+	f, err := newFill(c, key, size, header)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.fills[key] = f
+	return f.newLeader(body), f.meta, nil
+}
+
+// commit moves the part file, which has the meta written, to the data file
+// Must be called with the lock of the fill held, so no follower opens the part file meanwhile
+func (c *Cache) commit(f *fill) error {
+	if err := os.Rename(f.partPath, c.pathOf(f.meta.Key, dataFileSuffix)); err != nil {
+		return err
+	}
+	log.Debugf("Disk cache committed %+q (%d bytes)", f.meta.Key, f.meta.Size)
+	return nil
+}
+
+func (c *Cache) finishFill(f *fill) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.fills[f.meta.Key] == f {
+		delete(c.fills, f.meta.Key)
+	}
+}
+
+// evict removes the least recently used entries until the total size is within maxTotalSize
+func (c *Cache) evict() {
+	type dataFile struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		log.Errorf("Failed to list cache directory %+q: %v", c.dir, err)
+		return
+	}
+
+	var files []dataFile
+	var totalSize int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), dataFileSuffix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, dataFile{filepath.Join(c.dir, entry.Name()), info.Size(), info.ModTime()})
+		totalSize += info.Size()
+	}
+	if totalSize <= c.maxTotalSize {
+		return
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+	for _, file := range files {
+		if totalSize <= c.maxTotalSize {
+			break
+		}
+		if err := os.Remove(file.path); err == nil {
+			totalSize -= file.size
+			log.Debugf("Disk cache evicted %+q (%d bytes)", file.path, file.size)
+		}
+	}
+}
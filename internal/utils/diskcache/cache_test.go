@@ -0,0 +1,263 @@
+package diskcache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// chunkedReader returns data chunk by chunk, and blocks before each chunk until it's released
+type chunkedReader struct {
+	chunks  [][]byte
+	release chan struct{}
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	<-r.release
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func (r *chunkedReader) Close() error {
+	return nil
+}
+
+func TestCacheFillAndGet(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	_, _, ok := cache.Get("foo")
+	assert.False(t, ok)
+
+	data := []byte("hello world")
+	header := http.Header{"Content-Type": []string{"text/plain"}}
+	reader, meta, err := cache.Fill(context.Background(), "foo", int64(len(data)), header, io.NopCloser(bytes.NewReader(data)))
+	require.NoError(t, err)
+	assert.Equal(t, "text/plain", meta.Header.Get("Content-Type"))
+	readData, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, data, readData)
+	require.NoError(t, reader.Close())
+
+	file, meta, ok := cache.Get("foo")
+	require.True(t, ok)
+	defer func() { _ = file.Close() }()
+	assert.Equal(t, int64(len(data)), meta.Size)
+	cachedData, err := io.ReadAll(file)
+	require.NoError(t, err)
+	assert.Equal(t, data, cachedData)
+}
+
+func TestCacheFillSizeMismatch(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	reader, _, err := cache.Fill(context.Background(), "foo", 100, http.Header{}, io.NopCloser(bytes.NewReader([]byte("short"))))
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	require.NoError(t, err)
+
+	_, _, ok := cache.Get("foo")
+	assert.False(t, ok)
+}
+
+func TestCacheFillEarlyClose(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	reader, _, err := cache.Fill(context.Background(), "foo", -1, http.Header{}, io.NopCloser(bytes.NewReader([]byte("some data"))))
+	require.NoError(t, err)
+	_, err = reader.Read(make([]byte, 4))
+	require.NoError(t, err)
+	require.NoError(t, reader.Close())
+
+	_, _, ok := cache.Get("foo")
+	assert.False(t, ok)
+}
+
+func TestCacheCollapsedFill(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	chunks := [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")}
+	leaderBody := &chunkedReader{chunks: chunks, release: make(chan struct{})}
+	leader, _, err := cache.Fill(context.Background(), "key", 9, http.Header{}, leaderBody)
+	require.NoError(t, err)
+
+	followerBodyClosed := false
+	followerBody := &mockCloser{onClose: func() { followerBodyClosed = true }}
+	follower, _, err := cache.Fill(context.Background(), "key", 9, http.Header{}, followerBody)
+	require.NoError(t, err)
+	assert.True(t, followerBodyClosed)
+
+	var wg sync.WaitGroup
+	var followerData []byte
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var readErr error
+		followerData, readErr = io.ReadAll(follower)
+		assert.NoError(t, readErr)
+	}()
+
+	go func() {
+		for range chunks {
+			leaderBody.release <- struct{}{}
+		}
+	}()
+	leaderData, err := io.ReadAll(leader)
+	require.NoError(t, err)
+	wg.Wait()
+
+	assert.Equal(t, []byte("foobarbaz"), leaderData)
+	assert.Equal(t, []byte("foobarbaz"), followerData)
+
+	_, meta, ok := cache.Get("key")
+	require.True(t, ok)
+	assert.Equal(t, int64(9), meta.Size)
+}
+
+func TestCacheEviction(t *testing.T) {
+	// the meta is stored in the data file too, so the limit fits one entry only
+	cache, err := NewCache(t.TempDir(), 1000)
+	require.NoError(t, err)
+
+	fill := func(key string, data string) {
+		reader, _, err := cache.Fill(context.Background(), key, int64(len(data)), http.Header{}, io.NopCloser(bytes.NewReader([]byte(data))))
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.NoError(t, err)
+	}
+	fill("a", strings.Repeat("a", 600))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(cache.pathOf("a", dataFileSuffix), past, past))
+	fill("b", strings.Repeat("b", 600))
+
+	_, _, okA := cache.Get("a")
+	assert.False(t, okA)
+	fileB, _, okB := cache.Get("b")
+	require.True(t, okB)
+	_ = fileB.Close()
+}
+
+func TestCacheRefill(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	fill := func(data string, etag string) {
+		header := http.Header{"Etag": []string{etag}}
+		reader, _, err := cache.Fill(context.Background(), "key", int64(len(data)), header, io.NopCloser(bytes.NewReader([]byte(data))))
+		require.NoError(t, err)
+		_, err = io.ReadAll(reader)
+		require.NoError(t, err)
+	}
+	fill("old", `"v1"`)
+	oldFile, oldMeta, ok := cache.Get("key")
+	require.True(t, ok)
+	defer func() { _ = oldFile.Close() }()
+
+	// the content and the meta are replaced together
+	fill("new content", `"v2"`)
+	newFile, newMeta, ok := cache.Get("key")
+	require.True(t, ok)
+	defer func() { _ = newFile.Close() }()
+	assert.Equal(t, `"v2"`, newMeta.Header.Get("ETag"))
+	assert.Equal(t, int64(11), newMeta.Size)
+	newData, err := io.ReadAll(newFile)
+	require.NoError(t, err)
+	assert.Equal(t, "new content", string(newData))
+
+	// the opened entry is still readable
+	assert.Equal(t, `"v1"`, oldMeta.Header.Get("ETag"))
+	oldData, err := io.ReadAll(oldFile)
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(oldData))
+}
+
+type mockCloser struct {
+	onClose func()
+}
+
+func (m *mockCloser) Read(_ []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (m *mockCloser) Close() error {
+	m.onClose()
+	return nil
+}
+
+func TestCacheOpen(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	chunks := [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")}
+	body := &chunkedReader{chunks: chunks, release: make(chan struct{})}
+	var fetches atomic.Int32
+	fetch := func() (int64, http.Header, io.ReadCloser, error) {
+		fetches.Add(1)
+		time.Sleep(10 * time.Millisecond) // let other Open calls wait for the fetch
+		return 9, http.Header{}, body, nil
+	}
+
+	// concurrent readers at different offsets, while the fill is in progress
+	var wg sync.WaitGroup
+	results := make([][]byte, 3)
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reader, meta, err := cache.Open(context.Background(), "key", fetch)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer func() { _ = reader.Close() }()
+			assert.Equal(t, int64(9), meta.Size)
+
+			size, err := reader.Seek(0, io.SeekEnd)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(9), size)
+			_, err = reader.Seek(int64(i*3), io.SeekStart)
+			assert.NoError(t, err)
+			results[i], err = io.ReadAll(reader)
+			assert.NoError(t, err)
+		}()
+	}
+	for range chunks {
+		body.release <- struct{}{}
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(1), fetches.Load())
+	assert.Equal(t, []byte("foobarbaz"), results[0])
+	assert.Equal(t, []byte("barbaz"), results[1])
+	assert.Equal(t, []byte("baz"), results[2])
+
+	// served from the committed entry
+	reader, meta, err := cache.Open(context.Background(), "key", fetch)
+	require.NoError(t, err)
+	defer func() { _ = reader.Close() }()
+	assert.Equal(t, int64(9), meta.Size)
+	assert.Equal(t, int32(1), fetches.Load())
+
+	// fetch errors are returned as-is
+	fetchErr := errors.New("upstream error")
+	_, _, err = cache.Open(context.Background(), "other", func() (int64, http.Header, io.ReadCloser, error) {
+		return 0, nil, nil, fetchErr
+	})
+	assert.Equal(t, fetchErr, err)
+}
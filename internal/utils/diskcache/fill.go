@@ -0,0 +1,249 @@
+package diskcache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var FillAbortedError = errors.New("cache fill aborted")
+
+type fillState int
+
+const (
+	fillStateRunning fillState = iota
+	fillStateDone
+	fillStateFailed
+)
+
+// fill represents an in-progress cache population of a key
+type fill struct {
+	cache    *Cache
+	meta     *Meta
+	partPath string
+	file     *os.File // write-only, owned by the leader
+
+	mu      notifyingMutex
+	path    string // changes to the data file path after commit
+	written int64
+	state   fillState
+}
+
+func newFill(cache *Cache, key string, size int64, header http.Header) (*fill, error) {
+	partPath := cache.pathOf(key, partFileSuffix)
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create part file: %v", err)
+	}
+	return &fill{
+		cache: cache,
+		meta: &Meta{
+			Key:     key,
+			Size:    size,
+			Header:  header.Clone(),
+			Created: time.Now(),
+		},
+		partPath: partPath,
+		file:     file,
+		mu:       newNotifyingMutex(),
+		path:     partPath,
+		state:    fillStateRunning,
+	}, nil
+}
+
+func (f *fill) onWritten(n int) {
+	f.mu.Lock()
+	f.written += int64(n)
+	f.mu.NotifyAndUnlock()
+}
+
+func (f *fill) finish(ok bool) {
+	if ok && f.meta.Size >= 0 && f.written != f.meta.Size {
+		log.Warnf("Disk cache fill %+q size mismatch, expected %d, written %d", f.meta.Key, f.meta.Size, f.written)
+		ok = false
+	}
+	if ok {
+		f.mu.Lock()
+		if f.meta.Size < 0 {
+			f.meta.Size = f.written
+		}
+		f.mu.Unlock()
+
+		// followers only read the written content, so the meta can be written without the lock
+		if err := writeMeta(f.file, f.meta); err != nil {
+			log.Errorf("Disk cache write meta %+q failed: %v", f.meta.Key, err)
+			ok = false
+		} else if err := f.file.Sync(); err != nil {
+			log.Errorf("Disk cache sync %+q failed: %v", f.meta.Key, err)
+			ok = false
+		}
+	}
+	_ = f.file.Close()
+
+	f.mu.Lock()
+	if ok {
+		if err := f.cache.commit(f); err != nil {
+			log.Errorf("Disk cache commit %+q failed: %v", f.meta.Key, err)
+			ok = false
+		} else {
+			f.path = f.cache.pathOf(f.meta.Key, dataFileSuffix)
+		}
+	}
+	if ok {
+		f.state = fillStateDone
+	} else {
+		f.state = fillStateFailed
+		_ = os.Remove(f.partPath)
+	}
+	f.mu.NotifyAndUnlock()
+
+	f.cache.finishFill(f)
+
+	// the eviction lists the whole cache directory, so it's done after the followers are notified
+	if ok && f.cache.maxTotalSize > 0 {
+		f.cache.evict()
+	}
+}
+
+func (f *fill) newLeader(body io.ReadCloser) io.ReadCloser {
+	return &fillLeaderReader{
+		fill: f,
+		body: body,
+	}
+}
+
+func (f *fill) newFollower(ctx context.Context) (*fillFollowerReader, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.state == fillStateFailed {
+		return nil, FillAbortedError
+	}
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	return &fillFollowerReader{
+		ctx:  ctx,
+		fill: f,
+		file: file,
+	}, nil
+}
+
+type fillLeaderReader struct {
+	fill     *fill
+	body     io.ReadCloser
+	finished bool
+}
+
+var _ io.ReadCloser = &fillLeaderReader{}
+
+func (r *fillLeaderReader) Read(p []byte) (int, error) {
+	n, err := r.body.Read(p)
+	if n > 0 && !r.finished {
+		if _, writeErr := r.fill.file.Write(p[:n]); writeErr != nil {
+			log.Errorf("Disk cache write %+q failed: %v", r.fill.meta.Key, writeErr)
+			r.finish(false)
+		} else {
+			r.fill.onWritten(n)
+		}
+	}
+	if err == io.EOF {
+		r.finish(true)
+	} else if err != nil {
+		r.finish(false)
+	}
+	return n, err
+}
+
+func (r *fillLeaderReader) finish(ok bool) {
+	if !r.finished {
+		r.finished = true
+		r.fill.finish(ok)
+	}
+}
+
+func (r *fillLeaderReader) Close() error {
+	r.finish(false) // no-op if already finished
+	return r.body.Close()
+}
+
+type fillFollowerReader struct {
+	ctx  context.Context
+	fill *fill
+	file *os.File
+	pos  int64
+}
+
+var _ io.ReadSeekCloser = &fillFollowerReader{}
+
+func (r *fillFollowerReader) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		f := r.fill
+		f.mu.Lock()
+		written, state, notify := f.written, f.state, f.mu.NotifyChan()
+		f.mu.Unlock()
+
+		if r.pos < written {
+			toRead := p
+			if int64(len(toRead)) > written-r.pos {
+				toRead = toRead[:written-r.pos]
+			}
+			n, err := r.file.ReadAt(toRead, r.pos)
+			r.pos += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+
+		switch state {
+		case fillStateDone:
+			return 0, io.EOF
+		case fillStateFailed:
+			return 0, FillAbortedError
+		}
+		select {
+		case <-notify:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *fillFollowerReader) Close() error {
+	return r.file.Close()
+}
+
+// Seek sets the position of the next Read. Seeking from the end requires the fill size to be known
+func (r *fillFollowerReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		r.fill.mu.Lock()
+		size := r.fill.meta.Size
+		r.fill.mu.Unlock()
+		if size < 0 {
+			return 0, errors.New("seek from end with unknown size")
+		}
+		pos = size + offset
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	return pos, nil
+}
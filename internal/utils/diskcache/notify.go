@@ -0,0 +1,28 @@
+package diskcache
+
+import "sync"
+
+// notifyingMutex is a mutex with a broadcast channel, which gets closed and replaced on every notification
+// It works like a sync.Cond, but can be used in a select statement
+type notifyingMutex struct {
+	sync.Mutex
+	ch chan struct{}
+}
+
+func newNotifyingMutex() notifyingMutex {
+	return notifyingMutex{
+		ch: make(chan struct{}),
+	}
+}
+
+// NotifyChan returns the current notification channel. Must be called with the lock held
+func (m *notifyingMutex) NotifyChan() <-chan struct{} {
+	return m.ch
+}
+
+// NotifyAndUnlock wakes up all waiters of the current notification channel, then unlocks the mutex
+func (m *notifyingMutex) NotifyAndUnlock() {
+	close(m.ch)
+	m.ch = make(chan struct{})
+	m.Unlock()
+}
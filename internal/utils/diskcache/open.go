@@ -0,0 +1,90 @@
+package diskcache
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// FetchFunc fetches the content to fill the cache with. The size must be known
+type FetchFunc func() (size int64, header http.Header, body io.ReadCloser, err error)
+
+// Open returns a seekable reader of the given key, from either the committed entry or the in-progress fill.
+// Reads from an in-progress fill block until the requested data is written.
+//
+// If neither exists, fetch is called to start a new fill, which keeps going in background even if all readers are gone.
+// Concurrent Open calls of the same key wait for the ongoing fetch instead of fetching again.
+// Errors from fetch are returned as-is, and the waiting calls will then try fetching by themselves
+func (c *Cache) Open(ctx context.Context, key string, fetch FetchFunc) (io.ReadSeekCloser, *Meta, error) {
+	var done chan struct{}
+	for done == nil {
+		if file, meta, ok := c.Get(key); ok {
+			return file, meta, nil
+		}
+
+		c.mu.Lock()
+		if f, ok := c.fills[key]; ok {
+			reader, err := f.newFollower(ctx)
+			c.mu.Unlock()
+			if err != nil {
+				return nil, nil, err
+			}
+			return reader, f.meta, nil
+		}
+		if ch, ok := c.fetches[key]; ok {
+			c.mu.Unlock()
+			select {
+			case <-ch:
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		done = make(chan struct{})
+		c.fetches[key] = done
+		c.mu.Unlock()
+	}
+
+	reader, meta, err := c.startFill(ctx, key, fetch)
+
+	c.mu.Lock()
+	delete(c.fetches, key)
+	close(done)
+	c.mu.Unlock()
+
+	return reader, meta, err
+}
+
+func (c *Cache) startFill(ctx context.Context, key string, fetch FetchFunc) (io.ReadSeekCloser, *Meta, error) {
+	size, header, body, err := fetch()
+	if err != nil {
+		return nil, nil, err
+	}
+	if size < 0 {
+		_ = body.Close()
+		return nil, nil, errors.New("unknown content size")
+	}
+
+	c.mu.Lock()
+	f, err := newFill(c, key, size, header)
+	if err != nil {
+		c.mu.Unlock()
+		_ = body.Close()
+		return nil, nil, err
+	}
+	c.fills[key] = f
+	c.mu.Unlock()
+
+	leader := f.newLeader(body)
+	go func() {
+		_, _ = io.Copy(io.Discard, leader)
+		_ = leader.Close()
+	}()
+
+	reader, err := f.newFollower(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reader, f.meta, nil
+}
@@ -0,0 +1,135 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimitStore stores the counters of DistributedRateLimiter, which might be shared by multiple instances
+type RateLimitStore interface {
+	// IncrBy increases the counters by n, and returns the new values.
+	// Counters that are created by the call expire after the given ttl
+	IncrBy(ctx context.Context, keys []string, n int64, ttl time.Duration) ([]int64, error)
+}
+
+type rateLimitWindow struct {
+	name     string
+	duration time.Duration
+	limit    int64
+}
+
+// DistributedRateLimiter is a fixed window request counter in a RateLimitStore.
+// If the store fails, the local limiter is used instead. Only Allow is distributed, WaitN always uses the local limiter
+type DistributedRateLimiter struct {
+	store   RateLimitStore
+	key     string
+	windows []rateLimitWindow
+	timeout time.Duration
+	local   RateLimiter
+}
+
+var _ RateLimiter = &DistributedRateLimiter{}
+
+// CreateDistributedRequestRateLimiter creates the distributed version of CreateRequestRateLimiter, with the same limits.
+// The key should identify the client, and the limits of the client
+func CreateDistributedRequestRateLimiter(store RateLimitStore, key string, timeout time.Duration, qps, qpm, qph *float64) RateLimiter {
+	limiter := &DistributedRateLimiter{
+		store:   store,
+		key:     key,
+		timeout: timeout,
+		local:   CreateRequestRateLimiter(qps, qpm, qph),
+	}
+	addWindow := func(name string, rate *float64, duration time.Duration) {
+		if rate != nil {
+			limit := int64(math.Max(math.Floor(*rate), 1))
+			limiter.windows = append(limiter.windows, rateLimitWindow{name: name, duration: duration, limit: limit})
+		}
+	}
+	addWindow("s", qps, time.Second)
+	addWindow("m", qpm, time.Minute)
+	addWindow("h", qph, time.Hour)
+	if len(limiter.windows) == 0 {
+		return limiter.local
+	}
+	return limiter
+}
+
+func (l *DistributedRateLimiter) Allow() bool {
+	now := time.Now()
+	keys := make([]string, len(l.windows))
+	for i, window := range l.windows {
+		keys[i] = fmt.Sprintf("%s:%s:%d", l.key, window.name, now.UnixNano()/int64(window.duration))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), l.timeout)
+	defer cancel()
+	// the ttl only needs to cover the longest window
+	counts, err := l.store.IncrBy(ctx, keys, 1, l.windows[len(l.windows)-1].duration+time.Minute)
+	if err != nil {
+		log.Debugf("Rate limit store failed, fallback to the local limiter: %v", err)
+		return l.local.Allow()
+	}
+	// rejected requests are counted as well, so clients that keep retrying stay limited
+	allow := true
+	for i, window := range l.windows {
+		allow = allow && counts[i] <= window.limit
+	}
+	return allow
+}
+
+func (l *DistributedRateLimiter) WaitN(ctx context.Context, n int) error {
+	return l.local.WaitN(ctx, n)
+}
+
+// MemoryRateLimitStore is a RateLimitStore in the memory, which is not shared by the instances
+// It's mostly for testing, as a local stand-in of the shared stores
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	counters map[string]*memoryCounter
+	lastGc   time.Time
+}
+
+type memoryCounter struct {
+	value    int64
+	expireAt time.Time
+}
+
+var _ RateLimitStore = &MemoryRateLimitStore{}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		counters: make(map[string]*memoryCounter),
+		lastGc:   time.Now(),
+	}
+}
+
+func (s *MemoryRateLimitStore) IncrBy(_ context.Context, keys []string, n int64, ttl time.Duration) ([]int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastGc) > time.Minute {
+		for key, counter := range s.counters {
+			if now.After(counter.expireAt) {
+				delete(s.counters, key)
+			}
+		}
+		s.lastGc = now
+	}
+
+	values := make([]int64, len(keys))
+	for i, key := range keys {
+		counter, ok := s.counters[key]
+		if !ok || now.After(counter.expireAt) {
+			counter = &memoryCounter{expireAt: now.Add(ttl)}
+			s.counters[key] = counter
+		}
+		counter.value += n
+		values[i] = counter.value
+	}
+	return values, nil
+}
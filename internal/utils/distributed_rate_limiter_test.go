@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func countAllowed(limiters []RateLimiter, n int) int {
+	allowed := 0
+	for i := 0; i < n; i++ {
+		if limiters[i%len(limiters)].Allow() {
+			allowed++
+		}
+	}
+	return allowed
+}
+
+func TestDistributedRateLimiterSharedStore(t *testing.T) {
+	// two instances with the same store share the limit
+	store := NewMemoryRateLimitStore()
+	qph := 5.0
+	limiters := []RateLimiter{
+		CreateDistributedRequestRateLimiter(store, "client", time.Second, nil, nil, &qph),
+		CreateDistributedRequestRateLimiter(store, "client", time.Second, nil, nil, &qph),
+	}
+	assert.Equal(t, 5, countAllowed(limiters, 20))
+
+	// other clients are not affected
+	other := CreateDistributedRequestRateLimiter(store, "other", time.Second, nil, nil, &qph)
+	assert.True(t, other.Allow())
+}
+
+type failingRateLimitStore struct{}
+
+func (failingRateLimitStore) IncrBy(context.Context, []string, int64, time.Duration) ([]int64, error) {
+	return nil, errors.New("unreachable")
+}
+
+func TestDistributedRateLimiterFallback(t *testing.T) {
+	qph := 5.0
+	limiters := []RateLimiter{
+		CreateDistributedRequestRateLimiter(failingRateLimitStore{}, "client", time.Second, nil, nil, &qph),
+		CreateDistributedRequestRateLimiter(failingRateLimitStore{}, "client", time.Second, nil, nil, &qph),
+	}
+	// each instance is limited by its own local limiter
+	assert.Equal(t, 10, countAllowed(limiters, 20))
+}
+
+type fakeRedis struct {
+	mu       sync.Mutex
+	counters map[string]int64
+	ttls     map[string]time.Duration
+}
+
+func (r *fakeRedis) counter(key string) (int64, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counters[key], r.ttls[key]
+}
+
+// exec executes a command other than AUTH, MULTI and EXEC, and returns the RESP reply
+func (r *fakeRedis) exec(args []any) string {
+	switch args[0] {
+	case "SELECT":
+		return "+OK\r\n"
+	case "SET":
+		// only "SET key value NX PX ttl" is supported
+		key := args[1].(string)
+		if _, ok := r.counters[key]; ok {
+			return "$-1\r\n"
+		}
+		value, _ := strconv.ParseInt(args[2].(string), 10, 64)
+		ttl, _ := strconv.ParseInt(args[5].(string), 10, 64)
+		r.counters[key] = value
+		r.ttls[key] = time.Duration(ttl) * time.Millisecond
+		return "+OK\r\n"
+	case "INCRBY":
+		n, _ := strconv.ParseInt(args[2].(string), 10, 64)
+		r.counters[args[1].(string)] += n
+		return ":" + strconv.FormatInt(r.counters[args[1].(string)], 10) + "\r\n"
+	default:
+		return "-ERR unknown command\r\n"
+	}
+}
+
+// startFakeRedis serves AUTH, SELECT, MULTI, EXEC, INCRBY and "SET NX PX", with the counters and their ttls in maps
+func startFakeRedis(t *testing.T, password string) (string, *fakeRedis) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	redis := &fakeRedis{
+		counters: make(map[string]int64),
+		ttls:     make(map[string]time.Duration),
+	}
+	serve := func(conn net.Conn) {
+		defer func() { _ = conn.Close() }()
+		reader := bufio.NewReader(conn)
+		authed := password == ""
+		var queued [][]any // nil if not in a transaction
+		for {
+			command, err := readRedisReply(reader)
+			if err != nil {
+				return
+			}
+			args := command.([]any)
+			var reply string
+			redis.mu.Lock()
+			switch {
+			case args[0] == "AUTH":
+				authed = args[1] == password
+				reply = "+OK\r\n"
+				if !authed {
+					reply = "-WRONGPASS invalid password\r\n"
+				}
+			case !authed:
+				reply = "-NOAUTH Authentication required\r\n"
+			case args[0] == "MULTI":
+				queued = [][]any{}
+				reply = "+OK\r\n"
+			case args[0] == "EXEC":
+				reply = "*" + strconv.Itoa(len(queued)) + "\r\n"
+				for _, queuedArgs := range queued {
+					reply += redis.exec(queuedArgs)
+				}
+				queued = nil
+			case queued != nil:
+				queued = append(queued, args)
+				reply = "+QUEUED\r\n"
+			default:
+				reply = redis.exec(args)
+			}
+			redis.mu.Unlock()
+			if _, err := conn.Write([]byte(reply)); err != nil {
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String(), redis
+}
+
+func TestRedisRateLimitStore(t *testing.T) {
+	address, redis := startFakeRedis(t, "secret")
+
+	store := NewRedisRateLimitStore(address, "secret", 1, "test:")
+	defer store.Close()
+	values, err := store.IncrBy(context.Background(), []string{"a", "b"}, 2, time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{2, 2}, values)
+	values, err = store.IncrBy(context.Background(), []string{"a"}, 1, time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []int64{3}, values)
+
+	// the ttl is set when the counter is created, and is not extended by the later increments
+	value, ttl := redis.counter("test:a")
+	assert.Equal(t, int64(3), value)
+	assert.Equal(t, time.Minute, ttl)
+	value, ttl = redis.counter("test:b")
+	assert.Equal(t, int64(2), value)
+	assert.Equal(t, time.Minute, ttl)
+
+	// wrong password
+	badStore := NewRedisRateLimitStore(address, "wrong", 0, "test:")
+	_, err = badStore.IncrBy(context.Background(), []string{"a"}, 1, time.Minute)
+	assert.Error(t, err)
+	// no retry within the backoff
+	_, err = badStore.IncrBy(context.Background(), []string{"a"}, 1, time.Minute)
+	assert.ErrorIs(t, err, errRedisUnavailable)
+}
@@ -0,0 +1,198 @@
+package utils
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"sync"
+	"time"
+)
+
+// FairSharedRateLimiter is a token bucket shared by multiple keys, e.g. clients.
+// When the bucket is drained, the waiters are served with start-time fair queueing,
+// where each key gets an equal share of the tokens, regardless of how many concurrent waiters it has.
+// So a client with lots of parallel downloads cannot starve the other clients
+type FairSharedRateLimiter struct {
+	limiter *rate.Limiter
+
+	mu          sync.Mutex
+	queues      map[string]*fairQueue // keys with waiters
+	lastFinish  map[string]float64    // virtual finish tag of the latest waiter of the keys
+	virtualTime float64               // virtual start tag of the latest dispatched waiter
+	dispatching bool
+}
+
+type fairQueue struct {
+	waiters []*fairWaiter
+}
+
+type fairWaiter struct {
+	ctx   context.Context
+	n     int
+	start float64 // virtual start tag
+	ready chan struct{}
+}
+
+func NewFairSharedRateLimiter(limit rate.Limit, burst int) *FairSharedRateLimiter {
+	return &FairSharedRateLimiter{
+		limiter:    rate.NewLimiter(limit, burst),
+		queues:     make(map[string]*fairQueue),
+		lastFinish: make(map[string]float64),
+	}
+}
+
+// Limiter returns the view of the shared limiter for the given key
+func (l *FairSharedRateLimiter) Limiter(key string) RateLimiter {
+	return &fairKeyLimiter{parent: l, key: key}
+}
+
+type fairKeyLimiter struct {
+	parent *FairSharedRateLimiter
+	key    string
+}
+
+var _ RateLimiter = &fairKeyLimiter{}
+
+func (k *fairKeyLimiter) Allow() bool {
+	return k.parent.allowN(1)
+}
+
+func (k *fairKeyLimiter) WaitN(ctx context.Context, n int) error {
+	return k.parent.waitN(ctx, k.key, n)
+}
+
+func (l *FairSharedRateLimiter) allowN(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.queues) == 0 && l.limiter.AllowN(time.Now(), n)
+}
+
+func (l *FairSharedRateLimiter) waitN(ctx context.Context, key string, n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	// fast path, no contention
+	if len(l.queues) == 0 && l.limiter.AllowN(time.Now(), n) {
+		l.mu.Unlock()
+		return nil
+	}
+
+	// a newly active key starts from the current virtual time, instead of its long-gone history
+	start := max(l.virtualTime, l.lastFinish[key])
+	l.lastFinish[key] = start + float64(n)
+	waiter := &fairWaiter{ctx: ctx, n: n, start: start, ready: make(chan struct{})}
+	queue, ok := l.queues[key]
+	if !ok {
+		queue = &fairQueue{}
+		l.queues[key] = queue
+	}
+	queue.waiters = append(queue.waiters, waiter)
+	if !l.dispatching {
+		l.dispatching = true
+		go l.dispatchRoutine()
+	}
+	l.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.removeWaiter(key, waiter)
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// removeWaiter removes the waiter from the queue if it's not dispatched yet. Lock l.mu before calling this
+func (l *FairSharedRateLimiter) removeWaiter(key string, waiter *fairWaiter) {
+	queue, ok := l.queues[key]
+	if !ok {
+		return
+	}
+	for i, w := range queue.waiters {
+		if w == waiter {
+			queue.waiters = append(queue.waiters[:i], queue.waiters[i+1:]...)
+			break
+		}
+	}
+	if len(queue.waiters) == 0 {
+		delete(l.queues, key)
+	}
+}
+
+// popWaiter pops the waiter with the least start tag. Lock l.mu before calling this
+func (l *FairSharedRateLimiter) popWaiter() *fairWaiter {
+	var selectedKey string
+	var selectedQueue *fairQueue
+	for key, queue := range l.queues {
+		if selectedQueue == nil || queue.waiters[0].start < selectedQueue.waiters[0].start {
+			selectedKey, selectedQueue = key, queue
+		}
+	}
+	if selectedQueue == nil {
+		return nil
+	}
+
+	waiter := selectedQueue.waiters[0]
+	selectedQueue.waiters = selectedQueue.waiters[1:]
+	if len(selectedQueue.waiters) == 0 {
+		delete(l.queues, selectedKey)
+	}
+	l.virtualTime = waiter.start
+
+	// idle keys behind the virtual time are the same as the new keys
+	for key, finish := range l.lastFinish {
+		if _, ok := l.queues[key]; !ok && finish <= l.virtualTime {
+			delete(l.lastFinish, key)
+		}
+	}
+	return waiter
+}
+
+// dispatchRoutine grants the tokens to the waiters one by one, and exits when there's no more waiter
+func (l *FairSharedRateLimiter) dispatchRoutine() {
+	for {
+		l.mu.Lock()
+		waiter := l.popWaiter()
+		if waiter == nil {
+			l.dispatching = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+
+		if waiter.ctx.Err() != nil {
+			continue
+		}
+		l.waitTokens(waiter.ctx, waiter.n)
+		close(waiter.ready)
+	}
+}
+
+// waitTokens waits until n tokens are taken. n larger than the burst size is taken in multiple parts
+func (l *FairSharedRateLimiter) waitTokens(ctx context.Context, n int) {
+	for n > 0 {
+		part := min(n, l.limiter.Burst())
+		if part <= 0 {
+			return
+		}
+		reservation := l.limiter.ReserveN(time.Now(), part)
+		if !reservation.OK() {
+			return
+		}
+		if delay := reservation.Delay(); delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				// the waiter is gone, give the tokens back to the others
+				timer.Stop()
+				reservation.Cancel()
+				return
+			}
+		}
+		n -= part
+	}
+}
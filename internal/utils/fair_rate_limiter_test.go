@@ -0,0 +1,55 @@
+package utils
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFairSharedRateLimiter(t *testing.T) {
+	limiter := NewFairSharedRateLimiter(200000, 1000)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// a heavy client with 10 parallel streams, and a light client with 1 stream
+	var heavy, light atomic.Int64
+	var wg sync.WaitGroup
+	stream := func(key string, counter *atomic.Int64) {
+		defer wg.Done()
+		keyLimiter := limiter.Limiter(key)
+		for keyLimiter.WaitN(ctx, 1000) == nil {
+			counter.Add(1000)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go stream("heavy", &heavy)
+	}
+	wg.Add(1)
+	go stream("light", &light)
+	wg.Wait()
+
+	total := heavy.Load() + light.Load()
+	assert.InDelta(t, 100000, total, 30000)
+	assert.Greater(t, float64(light.Load()), float64(total)*0.4)
+}
+
+func TestFairSharedRateLimiterCancel(t *testing.T) {
+	limiter := NewFairSharedRateLimiter(1000, 1000)
+	assert.NoError(t, limiter.Limiter("a").WaitN(context.Background(), 1000))
+
+	// the bucket is drained, so the waiter has to wait for 1s
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, limiter.Limiter("a").WaitN(ctx, 1000), context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 500*time.Millisecond)
+
+	// larger than the burst size
+	limiter = NewFairSharedRateLimiter(100000, 1000)
+	assert.NoError(t, limiter.Limiter("a").WaitN(context.Background(), 5000))
+}
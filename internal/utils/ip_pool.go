@@ -6,6 +6,7 @@ import (
 	"math/big"
 	"math/rand"
 	"net"
+	"strconv"
 )
 
 type IpPool struct {
@@ -141,3 +142,63 @@ func (p *IpPool) GetRandomly() net.IP {
 	index := big.NewInt(0).Rand(p.rnd, p.total)
 	return p.ipFromIndex(index)
 }
+
+// maxIpPickAttempts is the max attempts to pick an accepted address, before falling back to the first pick
+const maxIpPickAttempts = 8
+
+// GetRandomlyAccepted returns a random address that is accepted by the given function.
+// If no accepted address is found within a few attempts, the first picked address is returned
+func (p *IpPool) GetRandomlyAccepted(accept func(ip net.IP) bool) net.IP {
+	var first net.IP
+	for i := 0; i < maxIpPickAttempts; i++ {
+		ip := p.GetRandomly()
+		if accept(ip) {
+			return ip
+		}
+		if first == nil {
+			first = ip
+		}
+	}
+	return first
+}
+
+// GetByKeyAccepted is GetByKey that re-hashes the key until the address is accepted by the given function.
+// The re-hashed address of a key is stable, so the key still sticks to the same address when its own address is not accepted.
+// If no accepted address is found within a few attempts, the address of GetByKey is returned
+func (p *IpPool) GetByKeyAccepted(key string, accept func(ip net.IP) bool) net.IP {
+	first := p.GetByKey(key)
+	if accept(first) {
+		return first
+	}
+	for i := 1; i < maxIpPickAttempts; i++ {
+		if ip := p.GetByKey(key + "#" + strconv.Itoa(i)); accept(ip) {
+			return ip
+		}
+	}
+	return first
+}
+
+// Sample returns at most n distinct addresses of the pool.
+// All addresses are returned in order if the pool is not larger than n, otherwise the addresses are picked randomly
+func (p *IpPool) Sample(n int) []net.IP {
+	if p.total.Cmp(big.NewInt(int64(n))) <= 0 {
+		ips := make([]net.IP, 0, p.total.Int64())
+		for i := int64(0); i < p.total.Int64(); i++ {
+			ips = append(ips, p.ipFromIndex(big.NewInt(i)))
+		}
+		return ips
+	}
+
+	// p.rnd is not used, since it's not safe for concurrent use
+	rnd := rand.New(rand.NewSource(rand.Int63()))
+	picked := make(map[string]bool)
+	ips := make([]net.IP, 0, n)
+	for len(ips) < n {
+		index := big.NewInt(0).Rand(rnd, p.total)
+		if key := index.String(); !picked[key] {
+			picked[key] = true
+			ips = append(ips, p.ipFromIndex(index))
+		}
+	}
+	return ips
+}
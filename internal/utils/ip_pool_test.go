@@ -225,3 +225,24 @@ func TestCalculateUsableIPs(t *testing.T) {
 		})
 	}
 }
+
+func TestIpPoolSample(t *testing.T) {
+	pool, err := NewIpPool([]string{"192.168.1.1", "10.0.0.0/30"})
+	require.NoError(t, err)
+	var ips []string
+	for _, ip := range pool.Sample(10) {
+		ips = append(ips, ip.String())
+	}
+	assert.Equal(t, []string{"192.168.1.1", "10.0.0.0", "10.0.0.1", "10.0.0.2", "10.0.0.3"}, ips)
+
+	pool, err = NewIpPool([]string{"2001:db8:cafe::/64"})
+	require.NoError(t, err)
+	sampled := pool.Sample(20)
+	assert.Len(t, sampled, 20)
+	seen := make(map[string]bool)
+	for _, ip := range sampled {
+		assert.True(t, pool.Contains(ip), ip.String())
+		seen[ip.String()] = true
+	}
+	assert.Len(t, seen, 20)
+}
@@ -0,0 +1,325 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"net"
+	"os"
+)
+
+var maxMindMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+const maxMindDataSectionSeparator = 16
+
+// MaxMindDb is a reader of the MaxMind DB format, e.g. the GeoLite2 / GeoIP2 country and city databases.
+// See https://maxmind.github.io/MaxMind-DB/ for the format
+type MaxMindDb struct {
+	buf          []byte
+	dataSection  []byte
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	ipv4Start    uint // the node of ::/96 in an IPv6 tree, where the IPv4 addresses are
+	DatabaseType string
+}
+
+func OpenMaxMindDb(path string) (*MaxMindDb, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewMaxMindDb(buf)
+}
+
+func NewMaxMindDb(buf []byte) (*MaxMindDb, error) {
+	markerIdx := bytes.LastIndex(buf, maxMindMetadataMarker)
+	if markerIdx < 0 {
+		return nil, errors.New("metadata marker not found, not a MaxMind DB file")
+	}
+	metadataStart := markerIdx + len(maxMindMetadataMarker)
+	metadataValue, _, err := (&maxMindDecoder{buf: buf[metadataStart:]}).decode(0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode the metadata: %v", err)
+	}
+	metadata, ok := metadataValue.(map[string]any)
+	if !ok {
+		return nil, errors.New("bad metadata")
+	}
+	getUint := func(key string) (uint, error) {
+		value, ok := metadata[key].(uint64)
+		if !ok {
+			return 0, fmt.Errorf("bad metadata field %s: %v", key, metadata[key])
+		}
+		return uint(value), nil
+	}
+
+	db := &MaxMindDb{buf: buf}
+	if db.nodeCount, err = getUint("node_count"); err != nil {
+		return nil, err
+	}
+	if db.recordSize, err = getUint("record_size"); err != nil {
+		return nil, err
+	}
+	if db.ipVersion, err = getUint("ip_version"); err != nil {
+		return nil, err
+	}
+	db.DatabaseType, _ = metadata["database_type"].(string)
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	if db.ipVersion != 4 && db.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported ip version %d", db.ipVersion)
+	}
+
+	treeSize := db.nodeCount * db.recordSize / 4
+	if treeSize+maxMindDataSectionSeparator > uint(markerIdx) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	db.dataSection = buf[treeSize+maxMindDataSectionSeparator : markerIdx]
+
+	if db.ipVersion == 6 {
+		for i := 0; i < 96 && db.ipv4Start < db.nodeCount; i++ {
+			db.ipv4Start = db.readRecord(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+func (db *MaxMindDb) readRecord(node uint, bit uint) uint {
+	switch db.recordSize {
+	case 24:
+		offset := node*6 + bit*3
+		b := db.buf[offset : offset+3]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := db.buf[node*7 : node*7+7]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		offset := node*8 + bit*4
+		return uint(binary.BigEndian.Uint32(db.buf[offset : offset+4]))
+	}
+}
+
+// Lookup returns the record of the ip, or nil if the ip is not in the database.
+// Maps are decoded as map[string]any, arrays as []any, and unsigned integers as uint64 (*big.Int for uint128)
+func (db *MaxMindDb) Lookup(ip net.IP) (any, error) {
+	var ipBytes []byte
+	node := uint(0)
+	if ip4 := ip.To4(); ip4 != nil {
+		ipBytes = ip4
+		if db.ipVersion == 6 {
+			node = db.ipv4Start
+		}
+	} else if ip16 := ip.To16(); ip16 != nil {
+		if db.ipVersion == 4 {
+			return nil, nil
+		}
+		ipBytes = ip16
+	} else {
+		return nil, fmt.Errorf("invalid ip %v", ip)
+	}
+
+	for i := 0; i < len(ipBytes)*8 && node < db.nodeCount; i++ {
+		bit := uint(ipBytes[i/8]>>(7-i%8)) & 1
+		node = db.readRecord(node, bit)
+	}
+	if node == db.nodeCount {
+		return nil, nil
+	}
+	if node < db.nodeCount {
+		return nil, errors.New("invalid search tree")
+	}
+	offset := node - db.nodeCount - maxMindDataSectionSeparator
+	value, _, err := (&maxMindDecoder{buf: db.dataSection}).decode(offset, 0)
+	return value, err
+}
+
+// LookupCountry returns the ISO 3166-1 alpha-2 code of the country of the ip, or the registered country as the fallback.
+// Empty string is returned if the country is unknown
+func (db *MaxMindDb) LookupCountry(ip net.IP) (string, error) {
+	record, err := db.Lookup(ip)
+	if err != nil {
+		return "", err
+	}
+	recordMap, _ := record.(map[string]any)
+	for _, field := range []string{"country", "registered_country"} {
+		if country, ok := recordMap[field].(map[string]any); ok {
+			if isoCode, ok := country["iso_code"].(string); ok && isoCode != "" {
+				return isoCode, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+type maxMindDecoder struct {
+	buf []byte
+}
+
+const (
+	maxMindTypeExtended = 0
+	maxMindTypePointer  = 1
+	maxMindTypeString   = 2
+	maxMindTypeDouble   = 3
+	maxMindTypeBytes    = 4
+	maxMindTypeUint16   = 5
+	maxMindTypeUint32   = 6
+	maxMindTypeMap      = 7
+	maxMindTypeInt32    = 8
+	maxMindTypeUint64   = 9
+	maxMindTypeUint128  = 10
+	maxMindTypeArray    = 11
+	maxMindTypeBoolean  = 14
+	maxMindTypeFloat    = 15
+
+	maxMindMaxDepth = 32
+)
+
+func (d *maxMindDecoder) read(offset uint, size uint) ([]byte, error) {
+	if offset+size > uint(len(d.buf)) || offset+size < offset {
+		return nil, errors.New("unexpected end of the data")
+	}
+	return d.buf[offset : offset+size], nil
+}
+
+// decode decodes the value at the offset, and returns the offset after the value
+func (d *maxMindDecoder) decode(offset uint, depth int) (any, uint, error) {
+	if depth > maxMindMaxDepth {
+		return nil, 0, errors.New("data is nested too deep")
+	}
+	ctrl, err := d.read(offset, 1)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+	typ := uint(ctrl[0] >> 5)
+
+	if typ == maxMindTypePointer {
+		ss, vvv := uint(ctrl[0]>>3)&0x3, uint(ctrl[0]&0x7)
+		b, err := d.read(offset, ss+1)
+		if err != nil {
+			return nil, 0, err
+		}
+		var pointer uint
+		switch ss {
+		case 0:
+			pointer = vvv<<8 | uint(b[0])
+		case 1:
+			pointer = (vvv<<16 | uint(b[0])<<8 | uint(b[1])) + 2048
+		case 2:
+			pointer = (vvv<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])) + 526336
+		default:
+			pointer = uint(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := d.decode(pointer, depth+1)
+		return value, offset + ss + 1, err
+	}
+
+	if typ == maxMindTypeExtended {
+		b, err := d.read(offset, 1)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset++
+		typ = 7 + uint(b[0])
+	}
+
+	size := uint(ctrl[0] & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.read(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		switch n {
+		case 1:
+			size = 29 + uint(b[0])
+		case 2:
+			size = 285 + (uint(b[0])<<8 | uint(b[1]))
+		default:
+			size = 65821 + (uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2]))
+		}
+	}
+
+	switch typ {
+	case maxMindTypeMap:
+		result := make(map[string]any, size)
+		for i := uint(0); i < size; i++ {
+			var key, value any
+			if key, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, 0, fmt.Errorf("map key %v is not a string", key)
+			}
+			if value, offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+			result[keyStr] = value
+		}
+		return result, offset, nil
+	case maxMindTypeArray:
+		result := make([]any, size)
+		for i := range result {
+			if result[i], offset, err = d.decode(offset, depth+1); err != nil {
+				return nil, 0, err
+			}
+		}
+		return result, offset, nil
+	case maxMindTypeBoolean:
+		return size != 0, offset, nil
+	}
+
+	b, err := d.read(offset, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset += size
+	switch typ {
+	case maxMindTypeString:
+		return string(b), offset, nil
+	case maxMindTypeBytes:
+		return bytes.Clone(b), offset, nil
+	case maxMindTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("bad double size %d", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case maxMindTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("bad float size %d", size)
+		}
+		return math.Float32frombits(binary.BigEndian.Uint32(b)), offset, nil
+	case maxMindTypeUint16, maxMindTypeUint32, maxMindTypeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("bad uint size %d", size)
+		}
+		var value uint64
+		for _, c := range b {
+			value = value<<8 | uint64(c)
+		}
+		return value, offset, nil
+	case maxMindTypeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("bad int32 size %d", size)
+		}
+		var value uint32
+		for _, c := range b {
+			value = value<<8 | uint32(c)
+		}
+		return int32(value), offset, nil
+	case maxMindTypeUint128:
+		return new(big.Int).SetBytes(b), offset, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported data type %d", typ)
+	}
+}
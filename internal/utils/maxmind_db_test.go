@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+// maxMindTestWriter builds a MaxMind DB with non-overlapping networks, and string / uint / map values only
+type maxMindTestWriter struct {
+	ipVersion  int
+	recordSize int
+	nodes      [][2]int // -1 for empty, -2-offset for data
+	data       []byte
+}
+
+func newMaxMindTestWriter(ipVersion int, recordSize int) *maxMindTestWriter {
+	return &maxMindTestWriter{ipVersion: ipVersion, recordSize: recordSize, nodes: [][2]int{{-1, -1}}}
+}
+
+func encodeMaxMindValue(value any) []byte {
+	header := func(typ int, size int) []byte {
+		if typ <= 7 {
+			return []byte{byte(typ<<5 | size)}
+		}
+		return []byte{byte(size), byte(typ - 7)}
+	}
+	switch v := value.(type) {
+	case string:
+		return append(header(maxMindTypeString, len(v)), v...)
+	case uint16:
+		return append(header(maxMindTypeUint16, 2), byte(v>>8), byte(v))
+	case map[string]any:
+		buf := header(maxMindTypeMap, len(v))
+		for key, item := range v {
+			buf = append(buf, encodeMaxMindValue(key)...)
+			buf = append(buf, encodeMaxMindValue(item)...)
+		}
+		return buf
+	default:
+		panic(v)
+	}
+}
+
+func (w *maxMindTestWriter) insert(cidr string, record map[string]any) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	ip := network.IP.To16()
+	ones, _ := network.Mask.Size()
+	if w.ipVersion == 4 {
+		ip = network.IP.To4()
+	} else if ip4 := network.IP.To4(); ip4 != nil {
+		// IPv4 addresses are in ::/96 of the IPv6 tree
+		ip = append(make(net.IP, 12), ip4...)
+		ones += 96
+	}
+
+	dataOffset := len(w.data)
+	w.data = append(w.data, encodeMaxMindValue(record)...)
+	node := 0
+	for i := 0; i < ones; i++ {
+		bit := int(ip[i/8]>>(7-i%8)) & 1
+		if i == ones-1 {
+			w.nodes[node][bit] = -2 - dataOffset
+			break
+		}
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+}
+
+func (w *maxMindTestWriter) build() []byte {
+	var buf []byte
+	nodeCount := len(w.nodes)
+	for _, node := range w.nodes {
+		var records [2]uint32
+		for bit, record := range node {
+			switch {
+			case record == -1:
+				records[bit] = uint32(nodeCount)
+			case record < -1:
+				records[bit] = uint32(nodeCount + maxMindDataSectionSeparator + (-2 - record))
+			default:
+				records[bit] = uint32(record)
+			}
+		}
+		if w.recordSize == 24 {
+			buf = append(buf, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]), byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		} else {
+			buf = append(buf, byte(records[0]>>24), byte(records[0]>>16), byte(records[0]>>8), byte(records[0]), byte(records[1]>>24), byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		}
+	}
+	buf = append(buf, make([]byte, maxMindDataSectionSeparator)...)
+	buf = append(buf, w.data...)
+	buf = append(buf, maxMindMetadataMarker...)
+	metadata := map[string]any{
+		"node_count":    uint16(nodeCount),
+		"record_size":   uint16(w.recordSize),
+		"ip_version":    uint16(w.ipVersion),
+		"database_type": "Test-Country",
+	}
+	// uint16 values are decoded as uint64, same as the real uint32 fields
+	return append(buf, encodeMaxMindValue(metadata)...)
+}
+
+func country(code string) map[string]any {
+	return map[string]any{"country": map[string]any{"iso_code": code, "names": map[string]any{"en": "Test " + code}}}
+}
+
+func TestMaxMindDb(t *testing.T) {
+	for _, testCase := range []struct {
+		ipVersion  int
+		recordSize int
+	}{{4, 24}, {6, 24}, {6, 32}} {
+		w := newMaxMindTestWriter(testCase.ipVersion, testCase.recordSize)
+		w.insert("10.0.0.0/8", country("AA"))
+		w.insert("192.168.1.0/24", map[string]any{"registered_country": map[string]any{"iso_code": "BB"}})
+		if testCase.ipVersion == 6 {
+			w.insert("2001:db8::/32", country("CC"))
+		}
+
+		db, err := NewMaxMindDb(w.build())
+		require.NoError(t, err)
+		assert.Equal(t, "Test-Country", db.DatabaseType)
+
+		lookup := func(ip string) string {
+			code, err := db.LookupCountry(net.ParseIP(ip))
+			require.NoError(t, err)
+			return code
+		}
+		assert.Equal(t, "AA", lookup("10.1.2.3"))
+		assert.Equal(t, "BB", lookup("192.168.1.100"))
+		assert.Equal(t, "", lookup("192.168.2.1"))
+		assert.Equal(t, "", lookup("1.1.1.1"))
+		if testCase.ipVersion == 6 {
+			assert.Equal(t, "CC", lookup("2001:db8::1"))
+			assert.Equal(t, "", lookup("2001:db9::1"))
+		} else {
+			assert.Equal(t, "", lookup("2001:db8::1"))
+		}
+
+		record, err := db.Lookup(net.ParseIP("10.0.0.1"))
+		require.NoError(t, err)
+		assert.Equal(t, "Test AA", record.(map[string]any)["country"].(map[string]any)["names"].(map[string]any)["en"])
+	}
+}
+
+func TestMaxMindDbPointer(t *testing.T) {
+	// pointers to the strings, which is how the real databases deduplicate the values
+	decoder := &maxMindDecoder{buf: bytes.Join([][]byte{
+		encodeMaxMindValue("iso_code"),
+		encodeMaxMindValue("JP"),
+		{maxMindTypeMap<<5 | 1, maxMindTypePointer << 5, 0, maxMindTypePointer << 5, 9},
+	}, nil)}
+	value, _, err := decoder.decode(12, 0)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]any{"iso_code": "JP"}, value)
+
+	_, err = NewMaxMindDb([]byte("not a database"))
+	assert.Error(t, err)
+}
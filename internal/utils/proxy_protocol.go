@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+const (
+	proxyProtocolV1MaxLength    = 107
+	proxyProtocolHeaderTimeout  = 10 * time.Second
+	proxyProtocolV2CommandLocal = 0x0
+	proxyProtocolV2CommandProxy = 0x1
+	proxyProtocolV2FamilyTcp4   = 0x11
+	proxyProtocolV2FamilyTcp6   = 0x21
+)
+
+// ProxyProtocolListener accepts the HAProxy PROXY protocol v1 and v2 headers from the trusted peers,
+// and reports the source address in the header as the remote address of the connection.
+// The header is optional, and the header from an untrusted peer is not parsed, so it will be treated as the data.
+// See https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+type ProxyProtocolListener struct {
+	net.Listener
+	isTrustedPeer func(ip net.IP) bool
+}
+
+func NewProxyProtocolListener(listener net.Listener, isTrustedPeer func(ip net.IP) bool) *ProxyProtocolListener {
+	return &ProxyProtocolListener{
+		Listener:      listener,
+		isTrustedPeer: isTrustedPeer,
+	}
+}
+
+func (l *ProxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if peerIp, _ := GetIpFromHostPort(conn.RemoteAddr().String()); peerIp == nil || !l.isTrustedPeer(peerIp) {
+		return conn, nil
+	}
+	// the header is read on the first use in the connection goroutine, so a slow peer won't block the accept loop
+	return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr // nil if there's no address in the header
+	headerErr  error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolHeaderTimeout))
+		c.remoteAddr, c.headerErr = readProxyProtocolHeader(c.reader)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		if c.headerErr != nil {
+			_ = c.Conn.Close()
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// readProxyProtocolHeader reads the header if there's one. Returns nil address if there's no header,
+// or the header does not contain the address, e.g. the health checks of the proxy
+func readProxyProtocolHeader(reader *bufio.Reader) (net.Addr, error) {
+	// peek the first byte first, so short data without the header won't be waited for more bytes
+	first, err := reader.Peek(1)
+	if err != nil {
+		// the connection is closed before sending any data, which will be seen by the next read
+		return nil, nil
+	}
+	switch first[0] {
+	case proxyProtocolV2Signature[0]:
+		if peek, err := reader.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(peek, proxyProtocolV2Signature) {
+			return readProxyProtocolV2Header(reader)
+		}
+	case 'P':
+		if peek, err := reader.Peek(6); err == nil && string(peek) == "PROXY " {
+			return readProxyProtocolV1Header(reader)
+		}
+	}
+	return nil, nil
+}
+
+func readProxyProtocolV1Header(reader *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, fmt.Errorf("read PROXY v1 header failed: %v", err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+		if len(line) >= proxyProtocolV1MaxLength {
+			return nil, errors.New("PROXY v1 header is too long")
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("PROXY v1 header does not end with CRLF")
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("bad PROXY v1 header %+q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("bad PROXY v1 header %+q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyProtocolV2Header(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, fmt.Errorf("read PROXY v2 header failed: %v", err)
+	}
+	version, command, family := header[12]>>4, header[12]&0x0f, header[13]
+	if version != 2 {
+		return nil, fmt.Errorf("bad PROXY v2 version %d", version)
+	}
+	length := binary.BigEndian.Uint16(header[14:16])
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, fmt.Errorf("read PROXY v2 addresses failed: %v", err)
+	}
+
+	switch command {
+	case proxyProtocolV2CommandLocal:
+		return nil, nil
+	case proxyProtocolV2CommandProxy:
+	default:
+		return nil, fmt.Errorf("bad PROXY v2 command %d", command)
+	}
+	// the TLVs after the addresses are ignored
+	switch family {
+	case proxyProtocolV2FamilyTcp4:
+		if len(payload) < 12 {
+			return nil, errors.New("PROXY v2 IPv4 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case proxyProtocolV2FamilyTcp6:
+		if len(payload) < 36 {
+			return nil, errors.New("PROXY v2 IPv6 addresses are truncated")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		// UDP and unix sockets are not used by the http server
+		return nil, nil
+	}
+}
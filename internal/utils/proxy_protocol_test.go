@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"testing"
+)
+
+func proxyProtocolV2Header(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	ipv4Addresses := []byte{192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0, 80}
+	ipv6Addresses := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0, 80)
+
+	for _, testCase := range []struct {
+		name       string
+		trusted    bool
+		header     []byte
+		remoteAddr string // empty for the peer address
+		data       string // empty for the connection to be closed
+	}{
+		{"v1 tcp4", true, []byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 80\r\n"), "192.0.2.1:12345", "GET / HTTP/1.1\r\n"},
+		{"v1 tcp6", true, []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n"), "[2001:db8::1]:12345", "GET / HTTP/1.1\r\n"},
+		{"v1 unknown", true, []byte("PROXY UNKNOWN\r\n"), "", "GET / HTTP/1.1\r\n"},
+		{"v2 tcp4", true, proxyProtocolV2Header(proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTcp4, ipv4Addresses), "192.0.2.1:12345", "GET / HTTP/1.1\r\n"},
+		{"v2 tcp6 with tlv", true, proxyProtocolV2Header(proxyProtocolV2CommandProxy, proxyProtocolV2FamilyTcp6, append(ipv6Addresses, 0x04, 0, 1, 'x')), "[2001:db8::1]:12345", "GET / HTTP/1.1\r\n"},
+		{"v2 local", true, proxyProtocolV2Header(proxyProtocolV2CommandLocal, 0, nil), "", "GET / HTTP/1.1\r\n"},
+		{"no header", true, nil, "", "GET / HTTP/1.1\r\n"},
+		{"no header, starts with P", true, nil, "", "PUT / HTTP/1.1\r\n"},
+		{"bad v1 header", true, []byte("PROXY TCP4 192.0.2.1\r\n"), "", ""},
+		{"v1 family mismatch", true, []byte("PROXY TCP4 2001:db8::1 2001:db8::2 12345 80\r\n"), "", ""},
+		// a client connecting directly cannot spoof its address with the header
+		{"untrusted peer", false, []byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 80\r\n"), "", "PROXY TCP4 192.0.2.1 10.0.0.1 12345 80\r\nGET / HTTP/1.1\r\n"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			rawListener, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			listener := NewProxyProtocolListener(rawListener, func(net.IP) bool { return testCase.trusted })
+			defer func() { _ = listener.Close() }()
+
+			client, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			defer func() { _ = client.Close() }()
+			request := "GET / HTTP/1.1\r\n"
+			if testCase.header == nil {
+				request = testCase.data
+			}
+			_, err = client.Write(append(append([]byte{}, testCase.header...), request...))
+			require.NoError(t, err)
+
+			conn, err := listener.Accept()
+			require.NoError(t, err)
+			defer func() { _ = conn.Close() }()
+
+			buf := make([]byte, len(testCase.header)+len(request))
+			n, err := io.ReadAtLeast(conn, buf, 1)
+			if testCase.data == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			if n < len(testCase.data) {
+				m, _ := io.ReadFull(conn, buf[n:len(testCase.data)])
+				n += m
+			}
+			assert.Equal(t, testCase.data, string(buf[:n]))
+
+			expectedAddr := testCase.remoteAddr
+			if expectedAddr == "" {
+				expectedAddr = client.LocalAddr().String()
+			}
+			assert.Equal(t, expectedAddr, conn.RemoteAddr().String())
+		})
+	}
+}
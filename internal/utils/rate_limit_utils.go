@@ -31,6 +31,17 @@ func CreateTrafficRateLimiter(avgMbps, burstMb, maxMbps *float64) RateLimiter {
 	return limiter
 }
 
+// CreateTrafficPool creates the traffic limiter shared by all clients, or returns nil if avgMbps is nil
+func CreateTrafficPool(avgMbps, burstMb *float64) *FairSharedRateLimiter {
+	if avgMbps == nil {
+		return nil
+	}
+	if burstMb == nil {
+		burstMb = ToPtr(math.Max(*avgMbps, 1))
+	}
+	return NewFairSharedRateLimiter(rate.Limit(*avgMbps*bytePerMib), max(constrainToInt(*burstMb*bytePerMib), 1))
+}
+
 func CreateRequestRateLimiter(qps, qpm, qph *float64) RateLimiter {
 	limiter := NewMultiRateLimiter()
 	if qps != nil {
@@ -0,0 +1,254 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	redisMaxIdleConns = 16
+	redisRetryBackoff = 5 * time.Second // the store is not used within the backoff after a failure
+)
+
+var errRedisUnavailable = errors.New("redis store is unavailable")
+
+// RedisRateLimitStore is a RateLimitStore in a Redis-protocol compatible server, e.g. Redis, Valkey, KeyDB or Dragonfly
+type RedisRateLimitStore struct {
+	address  string
+	password string
+	db       int
+	prefix   string
+
+	idleConns chan *redisConn
+
+	mu               sync.Mutex
+	unavailableUntil time.Time
+}
+
+var _ RateLimitStore = &RedisRateLimitStore{}
+
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisRateLimitStore(address, password string, db int, prefix string) *RedisRateLimitStore {
+	return &RedisRateLimitStore{
+		address:   address,
+		password:  password,
+		db:        db,
+		prefix:    prefix,
+		idleConns: make(chan *redisConn, redisMaxIdleConns),
+	}
+}
+
+// IncrBy increases the counters in a MULTI transaction. The new counters are created by "SET NX PX" in the same transaction,
+// so they always have the ttl, even if the connection breaks in the middle
+func (s *RedisRateLimitStore) IncrBy(ctx context.Context, keys []string, n int64, ttl time.Duration) ([]int64, error) {
+	s.mu.Lock()
+	unavailable := time.Now().Before(s.unavailableUntil)
+	s.mu.Unlock()
+	if unavailable {
+		return nil, errRedisUnavailable
+	}
+
+	values, err := s.incrBy(ctx, keys, n, ttl)
+	if err != nil {
+		s.mu.Lock()
+		if time.Now().After(s.unavailableUntil) {
+			log.Warnf("Redis rate limit store %s failed, use the local limiters for %s: %v", s.address, redisRetryBackoff, err)
+		}
+		s.unavailableUntil = time.Now().Add(redisRetryBackoff)
+		s.mu.Unlock()
+	}
+	return values, err
+}
+
+func (s *RedisRateLimitStore) incrBy(ctx context.Context, keys []string, n int64, ttl time.Duration) ([]int64, error) {
+	conn, err := s.getConn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.conn.SetDeadline(deadline)
+	}
+
+	ttlStr := strconv.FormatInt(ttl.Milliseconds(), 10)
+	commands := [][]string{{"MULTI"}}
+	for _, key := range keys {
+		commands = append(commands,
+			[]string{"SET", s.prefix + key, "0", "NX", "PX", ttlStr},
+			[]string{"INCRBY", s.prefix + key, strconv.FormatInt(n, 10)},
+		)
+	}
+	commands = append(commands, []string{"EXEC"})
+	replies, err := conn.pipeline(commands)
+	if err != nil {
+		_ = conn.conn.Close()
+		return nil, err
+	}
+	execReplies, ok := replies[len(replies)-1].([]any)
+	if !ok || len(execReplies) != 2*len(keys) {
+		_ = conn.conn.Close()
+		return nil, fmt.Errorf("unexpected EXEC reply %v", replies[len(replies)-1])
+	}
+	values := make([]int64, len(keys))
+	for i := range keys {
+		value, ok := execReplies[2*i+1].(int64)
+		if !ok {
+			_ = conn.conn.Close()
+			return nil, fmt.Errorf("unexpected INCRBY reply %v", execReplies[2*i+1])
+		}
+		values[i] = value
+	}
+
+	_ = conn.conn.SetDeadline(time.Time{})
+	s.putConn(conn)
+	return values, nil
+}
+
+func (s *RedisRateLimitStore) getConn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-s.idleConns:
+		return conn, nil
+	default:
+	}
+
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = netConn.SetDeadline(deadline)
+	}
+	conn := &redisConn{conn: netConn, reader: bufio.NewReader(netConn)}
+
+	var setupCommands [][]string
+	if s.password != "" {
+		setupCommands = append(setupCommands, []string{"AUTH", s.password})
+	}
+	if s.db != 0 {
+		setupCommands = append(setupCommands, []string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if len(setupCommands) > 0 {
+		if _, err := conn.pipeline(setupCommands); err != nil {
+			_ = netConn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (s *RedisRateLimitStore) putConn(conn *redisConn) {
+	select {
+	case s.idleConns <- conn:
+	default:
+		_ = conn.conn.Close()
+	}
+}
+
+// Close closes the idle connections
+func (s *RedisRateLimitStore) Close() {
+	for {
+		select {
+		case conn := <-s.idleConns:
+			_ = conn.conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// pipeline sends the commands at once, then reads the replies. Error replies are returned as an error
+func (c *redisConn) pipeline(commands [][]string) ([]any, error) {
+	var buf []byte
+	for _, args := range commands {
+		buf = append(buf, fmt.Sprintf("*%d\r\n", len(args))...)
+		for _, arg := range args {
+			buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+		}
+	}
+	if _, err := c.conn.Write(buf); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(commands))
+	var replyErr error
+	for i := range commands {
+		reply, err := readRedisReply(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if err, ok := reply.(redisError); ok && replyErr == nil {
+			replyErr = err
+		}
+		replies[i] = reply
+	}
+	return replies, replyErr
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// readRedisReply reads a RESP2 reply. Simple strings and bulk strings are returned as string, integers as int64
+func readRedisReply(reader *bufio.Reader) (any, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("bad redis reply line %+q", line)
+	}
+	kind, payload := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return payload, nil
+	case '-':
+		return redisError(payload), nil
+	case ':':
+		return strconv.ParseInt(payload, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(payload)
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]any, size)
+		for i := range items {
+			if items[i], err = readRedisReply(reader); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", kind)
+	}
+}
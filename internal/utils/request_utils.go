@@ -17,24 +17,103 @@ func GetIpFromHostPort(hostPort string) (net.IP, string) {
 	return nil, hostPort
 }
 
-func GetRequestClientIpFromProxyHeader(r *http.Request, headers []string) (string, bool) {
-	// Try each header in order
-	for _, header := range headers {
-		if value := r.Header.Get(header); value != "" {
-			// Parse as X-Forwarded-For: take first valid IP in comma-separated list
-			parts := strings.Split(strings.TrimSpace(value), ",")
-			for _, part := range parts {
-				ip := strings.TrimSpace(part)
-				if net.ParseIP(ip) != nil {
-					return ip, true
+// GetRequestClientIpFromProxyHeader resolves the client ip from the given header, which must be set by the trusted proxies.
+// Headers like X-Forwarded-For are lists of the hops, and the proxies append the ip of their peers to the list,
+// so only the rightmost hops are added by the trusted proxies. The hops are walked from the right,
+// and the first hop that is not a trusted proxy is the client. The leftmost hop is the client if all hops are trusted.
+// If a malformed hop is met before the client, the client is unknown, since the hops on its left cannot be trusted.
+// The RFC 7239 "Forwarded" header is supported as well
+func GetRequestClientIpFromProxyHeader(r *http.Request, header string, isTrustedProxy func(ip net.IP) bool) (string, bool) {
+	values := r.Header.Values(header)
+
+	var hops []string
+	if strings.EqualFold(header, "Forwarded") {
+		hops = parseForwardedHeaderHops(values)
+	} else {
+		for _, value := range values {
+			for _, part := range strings.Split(value, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					hops = append(hops, part)
 				}
 			}
 		}
 	}
 
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHopIp(hops[i])
+		if ip == nil {
+			// a malformed or obfuscated hop
+			return "", false
+		}
+		if i == 0 || !isTrustedProxy(ip) {
+			return ip.String(), true
+		}
+	}
 	return "", false
 }
 
+// parseHopIp parses the ip in the forms "1.2.3.4", "1.2.3.4:80", "::1" or "[::1]:80". Returns nil if it's not an ip
+func parseHopIp(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	if strings.HasPrefix(hop, "[") && strings.HasSuffix(hop, "]") {
+		return net.ParseIP(hop[1 : len(hop)-1])
+	}
+	return nil
+}
+
+// parseForwardedHeaderHops returns the "for" parameters of the elements in the RFC 7239 "Forwarded" header, e.g.
+// Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+// Elements without "for" parameter are returned as "unknown"
+func parseForwardedHeaderHops(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			if strings.TrimSpace(element) == "" {
+				continue
+			}
+			hop := "unknown"
+			for _, pair := range splitQuoted(element, ';') {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(key), "for") {
+					val = strings.TrimSpace(val)
+					if len(val) >= 2 && strings.HasPrefix(val, "\"") && strings.HasSuffix(val, "\"") {
+						val = strings.ReplaceAll(val[1:len(val)-1], "\\", "")
+					}
+					hop = val
+				}
+			}
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits the string by the separator outside the quoted strings
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case escaped:
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
 var flagPreserveSensitiveHeaders = slices.Contains([]string{"1", "true"}, os.Getenv("PAVONIS_DEBUG_PRESERVE_SENSITIVE_HEADERS"))
 
 var sensitiveHeaders = map[string]bool{
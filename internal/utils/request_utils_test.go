@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetRequestClientIpFromProxyHeader(t *testing.T) {
+	trustedProxies, _ := NewIpPool([]string{"10.0.0.0/8", "2001:db8:ffff::/48"})
+	isTrusted := trustedProxies.Contains
+	resolveWith := func(trustedHeader string, header http.Header) string {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header = header
+		ip, ok := GetRequestClientIpFromProxyHeader(r, trustedHeader, isTrusted)
+		if !ok {
+			return ""
+		}
+		return ip
+	}
+	resolve := func(header http.Header) string {
+		return resolveWith("X-Forwarded-For", header)
+	}
+	xff := func(values ...string) http.Header {
+		return http.Header{"X-Forwarded-For": values}
+	}
+
+	// client -> proxy 10.0.0.2 -> proxy 10.0.0.1 -> pavonis
+	assert.Equal(t, "192.0.2.1", resolve(xff("192.0.2.1, 10.0.0.2")))
+	assert.Equal(t, "192.0.2.1", resolve(xff("192.0.2.1", "10.0.0.2")))
+	assert.Equal(t, "2001:db8::1", resolve(xff("2001:db8::1, 2001:db8:ffff::2")))
+
+	// spoofing: the client sends its own X-Forwarded-For, and the proxy appends the real client ip
+	assert.Equal(t, "192.0.2.1", resolve(xff("1.2.3.4, 192.0.2.1, 10.0.0.2")))
+	assert.Equal(t, "192.0.2.1", resolve(xff("10.0.0.99, 192.0.2.1")))
+	assert.Equal(t, "192.0.2.1", resolve(xff("not-an-ip, 192.0.2.1")))
+	assert.Equal(t, "", resolve(xff("192.0.2.1, garbage, 10.0.0.2")))
+
+	// all hops are trusted, the leftmost one is the client
+	assert.Equal(t, "10.0.0.3", resolve(xff("10.0.0.3, 10.0.0.2")))
+	assert.Equal(t, "192.0.2.1", resolveWith("X-Real-IP", http.Header{"X-Real-Ip": {"192.0.2.1"}}))
+	assert.Equal(t, "", resolve(http.Header{}))
+
+	// RFC 7239
+	forwarded := func(values ...string) http.Header {
+		return http.Header{"Forwarded": values}
+	}
+	resolveForwarded := func(header http.Header) string {
+		return resolveWith("Forwarded", header)
+	}
+	assert.Equal(t, "192.0.2.60", resolveForwarded(forwarded(`for=192.0.2.60;proto=http;by=203.0.113.43`)))
+	assert.Equal(t, "2001:db8:cafe::17", resolveForwarded(forwarded(`for="[2001:db8:cafe::17]:4711", for=10.0.0.2`)))
+	assert.Equal(t, "192.0.2.1", resolveForwarded(forwarded(`For="192.0.2.1:80";by="a,b", for=10.0.0.2`)))
+	assert.Equal(t, "192.0.2.1", resolveForwarded(forwarded(`for=1.2.3.4`, `for=192.0.2.1;proto=https`)))
+	assert.Equal(t, "", resolveForwarded(forwarded(`for=192.0.2.1, for=_hidden, for=10.0.0.2`)))
+	assert.Equal(t, "", resolveForwarded(forwarded(`for=unknown`)))
+
+	// only the given header is used, the other headers are sent by the client
+	header := xff("192.0.2.1, 10.0.0.2")
+	header.Set("CF-Connecting-IP", "1.2.3.4")
+	header.Set("X-Real-IP", "1.2.3.4")
+	assert.Equal(t, "192.0.2.1", resolve(header))
+	header = forwarded(`for=192.0.2.1`)
+	header.Set("X-Forwarded-For", "1.2.3.4")
+	assert.Equal(t, "192.0.2.1", resolveForwarded(header))
+	assert.Equal(t, "", resolveForwarded(xff("1.2.3.4")))
+
+	// a malformed hop does not fall through to other headers
+	header = xff("192.0.2.1, garbage, 10.0.0.2")
+	header.Set("X-Real-IP", "1.2.3.4")
+	assert.Equal(t, "", resolve(header))
+
+	// trust all
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-Forwarded-For", "192.0.2.1, 192.0.2.2")
+	ip, ok := GetRequestClientIpFromProxyHeader(r, "X-Forwarded-For", func(net.IP) bool { return true })
+	assert.True(t, ok)
+	assert.Equal(t, "192.0.2.1", ip)
+}